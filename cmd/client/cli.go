@@ -0,0 +1,867 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/aveplen/mirea-modbus/internal/recording"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	ExitSuccess    = 0
+	ExitFailure    = 1
+	ExitUsage      = 2
+	ExitConnection = 3
+	ExitTimeout    = 4
+
+	// Modbus exceptions exit with ExitException + exception code,
+	// e.g. 12 for illegal data address (0x02).
+	ExitException = 10
+)
+
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputCSV   = "csv"
+)
+
+var ErrUsage = errors.New("usage error")
+
+type CliCommand struct {
+	Name           string
+	Description    string
+	NeedsCount     bool
+	NeedsValues    bool
+	NeedsWriteAddr bool
+	// NoAddr commands address no data, so -addr is not asked for.
+	NoAddr bool
+	// NeedsObject commands address identification objects with -level and
+	// -object.
+	NeedsObject bool
+	// NeedsSubFunction commands take a diagnostics sub-function with
+	// -sub-function.
+	NeedsSubFunction bool
+	// NeedsRecording commands replay the recording given with -recording.
+	NeedsRecording bool
+	Run            func(c *CliContext) error
+}
+
+// CliContext holds everything a single CLI command invocation needs.
+type CliContext struct {
+	service ModbusService
+	clients ClientManagmentService
+	out     io.Writer
+
+	addr        uint16
+	cnt         int
+	writeAddr   uint16
+	level       uint8
+	objectId    uint8
+	subFunction uint16
+	values      []string
+	format      string
+	hex         bool
+
+	recording []recording.RecordedRequest
+	speed     float64
+	// overrideUnit addresses every replayed request to -unit instead of its
+	// recorded unit.
+	overrideUnit bool
+}
+
+var cliCommands = []CliCommand{
+	{
+		Name:        "read-coils",
+		Description: "0x01 Read coils",
+		NeedsCount:  true,
+		Run: func(c *CliContext) error {
+			coils, err := c.service.ReadCoils0x01(c.addr, c.cnt)
+			if err != nil {
+				return err
+			}
+			return c.printBools(coils)
+		},
+	},
+	{
+		Name:        "read-discrete",
+		Description: "0x02 Read discrete inputs",
+		NeedsCount:  true,
+		Run: func(c *CliContext) error {
+			inputs, err := c.service.ReadDiscreteInputs0x02(c.addr, c.cnt)
+			if err != nil {
+				return err
+			}
+			return c.printBools(inputs)
+		},
+	},
+	{
+		Name:        "read-holding",
+		Description: "0x03 Read holding registers",
+		NeedsCount:  true,
+		Run: func(c *CliContext) error {
+			registers, err := c.service.ReadHoldingRegisters0x03(c.addr, c.cnt)
+			if err != nil {
+				return err
+			}
+			return c.printUints(registers)
+		},
+	},
+	{
+		Name:        "read-input",
+		Description: "0x04 Read input registers",
+		NeedsCount:  true,
+		Run: func(c *CliContext) error {
+			registers, err := c.service.ReadInputRegisters0x04(c.addr, c.cnt)
+			if err != nil {
+				return err
+			}
+			return c.printUints(registers)
+		},
+	},
+	{
+		Name:        "write-coil",
+		Description: "0x05 Write single coil",
+		NeedsValues: true,
+		Run: func(c *CliContext) error {
+			values, err := c.bools(1)
+			if err != nil {
+				return err
+			}
+			return c.service.WriteSingleCoil0x05(c.addr, values[0])
+		},
+	},
+	{
+		Name:        "write-register",
+		Description: "0x06 Write single register",
+		NeedsValues: true,
+		Run: func(c *CliContext) error {
+			values, err := c.uints(1)
+			if err != nil {
+				return err
+			}
+			return c.service.WriteSingleRegister0x06(c.addr, values[0])
+		},
+	},
+	{
+		Name:        "write-coils",
+		Description: "0x0F Write multiple coils",
+		NeedsValues: true,
+		Run: func(c *CliContext) error {
+			values, err := c.bools(-1)
+			if err != nil {
+				return err
+			}
+			return c.service.WriteMultipleCoils0x0F(c.addr, values)
+		},
+	},
+	{
+		Name:        "write-registers",
+		Description: "0x10 Write multiple registers",
+		NeedsValues: true,
+		Run: func(c *CliContext) error {
+			values, err := c.uints(-1)
+			if err != nil {
+				return err
+			}
+			return c.service.WriteMultipleRegisters0x10(c.addr, values)
+		},
+	},
+	{
+		Name:        "mask-write-register",
+		Description: "0x16 Mask write register, -values and_mask,or_mask",
+		NeedsValues: true,
+		Run: func(c *CliContext) error {
+			values, err := c.uints(2)
+			if err != nil {
+				return err
+			}
+			return c.service.MaskWriteRegister0x16(c.addr, values[0], values[1])
+		},
+	},
+	{
+		Name:           "read-write-registers",
+		Description:    "0x17 Write -values at -write-addr, then read -count registers at -addr",
+		NeedsCount:     true,
+		NeedsValues:    true,
+		NeedsWriteAddr: true,
+		Run: func(c *CliContext) error {
+			values, err := c.uints(-1)
+			if err != nil {
+				return err
+			}
+
+			registers, err := c.service.ReadWriteMultipleRegisters0x17(c.addr, c.cnt, c.writeAddr, values)
+			if err != nil {
+				return err
+			}
+			return c.printUints(registers)
+		},
+	},
+	{
+		Name:        "read-device-id",
+		Description: "0x2B/0x0E Read device identification, -level basic, regular, extended or individual",
+		NoAddr:      true,
+		NeedsObject: true,
+		Run: func(c *CliContext) error {
+			identification, err := c.service.ReadDeviceIdentification0x2B(c.level, c.objectId)
+			if err != nil {
+				return err
+			}
+			return c.printIdentification(identification)
+		},
+	},
+	{
+		Name:             "diagnostics",
+		Description:      "0x08 Diagnostics, -sub-function with the data in -values (0 by default)",
+		NoAddr:           true,
+		NeedsSubFunction: true,
+		Run: func(c *CliContext) error {
+			data, err := c.uints(0)
+			if err != nil {
+				return err
+			}
+			if len(data) == 0 {
+				data = []uint16{0}
+			}
+
+			result, err := c.service.Diagnostics0x08(c.subFunction, data)
+			if err != nil {
+				return err
+			}
+
+			name := DiagnosticSubFunctionName(c.subFunction)
+			counters := make([]DiagnosticCounter, 0, len(result))
+			for i, value := range result {
+				if len(result) > 1 {
+					counters = append(counters, DiagnosticCounter{Name: fmt.Sprintf("%s [%d]", name, i), Value: value})
+					continue
+				}
+				counters = append(counters, DiagnosticCounter{Name: name, Value: value})
+			}
+			return c.printCounters(counters)
+		},
+	},
+	{
+		Name:        "comm-event-counter",
+		Description: "0x0B Get comm event counter",
+		NoAddr:      true,
+		Run: func(c *CliContext) error {
+			counter, err := c.service.GetCommEventCounter0x0B()
+			if err != nil {
+				return err
+			}
+			return c.printCounters(commEventCounterList(counter))
+		},
+	},
+	{
+		Name:        "read-counters",
+		Description: "0x08/0x0B Read every diagnostic counter and the comm event counter",
+		NoAddr:      true,
+		Run: func(c *CliContext) error {
+			counters, err := ReadDiagnosticCounters(c.service)
+			if err != nil {
+				return err
+			}
+			return c.printCounters(counters)
+		},
+	},
+	{
+		Name:           "replay",
+		Description:    "Replay a -recording of the server and report the responses that differ",
+		NoAddr:         true,
+		NeedsRecording: true,
+		Run: func(c *CliContext) error {
+			results := Replay(c.service, c.clients, c.recording, c.speed, c.overrideUnit)
+			if err := c.printReplay(results); err != nil {
+				return err
+			}
+
+			differ := 0
+			for _, result := range results {
+				if len(result.Differences) > 0 {
+					differ++
+				}
+			}
+			if differ > 0 {
+				return fmt.Errorf("%d of %d replayed requests differ", differ, len(results))
+			}
+			return nil
+		},
+	},
+}
+
+// RunCli runs a single command given on the command line and returns
+// the process exit code.
+func RunCli(args []string) int {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printCliUsage(os.Stderr)
+		return ExitUsage
+	}
+
+	command, ok := findCliCommand(args[0])
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printCliUsage(os.Stderr)
+		return ExitUsage
+	}
+
+	flags := flag.NewFlagSet(command.Name, flag.ContinueOnError)
+	rawURL := flags.String("url", fmt.Sprintf("%s://%s:%s", DefaultTransport, DefaultAddress, DefaultPort), "server url, e.g. tcp://localhost:5502, tcp+tls://plc:802, rtuovertcp://gateway:4001, rtu:///dev/ttyUSB0 or ascii://COM3")
+	rawUnitId := flags.String("unit", strconv.Itoa(DefaultUnitId), "unit id (slave id) of the addressed device")
+	rawAddr := flags.String("addr", "", "starting address, hex ('0xAF83') or decimal ('44931')")
+	cnt := flags.Int("count", 1, "number of items to read")
+	rawWriteAddr := flags.String("write-addr", "", "starting address of the write, hex or decimal (read-write-registers only)")
+	level := flags.String("level", "basic", "identification objects to read: basic, regular, extended or individual (read-device-id only)")
+	rawObjectId := flags.String("object", "0", "object id to start from, or to read with -level individual, hex or decimal (read-device-id only)")
+	rawSubFunction := flags.String("sub-function", "0", "diagnostics sub-function, hex or decimal (diagnostics only)")
+	rawRecording := flags.String("recording", "", "recording written by the server with -record (replay only)")
+	speed := flags.Float64("speed", 1, "replay speed, 2 replays twice as fast, 0 sends the requests back to back (replay only)")
+	rawValues := flags.String("values", "", "comma separated values to write, e.g. '0x123,0x456' or 'true,false'")
+	format := flags.String("format", OutputTable, "output format: table, json or csv")
+	hex := flags.Bool("hex", false, "print register values in hex (table and csv only)")
+	baudRate := flags.Int("baud-rate", DefaultBaudRate, "baud rate of rtu and ascii links")
+	dataBits := flags.Int("data-bits", 0, "data bits of rtu and ascii links (default 8 for rtu, 7 for ascii)")
+	parity := flags.String("parity", DefaultParity, "parity of rtu and ascii links: none, even or odd")
+	stopBits := flags.Int("stop-bits", DefaultStopBits, "stop bits of rtu and ascii links")
+	timeout := flags.Duration("timeout", DefaultTimeout, "timeout of a single request")
+	tlsCert := flags.String("tls-cert", "", "client certificate PEM file, carries the client role (tcp+tls only)")
+	tlsKey := flags.String("tls-key", "", "client private key PEM file (tcp+tls only)")
+	tlsCA := flags.String("tls-ca", "", "PEM file of the CAs the server certificate must be signed by (tcp+tls only)")
+	logFormat := flags.String("log-format", logging.LogFormatText, "log format: text or json")
+	logLevel := flags.String("log-level", "", "lowest level logged: debug, info, warn or error, optionally per component, e.g. warn,manager=info")
+	capturePath := flags.String("capture", "", "write every frame sent or received to this file")
+	captureFormat := flags.String("capture-format", capture.CaptureFormatText, "capture file format: text or pcap")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return ExitUsage
+	}
+
+	ctx := &CliContext{
+		out:    os.Stdout,
+		cnt:    *cnt,
+		format: *format,
+		hex:    *hex,
+		speed:  *speed,
+	}
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "unit" {
+			ctx.overrideUnit = true
+		}
+	})
+
+	if err := ctx.parseArgs(command, *rawAddr, *rawWriteAddr, *level, *rawObjectId, *rawSubFunction, *rawValues, *rawRecording); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command.Name, err)
+		return ExitUsage
+	}
+
+	transport, address, port, err := parseServerURL(*rawURL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command.Name, err)
+		return ExitUsage
+	}
+
+	unitId, err := parseUnitId(*rawUnitId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: parse -unit: %v\n", command.Name, err)
+		return ExitUsage
+	}
+
+	serialParams := SerialParams{
+		BaudRate: *baudRate,
+		DataBits: *dataBits,
+		Parity:   *parity,
+		StopBits: *stopBits,
+	}
+	if err := serialParams.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", command.Name, err)
+		return ExitUsage
+	}
+
+	if *timeout <= 0 {
+		fmt.Fprintf(os.Stderr, "%s: -timeout must be positive\n", command.Name)
+		return ExitUsage
+	}
+
+	if *logFormat != logging.LogFormatText && *logFormat != logging.LogFormatJSON {
+		fmt.Fprintf(os.Stderr, "%s: -log-format %q is not one of %s, %s\n", command.Name, *logFormat, logging.LogFormatText, logging.LogFormatJSON)
+		return ExitUsage
+	}
+
+	logLevels, err := logging.ParseLogLevels(*logLevel, LogComponents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: parse -log-level: %v\n", command.Name, err)
+		return ExitUsage
+	}
+	logger := logging.NewLogger(*logFormat, logLevels)
+
+	if *captureFormat != capture.CaptureFormatText && *captureFormat != capture.CaptureFormatPcap {
+		fmt.Fprintf(os.Stderr, "%s: -capture-format %q is not one of %s, %s\n", command.Name, *captureFormat, capture.CaptureFormatText, capture.CaptureFormatPcap)
+		return ExitUsage
+	}
+
+	var frameCapture *capture.FrameCapture
+	if *capturePath != "" {
+		captureFile, err := capture.CreateCaptureFile(*capturePath, *captureFormat)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", command.Name, err)
+			return ExitUsage
+		}
+		defer func() {
+			if err := captureFile.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: could not write capture %s: %v\n", command.Name, *capturePath, err)
+			}
+		}()
+
+		frameCapture = capture.NewFrameCapture()
+		frameCapture.AddRecorder(captureFile)
+	}
+
+	clientManager := NewClientManagmentSercieImpl(logger.Component("manager"))
+	clientManager.SetUnitId(unitId)
+	clientManager.SetSerialParams(serialParams)
+	clientManager.SetTimeout(*timeout)
+	clientManager.SetCapture(frameCapture)
+	clientManager.SetTLSParams(TLSParams{
+		CertFile: *tlsCert,
+		KeyFile:  *tlsKey,
+		CAFile:   *tlsCA,
+	})
+	if err := clientManager.ConnectParams(transport, address, port); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: could not connect to %s: %v\n", command.Name, *rawURL, err)
+		return ExitConnection
+	}
+	defer clientManager.Disconnect()
+
+	ctx.service = NewModbusServiceImpl(clientManager, logger.Component("service"))
+	ctx.clients = clientManager
+	if err := command.Run(ctx); err != nil {
+		return reportCliError(command, err)
+	}
+
+	return ExitSuccess
+}
+
+func findCliCommand(name string) (CliCommand, bool) {
+	for _, command := range cliCommands {
+		if command.Name == name {
+			return command, true
+		}
+	}
+	return CliCommand{}, false
+}
+
+func printCliUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: client <command> [flags]")
+	fmt.Fprintln(w)
+	width := 0
+	for _, command := range cliCommands {
+		if len(command.Name) > width {
+			width = len(command.Name)
+		}
+	}
+
+	fmt.Fprintln(w, "commands:")
+	for _, command := range cliCommands {
+		fmt.Fprintf(w, "  %-*s %s\n", width, command.Name, command.Description)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "run 'client <command> -h' for the list of flags")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "exit codes:")
+	fmt.Fprintf(w, "  %d  success\n", ExitSuccess)
+	fmt.Fprintf(w, "  %d  failure\n", ExitFailure)
+	fmt.Fprintf(w, "  %d  usage error\n", ExitUsage)
+	fmt.Fprintf(w, "  %d  connection failure\n", ExitConnection)
+	fmt.Fprintf(w, "  %d  request timed out\n", ExitTimeout)
+	for _, e := range modbusclient.Exceptions {
+		fmt.Fprintf(w, "  %d %s (0x%02X)\n", ExitException+int(e.Code), e.Name, e.Code)
+	}
+}
+
+func reportCliError(command CliCommand, err error) int {
+	if e, ok := modbusclient.FindException(err); ok {
+		fmt.Fprintf(os.Stderr, "%s: %s (exception 0x%02X): %v\n", command.Name, e.Name, e.Code, err)
+		return ExitException + int(e.Code)
+	}
+
+	fmt.Fprintf(os.Stderr, "%s: %v\n", command.Name, err)
+	if errors.Is(err, modbus.ErrRequestTimedOut) {
+		return ExitTimeout
+	}
+
+	if errors.Is(err, ErrNoClient) || errors.Is(err, ErrNotEstablished) {
+		return ExitConnection
+	}
+
+	return ExitFailure
+}
+
+// parseServerURL splits 'transport://address:port' into the parameters
+// accepted by ClientManagmentService. Serial urls name a device instead,
+// e.g. 'rtu:///dev/ttyUSB0' or 'ascii://COM3', and have no port.
+func parseServerURL(rawURL string) (string, string, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", "", "", fmt.Errorf("parse url: %w", err)
+	}
+
+	if IsSerialTransport(u.Scheme) {
+		device := u.Host + u.Path
+		if device == "" {
+			return "", "", "", fmt.Errorf("url %q should look like '%s:///dev/ttyUSB0' or '%s://COM3'", rawURL, u.Scheme, u.Scheme)
+		}
+		return u.Scheme, device, "", nil
+	}
+
+	if u.Scheme == "" || u.Hostname() == "" {
+		return "", "", "", fmt.Errorf("url %q should look like 'tcp://localhost:5502'", rawURL)
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = DefaultPort
+	}
+
+	return u.Scheme, u.Hostname(), port, nil
+}
+
+func (c *CliContext) parseArgs(command CliCommand, rawAddr, rawWriteAddr, level, rawObjectId, rawSubFunction, rawValues, rawRecording string) error {
+	if command.NeedsObject {
+		code, err := ParseReadDeviceIdLevel(level)
+		if err != nil {
+			return fmt.Errorf("parse -level: %w", err)
+		}
+		c.level = code
+
+		objectId, err := parseUint16Auto(rawObjectId)
+		if err != nil {
+			return fmt.Errorf("parse -object: %w", err)
+		}
+		if objectId > 0xFF {
+			return fmt.Errorf("-object must be between 0 and 0xFF: %w", ErrUsage)
+		}
+		c.objectId = uint8(objectId)
+	}
+
+	if command.NeedsSubFunction {
+		subFunction, err := parseUint16Auto(rawSubFunction)
+		if err != nil {
+			return fmt.Errorf("parse -sub-function: %w", err)
+		}
+		c.subFunction = subFunction
+	}
+
+	if !command.NoAddr {
+		if rawAddr == "" {
+			return fmt.Errorf("-addr is required: %w", ErrUsage)
+		}
+
+		addr, err := parseUint16Auto(rawAddr)
+		if err != nil {
+			return fmt.Errorf("parse -addr: %w", err)
+		}
+		c.addr = addr
+	}
+
+	if command.NeedsCount && (c.cnt < 1 || c.cnt > 0xFFFF) {
+		return fmt.Errorf("-count must be between 1 and %d: %w", 0xFFFF, ErrUsage)
+	}
+
+	if command.NeedsWriteAddr {
+		if rawWriteAddr == "" {
+			return fmt.Errorf("-write-addr is required: %w", ErrUsage)
+		}
+
+		writeAddr, err := parseUint16Auto(rawWriteAddr)
+		if err != nil {
+			return fmt.Errorf("parse -write-addr: %w", err)
+		}
+		c.writeAddr = writeAddr
+	}
+
+	if command.NeedsRecording {
+		if rawRecording == "" {
+			return fmt.Errorf("-recording is required: %w", ErrUsage)
+		}
+
+		requests, err := recording.Load(rawRecording)
+		if err != nil {
+			return err
+		}
+		c.recording = requests
+
+		if c.speed < 0 {
+			return fmt.Errorf("-speed must not be negative: %w", ErrUsage)
+		}
+	}
+
+	if command.NeedsValues && rawValues == "" {
+		return fmt.Errorf("-values is required: %w", ErrUsage)
+	}
+
+	if rawValues != "" {
+		for _, chunk := range strings.Split(rawValues, ",") {
+			c.values = append(c.values, strings.TrimSpace(chunk))
+		}
+	}
+
+	switch c.format {
+	case OutputTable, OutputJSON, OutputCSV:
+	default:
+		return fmt.Errorf("unknown -format %q: %w", c.format, ErrUsage)
+	}
+
+	return nil
+}
+
+func (c *CliContext) bools(expected int) ([]bool, error) {
+	if expected > 0 && len(c.values) != expected {
+		return nil, fmt.Errorf("expected %d value(s), got %d: %w", expected, len(c.values), ErrUsage)
+	}
+
+	result := make([]bool, 0, len(c.values))
+	for _, value := range c.values {
+		parsed, err := parseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", value, err)
+		}
+		result = append(result, parsed)
+	}
+
+	return result, nil
+}
+
+func (c *CliContext) uints(expected int) ([]uint16, error) {
+	if expected > 0 && len(c.values) != expected {
+		return nil, fmt.Errorf("expected %d value(s), got %d: %w", expected, len(c.values), ErrUsage)
+	}
+
+	result := make([]uint16, 0, len(c.values))
+	for _, value := range c.values {
+		parsed, err := parseUint16Auto(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse %q: %w", value, err)
+		}
+		result = append(result, parsed)
+	}
+
+	return result, nil
+}
+
+type cliRow struct {
+	Addr  uint16      `json:"addr"`
+	Value interface{} `json:"value"`
+}
+
+func (c *CliContext) printBools(values []bool) error {
+	rows := make([]cliRow, 0, len(values))
+	for i, v := range values {
+		rows = append(rows, cliRow{Addr: c.addr + uint16(i), Value: v})
+	}
+	return c.printRows(rows)
+}
+
+func (c *CliContext) printUints(values []uint16) error {
+	rows := make([]cliRow, 0, len(values))
+	for i, v := range values {
+		rows = append(rows, cliRow{Addr: c.addr + uint16(i), Value: v})
+	}
+	return c.printRows(rows)
+}
+
+func (c *CliContext) printRows(rows []cliRow) error {
+	switch c.format {
+	case OutputJSON:
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+
+	case OutputCSV:
+		w := csv.NewWriter(c.out)
+		if err := w.Write([]string{"addr", "value"}); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if err := w.Write([]string{strconv.Itoa(int(row.Addr)), c.formatValue(row.Value)}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ADDRESS (DEC)\tADDRESS (HEX)\tVALUE")
+		for _, row := range rows {
+			fmt.Fprintf(w, "%d\t0x%X\t%s\n", row.Addr, row.Addr, c.formatValue(row.Value))
+		}
+		return w.Flush()
+	}
+}
+
+func (c *CliContext) formatValue(value interface{}) string {
+	if u, ok := value.(uint16); ok && c.hex {
+		return fmt.Sprintf("0x%X", u)
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+type cliObject struct {
+	Id    uint8  `json:"id"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (c *CliContext) printIdentification(identification *modbusclient.DeviceIdentification) error {
+	objects := make([]cliObject, 0, len(identification.Objects))
+	for _, object := range identification.Objects {
+		objects = append(objects, cliObject{Id: object.Id, Name: object.Name(), Value: object.Value})
+	}
+
+	switch c.format {
+	case OutputJSON:
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			ConformityLevel uint8       `json:"conformity_level"`
+			Objects         []cliObject `json:"objects"`
+		}{identification.ConformityLevel, objects})
+
+	case OutputCSV:
+		w := csv.NewWriter(c.out)
+		if err := w.Write([]string{"id", "name", "value"}); err != nil {
+			return err
+		}
+		for _, object := range objects {
+			if err := w.Write([]string{strconv.Itoa(int(object.Id)), object.Name, object.Value}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		fmt.Fprintf(c.out, "Conformity level: 0x%02X (%s)\n\n", identification.ConformityLevel, identification.ConformityName())
+
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "OBJECT ID\tNAME\tVALUE")
+		for _, object := range objects {
+			fmt.Fprintf(w, "0x%02X\t%s\t%s\n", object.Id, object.Name, object.Value)
+		}
+		return w.Flush()
+	}
+}
+
+func (c *CliContext) printCounters(counters []DiagnosticCounter) error {
+	switch c.format {
+	case OutputJSON:
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(counters)
+
+	case OutputCSV:
+		w := csv.NewWriter(c.out)
+		if err := w.Write([]string{"name", "value"}); err != nil {
+			return err
+		}
+		for _, counter := range counters {
+			if err := w.Write([]string{counter.Name, c.formatValue(counter.Value)}); err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVALUE")
+		for _, counter := range counters {
+			fmt.Fprintf(w, "%s\t%s\n", counter.Name, c.formatValue(counter.Value))
+		}
+		return w.Flush()
+	}
+}
+
+type cliReplayResult struct {
+	Index        int                `json:"index"`
+	Offset       recording.Duration `json:"offset"`
+	FunctionCode uint8              `json:"function_code"`
+	UnitId       uint8              `json:"unit_id"`
+	Addr         uint16             `json:"addr"`
+	Quantity     uint16             `json:"quantity"`
+	Differences  []string           `json:"differences"`
+}
+
+// printReplay prints the replayed requests whose responses differ, followed
+// by a summary in the table format.
+func (c *CliContext) printReplay(results []ReplayResult) error {
+	rows := make([]cliReplayResult, 0)
+	for _, result := range results {
+		if len(result.Differences) == 0 {
+			continue
+		}
+
+		request := result.Request
+		rows = append(rows, cliReplayResult{
+			Index:        result.Index + 1,
+			Offset:       request.Offset,
+			FunctionCode: request.FunctionCode,
+			UnitId:       request.UnitId,
+			Addr:         request.Addr,
+			Quantity:     request.Quantity,
+			Differences:  result.Differences,
+		})
+	}
+
+	switch c.format {
+	case OutputJSON:
+		encoder := json.NewEncoder(c.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(rows)
+
+	case OutputCSV:
+		w := csv.NewWriter(c.out)
+		if err := w.Write([]string{"index", "offset", "function_code", "unit_id", "addr", "quantity", "difference"}); err != nil {
+			return err
+		}
+		for _, row := range rows {
+			for _, difference := range row.Differences {
+				err := w.Write([]string{
+					strconv.Itoa(row.Index), time.Duration(row.Offset).String(), fmt.Sprintf("0x%02X", row.FunctionCode),
+					strconv.Itoa(int(row.UnitId)), strconv.Itoa(int(row.Addr)), strconv.Itoa(int(row.Quantity)), difference,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		w.Flush()
+		return w.Error()
+
+	default:
+		for _, row := range rows {
+			for _, difference := range row.Differences {
+				fmt.Fprintf(
+					c.out, "#%d +%s 0x%02X unit %d addr %d count %d: %s\n",
+					row.Index, time.Duration(row.Offset), row.FunctionCode, row.UnitId, row.Addr, row.Quantity, difference,
+				)
+			}
+		}
+		fmt.Fprintf(c.out, "Replayed %d requests, %d differ\n", len(results), len(rows))
+		return nil
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/simonvetter/modbus"
+)
+
+// Client is what ModbusServiceImpl needs from a connection.
+type Client interface {
+	Open() error
+	Close() error
+	SetUnitId(id uint8) error
+
+	ReadCoils(addr uint16, quantity uint16) ([]bool, error)
+	ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error)
+	ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error)
+	WriteCoil(addr uint16, value bool) error
+	WriteCoils(addr uint16, values []bool) error
+	WriteRegister(addr uint16, value uint16) error
+	WriteRegisters(addr uint16, values []uint16) error
+	MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error
+	ReadWriteRegisters(readAddr uint16, readQuantity uint16, writeAddr uint16, values []uint16) ([]uint16, error)
+	ReadDeviceIdentification(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error)
+	Diagnostics(subFunction uint16, data []uint16) ([]uint16, error)
+	GetCommEventCounter() (modbusclient.CommEventCounter, error)
+}
+
+const (
+	fcReadCoils              uint8 = 0x01
+	fcReadDiscreteInputs     uint8 = 0x02
+	fcReadHoldingRegisters   uint8 = 0x03
+	fcReadInputRegisters     uint8 = 0x04
+	fcWriteSingleCoil        uint8 = 0x05
+	fcWriteSingleRegister    uint8 = 0x06
+	fcDiagnostics            uint8 = 0x08
+	fcGetCommEventCounter    uint8 = 0x0B
+	fcWriteMultipleCoils     uint8 = 0x0F
+	fcWriteMultipleRegisters uint8 = 0x10
+
+	fcMaskWriteRegister          uint8 = 0x16
+	fcReadWriteMultipleRegisters uint8 = 0x17
+	fcEncapsulatedInterface      uint8 = 0x2B
+)
@@ -1,7 +1,18 @@
 package main
 
+import (
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+)
+
 type ClientManagmentService interface {
 	ConnectParams(transport, address, port string) error
+	SetUnitId(unitId uint8)
+	UnitId() uint8
+	SetSerialParams(params SerialParams)
+	SetTLSParams(params TLSParams)
+	SetTimeout(timeout time.Duration)
 	Reconnect() error
 	Disconnect() error
 }
@@ -15,6 +26,11 @@ type ModbusService interface {
 	WriteSingleRegister0x06(addr uint16, value uint16) error
 	WriteMultipleRegisters0x10(addr uint16, values []uint16) error
 	WriteMultipleCoils0x0F(addr uint16, values []bool) error
+	MaskWriteRegister0x16(addr uint16, andMask uint16, orMask uint16) error
+	ReadWriteMultipleRegisters0x17(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error)
+	ReadDeviceIdentification0x2B(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error)
+	Diagnostics0x08(subFunction uint16, data []uint16) ([]uint16, error)
+	GetCommEventCounter0x0B() (modbusclient.CommEventCounter, error)
 }
 
 type MainModelImpl struct {
@@ -36,6 +52,22 @@ func (m *MainModelImpl) Connect(transport, address, port string) error {
 	return m.clientService.ConnectParams(transport, address, port)
 }
 
+func (m *MainModelImpl) SetUnitId(unitId uint8) {
+	m.clientService.SetUnitId(unitId)
+}
+
+func (m *MainModelImpl) SetSerialParams(params SerialParams) {
+	m.clientService.SetSerialParams(params)
+}
+
+func (m *MainModelImpl) SetTLSParams(params TLSParams) {
+	m.clientService.SetTLSParams(params)
+}
+
+func (m *MainModelImpl) SetTimeout(timeout time.Duration) {
+	m.clientService.SetTimeout(timeout)
+}
+
 func (m *MainModelImpl) Reconnect() error {
 	return m.clientService.Reconnect()
 }
@@ -75,3 +107,27 @@ func (m *MainModelImpl) WriteMultipleRegisters(addr uint16, values []uint16) err
 func (m *MainModelImpl) WriteMultipleCoils(addr uint16, values []bool) error {
 	return m.modbusService.WriteMultipleCoils0x0F(addr, values)
 }
+
+func (m *MainModelImpl) MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error {
+	return m.modbusService.MaskWriteRegister0x16(addr, andMask, orMask)
+}
+
+func (m *MainModelImpl) ReadWriteMultipleRegisters(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	return m.modbusService.ReadWriteMultipleRegisters0x17(readAddr, readCnt, writeAddr, values)
+}
+
+func (m *MainModelImpl) ReadDeviceIdentification(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error) {
+	return m.modbusService.ReadDeviceIdentification0x2B(code, objectId)
+}
+
+func (m *MainModelImpl) Diagnostics(subFunction uint16, data []uint16) ([]uint16, error) {
+	return m.modbusService.Diagnostics0x08(subFunction, data)
+}
+
+func (m *MainModelImpl) GetCommEventCounter() (modbusclient.CommEventCounter, error) {
+	return m.modbusService.GetCommEventCounter0x0B()
+}
+
+func (m *MainModelImpl) ReadDiagnosticCounters() ([]DiagnosticCounter, error) {
+	return ReadDiagnosticCounters(m.modbusService)
+}
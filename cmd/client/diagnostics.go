@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+)
+
+const (
+	DiagReturnQueryData       uint16 = 0x00
+	DiagRestartCommunications uint16 = 0x01
+	DiagClearCounters         uint16 = 0x0A
+)
+
+// DiagnosticSubFunction is a sub-function of Diagnostics (0x08).
+type DiagnosticSubFunction struct {
+	Code uint16
+	Name string
+	// Counter tells the sub-functions that return a counter.
+	Counter bool
+}
+
+var DiagnosticSubFunctions = []DiagnosticSubFunction{
+	{Code: DiagReturnQueryData, Name: "Return query data"},
+	{Code: DiagRestartCommunications, Name: "Restart communications option"},
+	{Code: 0x02, Name: "Return diagnostic register"},
+	{Code: DiagClearCounters, Name: "Clear counters and diagnostic register"},
+	{Code: 0x0B, Name: "Return bus message count", Counter: true},
+	{Code: 0x0C, Name: "Return bus communication error count", Counter: true},
+	{Code: 0x0D, Name: "Return bus exception error count", Counter: true},
+	{Code: 0x0E, Name: "Return server message count", Counter: true},
+	{Code: 0x0F, Name: "Return server no response count", Counter: true},
+	{Code: 0x10, Name: "Return server NAK count", Counter: true},
+	{Code: 0x11, Name: "Return server busy count", Counter: true},
+	{Code: 0x12, Name: "Return bus character overrun count", Counter: true},
+	{Code: 0x14, Name: "Clear overrun counter and flag"},
+}
+
+// DiagnosticSubFunctionName returns the name of a sub-function, or its code
+// if it is not a known one.
+func DiagnosticSubFunctionName(code uint16) string {
+	for _, sub := range DiagnosticSubFunctions {
+		if sub.Code == code {
+			return sub.Name
+		}
+	}
+	return fmt.Sprintf("Sub-function 0x%02X", code)
+}
+
+// commEventCounterList returns the status word, 0xFFFF when busy, and the
+// event count.
+func commEventCounterList(c modbusclient.CommEventCounter) []DiagnosticCounter {
+	var status uint16
+	if c.Busy {
+		status = 0xFFFF
+	}
+
+	return []DiagnosticCounter{
+		{Name: "Comm event status", Value: status},
+		{Name: "Comm event count", Value: c.Count},
+	}
+}
+
+// DiagnosticCounter is a single named counter read from the device.
+type DiagnosticCounter struct {
+	Name  string `json:"name"`
+	Value uint16 `json:"value"`
+}
+
+// ReadDiagnosticCounters reads every counter of Diagnostics (0x08), then
+// the comm event counter.
+func ReadDiagnosticCounters(service ModbusService) ([]DiagnosticCounter, error) {
+	var counters []DiagnosticCounter
+	for _, sub := range DiagnosticSubFunctions {
+		if !sub.Counter {
+			continue
+		}
+
+		result, err := service.Diagnostics0x08(sub.Code, []uint16{0})
+		if err != nil {
+			return nil, err
+		}
+		counters = append(counters, DiagnosticCounter{Name: sub.Name, Value: result[0]})
+	}
+
+	counter, err := service.GetCommEventCounter0x0B()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(counters, commEventCounterList(counter)...), nil
+}
@@ -1,11 +1,12 @@
+//go:build windows
+
 package main
 
 import (
-	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
 	"github.com/lxn/walk"
 	d "github.com/lxn/walk/declarative"
 )
@@ -21,6 +22,11 @@ type DialogModel interface {
 	WriteSingleRegister(addr uint16, value uint16) error
 	WriteMultipleRegisters(addr uint16, values []uint16) error
 	WriteMultipleCoils(addr uint16, values []bool) error
+	MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error
+	ReadWriteMultipleRegisters(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error)
+	ReadDeviceIdentification(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error)
+	Diagnostics(subFunction uint16, data []uint16) ([]uint16, error)
+	ReadDiagnosticCounters() ([]DiagnosticCounter, error)
 }
 
 const (
@@ -32,98 +38,162 @@ const (
 	DialogTypeWriteSingleRegister
 	DialogTypeWriteMultipleRegisters
 	DialogTypeWriteMultipleCoils
+	DialogTypeMaskWriteRegister
+	DialogTypeReadWriteMultipleRegisters
+	DialogTypeReadDeviceIdentification
+	DialogTypeDiagnostics
+	DialogTypeReadDiagnosticCounters
 )
 
 var (
 	dialogTitles = map[DialogType]string{
-		DialogTypeReadCoils:              "Read coils 0x01",
-		DialogTypeReadDiscreteInputs:     "Read discrete inputs 0x02",
-		DialogTypeReadHoldingRegisters:   "Read holding registers 0x03",
-		DialogTypeReadInputRegisters:     "Read input registesrs 0x04",
-		DialogTypeWriteSingleCoil:        "Write single coild 0x05",
-		DialogTypeWriteSingleRegister:    "Write single register 0x06",
-		DialogTypeWriteMultipleRegisters: "Write multiple registers 0x10",
-		DialogTypeWriteMultipleCoils:     "Write multiple coils 0x0F",
+		DialogTypeReadCoils:                  "Read coils 0x01",
+		DialogTypeReadDiscreteInputs:         "Read discrete inputs 0x02",
+		DialogTypeReadHoldingRegisters:       "Read holding registers 0x03",
+		DialogTypeReadInputRegisters:         "Read input registesrs 0x04",
+		DialogTypeWriteSingleCoil:            "Write single coild 0x05",
+		DialogTypeWriteSingleRegister:        "Write single register 0x06",
+		DialogTypeWriteMultipleRegisters:     "Write multiple registers 0x10",
+		DialogTypeWriteMultipleCoils:         "Write multiple coils 0x0F",
+		DialogTypeMaskWriteRegister:          "Mask write register 0x16",
+		DialogTypeReadWriteMultipleRegisters: "Read/write multiple registers 0x17",
+		DialogTypeReadDeviceIdentification:   "Read device identification 0x2B/0x0E",
+		DialogTypeDiagnostics:                "Diagnostics 0x08",
+		DialogTypeReadDiagnosticCounters:     "Read diagnostic counters 0x08/0x0B",
 	}
 
 	inputTitleText = map[DialogType]string{
-		DialogTypeWriteSingleCoil:        "Input (example: 'true' or 'false')",
-		DialogTypeWriteSingleRegister:    "Input (example: '213' or '0x15')",
-		DialogTypeWriteMultipleRegisters: "Input (example: '213' or '0x15')",
-		DialogTypeWriteMultipleCoils:     "Input (example: 'true, false' or 'false')",
+		DialogTypeWriteSingleCoil:            "Input (example: 'true' or 'false')",
+		DialogTypeWriteSingleRegister:        "Input (example: '213' or '0x15')",
+		DialogTypeWriteMultipleRegisters:     "Input (example: '213' or '0x15')",
+		DialogTypeWriteMultipleCoils:         "Input (example: 'true, false' or 'false')",
+		DialogTypeMaskWriteRegister:          "AND mask, OR mask (example: '0xFF0F, 0x0050')",
+		DialogTypeReadWriteMultipleRegisters: "Values to write (example: '213' or '0x15')",
+		DialogTypeDiagnostics:                "Data (example: '0x0000' or '0xA537, 0x0001')",
 	}
 
 	renderAmount = map[DialogType]bool{
-		DialogTypeReadCoils:              true,
-		DialogTypeReadDiscreteInputs:     true,
-		DialogTypeReadHoldingRegisters:   true,
-		DialogTypeReadInputRegisters:     true,
-		DialogTypeWriteSingleCoil:        false,
-		DialogTypeWriteSingleRegister:    false,
-		DialogTypeWriteMultipleRegisters: true,
-		DialogTypeWriteMultipleCoils:     true,
+		DialogTypeReadCoils:                  true,
+		DialogTypeReadDiscreteInputs:         true,
+		DialogTypeReadHoldingRegisters:       true,
+		DialogTypeReadInputRegisters:         true,
+		DialogTypeWriteSingleCoil:            false,
+		DialogTypeWriteSingleRegister:        false,
+		DialogTypeWriteMultipleRegisters:     true,
+		DialogTypeWriteMultipleCoils:         true,
+		DialogTypeMaskWriteRegister:          false,
+		DialogTypeReadWriteMultipleRegisters: true,
+		DialogTypeReadDeviceIdentification:   false,
+		DialogTypeDiagnostics:                false,
+		DialogTypeReadDiagnosticCounters:     false,
+	}
+
+	renderWriteAddr = map[DialogType]bool{
+		DialogTypeReadWriteMultipleRegisters: true,
+	}
+
+	// renderObject dialogs address identification objects instead of data
+	renderObject = map[DialogType]bool{
+		DialogTypeReadDeviceIdentification: true,
+	}
+
+	renderSubFunction = map[DialogType]bool{
+		DialogTypeDiagnostics: true,
+	}
+
+	noAddr = map[DialogType]bool{
+		DialogTypeReadDeviceIdentification: true,
+		DialogTypeDiagnostics:              true,
+		DialogTypeReadDiagnosticCounters:   true,
+	}
+
+	multilineResult = map[DialogType]bool{
+		DialogTypeReadDeviceIdentification: true,
+		DialogTypeDiagnostics:              true,
+		DialogTypeReadDiagnosticCounters:   true,
 	}
 
 	renderInput = map[DialogType]bool{
-		DialogTypeReadCoils:              false,
-		DialogTypeReadDiscreteInputs:     false,
-		DialogTypeReadHoldingRegisters:   false,
-		DialogTypeReadInputRegisters:     false,
-		DialogTypeWriteSingleCoil:        true,
-		DialogTypeWriteSingleRegister:    true,
-		DialogTypeWriteMultipleRegisters: true,
-		DialogTypeWriteMultipleCoils:     true,
+		DialogTypeReadCoils:                  false,
+		DialogTypeReadDiscreteInputs:         false,
+		DialogTypeReadHoldingRegisters:       false,
+		DialogTypeReadInputRegisters:         false,
+		DialogTypeWriteSingleCoil:            true,
+		DialogTypeWriteSingleRegister:        true,
+		DialogTypeWriteMultipleRegisters:     true,
+		DialogTypeWriteMultipleCoils:         true,
+		DialogTypeMaskWriteRegister:          true,
+		DialogTypeReadWriteMultipleRegisters: true,
+		DialogTypeReadDeviceIdentification:   false,
+		DialogTypeDiagnostics:                true,
+		DialogTypeReadDiagnosticCounters:     false,
 	}
 
 	renderInputHex = map[DialogType]bool{
-		DialogTypeWriteSingleCoil:        false,
-		DialogTypeWriteSingleRegister:    true,
-		DialogTypeWriteMultipleRegisters: true,
-		DialogTypeWriteMultipleCoils:     false,
+		DialogTypeWriteSingleCoil:            false,
+		DialogTypeWriteSingleRegister:        true,
+		DialogTypeWriteMultipleRegisters:     true,
+		DialogTypeWriteMultipleCoils:         false,
+		DialogTypeMaskWriteRegister:          true,
+		DialogTypeReadWriteMultipleRegisters: true,
+		DialogTypeDiagnostics:                true,
 	}
 
 	inputDefaultText = map[DialogType]string{
-		DialogTypeReadCoils:              "",
-		DialogTypeReadDiscreteInputs:     "",
-		DialogTypeReadHoldingRegisters:   "",
-		DialogTypeReadInputRegisters:     "",
-		DialogTypeWriteSingleCoil:        "true",
-		DialogTypeWriteSingleRegister:    "0x123",
-		DialogTypeWriteMultipleRegisters: "0x123, 0x456",
-		DialogTypeWriteMultipleCoils:     "true, false",
+		DialogTypeReadCoils:                  "",
+		DialogTypeReadDiscreteInputs:         "",
+		DialogTypeReadHoldingRegisters:       "",
+		DialogTypeReadInputRegisters:         "",
+		DialogTypeWriteSingleCoil:            "true",
+		DialogTypeWriteSingleRegister:        "0x123",
+		DialogTypeWriteMultipleRegisters:     "0x123, 0x456",
+		DialogTypeWriteMultipleCoils:         "true, false",
+		DialogTypeMaskWriteRegister:          "0xFF0F, 0x0050",
+		DialogTypeReadWriteMultipleRegisters: "0x123, 0x456",
+		DialogTypeDiagnostics:                "0x0000",
 	}
 
 	mainButtonCaption = map[DialogType]string{
-		DialogTypeReadCoils:              "Read",
-		DialogTypeReadDiscreteInputs:     "Read",
-		DialogTypeReadHoldingRegisters:   "Read",
-		DialogTypeReadInputRegisters:     "Read",
-		DialogTypeWriteSingleCoil:        "Write",
-		DialogTypeWriteSingleRegister:    "Write",
-		DialogTypeWriteMultipleRegisters: "Write",
-		DialogTypeWriteMultipleCoils:     "Write",
+		DialogTypeReadCoils:                  "Read",
+		DialogTypeReadDiscreteInputs:         "Read",
+		DialogTypeReadHoldingRegisters:       "Read",
+		DialogTypeReadInputRegisters:         "Read",
+		DialogTypeWriteSingleCoil:            "Write",
+		DialogTypeWriteSingleRegister:        "Write",
+		DialogTypeWriteMultipleRegisters:     "Write",
+		DialogTypeWriteMultipleCoils:         "Write",
+		DialogTypeMaskWriteRegister:          "Write",
+		DialogTypeReadWriteMultipleRegisters: "Write and read",
+		DialogTypeReadDeviceIdentification:   "Read",
+		DialogTypeDiagnostics:                "Send",
+		DialogTypeReadDiagnosticCounters:     "Read",
 	}
 
 	resultInHex = map[DialogType]bool{
-		DialogTypeReadCoils:            false,
-		DialogTypeReadDiscreteInputs:   false,
-		DialogTypeReadHoldingRegisters: true,
-		DialogTypeReadInputRegisters:   true,
+		DialogTypeReadCoils:                  false,
+		DialogTypeReadDiscreteInputs:         false,
+		DialogTypeReadHoldingRegisters:       true,
+		DialogTypeReadInputRegisters:         true,
+		DialogTypeReadWriteMultipleRegisters: true,
 	}
 )
 
 type DialogController struct {
 	model DialogModel
 
-	dialog            *walk.Dialog
-	errEdit           *walk.TextEdit
-	addrEdit          *walk.TextEdit
-	hexAddrCheckBox   *walk.CheckBox
-	hexInputCheckBox  *walk.CheckBox
-	inputEdit         *walk.TextEdit
-	cntEdit           *walk.TextEdit
-	resultEdit        *walk.TextEdit
-	hexResultCheckBox *walk.CheckBox
+	dialog              *walk.Dialog
+	errEdit             *walk.TextEdit
+	addrEdit            *walk.TextEdit
+	hexAddrCheckBox     *walk.CheckBox
+	writeAddrEdit       *walk.TextEdit
+	levelComboBox       *walk.ComboBox
+	objectEdit          *walk.TextEdit
+	subFunctionComboBox *walk.ComboBox
+	hexInputCheckBox    *walk.CheckBox
+	inputEdit           *walk.TextEdit
+	cntEdit             *walk.TextEdit
+	resultEdit          *walk.TextEdit
+	hexResultCheckBox   *walk.CheckBox
 }
 
 func (c *DialogController) Close() {
@@ -290,6 +360,160 @@ func (c *DialogController) WriteMultipleCoils() {
 	c.clearError()
 }
 
+func (c *DialogController) MaskWriteRegister() {
+	addr, ok := c.addr()
+	if !ok {
+		return
+	}
+
+	inputParser := parseUint16
+	if c.hexInputCheckBox.Checked() {
+		inputParser = parseHex
+	}
+
+	chunks := strings.Split(c.inputEdit.Text(), ", ")
+	if len(chunks) != 2 {
+		c.setError(fmt.Errorf("expected AND mask and OR mask, got %d values", len(chunks)))
+		c.resultFail()
+		return
+	}
+
+	masks := make([]uint16, 0, 2)
+	for _, chunk := range chunks {
+		parsed, err := inputParser(chunk)
+		if err != nil {
+			c.setError(err)
+			return
+		}
+		masks = append(masks, parsed)
+	}
+
+	if err := c.model.MaskWriteRegister(addr, masks[0], masks[1]); err != nil {
+		c.setError(err)
+		c.resultFail()
+		return
+	}
+
+	c.resultSuccess()
+	c.clearError()
+}
+
+func (c *DialogController) ReadWriteMultipleRegisters() {
+	addr, cnt, ok := c.addrCnt()
+	if !ok {
+		return
+	}
+
+	writeAddr, ok := c.writeAddr()
+	if !ok {
+		return
+	}
+
+	inputs, ok := c.inputUints()
+	if !ok {
+		return
+	}
+
+	registers, err := c.model.ReadWriteMultipleRegisters(addr, cnt, writeAddr, inputs)
+	if err != nil {
+		c.setError(err)
+		c.resultFail()
+		return
+	}
+
+	c.resultUints(registers)
+	if c.hexResultCheckBox.Checked() {
+		c.resultUintsHex(registers)
+	}
+
+	c.clearError()
+}
+
+func (c *DialogController) ReadDeviceIdentification() {
+	code, err := ParseReadDeviceIdLevel(c.levelComboBox.Text())
+	if err != nil {
+		c.setError(err)
+		return
+	}
+
+	objectId, err := parseUint16Auto(c.objectEdit.Text())
+	if err == nil && objectId > 0xFF {
+		err = fmt.Errorf("object id must be between 0x00 and 0xFF, got 0x%X", objectId)
+	}
+	if err != nil {
+		c.setError(err)
+		return
+	}
+
+	identification, err := c.model.ReadDeviceIdentification(code, uint8(objectId))
+	if err != nil {
+		c.setError(err)
+		c.resultFail()
+		return
+	}
+
+	lines := []string{fmt.Sprintf("Conformity level: 0x%02X (%s)", identification.ConformityLevel, identification.ConformityName())}
+	for _, object := range identification.Objects {
+		lines = append(lines, fmt.Sprintf("0x%02X %s: %s", object.Id, object.Name(), object.Value))
+	}
+	c.resultEdit.SetText(strings.Join(lines, "\r\n"))
+	c.clearError()
+}
+
+func (c *DialogController) Diagnostics() {
+	index := c.subFunctionComboBox.CurrentIndex()
+	if index < 0 || index >= len(DiagnosticSubFunctions) {
+		c.setError(fmt.Errorf("choose a sub-function"))
+		return
+	}
+	sub := DiagnosticSubFunctions[index]
+
+	inputParser := parseUint16
+	if c.hexInputCheckBox.Checked() {
+		inputParser = parseHex
+	}
+
+	data := make([]uint16, 0, 1)
+	for _, chunk := range strings.Split(c.inputEdit.Text(), ", ") {
+		parsed, err := inputParser(chunk)
+		if err != nil {
+			c.setError(err)
+			return
+		}
+		data = append(data, parsed)
+	}
+
+	result, err := c.model.Diagnostics(sub.Code, data)
+	if err != nil {
+		c.setError(err)
+		c.resultFail()
+		return
+	}
+
+	lines := make([]string, 0, len(result))
+	for _, value := range result {
+		lines = append(lines, fmt.Sprintf("%s: 0x%04X (%d)", sub.Name, value, value))
+	}
+	c.resultEdit.SetText(strings.Join(lines, "\r\n"))
+	c.clearError()
+}
+
+func (c *DialogController) ReadDiagnosticCounters() {
+	counters, err := c.model.ReadDiagnosticCounters()
+	if err != nil {
+		c.setError(err)
+		c.resultFail()
+		return
+	}
+
+	lines := make([]string, 0, len(counters))
+	for _, counter := range counters {
+		lines = append(lines, fmt.Sprintf("%s: %d", counter.Name, counter.Value))
+	}
+	c.resultEdit.SetText(strings.Join(lines, "\r\n"))
+	c.clearError()
+}
+
 func (c *DialogController) addr() (uint16, bool) {
 	addrParser := parseUint16
 	if c.hexAddrCheckBox.Checked() {
@@ -306,6 +530,22 @@ func (c *DialogController) addr() (uint16, bool) {
 	return addr, true
 }
 
+func (c *DialogController) writeAddr() (uint16, bool) {
+	addrParser := parseUint16
+	if c.hexAddrCheckBox.Checked() {
+		addrParser = parseHex
+	}
+
+	addr, err := addrParser(c.writeAddrEdit.Text())
+	if err != nil {
+		c.setError(err)
+		return 0, false
+	}
+
+	c.clearError()
+	return addr, true
+}
+
 func (c *DialogController) cnt() (int, bool) {
 	cnt, err := parseInt(c.cntEdit.Text())
 	if err != nil {
@@ -473,75 +713,25 @@ func (c *DialogController) clearError() {
 	c.errEdit.SetText("")
 }
 
-func parseHex(input string) (uint16, error) {
-	if input[:2] != "0x" {
-		return 0, errors.New("hex should start with '0x'")
-	}
-
-	input = input[2:]
-	for len(input) < 4 {
-		input = "0" + input
-	}
-
-	u64, err := strconv.ParseUint(input, 16, 64)
-	if err != nil {
-		return 0, errors.New("could not parse hex input")
-	}
-
-	if u64 > 0xFFFF {
-		return 0, errors.New("value must be less or equal then 0xFFFF")
-	}
-
-	return uint16(u64), nil
-}
-
-func parseUint16(input string) (uint16, error) {
-	u64, err := strconv.ParseUint(input, 10, 64)
-	if err != nil {
-		return 0, errors.New("could not parse decimal input")
-	}
-
-	if u64 > 0xFFFF {
-		return 0, fmt.Errorf("value must be less or equal then %d", 0xFFFF)
-	}
-
-	return uint16(u64), nil
-}
-
-func parseInt(input string) (int, error) {
-	i, err := strconv.Atoi(input)
-	if err != nil {
-		return 0, errors.New("could not parse integer")
-	}
-	return i, nil
-}
-
-func parseBool(input string) (bool, error) {
-	if input == "true" {
-		return true, nil
-	}
-
-	if input == "false" {
-		return false, nil
-	}
-
-	return false, fmt.Errorf("could not parse bool")
-}
-
 func DialogView(window *walk.MainWindow, model DialogModel, dialogType DialogType) func() {
 	controller := &DialogController{
 		model: model,
 	}
 
 	mainButtonFunction := map[DialogType]func(){
-		DialogTypeReadCoils:              controller.ReadCoils,
-		DialogTypeReadDiscreteInputs:     controller.ReadDiscreteInputs,
-		DialogTypeReadHoldingRegisters:   controller.ReadHoldingRegisters,
-		DialogTypeReadInputRegisters:     controller.ReadInputRegisters,
-		DialogTypeWriteSingleCoil:        controller.WriteSingleCoil,
-		DialogTypeWriteSingleRegister:    controller.WriteSingleRegister,
-		DialogTypeWriteMultipleRegisters: controller.WriteMultipleRegisters,
-		DialogTypeWriteMultipleCoils:     controller.WriteMultipleCoils,
+		DialogTypeReadCoils:                  controller.ReadCoils,
+		DialogTypeReadDiscreteInputs:         controller.ReadDiscreteInputs,
+		DialogTypeReadHoldingRegisters:       controller.ReadHoldingRegisters,
+		DialogTypeReadInputRegisters:         controller.ReadInputRegisters,
+		DialogTypeWriteSingleCoil:            controller.WriteSingleCoil,
+		DialogTypeWriteSingleRegister:        controller.WriteSingleRegister,
+		DialogTypeWriteMultipleRegisters:     controller.WriteMultipleRegisters,
+		DialogTypeWriteMultipleCoils:         controller.WriteMultipleCoils,
+		DialogTypeMaskWriteRegister:          controller.MaskWriteRegister,
+		DialogTypeReadWriteMultipleRegisters: controller.ReadWriteMultipleRegisters,
+		DialogTypeReadDeviceIdentification:   controller.ReadDeviceIdentification,
+		DialogTypeDiagnostics:                controller.Diagnostics,
+		DialogTypeReadDiagnosticCounters:     controller.ReadDiagnosticCounters,
 	}
 
 	return func() {
@@ -554,14 +744,58 @@ func DialogView(window *walk.MainWindow, model DialogModel, dialogType DialogTyp
 
 				widgets := make([]d.Widget, 0)
 
-				widgets = append(widgets, d.GroupBox{
-					Title:  "Starting address (hex or decimal)",
-					Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
-					Children: []d.Widget{
-						d.TextEdit{AssignTo: &controller.addrEdit, Text: "0x01"},
-						d.CheckBox{AssignTo: &controller.hexAddrCheckBox, Checked: true, Text: "Hexadecimal format"},
-					},
-				})
+				if renderObject[dialogType] {
+					levels := make([]string, 0, len(ReadDeviceIdLevels))
+					for _, level := range ReadDeviceIdLevels {
+						levels = append(levels, level.Name)
+					}
+
+					widgets = append(widgets, d.GroupBox{
+						Title:  "Objects",
+						Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
+						Children: []d.Widget{
+							d.ComboBox{AssignTo: &controller.levelComboBox, Model: levels, CurrentIndex: 0},
+							d.Label{Text: "Starting object id (example: '0x00' or '128')"},
+							d.TextEdit{AssignTo: &controller.objectEdit, Text: "0x00"},
+						},
+					})
+				}
+
+				if renderSubFunction[dialogType] {
+					subFunctions := make([]string, 0, len(DiagnosticSubFunctions))
+					for _, sub := range DiagnosticSubFunctions {
+						subFunctions = append(subFunctions, fmt.Sprintf("0x%02X %s", sub.Code, sub.Name))
+					}
+
+					widgets = append(widgets, d.GroupBox{
+						Title:  "Sub-function",
+						Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
+						Children: []d.Widget{
+							d.ComboBox{AssignTo: &controller.subFunctionComboBox, Model: subFunctions, CurrentIndex: 0},
+						},
+					})
+				}
+
+				if !noAddr[dialogType] {
+					widgets = append(widgets, d.GroupBox{
+						Title:  "Starting address (hex or decimal)",
+						Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
+						Children: []d.Widget{
+							d.TextEdit{AssignTo: &controller.addrEdit, Text: "0x01"},
+							d.CheckBox{AssignTo: &controller.hexAddrCheckBox, Checked: true, Text: "Hexadecimal format"},
+						},
+					})
+				}
+
+				if renderWriteAddr[dialogType] {
+					widgets = append(widgets, d.GroupBox{
+						Title:  "Write starting address (same format)",
+						Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
+						Children: []d.Widget{
+							d.TextEdit{AssignTo: &controller.writeAddrEdit, Text: "0x01"},
+						},
+					})
+				}
 
 				if renderAmount[dialogType] {
 					widgets = append(widgets, d.GroupBox{
@@ -603,10 +837,15 @@ func DialogView(window *walk.MainWindow, model DialogModel, dialogType DialogTyp
 					Children: func() []d.Widget {
 						children := make([]d.Widget, 0, 1)
 
-						children = append(children, d.TextEdit{
+						result := d.TextEdit{
 							AssignTo: &controller.resultEdit,
 							Enabled:  false,
-						})
+						}
+						if multilineResult[dialogType] {
+							result.MinSize = d.Size{Height: 120}
+							result.VScroll = true
+						}
+						children = append(children, result)
 
 						if resultInHex[dialogType] {
 							children = append(children, d.CheckBox{
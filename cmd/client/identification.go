@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+)
+
+// ReadDeviceIdLevels maps the names accepted by the CLI and the GUI to read
+// device id codes.
+var ReadDeviceIdLevels = []struct {
+	Name string
+	Code uint8
+}{
+	{"basic", modbusclient.ReadDeviceIdBasic},
+	{"regular", modbusclient.ReadDeviceIdRegular},
+	{"extended", modbusclient.ReadDeviceIdExtended},
+	{"individual", modbusclient.ReadDeviceIdIndividual},
+}
+
+// ParseReadDeviceIdLevel returns the read device id code of a level name.
+func ParseReadDeviceIdLevel(name string) (uint8, error) {
+	names := make([]string, 0, len(ReadDeviceIdLevels))
+	for _, level := range ReadDeviceIdLevels {
+		if level.Name == name {
+			return level.Code, nil
+		}
+		names = append(names, level.Name)
+	}
+	return 0, fmt.Errorf("level %q is not one of %s: %w", name, strings.Join(names, ", "), ErrUsage)
+}
@@ -0,0 +1,4 @@
+package main
+
+// LogComponents are the parts of the client with their own log level.
+var LogComponents = []string{"manager", "service"}
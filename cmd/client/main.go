@@ -1,9 +1,25 @@
+//go:build windows
+
 package main
 
+import (
+	"os"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
 func main() {
-	clientManager := NewClientManagmentSercieImpl()
-	modbusService := NewModbusServiceImpl(clientManager)
+	if len(os.Args) > 1 {
+		os.Exit(RunCli(os.Args[1:]))
+	}
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{Default: logging.LevelInfo})
+	frameCapture := capture.NewFrameCapture()
+	clientManager := NewClientManagmentSercieImpl(logger.Component("manager"))
+	clientManager.SetCapture(frameCapture)
+	modbusService := NewModbusServiceImpl(clientManager, logger.Component("service"))
 	viewController := NewMainModelImpl(modbusService, clientManager)
 
-	MainView(viewController)()
+	MainView(viewController, frameCapture)()
 }
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+func main() {
+	os.Exit(RunCli(os.Args[1:]))
+}
@@ -1,29 +1,154 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
-	"log"
+	"net"
+	"time"
 
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/goburrow/serial"
 	"github.com/simonvetter/modbus"
 )
 
 const (
-	DefaultTransport = "tcp"
+	TransportTCP        = "tcp"
+	TransportTCPTLS     = "tcp+tls"
+	TransportUDP        = "udp"
+	TransportRTU        = "rtu"
+	TransportASCII      = "ascii"
+	TransportRTUOverTCP = "rtuovertcp"
+	TransportRTUOverUDP = "rtuoverudp"
+
+	ParityNone = "none"
+	ParityEven = "even"
+	ParityOdd  = "odd"
+)
+
+const (
+	DefaultTransport = TransportTCP
 	DefaultAddress   = "localhost"
 	DefaultPort      = "5502"
+	DefaultUnitId    = 1
+
+	DefaultBaudRate      = 19200
+	DefaultParity        = ParityNone
+	DefaultStopBits      = 2
+	DefaultRTUDataBits   = 8
+	DefaultASCIIDataBits = 7
+	DefaultTimeout       = time.Second
 )
 
+// Transports lists the supported transports, network ones first.
+var Transports = []string{
+	TransportTCP,
+	TransportTCPTLS,
+	TransportUDP,
+	TransportRTUOverTCP,
+	TransportRTUOverUDP,
+	TransportRTU,
+	TransportASCII,
+}
+
+// Parities lists the accepted parity settings of serial links.
+var Parities = []string{ParityNone, ParityEven, ParityOdd}
+
+var serialParities = map[string]string{
+	ParityNone: "N",
+	ParityEven: "E",
+	ParityOdd:  "O",
+}
+
+// IsSerialTransport reports whether the transport talks to a serial port
+// rather than to a host and port.
+func IsSerialTransport(transport string) bool {
+	return transport == TransportRTU || transport == TransportASCII
+}
+
+// SerialParams holds the line settings of serial transports. A zero
+// DataBits picks the default of the transport: 8 for RTU, 7 for ASCII.
+type SerialParams struct {
+	BaudRate int
+	DataBits int
+	Parity   string
+	StopBits int
+}
+
+// TLSParams holds the PEM files of tcp+tls connections: the client key pair
+// presented to the server and the CAs the server certificate is checked
+// against. The role the server authorizes is part of the client certificate.
+type TLSParams struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// Load reads the client key pair and the root CA pool.
+func (p TLSParams) Load() (*tls.Certificate, *x509.CertPool, error) {
+	if p.CertFile == "" || p.KeyFile == "" || p.CAFile == "" {
+		return nil, nil, ErrTLSParamsUnknown
+	}
+
+	cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load key pair: %w", err)
+	}
+
+	rootCAs, err := modbus.LoadCertPool(p.CAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load root CAs: %w", err)
+	}
+
+	return &cert, rootCAs, nil
+}
+
+func DefaultSerialParams() SerialParams {
+	return SerialParams{
+		BaudRate: DefaultBaudRate,
+		Parity:   DefaultParity,
+		StopBits: DefaultStopBits,
+	}
+}
+
+// Validate checks the line settings.
+func (p SerialParams) Validate() error {
+	if p.BaudRate <= 0 {
+		return fmt.Errorf("baud rate must be positive, got %d", p.BaudRate)
+	}
+
+	if p.DataBits != 0 && (p.DataBits < 5 || p.DataBits > 8) {
+		return fmt.Errorf("data bits must be between 5 and 8, got %d", p.DataBits)
+	}
+
+	if _, ok := serialParities[p.Parity]; !ok {
+		return fmt.Errorf("parity %q is not one of %s, %s, %s", p.Parity, ParityNone, ParityEven, ParityOdd)
+	}
+
+	if p.StopBits != 1 && p.StopBits != 2 {
+		return fmt.Errorf("stop bits must be 1 or 2, got %d", p.StopBits)
+	}
+
+	return nil
+}
+
 var (
 	ErrTransportUnknown = errors.New("transport unknown")
 	ErrAddressUnknown   = errors.New("address unknown")
 	ErrPortUnknown      = errors.New("port unknown")
+	ErrTransportInvalid = errors.New("transport not supported")
+	ErrTLSParamsUnknown = errors.New("tls certificate, key and CA files are required")
 	ErrNoClient         = errors.New("no client")
-	ErrNotEstablished   = errors.New("connection not established")
+	// ErrNotEstablished is the error of the transports as well, so requests
+	// sent before connecting fail the same way.
+	ErrNotEstablished = modbusclient.ErrNotConnected
 )
 
 type ClientManagmentServiceImpl struct {
-	client *modbus.ModbusClient
+	client Client
 
 	transport       string
 	transportSet    bool
@@ -31,13 +156,60 @@ type ClientManagmentServiceImpl struct {
 	addressSet      bool
 	port            string
 	portSet         bool
+	unitId          uint8
+	serial          SerialParams
+	tls             TLSParams
+	timeout         time.Duration
+	capture         *capture.FrameCapture
 	connEstablished bool
 
-	logPrefix string
+	logger *logging.Logger
+}
+
+func NewClientManagmentSercieImpl(logger *logging.Logger) *ClientManagmentServiceImpl {
+	return &ClientManagmentServiceImpl{
+		unitId:  DefaultUnitId,
+		serial:  DefaultSerialParams(),
+		timeout: DefaultTimeout,
+		logger:  logger,
+	}
+}
+
+// SetSerialParams sets the line settings used by the rtu and ascii
+// transports on the next connect.
+func (m *ClientManagmentServiceImpl) SetSerialParams(params SerialParams) {
+	m.serial = params
+}
+
+// SetTLSParams sets the certificates used by the tcp+tls transport on the
+// next connect.
+func (m *ClientManagmentServiceImpl) SetTLSParams(params TLSParams) {
+	m.tls = params
+}
+
+// SetTimeout sets the per-request timeout used on the next connect.
+func (m *ClientManagmentServiceImpl) SetTimeout(timeout time.Duration) {
+	m.timeout = timeout
+}
+
+// SetCapture sets the capture the frames of the next connect are recorded
+// to, nil records nothing.
+func (m *ClientManagmentServiceImpl) SetCapture(capture *capture.FrameCapture) {
+	m.capture = capture
+}
+
+// SetUnitId sets the unit id (slave id) requests are addressed to. It is
+// applied to the current connection as well as to future ones.
+func (m *ClientManagmentServiceImpl) SetUnitId(unitId uint8) {
+	m.unitId = unitId
+	if m.client != nil {
+		m.client.SetUnitId(unitId)
+	}
 }
 
-func NewClientManagmentSercieImpl() *ClientManagmentServiceImpl {
-	return &ClientManagmentServiceImpl{}
+// UnitId returns the unit id requests are addressed to.
+func (m *ClientManagmentServiceImpl) UnitId() uint8 {
+	return m.unitId
 }
 
 func (m *ClientManagmentServiceImpl) SetParams(transport, address, port string) {
@@ -93,33 +265,78 @@ func (m *ClientManagmentServiceImpl) Connect() error {
 		return fmt.Errorf("resolve address: %w", err)
 	}
 
-	port, err := m.resolvePortStrict()
+	client, err := m.newClient(transport, address)
 	if err != nil {
-		return fmt.Errorf("resolve port: %w", err)
+		m.logger.Error("Client not created", logging.Field("transport", transport), logging.Field("address", address), logging.FieldError(err))
+		return err
 	}
 
-	client, err := modbus.NewClient(
-		&modbus.ClientConfiguration{
-			URL: fmt.Sprintf("%s://%s:%s", transport, address, port),
-		},
-	)
-
-	if err != nil {
-		log.Printf("%s: client not created: %v\n", m.logPrefix, err)
+	if err := client.Open(); err != nil {
+		m.logger.Warn("Connection not established", logging.Field("transport", transport), logging.Field("address", address), logging.FieldError(err))
 		return err
 	}
 
-	if err := client.Open(); err != nil {
-		log.Printf("%s: conn is not established: %v\n", m.logPrefix, err)
+	if err := client.SetUnitId(m.unitId); err != nil {
+		m.logger.Error("Could not set unit id", logging.FieldUnitId(m.unitId), logging.FieldError(err))
 		return err
 	}
 
-	log.Printf("%s: conn established", m.logPrefix)
+	m.logger.Info("Connection established", logging.Field("transport", transport), logging.Field("address", address), logging.FieldUnitId(m.unitId))
 	m.connEstablished = true
 	m.client = client
 	return nil
 }
 
+// newClient creates the client for the transport: serial transports talk to
+// the serial port named by address, the others to address and port.
+func (m *ClientManagmentServiceImpl) newClient(transport, address string) (Client, error) {
+	if IsSerialTransport(transport) {
+		if err := m.serial.Validate(); err != nil {
+			return nil, fmt.Errorf("serial params: %w", err)
+		}
+
+		if transport == TransportASCII {
+			return modbusclient.NewRawClient(modbusclient.NewASCIITransport(newSerialConfig(address, m.serial, DefaultASCIIDataBits, m.timeout), m.capture)), nil
+		}
+		return modbusclient.NewRawClient(modbusclient.NewSerialRTUTransport(newSerialConfig(address, m.serial, DefaultRTUDataBits, m.timeout), m.capture)), nil
+	}
+
+	port, err := m.resolvePortStrict()
+	if err != nil {
+		return nil, fmt.Errorf("resolve port: %w", err)
+	}
+	hostPort := net.JoinHostPort(address, port)
+
+	switch transport {
+	case TransportTCP:
+		return modbusclient.NewRawClient(modbusclient.NewMBAPTransport("tcp", hostPort, nil, m.timeout, m.capture)), nil
+
+	case TransportUDP:
+		return modbusclient.NewRawClient(modbusclient.NewMBAPTransport("udp", hostPort, nil, m.timeout, m.capture)), nil
+
+	case TransportTCPTLS:
+		cert, rootCAs, err := m.tls.Load()
+		if err != nil {
+			return nil, fmt.Errorf("tls params: %w", err)
+		}
+
+		return modbusclient.NewRawClient(modbusclient.NewMBAPTransport("tcp", hostPort, &tls.Config{
+			Certificates: []tls.Certificate{*cert},
+			RootCAs:      rootCAs,
+			// TLS 1.2 or higher (R-01 of the Modbus/TCP Security spec)
+			MinVersion: tls.VersionTLS12,
+		}, m.timeout, m.capture)), nil
+
+	case TransportRTUOverTCP:
+		return modbusclient.NewRawClient(modbusclient.NewNetworkRTUTransport("tcp", hostPort, m.timeout, m.capture)), nil
+
+	case TransportRTUOverUDP:
+		return modbusclient.NewRawClient(modbusclient.NewNetworkRTUTransport("udp", hostPort, m.timeout, m.capture)), nil
+	}
+
+	return nil, fmt.Errorf("%q: %w", transport, ErrTransportInvalid)
+}
+
 func (m *ClientManagmentServiceImpl) Reconnect() error {
 	if err := m.Disconnect(); err != nil {
 		return fmt.Errorf("disconnect: %w", err)
@@ -135,7 +352,7 @@ func (m *ClientManagmentServiceImpl) Reconnect() error {
 func (m *ClientManagmentServiceImpl) Disconnect() error {
 	if m.connEstablished && m.client != nil {
 		if err := m.client.Close(); err != nil {
-			log.Printf("%s: close client connection: %v", m.logPrefix, err)
+			m.logger.Warn("Could not close client connection", logging.FieldError(err))
 		}
 
 		m.client = nil
@@ -145,7 +362,7 @@ func (m *ClientManagmentServiceImpl) Disconnect() error {
 	return nil
 }
 
-func (m *ClientManagmentServiceImpl) GetClient() (*modbus.ModbusClient, error) {
+func (m *ClientManagmentServiceImpl) GetClient() (Client, error) {
 	if m.client == nil {
 		return nil, ErrNoClient
 	}
@@ -198,3 +415,21 @@ func (m *ClientManagmentServiceImpl) resolvePortStrict() (string, error) {
 	}
 	return m.port, nil
 }
+
+// newSerialConfig returns the port settings of a serial transport, using
+// defaultDataBits unless the params set them.
+func newSerialConfig(device string, params SerialParams, defaultDataBits int, timeout time.Duration) *serial.Config {
+	dataBits := params.DataBits
+	if dataBits == 0 {
+		dataBits = defaultDataBits
+	}
+
+	return &serial.Config{
+		Address:  device,
+		BaudRate: params.BaudRate,
+		DataBits: dataBits,
+		StopBits: params.StopBits,
+		Parity:   serialParities[params.Parity],
+		Timeout:  timeout,
+	}
+}
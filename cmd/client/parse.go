@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func parseHex(input string) (uint16, error) {
+	if !strings.HasPrefix(input, "0x") {
+		return 0, errors.New("hex should start with '0x'")
+	}
+
+	input = input[2:]
+	for len(input) < 4 {
+		input = "0" + input
+	}
+
+	u64, err := strconv.ParseUint(input, 16, 64)
+	if err != nil {
+		return 0, errors.New("could not parse hex input")
+	}
+
+	if u64 > 0xFFFF {
+		return 0, errors.New("value must be less or equal then 0xFFFF")
+	}
+
+	return uint16(u64), nil
+}
+
+func parseUint16(input string) (uint16, error) {
+	u64, err := strconv.ParseUint(input, 10, 64)
+	if err != nil {
+		return 0, errors.New("could not parse decimal input")
+	}
+
+	if u64 > 0xFFFF {
+		return 0, fmt.Errorf("value must be less or equal then %d", 0xFFFF)
+	}
+
+	return uint16(u64), nil
+}
+
+// parseUint16Auto parses hex input if it starts with '0x' and decimal
+// input otherwise.
+func parseUint16Auto(input string) (uint16, error) {
+	if strings.HasPrefix(input, "0x") {
+		return parseHex(input)
+	}
+	return parseUint16(input)
+}
+
+func parseUnitId(input string) (uint8, error) {
+	u64, err := strconv.ParseUint(input, 10, 64)
+	if err != nil {
+		return 0, errors.New("could not parse unit id")
+	}
+
+	if u64 > 0xFF {
+		return 0, fmt.Errorf("unit id must be less or equal then %d", 0xFF)
+	}
+
+	return uint8(u64), nil
+}
+
+func parseInt(input string) (int, error) {
+	i, err := strconv.Atoi(input)
+	if err != nil {
+		return 0, errors.New("could not parse integer")
+	}
+	return i, nil
+}
+
+func parseBool(input string) (bool, error) {
+	if input == "true" {
+		return true, nil
+	}
+
+	if input == "false" {
+		return false, nil
+	}
+
+	return false, fmt.Errorf("could not parse bool")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/aveplen/mirea-modbus/internal/recording"
+)
+
+// ReplayResult is a replayed request with the differences between the
+// response it got and the recorded one, none if they match.
+type ReplayResult struct {
+	// Index is the position of the request in the recording, from 0.
+	Index       int
+	Request     recording.RecordedRequest
+	Differences []string
+}
+
+// Replay issues the recorded requests in order, each at its offset divided
+// by speed from the start of the replay, or back to back with a zero speed.
+// Unless overrideUnit is set, every request is addressed to its recorded
+// unit, and the unit set before is restored afterwards. Requests that fail
+// without an exception are reported as differences, the replay goes on.
+func Replay(service ModbusService, clients ClientManagmentService, requests []recording.RecordedRequest, speed float64, overrideUnit bool) []ReplayResult {
+	if !overrideUnit {
+		defer clients.SetUnitId(clients.UnitId())
+	}
+
+	results := make([]ReplayResult, 0, len(requests))
+	start := time.Now()
+	for i, request := range requests {
+		if speed > 0 {
+			if wait := time.Until(start.Add(time.Duration(float64(request.Offset) / speed))); wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+
+		if !overrideUnit {
+			clients.SetUnitId(request.UnitId)
+		}
+
+		result := ReplayResult{Index: i, Request: request}
+		response, err := replayRequest(service, request)
+		if err != nil {
+			result.Differences = []string{fmt.Sprintf("request failed: %v", err)}
+		} else {
+			result.Differences = compareResponses(request.Response, response)
+		}
+		results = append(results, result)
+	}
+
+	return results
+}
+
+// replayRequest issues the request and returns the response it got, with
+// modbus exceptions as the response exception.
+func replayRequest(service ModbusService, request recording.RecordedRequest) (recording.RecordedResponse, error) {
+	var response recording.RecordedResponse
+	var err error
+
+	switch request.FunctionCode {
+	case fcReadCoils:
+		response.Coils, err = service.ReadCoils0x01(request.Addr, int(request.Quantity))
+
+	case fcReadDiscreteInputs:
+		response.Coils, err = service.ReadDiscreteInputs0x02(request.Addr, int(request.Quantity))
+
+	case fcReadHoldingRegisters:
+		response.Registers, err = service.ReadHoldingRegisters0x03(request.Addr, int(request.Quantity))
+
+	case fcReadInputRegisters:
+		response.Registers, err = service.ReadInputRegisters0x04(request.Addr, int(request.Quantity))
+
+	case fcWriteSingleCoil:
+		err = service.WriteSingleCoil0x05(request.Addr, request.Coils[0])
+
+	case fcWriteSingleRegister:
+		err = service.WriteSingleRegister0x06(request.Addr, request.Registers[0])
+
+	case fcWriteMultipleCoils:
+		err = service.WriteMultipleCoils0x0F(request.Addr, request.Coils)
+
+	case fcWriteMultipleRegisters:
+		err = service.WriteMultipleRegisters0x10(request.Addr, request.Registers)
+
+	case fcMaskWriteRegister:
+		err = service.MaskWriteRegister0x16(request.Addr, request.Registers[0], request.Registers[1])
+
+	case fcReadWriteMultipleRegisters:
+		response.Registers, err = service.ReadWriteMultipleRegisters0x17(request.Addr, int(request.Quantity), request.WriteAddr, request.Registers)
+
+	case fcEncapsulatedInterface:
+		var identification *modbusclient.DeviceIdentification
+		identification, err = service.ReadDeviceIdentification0x2B(request.ReadDeviceIdCode, uint8(request.Addr))
+		if err == nil {
+			for _, object := range identification.Objects {
+				response.Objects = append(response.Objects, recording.RecordedObject{Id: object.Id, Value: object.Value})
+			}
+		}
+
+	default:
+		return response, fmt.Errorf("function code 0x%02X can't be replayed", request.FunctionCode)
+	}
+
+	if err != nil {
+		e, ok := modbusclient.FindException(err)
+		if !ok {
+			return response, err
+		}
+		return recording.RecordedResponse{Exception: e.Code}, nil
+	}
+
+	return response, nil
+}
+
+// compareResponses describes every difference of the replayed response from
+// the recorded one. The client reads every identification object of a
+// stream, so the recorded objects only have to come first.
+func compareResponses(recorded, replayed recording.RecordedResponse) []string {
+	if recorded.Exception != replayed.Exception {
+		return []string{fmt.Sprintf("recorded %s, got %s", describeException(recorded.Exception), describeException(replayed.Exception))}
+	}
+
+	differences := make([]string, 0)
+	if len(recorded.Registers) != len(replayed.Registers) {
+		differences = append(differences, fmt.Sprintf("recorded %d registers, got %d", len(recorded.Registers), len(replayed.Registers)))
+	}
+	for i := 0; i < len(recorded.Registers) && i < len(replayed.Registers); i++ {
+		if recorded.Registers[i] != replayed.Registers[i] {
+			differences = append(differences, fmt.Sprintf("register %d: recorded 0x%04X, got 0x%04X", i, recorded.Registers[i], replayed.Registers[i]))
+		}
+	}
+
+	if len(recorded.Coils) != len(replayed.Coils) {
+		differences = append(differences, fmt.Sprintf("recorded %d coils, got %d", len(recorded.Coils), len(replayed.Coils)))
+	}
+	for i := 0; i < len(recorded.Coils) && i < len(replayed.Coils); i++ {
+		if recorded.Coils[i] != replayed.Coils[i] {
+			differences = append(differences, fmt.Sprintf("coil %d: recorded %t, got %t", i, recorded.Coils[i], replayed.Coils[i]))
+		}
+	}
+
+	if len(replayed.Objects) < len(recorded.Objects) {
+		differences = append(differences, fmt.Sprintf("recorded %d objects, got %d", len(recorded.Objects), len(replayed.Objects)))
+	}
+	for i := 0; i < len(recorded.Objects) && i < len(replayed.Objects); i++ {
+		if recorded.Objects[i] != replayed.Objects[i] {
+			differences = append(differences, fmt.Sprintf(
+				"object %d: recorded 0x%02X %q, got 0x%02X %q",
+				i, recorded.Objects[i].Id, recorded.Objects[i].Value, replayed.Objects[i].Id, replayed.Objects[i].Value,
+			))
+		}
+	}
+
+	return differences
+}
+
+func describeException(code uint8) string {
+	if code == 0 {
+		return "a normal response"
+	}
+
+	if e, ok := modbusclient.ExceptionByCode(code); ok {
+		return fmt.Sprintf("exception 0x%02X (%s)", code, e.Name)
+	}
+	return fmt.Sprintf("exception 0x%02X", code)
+}
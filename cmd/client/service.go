@@ -2,48 +2,70 @@ package main
 
 import (
 	"fmt"
-	"log"
 
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
 	"github.com/simonvetter/modbus"
 )
 
 const retries = 2
 
+func isModbusException(err error) bool {
+	_, ok := modbusclient.FindException(err)
+	return ok
+}
+
 type ClientSupplier interface {
-	GetClient() (*modbus.ModbusClient, error)
+	GetClient() (Client, error)
 	Reconnect() error
 }
 
 type ModbusServiceImpl struct {
 	clientService ClientSupplier
+	logger        *logging.Logger
 }
 
-func NewModbusServiceImpl(clientService ClientSupplier) *ModbusServiceImpl {
+func NewModbusServiceImpl(clientService ClientSupplier, logger *logging.Logger) *ModbusServiceImpl {
 	return &ModbusServiceImpl{
 		clientService: clientService,
+		logger:        logger,
 	}
 }
 
-func (a *ModbusServiceImpl) ReadCoils0x01(addr uint16, cnt int) ([]bool, error) {
-	var coils []bool
+// retry runs the request, reconnecting and running it again up to retries
+// times while it fails. The op names the request in the log, e.g. "reading
+// coils".
+func (a *ModbusServiceImpl) retry(op string, fields []logging.LogField, run func() error) error {
 	var err error
-	var succ bool
 
 	for attempt := 0; attempt < retries+1; attempt++ {
-		coils, err = a.readCoils0x01(addr, cnt)
-		if err == nil {
-			succ = true
-			break
+		if err = run(); err == nil {
+			return nil
 		}
 
-		log.Printf(
-			"retry reading %d coils at 0x%X, attempts left: %d",
-			cnt, addr, retries-attempt,
-		)
+		// the answer to an exception won't change, only the transport is
+		// worth retrying
+		if isModbusException(err) {
+			return err
+		}
+
+		retryFields := append(fields[:len(fields):len(fields)], logging.Field("attempts_left", retries-attempt), logging.FieldError(err))
+		a.logger.Warn("Retry "+op, retryFields...)
 		a.clientService.Reconnect()
 	}
 
-	if !succ {
+	return err
+}
+
+func (a *ModbusServiceImpl) ReadCoils0x01(addr uint16, cnt int) ([]bool, error) {
+	var coils []bool
+	err := a.retry("reading coils", []logging.LogField{
+		logging.FieldFunctionCode(fcReadCoils), logging.FieldAddr(addr), logging.FieldCount(cnt),
+	}, func() (err error) {
+		coils, err = a.readCoils0x01(addr, cnt)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -66,24 +88,13 @@ func (a *ModbusServiceImpl) readCoils0x01(addr uint16, cnt int) ([]bool, error)
 
 func (a *ModbusServiceImpl) ReadDiscreteInputs0x02(addr uint16, cnt int) ([]bool, error) {
 	var discreteInputs []bool
-	var err error
-	var succ bool
-
-	for attempt := 0; attempt < retries+1; attempt++ {
+	err := a.retry("reading discrete inputs", []logging.LogField{
+		logging.FieldFunctionCode(fcReadDiscreteInputs), logging.FieldAddr(addr), logging.FieldCount(cnt),
+	}, func() (err error) {
 		discreteInputs, err = a.readDiscreteInputs0x02(addr, cnt)
-		if err == nil {
-			succ = true
-			break
-		}
-
-		log.Printf(
-			"retry reading discrete inputs %d coils at 0x%X, attempts left: %d",
-			cnt, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
-	}
-
-	if !succ {
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -106,24 +117,13 @@ func (a *ModbusServiceImpl) readDiscreteInputs0x02(addr uint16, cnt int) ([]bool
 
 func (a *ModbusServiceImpl) ReadHoldingRegisters0x03(addr uint16, cnt int) ([]uint16, error) {
 	var holdingRegisters []uint16
-	var err error
-	var succ bool
-
-	for attempt := 0; attempt < retries+1; attempt++ {
+	err := a.retry("reading holding registers", []logging.LogField{
+		logging.FieldFunctionCode(fcReadHoldingRegisters), logging.FieldAddr(addr), logging.FieldCount(cnt),
+	}, func() (err error) {
 		holdingRegisters, err = a.readHoldingRegisters0x03(addr, cnt)
-		if err == nil {
-			succ = true
-			break
-		}
-
-		log.Printf(
-			"retry reading holding registers %d coils at 0x%X, attempts left: %d",
-			cnt, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
-	}
-
-	if !succ {
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -146,24 +146,13 @@ func (a *ModbusServiceImpl) readHoldingRegisters0x03(addr uint16, cnt int) ([]ui
 
 func (a *ModbusServiceImpl) ReadInputRegisters0x04(addr uint16, cnt int) ([]uint16, error) {
 	var inputRegisters []uint16
-	var err error
-	var succ bool
-
-	for attempt := 0; attempt < retries+1; attempt++ {
+	err := a.retry("reading input registers", []logging.LogField{
+		logging.FieldFunctionCode(fcReadInputRegisters), logging.FieldAddr(addr), logging.FieldCount(cnt),
+	}, func() (err error) {
 		inputRegisters, err = a.readInputRegisters0x04(addr, cnt)
-		if err == nil {
-			succ = true
-			break
-		}
-
-		log.Printf(
-			"retry reading input registers %d coils at 0x%X, attempts left: %d",
-			cnt, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
-	}
-
-	if !succ {
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -185,149 +174,222 @@ func (a *ModbusServiceImpl) readInputRegisters0x04(addr uint16, cnt int) ([]uint
 }
 
 func (a *ModbusServiceImpl) WriteSingleCoil0x05(addr uint16, value bool) error {
-	var err error
-	var succ bool
-
-	for attempt := 0; attempt < retries+1; attempt++ {
-		if err = a.writeSingleCoil0x05(addr, value); err == nil {
-			succ = true
-			break
-		}
+	return a.retry("writing single coil", []logging.LogField{
+		logging.FieldFunctionCode(fcWriteSingleCoil), logging.FieldAddr(addr), logging.Field("value", value),
+	}, func() error {
+		return a.writeSingleCoil0x05(addr, value)
+	})
+}
 
-		log.Printf(
-			"retry writing %v to single coil at 0x%X, attempts left: %d",
-			value, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
+func (a *ModbusServiceImpl) writeSingleCoil0x05(addr uint16, value bool) error {
+	client, err := a.clientService.GetClient()
+	if err != nil {
+		return fmt.Errorf("get client: %w", err)
 	}
 
-	if !succ {
-		return err
+	if err := client.WriteCoil(addr, value); err != nil {
+		return fmt.Errorf("write coil at %d: %w", addr, err)
 	}
 
 	return nil
 }
 
-func (a *ModbusServiceImpl) writeSingleCoil0x05(addr uint16, value bool) error {
+func (a *ModbusServiceImpl) WriteSingleRegister0x06(addr uint16, value uint16) error {
+	return a.retry("writing single register", []logging.LogField{
+		logging.FieldFunctionCode(fcWriteSingleRegister), logging.FieldAddr(addr), logging.Field("value", value),
+	}, func() error {
+		return a.writeSingleRegister0x06(addr, value)
+	})
+}
+
+func (a *ModbusServiceImpl) writeSingleRegister0x06(addr uint16, value uint16) error {
 	client, err := a.clientService.GetClient()
 	if err != nil {
 		return fmt.Errorf("get client: %w", err)
 	}
 
-	if err := client.WriteCoil(addr, value); err != nil {
-		return fmt.Errorf("write coil at %d: %w", addr, err)
+	if err := client.WriteRegister(addr, value); err != nil {
+		return fmt.Errorf("write value at %d: %w", addr, err)
 	}
 
 	return nil
 }
 
-func (a *ModbusServiceImpl) WriteSingleRegister0x06(addr uint16, value uint16) error {
-	var err error
-	var succ bool
+func (a *ModbusServiceImpl) WriteMultipleRegisters0x10(addr uint16, values []uint16) error {
+	return a.retry("writing multiple registers", []logging.LogField{
+		logging.FieldFunctionCode(fcWriteMultipleRegisters), logging.FieldAddr(addr), logging.FieldCount(len(values)),
+	}, func() error {
+		return a.writeMultipleRegisters0x10(addr, values)
+	})
+}
 
-	for attempt := 0; attempt < retries+1; attempt++ {
-		if err = a.writeSingleRegister0x06(addr, value); err == nil {
-			succ = true
-			break
-		}
+func (a *ModbusServiceImpl) writeMultipleRegisters0x10(addr uint16, values []uint16) error {
+	client, err := a.clientService.GetClient()
+	if err != nil {
+		return fmt.Errorf("get client: %w", err)
+	}
 
-		log.Printf(
-			"retry writing %v to single register at 0x%X, attempts left: %d",
-			value, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
+	if err := client.WriteRegisters(addr, values); err != nil {
+		return fmt.Errorf("write %d registers at address %d: %w", len(values), addr, err)
 	}
 
-	if !succ {
-		return err
+	return nil
+}
+
+func (a *ModbusServiceImpl) WriteMultipleCoils0x0F(addr uint16, values []bool) error {
+	return a.retry("writing multiple coils", []logging.LogField{
+		logging.FieldFunctionCode(fcWriteMultipleCoils), logging.FieldAddr(addr), logging.FieldCount(len(values)),
+	}, func() error {
+		return a.writeMultipleCoils0x0F(addr, values)
+	})
+}
+
+func (a *ModbusServiceImpl) writeMultipleCoils0x0F(addr uint16, values []bool) error {
+	client, err := a.clientService.GetClient()
+	if err != nil {
+		return fmt.Errorf("get client: %w", err)
+	}
+
+	if err := client.WriteCoils(addr, values); err != nil {
+		return fmt.Errorf("write %v coils at address %d: %w", len(values), addr, err)
 	}
 
 	return nil
 }
 
-func (a *ModbusServiceImpl) writeSingleRegister0x06(addr uint16, value uint16) error {
+func (a *ModbusServiceImpl) MaskWriteRegister0x16(addr uint16, andMask uint16, orMask uint16) error {
+	return a.retry("mask writing register", []logging.LogField{
+		logging.FieldFunctionCode(fcMaskWriteRegister), logging.FieldAddr(addr),
+	}, func() error {
+		return a.maskWriteRegister0x16(addr, andMask, orMask)
+	})
+}
+
+func (a *ModbusServiceImpl) maskWriteRegister0x16(addr uint16, andMask uint16, orMask uint16) error {
 	client, err := a.clientService.GetClient()
 	if err != nil {
 		return fmt.Errorf("get client: %w", err)
 	}
 
-	if err := client.WriteRegister(addr, value); err != nil {
-		return fmt.Errorf("write value at %d: %w", addr, err)
+	if err := client.MaskWriteRegister(addr, andMask, orMask); err != nil {
+		return fmt.Errorf("mask write register at address %d: %w", addr, err)
 	}
 
 	return nil
 }
 
-func (a *ModbusServiceImpl) WriteMultipleRegisters0x10(addr uint16, values []uint16) error {
-	var err error
-	var succ bool
+func (a *ModbusServiceImpl) ReadWriteMultipleRegisters0x17(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	var registers []uint16
+	err := a.retry("reading/writing registers", []logging.LogField{
+		logging.FieldFunctionCode(fcReadWriteMultipleRegisters), logging.FieldAddr(readAddr), logging.FieldCount(readCnt), logging.Field("write_addr", writeAddr),
+	}, func() (err error) {
+		registers, err = a.readWriteMultipleRegisters0x17(readAddr, readCnt, writeAddr, values)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for attempt := 0; attempt < retries+1; attempt++ {
-		if err = a.writeMultipleRegisters0x10(addr, values); err == nil {
-			succ = true
-			break
-		}
+	return registers, nil
+}
 
-		log.Printf(
-			"retry writing %v to multiple registers starting at 0x%X, attempts left: %d",
-			values, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
+func (a *ModbusServiceImpl) readWriteMultipleRegisters0x17(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	client, err := a.clientService.GetClient()
+	if err != nil {
+		return nil, fmt.Errorf("get client: %w", err)
+	}
+
+	regs, err := client.ReadWriteRegisters(readAddr, uint16(readCnt), writeAddr, values)
+	if err != nil {
+		return nil, fmt.Errorf("write %d registers at address %d, read %d registers at address %d: %w", len(values), writeAddr, readCnt, readAddr, err)
 	}
 
-	if !succ {
+	return regs, nil
+}
+
+func (a *ModbusServiceImpl) ReadDeviceIdentification0x2B(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error) {
+	var identification *modbusclient.DeviceIdentification
+	err := a.retry("reading device identification", []logging.LogField{
+		logging.FieldFunctionCode(fcEncapsulatedInterface), logging.Field("object_id", fmt.Sprintf("0x%02X", objectId)),
+	}, func() (err error) {
+		identification, err = a.readDeviceIdentification0x2B(code, objectId)
 		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return identification, nil
 }
 
-func (a *ModbusServiceImpl) writeMultipleRegisters0x10(addr uint16, values []uint16) error {
+func (a *ModbusServiceImpl) readDeviceIdentification0x2B(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error) {
 	client, err := a.clientService.GetClient()
 	if err != nil {
-		return fmt.Errorf("get client: %w", err)
+		return nil, fmt.Errorf("get client: %w", err)
 	}
 
-	if err := client.WriteRegisters(addr, values); err != nil {
-		return fmt.Errorf("write %d registers at address %d: %w", len(values), addr, err)
+	identification, err := client.ReadDeviceIdentification(code, objectId)
+	if err != nil {
+		return nil, fmt.Errorf("read device identification 0x%02X from object 0x%02X: %w", code, objectId, err)
 	}
 
-	return nil
+	return identification, nil
 }
 
-func (a *ModbusServiceImpl) WriteMultipleCoils0x0F(addr uint16, values []bool) error {
-	var err error
-	var succ bool
+func (a *ModbusServiceImpl) Diagnostics0x08(subFunction uint16, data []uint16) ([]uint16, error) {
+	var result []uint16
+	err := a.retry("diagnostics", []logging.LogField{
+		logging.FieldFunctionCode(fcDiagnostics), logging.Field("sub_function", fmt.Sprintf("0x%02X", subFunction)),
+	}, func() (err error) {
+		result, err = a.diagnostics0x08(subFunction, data)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	for attempt := 0; attempt < retries+1; attempt++ {
-		if err = a.writeMultipleCoils0x0F(addr, values); err == nil {
-			succ = true
-			break
-		}
+	return result, nil
+}
 
-		log.Printf(
-			"retry writing %v to multiple coils starting at 0x%X, attempts left: %d",
-			values, addr, retries-attempt,
-		)
-		a.clientService.Reconnect()
+func (a *ModbusServiceImpl) diagnostics0x08(subFunction uint16, data []uint16) ([]uint16, error) {
+	client, err := a.clientService.GetClient()
+	if err != nil {
+		return nil, fmt.Errorf("get client: %w", err)
 	}
 
-	if !succ {
+	result, err := client.Diagnostics(subFunction, data)
+	if err != nil {
+		return nil, fmt.Errorf("diagnostics sub-function 0x%02X: %w", subFunction, err)
+	}
+
+	return result, nil
+}
+
+func (a *ModbusServiceImpl) GetCommEventCounter0x0B() (modbusclient.CommEventCounter, error) {
+	var counter modbusclient.CommEventCounter
+	err := a.retry("getting comm event counter", []logging.LogField{
+		logging.FieldFunctionCode(fcGetCommEventCounter),
+	}, func() (err error) {
+		counter, err = a.getCommEventCounter0x0B()
 		return err
+	})
+	if err != nil {
+		return modbusclient.CommEventCounter{}, err
 	}
 
-	return nil
+	return counter, nil
 }
 
-func (a *ModbusServiceImpl) writeMultipleCoils0x0F(addr uint16, values []bool) error {
+func (a *ModbusServiceImpl) getCommEventCounter0x0B() (modbusclient.CommEventCounter, error) {
 	client, err := a.clientService.GetClient()
 	if err != nil {
-		return fmt.Errorf("get client: %w", err)
+		return modbusclient.CommEventCounter{}, fmt.Errorf("get client: %w", err)
 	}
 
-	if err := client.WriteCoils(addr, values); err != nil {
-		return fmt.Errorf("write %v coils at address %d: %w", len(values), addr, err)
+	counter, err := client.GetCommEventCounter()
+	if err != nil {
+		return modbusclient.CommEventCounter{}, fmt.Errorf("get comm event counter: %w", err)
 	}
 
-	return nil
+	return counter, nil
 }
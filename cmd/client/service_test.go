@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// fakeClient answers requests with the errors queued in errs, then
+// successfully. Requests it doesn't override panic on the nil Client.
+type fakeClient struct {
+	Client
+	errs     []error
+	requests int
+}
+
+func (c *fakeClient) next() error {
+	c.requests++
+	if len(c.errs) == 0 {
+		return nil
+	}
+	err := c.errs[0]
+	c.errs = c.errs[1:]
+	return err
+}
+
+func (c *fakeClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	if err := c.next(); err != nil {
+		return nil, err
+	}
+	return make([]uint16, quantity), nil
+}
+
+func (c *fakeClient) WriteRegister(addr uint16, value uint16) error {
+	return c.next()
+}
+
+type fakeClientSupplier struct {
+	client     *fakeClient
+	reconnects int
+}
+
+func (s *fakeClientSupplier) GetClient() (Client, error) {
+	return s.client, nil
+}
+
+func (s *fakeClientSupplier) Reconnect() error {
+	s.reconnects++
+	return nil
+}
+
+func TestServiceRetry(t *testing.T) {
+	errTimeout := errors.New("i/o timeout")
+
+	tests := []struct {
+		name           string
+		errs           []error
+		wantErr        error
+		wantRequests   int
+		wantReconnects int
+	}{
+		{"success", nil, nil, 1, 0},
+		{"exception", []error{modbus.ErrIllegalDataAddress}, modbus.ErrIllegalDataAddress, 1, 0},
+		{"busy", []error{modbus.ErrServerDeviceBusy}, modbus.ErrServerDeviceBusy, 1, 0},
+		{"transport error", []error{errTimeout}, nil, 2, 1},
+		{"transport error, then exception", []error{errTimeout, modbus.ErrIllegalFunction}, modbus.ErrIllegalFunction, 2, 1},
+		{"transport errors", []error{errTimeout, errTimeout, errTimeout}, errTimeout, retries + 1, retries + 1},
+	}
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			check := func(request string, err error, client *fakeClient, supplier *fakeClientSupplier) {
+				t.Helper()
+
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("%s: got error %v, want %v", request, err, test.wantErr)
+				}
+				if client.requests != test.wantRequests {
+					t.Errorf("%s: sent %d requests, want %d", request, client.requests, test.wantRequests)
+				}
+				if supplier.reconnects != test.wantReconnects {
+					t.Errorf("%s: reconnected %d times, want %d", request, supplier.reconnects, test.wantReconnects)
+				}
+			}
+
+			client := &fakeClient{errs: append([]error(nil), test.errs...)}
+			supplier := &fakeClientSupplier{client: client}
+			registers, err := NewModbusServiceImpl(supplier, logger).ReadHoldingRegisters0x03(100, 2)
+			check("read", err, client, supplier)
+			if err == nil && len(registers) != 2 {
+				t.Errorf("read: got %d registers, want 2", len(registers))
+			}
+
+			client = &fakeClient{errs: append([]error(nil), test.errs...)}
+			supplier = &fakeClientSupplier{client: client}
+			err = NewModbusServiceImpl(supplier, logger).WriteSingleRegister0x06(100, 1)
+			check("write", err, client, supplier)
+		})
+	}
+}
@@ -1,12 +1,24 @@
+//go:build windows
+
 package main
 
 import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
 	"github.com/lxn/walk"
 	d "github.com/lxn/walk/declarative"
 )
 
 type MainModel interface {
 	Connect(transport, address, port string) error
+	SetUnitId(unitId uint8)
+	SetSerialParams(params SerialParams)
+	SetTLSParams(params TLSParams)
+	SetTimeout(timeout time.Duration)
 	Reconnect() error
 	Disconnect() error
 
@@ -18,10 +30,16 @@ type MainModel interface {
 	WriteSingleRegister(addr uint16, value uint16) error
 	WriteMultipleRegisters(addr uint16, values []uint16) error
 	WriteMultipleCoils(addr uint16, values []bool) error
+	MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error
+	ReadWriteMultipleRegisters(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error)
+	ReadDeviceIdentification(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error)
+	Diagnostics(subFunction uint16, data []uint16) ([]uint16, error)
+	ReadDiagnosticCounters() ([]DiagnosticCounter, error)
 }
 
 type MainController struct {
-	model MainModel
+	model  MainModel
+	frames *FrameView
 
 	connParamsSaved bool
 	connEstablished bool
@@ -30,9 +48,25 @@ type MainController struct {
 	connectButton                *walk.PushButton
 	reconnectButton              *walk.PushButton
 	disconnectButton             *walk.PushButton
-	transportEdit                *walk.TextEdit
+	transportBox                 *walk.ComboBox
+	addressLabel                 *walk.Label
 	addressEdit                  *walk.TextEdit
+	portLabel                    *walk.Label
 	portEdit                     *walk.TextEdit
+	baudRateLabel                *walk.Label
+	baudRateEdit                 *walk.TextEdit
+	parityLabel                  *walk.Label
+	parityBox                    *walk.ComboBox
+	stopBitsLabel                *walk.Label
+	stopBitsBox                  *walk.ComboBox
+	tlsCertLabel                 *walk.Label
+	tlsCertEdit                  *walk.TextEdit
+	tlsKeyLabel                  *walk.Label
+	tlsKeyEdit                   *walk.TextEdit
+	tlsCALabel                   *walk.Label
+	tlsCAEdit                    *walk.TextEdit
+	unitIdEdit                   *walk.TextEdit
+	timeoutEdit                  *walk.TextEdit
 	readCoilsButton              *walk.PushButton
 	readDiscreteInputsButton     *walk.PushButton
 	readHoldingRegistersButton   *walk.PushButton
@@ -41,15 +75,54 @@ type MainController struct {
 	writeSingleRegisterButton    *walk.PushButton
 	writeMultipleRegistersButton *walk.PushButton
 	writeMultipleCoilsButton     *walk.PushButton
+	maskWriteRegisterButton      *walk.PushButton
+	readWriteRegistersButton     *walk.PushButton
+	readDeviceIdButton           *walk.PushButton
+	diagnosticsButton            *walk.PushButton
+	readCountersButton           *walk.PushButton
 	errEdit                      *walk.TextEdit
 }
 
 func (c *MainController) Connect() {
 	defer c.resetButtons()
 
-	tansport := c.transportEdit.Text()
+	tansport := c.transportBox.Text()
 	address := c.addressEdit.Text()
 	port := c.portEdit.Text()
+
+	unitId, err := parseUnitId(c.unitIdEdit.Text())
+	if err != nil {
+		c.setError(err)
+		return
+	}
+
+	timeout, err := time.ParseDuration(c.timeoutEdit.Text())
+	if err != nil || timeout <= 0 {
+		c.setError(fmt.Errorf("timeout %q should look like '1s' or '500ms'", c.timeoutEdit.Text()))
+		return
+	}
+
+	if IsSerialTransport(tansport) {
+		params, err := c.serialParams()
+		if err != nil {
+			c.setError(err)
+			return
+		}
+
+		c.model.SetSerialParams(params)
+		port = ""
+	}
+
+	if tansport == TransportTCPTLS {
+		c.model.SetTLSParams(TLSParams{
+			CertFile: c.tlsCertEdit.Text(),
+			KeyFile:  c.tlsKeyEdit.Text(),
+			CAFile:   c.tlsCAEdit.Text(),
+		})
+	}
+
+	c.model.SetUnitId(unitId)
+	c.model.SetTimeout(timeout)
 	c.connParamsSaved = true
 
 	if err := c.model.Connect(tansport, address, port); err != nil {
@@ -61,6 +134,68 @@ func (c *MainController) Connect() {
 	c.clearError()
 }
 
+func (c *MainController) serialParams() (SerialParams, error) {
+	baudRate, err := strconv.Atoi(c.baudRateEdit.Text())
+	if err != nil {
+		return SerialParams{}, fmt.Errorf("parse baud rate: %w", err)
+	}
+
+	stopBits, err := strconv.Atoi(c.stopBitsBox.Text())
+	if err != nil {
+		return SerialParams{}, fmt.Errorf("parse stop bits: %w", err)
+	}
+
+	params := SerialParams{
+		BaudRate: baudRate,
+		Parity:   c.parityBox.Text(),
+		StopBits: stopBits,
+	}
+
+	return params, params.Validate()
+}
+
+// resetTransportFields shows the port for network transports, the line
+// settings for serial ones and the certificates for tcp+tls.
+func (c *MainController) resetTransportFields() {
+	serial := IsSerialTransport(c.transportBox.Text())
+	secure := c.transportBox.Text() == TransportTCPTLS
+
+	if serial {
+		c.addressLabel.SetText("Device:")
+	} else {
+		c.addressLabel.SetText("Address:")
+	}
+
+	c.portLabel.SetVisible(!serial)
+	c.portEdit.SetVisible(!serial)
+
+	serialWidgets := []walk.Widget{
+		c.baudRateLabel,
+		c.baudRateEdit,
+		c.parityLabel,
+		c.parityBox,
+		c.stopBitsLabel,
+		c.stopBitsBox,
+	}
+
+	for _, w := range serialWidgets {
+		w.SetVisible(serial)
+	}
+
+	tlsWidgets := []walk.Widget{
+		c.tlsCertLabel,
+		c.tlsCertEdit,
+		c.tlsKeyLabel,
+		c.tlsKeyEdit,
+		c.tlsCALabel,
+		c.tlsCAEdit,
+	}
+
+	for _, w := range tlsWidgets {
+		w.SetVisible(secure)
+	}
+}
+
 func (c *MainController) Reconnect() {
 	defer c.resetButtons()
 
@@ -158,6 +293,51 @@ func (c *MainController) WriteMultipleCoils() {
 	)()
 }
 
+func (c *MainController) MaskWriteRegister() {
+	c.clearError()
+	DialogView(
+		c.window,
+		&DialogModelImpl{c.model},
+		DialogTypeMaskWriteRegister,
+	)()
+}
+
+func (c *MainController) ReadWriteMultipleRegisters() {
+	c.clearError()
+	DialogView(
+		c.window,
+		&DialogModelImpl{c.model},
+		DialogTypeReadWriteMultipleRegisters,
+	)()
+}
+
+func (c *MainController) ReadDeviceIdentification() {
+	c.clearError()
+	DialogView(
+		c.window,
+		&DialogModelImpl{c.model},
+		DialogTypeReadDeviceIdentification,
+	)()
+}
+
+func (c *MainController) Diagnostics() {
+	c.clearError()
+	DialogView(
+		c.window,
+		&DialogModelImpl{c.model},
+		DialogTypeDiagnostics,
+	)()
+}
+
+func (c *MainController) ReadDiagnosticCounters() {
+	c.clearError()
+	DialogView(
+		c.window,
+		&DialogModelImpl{c.model},
+		DialogTypeReadDiagnosticCounters,
+	)()
+}
+
 func (c *MainController) resetConnectButton() {
 	if c.connEstablished {
 		c.connectButton.SetEnabled(false)
@@ -195,6 +375,11 @@ func (c *MainController) resetFunctionButtons() {
 		c.writeSingleRegisterButton,
 		c.writeMultipleRegistersButton,
 		c.writeMultipleCoilsButton,
+		c.maskWriteRegisterButton,
+		c.readWriteRegistersButton,
+		c.readDeviceIdButton,
+		c.diagnosticsButton,
+		c.readCountersButton,
 	}
 
 	for _, b := range buttons {
@@ -214,6 +399,15 @@ func (c *MainController) resetButtons() {
 	c.resetFunctionButtons()
 }
 
+// SaveFrames saves the frames of the frame view to a file.
+func (c *MainController) SaveFrames() {
+	if err := c.frames.SaveFrames(c.window); err != nil {
+		c.setError(err)
+		return
+	}
+	c.clearError()
+}
+
 func (c *MainController) setError(err error) {
 	c.errEdit.SetText(err.Error())
 }
@@ -222,16 +416,20 @@ func (c *MainController) clearError() {
 	c.errEdit.SetText("")
 }
 
-func MainView(model MainModel) func() {
+// MainView creates the main window, its frame view records the frames of
+// the capture.
+func MainView(model MainModel, capture *capture.FrameCapture) func() {
 	controller := &MainController{
-		model: model,
+		model:  model,
+		frames: NewFrameView(),
 	}
+	capture.AddRecorder(controller.frames)
 
 	return func() {
 		d.MainWindow{
 			AssignTo: &controller.window,
 			Title:    "Modbus client (master)",
-			Size:     d.Size{Width: 320, Height: 300},
+			Size:     d.Size{Width: 600, Height: 760},
 			Layout:   d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
 			Children: []d.Widget{
 				d.GroupBox{
@@ -239,27 +437,56 @@ func MainView(model MainModel) func() {
 					Layout: d.VBox{Margins: d.Margins{Left: 10, Right: 10, Top: 10, Bottom: 10}},
 					Children: []d.Widget{
 
-						d.HSplitter{
+						d.Composite{
+							Layout: d.Grid{Columns: 2, MarginsZero: true},
 							Children: []d.Widget{
-								d.VSplitter{
-									Children: []d.Widget{
-										d.Label{Text: "Transport:"},
-										d.VSpacer{},
-										d.Label{Text: "Address:"},
-										d.VSpacer{},
-										d.Label{Text: "Port:"},
-									},
+								d.Label{Text: "Transport:"},
+								d.ComboBox{
+									AssignTo:              &controller.transportBox,
+									Model:                 Transports,
+									Value:                 DefaultTransport,
+									OnCurrentIndexChanged: controller.resetTransportFields,
 								},
 
-								d.HSpacer{},
+								d.Label{AssignTo: &controller.addressLabel, Text: "Address:"},
+								d.TextEdit{AssignTo: &controller.addressEdit, Text: DefaultAddress},
+
+								d.Label{AssignTo: &controller.portLabel, Text: "Port:"},
+								d.TextEdit{AssignTo: &controller.portEdit, Text: DefaultPort},
+
+								d.Label{AssignTo: &controller.baudRateLabel, Text: "Baud rate:", Visible: false},
+								d.TextEdit{AssignTo: &controller.baudRateEdit, Text: strconv.Itoa(DefaultBaudRate), Visible: false},
 
-								d.VSplitter{
-									Children: []d.Widget{
-										d.TextEdit{AssignTo: &controller.transportEdit, Text: "tcp"},
-										d.TextEdit{AssignTo: &controller.addressEdit, Text: "localhost"},
-										d.TextEdit{AssignTo: &controller.portEdit, Text: "5502"},
-									},
+								d.Label{AssignTo: &controller.parityLabel, Text: "Parity:", Visible: false},
+								d.ComboBox{
+									AssignTo: &controller.parityBox,
+									Model:    Parities,
+									Value:    DefaultParity,
+									Visible:  false,
 								},
+
+								d.Label{AssignTo: &controller.stopBitsLabel, Text: "Stop bits:", Visible: false},
+								d.ComboBox{
+									AssignTo: &controller.stopBitsBox,
+									Model:    []string{"1", "2"},
+									Value:    strconv.Itoa(DefaultStopBits),
+									Visible:  false,
+								},
+
+								d.Label{AssignTo: &controller.tlsCertLabel, Text: "Certificate:", Visible: false},
+								d.TextEdit{AssignTo: &controller.tlsCertEdit, Visible: false},
+
+								d.Label{AssignTo: &controller.tlsKeyLabel, Text: "Key:", Visible: false},
+								d.TextEdit{AssignTo: &controller.tlsKeyEdit, Visible: false},
+
+								d.Label{AssignTo: &controller.tlsCALabel, Text: "Server CA:", Visible: false},
+								d.TextEdit{AssignTo: &controller.tlsCAEdit, Visible: false},
+
+								d.Label{Text: "Unit ID:"},
+								d.TextEdit{AssignTo: &controller.unitIdEdit, Text: strconv.Itoa(DefaultUnitId)},
+
+								d.Label{Text: "Timeout:"},
+								d.TextEdit{AssignTo: &controller.timeoutEdit, Text: DefaultTimeout.String()},
 							},
 						},
 					},
@@ -349,6 +576,41 @@ func MainView(model MainModel) func() {
 							OnClicked: controller.WriteMultipleCoils,
 							Enabled:   false,
 						},
+
+						d.PushButton{
+							AssignTo:  &controller.maskWriteRegisterButton,
+							Text:      "0x16 Mask write register",
+							OnClicked: controller.MaskWriteRegister,
+							Enabled:   false,
+						},
+
+						d.PushButton{
+							AssignTo:  &controller.readWriteRegistersButton,
+							Text:      "0x17 Read/write multiple registers",
+							OnClicked: controller.ReadWriteMultipleRegisters,
+							Enabled:   false,
+						},
+
+						d.PushButton{
+							AssignTo:  &controller.readDeviceIdButton,
+							Text:      "0x2B Read device identification",
+							OnClicked: controller.ReadDeviceIdentification,
+							Enabled:   false,
+						},
+
+						d.PushButton{
+							AssignTo:  &controller.diagnosticsButton,
+							Text:      "0x08 Diagnostics",
+							OnClicked: controller.Diagnostics,
+							Enabled:   false,
+						},
+
+						d.PushButton{
+							AssignTo:  &controller.readCountersButton,
+							Text:      "0x08/0x0B Read diagnostic counters",
+							OnClicked: controller.ReadDiagnosticCounters,
+							Enabled:   false,
+						},
 					},
 				},
 
@@ -359,6 +621,24 @@ func MainView(model MainModel) func() {
 					TextColor: walk.RGB(255, 0, 0),
 					ReadOnly:  true,
 				},
+
+				d.Composite{
+					Layout: d.HBox{MarginsZero: true},
+					Children: []d.Widget{
+						d.Label{Text: "Frames:"},
+						*controller.frames.CaptureCheckBox,
+						d.PushButton{
+							Text:      "Clear",
+							OnClicked: controller.frames.ClearFrames,
+						},
+						d.PushButton{
+							Text:      "Save...",
+							OnClicked: controller.SaveFrames,
+						},
+					},
+				},
+
+				controller.frames.TextEdit,
 			},
 		}.Run()
 	}
@@ -399,3 +679,23 @@ func (d *DialogModelImpl) WriteMultipleRegisters(addr uint16, values []uint16) e
 func (d *DialogModelImpl) WriteMultipleCoils(addr uint16, values []bool) error {
 	return d.MainModel.WriteMultipleCoils(addr, values)
 }
+
+func (d *DialogModelImpl) MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error {
+	return d.MainModel.MaskWriteRegister(addr, andMask, orMask)
+}
+
+func (d *DialogModelImpl) ReadWriteMultipleRegisters(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	return d.MainModel.ReadWriteMultipleRegisters(readAddr, readCnt, writeAddr, values)
+}
+
+func (d *DialogModelImpl) ReadDeviceIdentification(code uint8, objectId uint8) (*modbusclient.DeviceIdentification, error) {
+	return d.MainModel.ReadDeviceIdentification(code, objectId)
+}
+
+func (d *DialogModelImpl) Diagnostics(subFunction uint16, data []uint16) ([]uint16, error) {
+	return d.MainModel.Diagnostics(subFunction, data)
+}
+
+func (d *DialogModelImpl) ReadDiagnosticCounters() ([]DiagnosticCounter, error) {
+	return d.MainModel.ReadDiagnosticCounters()
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	OperationRead  = "read"
+	OperationWrite = "write"
+
+	ClientAccessReadOnly  = "read-only"
+	ClientAccessReadWrite = "read-write"
+	ClientAccessNone      = "none"
+)
+
+// AccessConfig limits what clients may read and write by their address.
+type AccessConfig struct {
+	// Default is the access of clients no rule decides for: "read-only"
+	// (when empty), "read-write" or "none".
+	Default string `json:"default"`
+	// Rules are tried in order for every address of a request, the first
+	// one that matches and allows or denies the operation decides.
+	Rules []AccessRule `json:"rules"`
+}
+
+// AccessRule allows or denies reads and writes to the clients, units and
+// addresses it matches. Empty lists match everything.
+type AccessRule struct {
+	// Clients are IP addresses or CIDR networks, e.g. "192.168.0.10" or
+	// "10.0.0.0/8". Clients of the rtu listener have no IP address and only
+	// match rules without clients.
+	Clients []string       `json:"clients"`
+	UnitIds []uint8        `json:"unit_ids"`
+	Ranges  []AddressRange `json:"ranges"`
+	// Allow and Deny list the operations, "read" and/or "write".
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Validate reports the problems of the access settings.
+func (c AccessConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	switch c.Default {
+	case "", ClientAccessReadOnly, ClientAccessReadWrite, ClientAccessNone:
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"default: %q is not one of %s, %s, %s",
+			c.Default, ClientAccessReadOnly, ClientAccessReadWrite, ClientAccessNone,
+		))
+	}
+
+	for i, rule := range c.Rules {
+		for _, problem := range rule.Validate() {
+			problems = append(problems, fmt.Sprintf("rules[%d].%s", i, problem))
+		}
+	}
+
+	return problems
+}
+
+// Validate reports the problems of the rule.
+func (r AccessRule) Validate() []string {
+	problems := make([]string, 0)
+
+	for i, client := range r.Clients {
+		if _, err := parseClientNetwork(client); err != nil {
+			problems = append(problems, fmt.Sprintf("clients[%d]: %v", i, err))
+		}
+	}
+
+	for i, rng := range r.Ranges {
+		for _, problem := range rng.Validate() {
+			problems = append(problems, fmt.Sprintf("ranges[%d].%s", i, problem))
+		}
+	}
+
+	operations := []struct {
+		name string
+		list []string
+	}{
+		{"allow", r.Allow},
+		{"deny", r.Deny},
+	}
+
+	for _, operation := range operations {
+		for i, op := range operation.list {
+			if op != OperationRead && op != OperationWrite {
+				problems = append(problems, fmt.Sprintf("%s[%d]: %q is not one of %s, %s", operation.name, i, op, OperationRead, OperationWrite))
+			}
+		}
+	}
+
+	for _, op := range r.Allow {
+		for _, denied := range r.Deny {
+			if op == denied {
+				problems = append(problems, fmt.Sprintf("%s: is both allowed and denied", op))
+			}
+		}
+	}
+
+	if len(r.Allow) == 0 && len(r.Deny) == 0 {
+		problems = append(problems, "allow: a rule must allow or deny read or write")
+	}
+
+	return problems
+}
+
+// parseClientNetwork parses an IP address as a network of that address
+// alone, or a CIDR network.
+func parseClientNetwork(client string) (*net.IPNet, error) {
+	if strings.Contains(client, "/") {
+		_, network, err := net.ParseCIDR(client)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a CIDR network like 10.0.0.0/8", client)
+		}
+		return network, nil
+	}
+
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", client)
+	}
+
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// accessRule is a rule with its client networks parsed.
+type accessRule struct {
+	AccessRule
+	networks []*net.IPNet
+}
+
+// accessPolicy is a validated AccessConfig ready to decide requests.
+type accessPolicy struct {
+	rules        []accessRule
+	defaultRead  bool
+	defaultWrite bool
+}
+
+func newAccessPolicy(config AccessConfig) (*accessPolicy, error) {
+	policy := &accessPolicy{
+		rules:       make([]accessRule, 0, len(config.Rules)),
+		defaultRead: config.Default != ClientAccessNone,
+		// unknown clients are read-only unless told otherwise
+		defaultWrite: config.Default == ClientAccessReadWrite,
+	}
+
+	for i, rule := range config.Rules {
+		networks := make([]*net.IPNet, 0, len(rule.Clients))
+		for _, client := range rule.Clients {
+			network, err := parseClientNetwork(client)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			networks = append(networks, network)
+		}
+		policy.rules = append(policy.rules, accessRule{AccessRule: rule, networks: networks})
+	}
+
+	return policy, nil
+}
+
+// allowed decides a single address of a request, table is empty for
+// requests without addresses.
+func (p *accessPolicy) allowed(ip net.IP, unitId uint8, op string, table string, addr uint16) bool {
+	for _, rule := range p.rules {
+		if !rule.matches(ip, unitId, table, addr) {
+			continue
+		}
+
+		for _, allowed := range rule.Allow {
+			if allowed == op {
+				return true
+			}
+		}
+		for _, denied := range rule.Deny {
+			if denied == op {
+				return false
+			}
+		}
+	}
+
+	if op == OperationWrite {
+		return p.defaultWrite
+	}
+	return p.defaultRead
+}
+
+func (r accessRule) matches(ip net.IP, unitId uint8, table string, addr uint16) bool {
+	if len(r.networks) != 0 {
+		found := false
+		for _, network := range r.networks {
+			found = found || (ip != nil && network.Contains(ip))
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.UnitIds) != 0 && !containsUint8(r.UnitIds, unitId) {
+		return false
+	}
+
+	if len(r.Ranges) == 0 {
+		return true
+	}
+
+	for _, rng := range r.Ranges {
+		if rng.contains(table, addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of a client, nil for clients of the rtu
+// listener, which are known by the serial port only.
+func clientIP(clientAddr string) net.IP {
+	host, _, err := net.SplitHostPort(clientAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// AccessControlMiddleware allows or denies reads and writes by the address
+// of the client, as told by the access rules. Without rules clients get the
+// default access, read-only unless set otherwise. Denied requests are answered with Illegal Function, like the
+// writes denied by AuthorizationMiddleware.
+type AccessControlMiddleware struct {
+	base   RequestHandler
+	logger *logging.Logger
+
+	lock   sync.RWMutex
+	policy *accessPolicy
+}
+
+func NewAccessControlMiddleware(base RequestHandler, config AccessConfig, logger *logging.Logger) (*AccessControlMiddleware, error) {
+	middleware := &AccessControlMiddleware{
+		base:   base,
+		logger: logger,
+	}
+
+	if err := middleware.SetConfig(config); err != nil {
+		return nil, err
+	}
+
+	return middleware, nil
+}
+
+// SetConfig replaces the access rules.
+func (h *AccessControlMiddleware) SetConfig(config AccessConfig) error {
+	policy, err := newAccessPolicy(config)
+	if err != nil {
+		return fmt.Errorf("parse access rules: %w", err)
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.policy = policy
+	return nil
+}
+
+// check tells whether the client may apply the operation to quantity
+// addresses of the table from addr on, and logs the denials.
+func (h *AccessControlMiddleware) check(clientAddr string, unitId uint8, op string, table string, addr uint16, quantity uint16) bool {
+	h.lock.RLock()
+	policy := h.policy
+	h.lock.RUnlock()
+
+	ip := clientIP(clientAddr)
+	if table == "" {
+		if policy.allowed(ip, unitId, op, "", 0) {
+			return true
+		}
+
+		h.logger.Warn("Denied access", logging.Field("operation", op), logging.FieldUnitId(unitId), logging.FieldClientAddr(clientAddr))
+		return false
+	}
+
+	for i := 0; i < int(quantity); i++ {
+		if !policy.allowed(ip, unitId, op, table, addr+uint16(i)) {
+			h.logger.Warn(
+				"Denied access", logging.Field("operation", op), logging.FieldUnitId(unitId), logging.FieldClientAddr(clientAddr),
+				logging.Field("table", table), logging.FieldAddr(addr), logging.FieldCount(int(quantity)), logging.Field("denied_addr", addr+uint16(i)),
+			)
+			return false
+		}
+	}
+
+	return true
+}
+
+func accessOperation(isWrite bool) string {
+	if isWrite {
+		return OperationWrite
+	}
+	return OperationRead
+}
+
+func (h *AccessControlMiddleware) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	if !h.check(req.ClientAddr, req.UnitId, accessOperation(req.IsWrite), coilsSection.name, req.Addr, req.Quantity) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleCoils(req)
+}
+
+func (h *AccessControlMiddleware) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	if !h.check(req.ClientAddr, req.UnitId, OperationRead, discreteInputsSection.name, req.Addr, req.Quantity) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleDiscreteInputs(req)
+}
+
+func (h *AccessControlMiddleware) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if !h.check(req.ClientAddr, req.UnitId, accessOperation(req.IsWrite), holdingRegistersSection.name, req.Addr, req.Quantity) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleHoldingRegisters(req)
+}
+
+func (h *AccessControlMiddleware) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	if !h.check(req.ClientAddr, req.UnitId, OperationRead, inputRegistersSection.name, req.Addr, req.Quantity) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleInputRegisters(req)
+}
+
+func (h *AccessControlMiddleware) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	if !h.check(req.ClientAddr, req.UnitId, OperationWrite, holdingRegistersSection.name, req.Addr, 1) {
+		return modbus.ErrIllegalFunction
+	}
+	return h.base.HandleMaskWriteRegister(req)
+}
+
+func (h *AccessControlMiddleware) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	if !h.check(req.ClientAddr, req.UnitId, OperationWrite, holdingRegistersSection.name, req.WriteAddr, uint16(len(req.Args))) ||
+		!h.check(req.ClientAddr, req.UnitId, OperationRead, holdingRegistersSection.name, req.ReadAddr, req.ReadQuantity) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleReadWriteRegisters(req)
+}
+
+func (h *AccessControlMiddleware) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	if !h.check(req.ClientAddr, req.UnitId, OperationRead, "", 0, 0) {
+		return IdentificationResult{}, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleDeviceIdentification(req)
+}
+
+func (h *AccessControlMiddleware) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	if !h.check(req.ClientAddr, req.UnitId, accessOperation(req.IsWrite()), "", 0, 0) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleDiagnostics(req)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// newTestAccess serves holding registers 100 to 103 and input register 30
+// of units 1 and 2 behind access control, logging to output.
+func newTestAccess(t *testing.T, config AccessConfig, output io.Writer) *AccessControlMiddleware {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatJSON, logging.LogLevels{})
+	logger.SetOutputs(output)
+
+	router := NewUnitRouter(nil, logger)
+	for _, unitId := range []uint8{1, 2} {
+		service := NewModbusService(Dump{
+			InputRegisters:   []Register{{addr: 30}},
+			HoldingRegisters: []Register{{addr: 100}, {addr: 101}, {addr: 102}, {addr: 103}},
+		})
+		router.AddUnit(unitId, NewAdapterHandler(NewModbusHandler(service, nil, logger), logger))
+	}
+
+	access, err := NewAccessControlMiddleware(router, config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return access
+}
+
+// accessAllowed tells whether the client may read or write quantity holding
+// registers of the unit from addr on.
+func accessAllowed(t *testing.T, access *AccessControlMiddleware, clientAddr string, unitId uint8, op string, addr uint16, quantity uint16) bool {
+	t.Helper()
+
+	req := &modbus.HoldingRegistersRequest{ClientAddr: clientAddr, UnitId: unitId, Addr: addr, Quantity: quantity}
+	if op == OperationWrite {
+		req.IsWrite = true
+		req.Args = make([]uint16, quantity)
+	}
+
+	_, err := access.HandleHoldingRegisters(req)
+	if err != nil && !errors.Is(err, modbus.ErrIllegalFunction) {
+		t.Fatalf("%s %d registers at %d: %v", op, quantity, addr, err)
+	}
+	return err == nil
+}
+
+func TestAccessRules(t *testing.T) {
+	access := newTestAccess(t, AccessConfig{
+		Default: ClientAccessNone,
+		Rules: []AccessRule{
+			{
+				Clients: []string{"192.168.0.10"},
+				Ranges:  []AddressRange{{Table: holdingRegistersSection.name, Start: 102, End: 103}},
+				Deny:    []string{OperationWrite},
+			},
+			{Clients: []string{"192.168.0.0/24"}, UnitIds: []uint8{1}, Allow: []string{OperationRead, OperationWrite}},
+			{Clients: []string{"10.0.0.0/8", "2001:db8::/32"}, Allow: []string{OperationRead}},
+			{Ranges: []AddressRange{{Table: holdingRegistersSection.name, Start: 100, End: 100}}, Allow: []string{OperationRead}},
+		},
+	}, io.Discard)
+
+	tests := []struct {
+		name       string
+		clientAddr string
+		unitId     uint8
+		op         string
+		addr       uint16
+		quantity   uint16
+		want       bool
+	}{
+		{"network of the unit writes", "192.168.0.20:5000", 1, OperationWrite, 100, 4, true},
+		{"network writes another unit", "192.168.0.20:5000", 2, OperationWrite, 100, 1, false},
+		{"address denied in range", "192.168.0.10:5000", 1, OperationWrite, 102, 1, false},
+		{"address denied for part of a request", "192.168.0.10:5000", 1, OperationWrite, 100, 3, false},
+		{"address outside the denied range", "192.168.0.10:5000", 1, OperationWrite, 100, 2, true},
+		{"address reads the denied range", "192.168.0.10:5000", 1, OperationRead, 102, 2, true},
+		{"read-only network reads", "10.1.2.3:5000", 2, OperationRead, 100, 4, true},
+		{"read-only network writes", "10.1.2.3:5000", 2, OperationWrite, 100, 1, false},
+		{"ipv6 network reads", "[2001:db8::1]:5000", 1, OperationRead, 101, 1, true},
+		{"rule without clients", "172.16.0.1:5000", 1, OperationRead, 100, 1, true},
+		{"default outside the range", "172.16.0.1:5000", 1, OperationRead, 100, 2, false},
+		{"rtu client only matches rules without clients", "/dev/ttyUSB0", 1, OperationRead, 100, 1, true},
+		{"rtu client and client rules", "/dev/ttyUSB0", 1, OperationWrite, 100, 1, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := accessAllowed(t, access, test.clientAddr, test.unitId, test.op, test.addr, test.quantity); got != test.want {
+				t.Errorf("%s of %d at %d by %s on unit %d: allowed %v, want %v",
+					test.op, test.quantity, test.addr, test.clientAddr, test.unitId, got, test.want)
+			}
+		})
+	}
+}
+
+func TestAccessDefault(t *testing.T) {
+	tests := []struct {
+		access      string
+		read, write bool
+	}{
+		{"", true, false},
+		{ClientAccessReadOnly, true, false},
+		{ClientAccessReadWrite, true, true},
+		{ClientAccessNone, false, false},
+	}
+
+	for _, test := range tests {
+		access := newTestAccess(t, AccessConfig{Default: test.access}, io.Discard)
+
+		if got := accessAllowed(t, access, "127.0.0.1:5000", 1, OperationRead, 100, 1); got != test.read {
+			t.Errorf("default %q: read allowed %v, want %v", test.access, got, test.read)
+		}
+		if got := accessAllowed(t, access, "127.0.0.1:5000", 1, OperationWrite, 100, 1); got != test.write {
+			t.Errorf("default %q: write allowed %v, want %v", test.access, got, test.write)
+		}
+	}
+}
+
+func TestAccessDenialLogged(t *testing.T) {
+	var output bytes.Buffer
+	access := newTestAccess(t, AccessConfig{
+		Rules: []AccessRule{{
+			Clients: []string{"127.0.0.1"},
+			Ranges:  []AddressRange{{Table: holdingRegistersSection.name, Start: 100, End: 101}},
+			Allow:   []string{OperationWrite},
+		}},
+	}, &output)
+
+	if accessAllowed(t, access, "127.0.0.1:42360", 1, OperationWrite, 101, 2) {
+		t.Fatal("write past the allowed range was allowed")
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(output.Bytes(), &entry); err != nil {
+		t.Fatalf("log %q: %v", output.String(), err)
+	}
+
+	want := map[string]interface{}{
+		"msg":         "Denied access",
+		"operation":   OperationWrite,
+		"client_addr": "127.0.0.1:42360",
+		"table":       holdingRegistersSection.name,
+		"addr":        float64(101),
+		"count":       float64(2),
+		"denied_addr": float64(102),
+	}
+	for key, value := range want {
+		if entry[key] != value {
+			t.Errorf("%s: got %v, want %v", key, entry[key], value)
+		}
+	}
+}
+
+func TestReloadAccess(t *testing.T) {
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	file := filepath.Join(t.TempDir(), "server.json")
+	writeConfig := func(config string) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	access := newTestAccess(t, AccessConfig{Default: ClientAccessReadWrite}, io.Discard)
+	app := &App{Config: Config{File: file}, Logger: logger, Access: access}
+
+	// without the section clients may only read
+	writeConfig(`{"url": "tcp://localhost:5502"}`)
+	if err := app.ReloadAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if accessAllowed(t, access, "127.0.0.1:5000", 1, OperationWrite, 100, 1) {
+		t.Error("write allowed without an access section")
+	}
+
+	writeConfig(`{"access": {"rules": [{"clients": ["127.0.0.0/8"], "allow": ["write"]}]}}`)
+	if err := app.ReloadAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if !accessAllowed(t, access, "127.0.0.1:5000", 1, OperationWrite, 100, 1) {
+		t.Error("write denied after reloading a rule allowing it")
+	}
+	if accessAllowed(t, access, "192.168.0.1:5000", 1, OperationWrite, 100, 1) {
+		t.Error("write allowed to a client no rule allows it")
+	}
+
+	// invalid rules keep the old ones
+	writeConfig(`{"access": {"rules": [{"clients": ["localhost"], "deny": ["write"]}]}}`)
+	if err := app.ReloadAccess(); !errors.Is(err, ErrInvalidConfig) {
+		t.Errorf("reload of invalid rules: got %v, want %v", err, ErrInvalidConfig)
+	}
+	if !accessAllowed(t, access, "127.0.0.1:5000", 1, OperationWrite, 100, 1) {
+		t.Error("write denied after a failed reload")
+	}
+
+	writeConfig(`{"access": {`)
+	if err := app.ReloadAccess(); err == nil || !strings.Contains(err.Error(), "read config") {
+		t.Errorf("reload of a broken file: got %v", err)
+	}
+
+	// the default given by the flag outlives reloads
+	app.Config.AccessDefault = ClientAccessReadWrite
+	writeConfig(`{}`)
+	if err := app.ReloadAccess(); err != nil {
+		t.Fatal(err)
+	}
+	if !accessAllowed(t, access, "192.168.0.1:5000", 1, OperationWrite, 100, 1) {
+		t.Error("write denied with -access-default read-write")
+	}
+}
@@ -1,62 +1,68 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"time"
 
+	"github.com/aveplen/mirea-modbus/internal/logging"
 	"github.com/simonvetter/modbus"
 )
 
-const (
-	LogRequestSeparatorSymbol = "="
-	LogRequestSeparatorLength = 30
-)
-
-var LogRequestSeparator = func() string {
-	buf := ""
-	for i := 0; i < LogRequestSeparatorLength; i++ {
-		buf += LogRequestSeparatorSymbol
-	}
-	return buf
-}()
-
 type AdapterHandler struct {
 	handler *ModbusHandler
+	logger  *logging.Logger
 }
 
-func NewAdapterHandler(handler *ModbusHandler) *AdapterHandler {
+func NewAdapterHandler(handler *ModbusHandler, logger *logging.Logger) *AdapterHandler {
 
 	adapter := &AdapterHandler{
 		handler: handler,
+		logger:  logger,
 	}
 
 	return adapter
 }
 
+// logRequest logs a handled request with its result and duration, it is
+// deferred by every handler with a pointer to the error it returns.
+func (h *AdapterHandler) logRequest(err *error, start time.Time, functionCode uint8, unitId uint8, clientAddr string, details ...logging.LogField) {
+	fields := []logging.LogField{logging.FieldFunctionCode(functionCode), logging.FieldUnitId(unitId), logging.FieldClientAddr(clientAddr)}
+	fields = append(fields, details...)
+	fields = append(fields, logging.FieldDuration(time.Since(start)))
+
+	if *err != nil {
+		h.logger.Warn("Request failed", append(fields, logging.FieldError(*err))...)
+		return
+	}
+	h.logger.Info("Request handled", fields...)
+}
+
 // HandleCoils handles the read coils (0x01), write single coil (0x05)
 // and write multiple coils (0x0F)
 // - res:	coil values (only for reads)
 // - err:	either nil if no error occurred, a modbus error
-func (h *AdapterHandler) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
-	log.Print(LogRequestSeparator)
+func (h *AdapterHandler) HandleCoils(req *modbus.CoilsRequest) (res []bool, err error) {
+	fc := boolFunctionCodes(fcReadCoils, req.IsWrite, req.Quantity)[0]
+	defer h.logRequest(&err, time.Now(), fc, req.UnitId, req.ClientAddr, logging.FieldAddr(req.Addr), logging.FieldCount(int(req.Quantity)))
 
 	if req.IsWrite && req.Quantity == 1 {
 		if err := h.handler.WriteSingleCoil0x05(req.Addr, req.Args[0]); err != nil {
-			return nil, fmt.Errorf("handle coils: %w", err)
+			return nil, modbusError(err)
 		}
 		return nil, nil
 	}
 
 	if req.IsWrite {
 		if err := h.handler.WriteMultipleCoils0x0F(req.Addr, req.Args[:req.Quantity]); err != nil {
-			return nil, fmt.Errorf("handle coils: %w", err)
+			return nil, modbusError(err)
 		}
 		return nil, nil
 	}
 
 	coils, err := h.handler.ReadCoils0x01(req.Addr, int(req.Quantity))
 	if err != nil {
-		return nil, fmt.Errorf("handle coils: %w", err)
+		return nil, modbusError(err)
 	}
 
 	return coils, nil
@@ -65,12 +71,12 @@ func (h *AdapterHandler) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
 // HandleDiscreteInputs handles the read discrete inputs (0x02)
 // - res: discrete input values
 // - err:	either nil if no error occurred, a modbus error
-func (h *AdapterHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
-	log.Print(LogRequestSeparator)
+func (h *AdapterHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) (res []bool, err error) {
+	defer h.logRequest(&err, time.Now(), fcReadDiscreteInputs, req.UnitId, req.ClientAddr, logging.FieldAddr(req.Addr), logging.FieldCount(int(req.Quantity)))
 
 	inputs, err := h.handler.ReadDiscreteInputs0x02(req.Addr, int(req.Quantity))
 	if err != nil {
-		return nil, fmt.Errorf("handle discrete inputs: %w", err)
+		return nil, modbusError(err)
 	}
 
 	return inputs, nil
@@ -81,12 +87,13 @@ func (h *AdapterHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest)
 // A HoldingRegistersRequest object is passed to the handler (see above).
 // - res:	register values
 // - err:	either nil if no error occurred, a modbus error
-func (h *AdapterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
-	log.Print(LogRequestSeparator)
+func (h *AdapterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) (res []uint16, err error) {
+	fc := registerFunctionCodes(fcReadHoldingRegisters, req.IsWrite, req.Quantity)[0]
+	defer h.logRequest(&err, time.Now(), fc, req.UnitId, req.ClientAddr, logging.FieldAddr(req.Addr), logging.FieldCount(int(req.Quantity)))
 
 	if req.IsWrite && req.Quantity == 1 {
 		if err := h.handler.WriteSingleRegister0x06(req.Addr, req.Args[0]); err != nil {
-			return nil, fmt.Errorf("handle holding registers: %w", err)
+			return nil, modbusError(err)
 		}
 
 		return nil, nil
@@ -94,7 +101,7 @@ func (h *AdapterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequ
 
 	if req.IsWrite {
 		if err := h.handler.WriteMultipleRegisters0x10(req.Addr, req.Args[:req.Quantity]); err != nil {
-			return nil, fmt.Errorf("handle holding registers: %w", err)
+			return nil, modbusError(err)
 		}
 
 		return nil, nil
@@ -102,7 +109,7 @@ func (h *AdapterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequ
 
 	regs, err := h.handler.ReadHoldingRegisters0x03(req.Addr, int(req.Quantity))
 	if err != nil {
-		return nil, fmt.Errorf("handle holding registers: %w", err)
+		return nil, modbusError(err)
 	}
 
 	return regs, nil
@@ -112,13 +119,75 @@ func (h *AdapterHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequ
 // Note that input registers are always read-only as per the modbus spec.
 // - res:	register values
 // - err:	either nil if no error occurred, a modbus error
-func (h *AdapterHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
-	log.Print(LogRequestSeparator)
+func (h *AdapterHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) (res []uint16, err error) {
+	defer h.logRequest(&err, time.Now(), fcReadInputRegisters, req.UnitId, req.ClientAddr, logging.FieldAddr(req.Addr), logging.FieldCount(int(req.Quantity)))
 
 	regs, err := h.handler.ReadInputRegisters0x04(req.Addr, int(req.Quantity))
 	if err != nil {
-		return nil, fmt.Errorf("handle input registers: %w", err)
+		return nil, modbusError(err)
+	}
+
+	return regs, nil
+}
+
+// HandleMaskWriteRegister handles the mask write register (0x16).
+// - err:	either nil if no error occurred, a modbus error
+func (h *AdapterHandler) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) (err error) {
+	defer h.logRequest(&err, time.Now(), fcMaskWriteRegister, req.UnitId, req.ClientAddr, logging.FieldAddr(req.Addr), logging.FieldCount(1))
+
+	if err := h.handler.MaskWriteRegister0x16(req.Addr, req.AndMask, req.OrMask); err != nil {
+		return modbusError(err)
+	}
+
+	return nil
+}
+
+// HandleReadWriteRegisters handles the read/write multiple registers (0x17).
+// - res:	register values read after the write
+// - err:	either nil if no error occurred, a modbus error
+func (h *AdapterHandler) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) (res []uint16, err error) {
+	defer h.logRequest(&err, time.Now(), fcReadWriteMultipleRegisters, req.UnitId, req.ClientAddr, logging.FieldAddr(req.ReadAddr), logging.FieldCount(int(req.ReadQuantity)))
+
+	regs, err := h.handler.ReadWriteMultipleRegisters0x17(req.ReadAddr, int(req.ReadQuantity), req.WriteAddr, req.Args)
+	if err != nil {
+		return nil, modbusError(err)
 	}
 
 	return regs, nil
 }
+
+// HandleDeviceIdentification handles the read device identification
+// (0x2B/0x0E).
+// - res:	identification objects
+// - err:	either nil if no error occurred, a modbus error
+func (h *AdapterHandler) HandleDeviceIdentification(req *DeviceIdentificationRequest) (res IdentificationResult, err error) {
+	defer h.logRequest(&err, time.Now(), fcEncapsulatedInterface, req.UnitId, req.ClientAddr, logging.Field("object_id", fmt.Sprintf("0x%02X", req.ObjectId)))
+
+	result, err := h.handler.ReadDeviceIdentification0x2B(req.ReadDeviceIdCode, req.ObjectId)
+	if err != nil {
+		return IdentificationResult{}, modbusError(err)
+	}
+
+	return result, nil
+}
+
+// HandleDiagnostics handles the diagnostics (0x08) and get comm event
+// counter (0x0B) from the counters of the listener.
+// - res:	the response data
+// - err:	either nil if no error occurred, a modbus error
+func (h *AdapterHandler) HandleDiagnostics(req *DiagnosticsRequest) (res []byte, err error) {
+	defer h.logRequest(&err, time.Now(), req.FunctionCode, req.UnitId, req.ClientAddr, logging.Field("sub_function", fmt.Sprintf("0x%02X", req.SubFunction)))
+
+	return req.Diagnostics.answer(req)
+}
+
+// modbusError unwraps err down to the modbus error it carries. The modbus
+// server maps errors to exception codes by comparing them for equality, so
+// a wrapped error would always be answered with Server Device Failure.
+func modbusError(err error) error {
+	var modbusErr modbus.Error
+	if errors.As(err, &modbusErr) {
+		return modbusErr
+	}
+	return err
+}
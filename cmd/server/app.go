@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// Slave is a single virtual slave served behind the listener under its own
+// unit id, with its own register map and activity simulator.
+type Slave struct {
+	Id        uint8
+	Seed      Dump
+	Service   *ModbusService
+	Simulator *ActivitySimulatorImpl
+	// Gateway is set when the slave is forwarded to an upstream device.
+	Gateway *GatewayConfig
+
+	SnapshotPath string
+	Restored     bool
+}
+
+// App wires together the parts of the server that do not depend on the GUI:
+// the virtual slaves, the request handler chain, the server manager and the
+// activity simulators. Both the GUI and the headless entry points build on it.
+type App struct {
+	Config        Config
+	Logger        *logging.Logger
+	Slaves        []*Slave
+	ServerManager *ServerManager
+	Simulator     *SimulatorGroup
+	Snapshotter   *Snapshotter
+	Upstreams     []*Upstream
+	Faults        *FaultInjectionMiddleware
+	Access        *AccessControlMiddleware
+	RateLimit     *RateLimitMiddleware
+	Metrics       *Metrics
+	MetricsServer *MetricsServer
+	Capture       *capture.FrameCapture
+	CaptureFile   *capture.CaptureFile
+	Recorder      *RequestRecorder
+}
+
+func NewApp(config Config, logger *logging.Logger) (*App, error) {
+	unknownUnitErr := config.UnknownUnitError()
+	router := NewUnitRouter(unknownUnitErr, logger.Component("router"))
+	simulator := NewSimulatorGroup()
+
+	units := config.ResolveUnits()
+	sort.Slice(units, func(i, j int) bool {
+		return units[i].Id < units[j].Id
+	})
+
+	recorder := NewRequestRecorder(logger.Component("server"))
+	frameCapture := capture.NewFrameCapture()
+	slaves := make([]*Slave, 0, len(units))
+	upstreams := make(map[string]*Upstream)
+	upstreamList := make([]*Upstream, 0)
+	for _, unit := range units {
+		var seed Dump
+		if unit.Seed != "" {
+			var err error
+			seed, err = ReadSeed(unit.Seed)
+			if err != nil {
+				return nil, fmt.Errorf("read seed %s for unit %d: %w", unit.Seed, unit.Id, err)
+			}
+		}
+
+		var restored bool
+		if unit.Snapshot != "" {
+			var err error
+			seed, restored, err = RestoreSnapshot(unit.Snapshot, seed)
+			if err != nil {
+				return nil, fmt.Errorf("restore snapshot %s for unit %d: %w", unit.Snapshot, unit.Id, err)
+			}
+		}
+
+		identification := seed.Identification
+		if identification == nil {
+			identification = &config.DeviceIdentification
+		}
+
+		service := NewModbusService(seed)
+		slave := &Slave{
+			Id:        unit.Id,
+			Seed:      seed,
+			Service:   service,
+			Simulator: NewActivitySimulatorImpl(service, seed, time.Duration(config.SimulatorInterval), logger.Component("simulator").With(logging.FieldUnitId(unit.Id))),
+			Gateway:   unit.Gateway,
+
+			SnapshotPath: unit.Snapshot,
+			Restored:     restored,
+		}
+
+		var handler RequestHandler = NewAdapterHandler(
+			NewModbusHandler(service, identification, logger.Component("handler").With(logging.FieldUnitId(unit.Id))),
+			logger.Component("adapter"))
+		if unit.Gateway != nil {
+			upstream, ok := upstreams[unit.Gateway.URL]
+			if !ok {
+				upstream = NewUpstream(unit.Gateway.UpstreamConfig, frameCapture, logger.Component("upstream"))
+				upstreams[unit.Gateway.URL] = upstream
+				upstreamList = append(upstreamList, upstream)
+			}
+			handler = NewGatewayHandler(handler, upstream, *unit.Gateway, logger.Component("gateway"))
+		}
+
+		router.AddUnit(unit.Id, handler)
+		simulator.Add(slave.Simulator)
+		slaves = append(slaves, slave)
+	}
+
+	metrics := NewMetrics(config.MetricsWrites)
+	access, err := NewAccessControlMiddleware(
+		NewAuthorizationMiddleware(
+			router,
+			config.WriteRoles,
+			logger.Component("authorization")),
+		config.Access,
+		logger.Component("access"))
+	if err != nil {
+		return nil, fmt.Errorf("create access control: %w", err)
+	}
+
+	faults := NewFaultInjectionMiddleware(access, config.Faults, logger.Component("faults"))
+	rateLimit := NewRateLimitMiddleware(faults, config.RateLimit, logger.Component("ratelimit"))
+	fallback := NewFallbackMiddleware(rateLimit, logger.Component("fallback"))
+
+	serverConfig := &modbus.ServerConfiguration{
+		URL:        config.URL,
+		Timeout:    time.Duration(config.Timeout),
+		MaxClients: config.MaxClients,
+	}
+
+	if strings.HasPrefix(config.URL, "tcp+tls://") {
+		cert, clientCAs, err := config.TLS.Load()
+		if err != nil {
+			return nil, fmt.Errorf("load tls: %w", err)
+		}
+		serverConfig.TLSServerCert = cert
+		serverConfig.TLSClientCAs = clientCAs
+	}
+
+	serverManager := NewServerManager(
+		serverConfig,
+		config.Serial,
+		router.UnitIds(),
+		NewRequestDispatcher(fallback, NewDiagnostics(), metrics, recorder, logger.Component("listener")),
+		frameCapture,
+		logger.Component("listener"),
+	)
+
+	metrics.SetSources(MetricsSources{
+		Connections: serverManager.Connections,
+		SimulatorTicks: func() map[uint8]uint64 {
+			ticks := make(map[uint8]uint64, len(slaves))
+			for _, slave := range slaves {
+				ticks[slave.Id] = slave.Simulator.Ticks()
+			}
+			return ticks
+		},
+		RateLimit: rateLimit.Stats,
+	})
+
+	var metricsServer *MetricsServer
+	if config.Metrics != "" {
+		metricsServer = NewMetricsServer(config.Metrics, metrics, logger.Component("server"))
+	}
+
+	return &App{
+		Config:        config,
+		Logger:        logger,
+		Slaves:        slaves,
+		ServerManager: serverManager,
+		Simulator:     simulator,
+		Snapshotter:   NewSnapshotter(slaves, time.Duration(config.SnapshotInterval), logger.Component("server")),
+		Upstreams:     upstreamList,
+		Faults:        faults,
+		Access:        access,
+		RateLimit:     rateLimit,
+		Metrics:       metrics,
+		MetricsServer: metricsServer,
+		Capture:       frameCapture,
+		Recorder:      recorder,
+	}, nil
+}
+
+// LogUnits logs the served units, where their register maps came from and
+// where they are forwarded to, and whether faults are injected.
+func (a *App) LogUnits() {
+	for _, slave := range a.Slaves {
+		fields := []logging.LogField{logging.FieldUnitId(slave.Id)}
+		if slave.Gateway != nil {
+			fields = append(fields, logging.Field("upstream", slave.Gateway.URL))
+		}
+		if slave.Restored {
+			fields = append(fields, logging.Field("snapshot", slave.SnapshotPath))
+		}
+		a.logger().Info("Serving unit", fields...)
+	}
+
+	if a.Faults.Enabled() {
+		a.logger().Info("Fault injection enabled", logging.Field("rules", a.Faults.RuleCount()))
+	}
+
+	if a.RateLimit.Enabled() {
+		a.logger().Info(
+			"Rate limit enabled", logging.Field("requests_per_second", a.Config.RateLimit.Rate),
+			logging.Field("function_code_limits", len(a.Config.RateLimit.FunctionCodes)),
+		)
+	}
+
+	a.logAccess(a.Config.Access)
+}
+
+// ReloadAccess reads the access rules from the config file again and
+// applies them to the running server. The rest of the file is ignored, it
+// only takes effect on restart.
+func (a *App) ReloadAccess() error {
+	if a.Config.File == "" {
+		return errors.New("the server was started without a config file")
+	}
+
+	config, err := ReadConfig(a.Config.File)
+	if err != nil {
+		return fmt.Errorf("read config: %w", err)
+	}
+
+	if a.Config.AccessDefault != "" {
+		config.Access.Default = a.Config.AccessDefault
+	}
+	if problems := config.Access.Validate(); len(problems) != 0 {
+		return fmt.Errorf("%w:\n  access.%s", ErrInvalidConfig, strings.Join(problems, "\n  access."))
+	}
+
+	if err := a.Access.SetConfig(config.Access); err != nil {
+		return err
+	}
+
+	a.Config.Access = config.Access
+	a.logAccess(config.Access)
+	return nil
+}
+
+// logger returns the logger of what the app does as a whole, the server
+// component.
+func (a *App) logger() *logging.Logger {
+	return a.Logger.Component("server")
+}
+
+func (a *App) logAccess(config AccessConfig) {
+	if config.Default == ClientAccessReadWrite && len(config.Rules) == 0 {
+		a.logger().Info("Access control disabled, every client may read and write")
+		return
+	}
+
+	access := config.Default
+	if access == "" {
+		access = ClientAccessReadOnly
+	}
+	a.logger().Info("Access control enabled", logging.Field("rules", len(config.Rules)), logging.Field("default_access", access))
+}
+
+// StartMetrics starts serving the metrics, if enabled.
+func (a *App) StartMetrics() error {
+	if a.MetricsServer == nil {
+		return nil
+	}
+
+	if err := a.MetricsServer.Start(); err != nil {
+		return err
+	}
+
+	a.logger().Info("Serving metrics", logging.Field("url", fmt.Sprintf("http://%s/metrics", a.Config.Metrics)))
+	return nil
+}
+
+// StopMetrics stops serving the metrics.
+func (a *App) StopMetrics() {
+	if a.MetricsServer == nil {
+		return
+	}
+
+	if err := a.MetricsServer.Stop(); err != nil {
+		a.logger().Error("Could not stop metrics server", logging.FieldError(err))
+	}
+}
+
+// StartCapture starts writing the frames to the capture file, if enabled.
+func (a *App) StartCapture() error {
+	if a.Config.Capture.File == "" {
+		return nil
+	}
+
+	file, err := capture.CreateCaptureFile(a.Config.Capture.File, a.Config.Capture.Format)
+	if err != nil {
+		return err
+	}
+
+	a.CaptureFile = file
+	a.Capture.AddRecorder(file)
+	a.logger().Info("Capturing frames", logging.Field("file", a.Config.Capture.File), logging.Field("format", a.Config.Capture.Format))
+	return nil
+}
+
+// StopCapture closes the capture file. Frames still recorded afterwards
+// are dropped.
+func (a *App) StopCapture() {
+	if a.CaptureFile == nil {
+		return
+	}
+
+	if err := a.CaptureFile.Close(); err != nil {
+		a.logger().Error("Could not close capture file", logging.Field("file", a.Config.Capture.File), logging.FieldError(err))
+	}
+}
+
+// StartRecording starts recording the requests to the recording file, if
+// enabled.
+func (a *App) StartRecording() error {
+	if a.Config.Record == "" {
+		return nil
+	}
+
+	if err := a.Recorder.Start(a.Config.Record); err != nil {
+		return err
+	}
+
+	a.logger().Info("Recording requests", logging.Field("file", a.Config.Record))
+	return nil
+}
+
+// StopRecording closes the recording file.
+func (a *App) StopRecording() {
+	if err := a.Recorder.Stop(); err != nil {
+		a.logger().Error("Could not close recording", logging.Field("file", a.Config.Record), logging.FieldError(err))
+	}
+}
+
+// CloseUpstreams closes the connections to upstream devices.
+func (a *App) CloseUpstreams() {
+	for _, upstream := range a.Upstreams {
+		if err := upstream.Close(); err != nil {
+			a.logger().Error("Could not close upstream", logging.Field("upstream", upstream.URL()), logging.FieldError(err))
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// AuthorizationMiddleware lets only clients with one of the write roles
+// write coils and registers. The role comes from the Modbus Role extension
+// of the client certificate, so it is only known on tcp+tls listeners.
+// Reads are always allowed. Without write roles every write is allowed.
+type AuthorizationMiddleware struct {
+	base       RequestHandler
+	writeRoles map[string]bool
+	logger     *logging.Logger
+}
+
+func NewAuthorizationMiddleware(
+	base RequestHandler,
+	writeRoles []string,
+	logger *logging.Logger,
+) *AuthorizationMiddleware {
+	middleware := &AuthorizationMiddleware{
+		base:       base,
+		writeRoles: make(map[string]bool, len(writeRoles)),
+		logger:     logger,
+	}
+
+	for _, role := range writeRoles {
+		middleware.writeRoles[role] = true
+	}
+
+	return middleware
+}
+
+// canWrite reports whether a client with the role may write. Denied
+// writes are answered with Illegal Function, as the Modbus/TCP Security
+// spec asks for.
+func (h *AuthorizationMiddleware) canWrite(clientAddr string, clientRole string) bool {
+	if len(h.writeRoles) == 0 || h.writeRoles[clientRole] {
+		return true
+	}
+
+	h.logger.Warn("Denied write", logging.FieldClientAddr(clientAddr), logging.Field("role", clientRole))
+	return false
+}
+
+func (h *AuthorizationMiddleware) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	if req.IsWrite && !h.canWrite(req.ClientAddr, req.ClientRole) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleCoils(req)
+}
+
+func (h *AuthorizationMiddleware) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	return h.base.HandleDiscreteInputs(req)
+}
+
+func (h *AuthorizationMiddleware) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.IsWrite && !h.canWrite(req.ClientAddr, req.ClientRole) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleHoldingRegisters(req)
+}
+
+func (h *AuthorizationMiddleware) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	return h.base.HandleInputRegisters(req)
+}
+
+func (h *AuthorizationMiddleware) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	if !h.canWrite(req.ClientAddr, req.ClientRole) {
+		return modbus.ErrIllegalFunction
+	}
+	return h.base.HandleMaskWriteRegister(req)
+}
+
+func (h *AuthorizationMiddleware) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	if !h.canWrite(req.ClientAddr, req.ClientRole) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleReadWriteRegisters(req)
+}
+
+func (h *AuthorizationMiddleware) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	return h.base.HandleDeviceIdentification(req)
+}
+
+func (h *AuthorizationMiddleware) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	if req.IsWrite() && !h.canWrite(req.ClientAddr, req.ClientRole) {
+		return nil, modbus.ErrIllegalFunction
+	}
+	return h.base.HandleDiagnostics(req)
+}
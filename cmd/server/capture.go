@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+)
+
+// CaptureConfig writes every frame the listener sends or receives to a
+// file.
+type CaptureConfig struct {
+	// File is the path of the capture, empty disables it. It is overwritten
+	// on every start.
+	File string `json:"file"`
+	// Format is either "text" or "pcap".
+	Format string `json:"format"`
+}
+
+// Validate reports the problems of the capture settings.
+func (c CaptureConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	if c.Format != capture.CaptureFormatText && c.Format != capture.CaptureFormatPcap {
+		problems = append(problems, fmt.Sprintf("format: %q is not one of %s, %s", c.Format, capture.CaptureFormatText, capture.CaptureFormatPcap))
+	}
+
+	return problems
+}
@@ -0,0 +1,741 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	DefaultURL               = "tcp://localhost:5502"
+	DefaultTimeout           = 30 * time.Second
+	DefaultMaxClients        = 5
+	DefaultSeed              = "seed.json"
+	DefaultSimulatorInterval = 2 * time.Second
+	DefaultLogViewLines      = 5000
+
+	UnknownUnitIllegalFunction        = "illegal-function"
+	UnknownUnitGatewayPathUnavailable = "gateway-path-unavailable"
+	UnknownUnitGatewayTargetFailed    = "gateway-target-failed"
+
+	LogDestinationStdout = "stdout"
+	LogDestinationStderr = "stderr"
+)
+
+var ErrInvalidConfig = errors.New("invalid config")
+
+var unknownUnitExceptions = map[string]error{
+	UnknownUnitIllegalFunction:        modbus.ErrIllegalFunction,
+	UnknownUnitGatewayPathUnavailable: modbus.ErrGWPathUnavailable,
+	UnknownUnitGatewayTargetFailed:    modbus.ErrGWTargetFailedToRespond,
+}
+
+// Duration is a time.Duration that is written as "30s" or "1m30s" in the
+// config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parse duration: %w", err)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	// File is the config file the config was read from, if any.
+	File string `json:"-"`
+	// AccessDefault is the default access given with -access-default. It
+	// overrides the one of the access section, also when the rules are
+	// reloaded.
+	AccessDefault string `json:"-"`
+	// URL is where the server listens, e.g. tcp://0.0.0.0:502, or the serial
+	// port it serves as an RTU slave, e.g. rtu:///dev/ttyUSB0 or rtu://COM3.
+	URL string `json:"url"`
+	// Serial holds the line settings used with rtu:// urls.
+	Serial SerialConfig `json:"serial"`
+	// TLS holds the certificates used with tcp+tls:// urls.
+	TLS TLSConfig `json:"tls"`
+	// WriteRoles lists the client certificate roles allowed to write coils
+	// and registers. Empty allows every client to write.
+	WriteRoles []string `json:"write_roles"`
+	// Timeout is the idle timeout after which client connections are closed.
+	Timeout Duration `json:"timeout"`
+	// MaxClients is the maximum number of concurrent client connections.
+	MaxClients uint `json:"max_clients"`
+	// Seed is the path to the initial register map.
+	Seed string `json:"seed"`
+	// UnitIds lists unit ids the server answers to, each one gets its own
+	// register map seeded from Seed. Ignored when Units is set.
+	UnitIds []uint8 `json:"unit_ids"`
+	// Units lists the virtual slaves served behind the listener, each one
+	// with its own seed.
+	Units []UnitConfig `json:"units"`
+	// UnknownUnitException is the exception answered for unit ids that are
+	// not served: "illegal-function", "gateway-path-unavailable" or
+	// "gateway-target-failed".
+	UnknownUnitException string `json:"unknown_unit_exception"`
+	// Snapshot is the path the register image is saved to and restored from
+	// on startup. "{unit}" is replaced with the unit id, which is required
+	// when several units share this setting. Empty disables snapshots.
+	Snapshot string `json:"snapshot"`
+	// SnapshotInterval is how often the snapshot is saved while running,
+	// zero saves it only on demand and on shutdown.
+	SnapshotInterval Duration `json:"snapshot_interval"`
+	// SimulatorInterval is how often the activity simulator updates points.
+	SimulatorInterval Duration `json:"simulator_interval"`
+	// DeviceIdentification is answered to Read Device Identification by the
+	// units whose seed doesn't declare its own.
+	DeviceIdentification DeviceIdentification `json:"device_identification"`
+	// Gateway forwards the units that don't set their own gateway to an
+	// upstream device. Disabled while its url is empty.
+	Gateway GatewayConfig `json:"gateway"`
+	// Faults injects latency, exceptions and dropped responses into the
+	// answers of the server.
+	Faults FaultsConfig `json:"faults"`
+	// Access limits what clients may read and write by their address. When
+	// missing clients may only read, "default": "read-write" lets every
+	// client write. The rules are reloaded from the config file on demand.
+	Access AccessConfig `json:"access"`
+	// RateLimit answers Server Device Busy to clients sending requests
+	// faster than allowed.
+	RateLimit RateLimitConfig `json:"rate_limit"`
+	// Metrics is the address the Prometheus metrics are served on at
+	// /metrics, e.g. "localhost:9502". Empty disables the metrics.
+	Metrics string `json:"metrics"`
+	// MetricsWrites adds the writes of every coil and holding register by
+	// address to the metrics. It is off by default, as it may grow to a
+	// series per address of every unit.
+	MetricsWrites bool `json:"metrics_writes"`
+	// Log is either "stdout", "stderr" or a file path. When empty the log
+	// goes to the GUI log view or to stdout when running headless.
+	Log string `json:"log"`
+	// LogFormat is either "text" or "json".
+	LogFormat string `json:"log_format"`
+	// LogLevel is the lowest level logged, optionally per component, e.g.
+	// "info,handler=debug,access=warn". Empty logs from info on.
+	LogLevel string `json:"log_level"`
+	// LogRotation rotates the log file, when Log is a file path.
+	LogRotation LogRotationConfig `json:"log_rotation"`
+	// LogViewLines is how many lines the GUI log view keeps, older lines
+	// are dropped.
+	LogViewLines int `json:"log_view_lines"`
+	// Capture writes the raw frames to a file, as text or pcap.
+	Capture CaptureConfig `json:"capture"`
+	// Record writes every request answered by the server, with its
+	// response, to this file for the client to replay, empty disables it.
+	Record string `json:"record"`
+}
+
+// TLSConfig holds the PEM files of a tcp+tls listener. Clients must present
+// a certificate signed by one of the client CAs (mutual TLS).
+type TLSConfig struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+}
+
+// Validate reports the problems of the TLS settings.
+func (c TLSConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	files := []struct {
+		name string
+		path string
+	}{
+		{"cert_file", c.CertFile},
+		{"key_file", c.KeyFile},
+		{"client_ca_file", c.ClientCAFile},
+	}
+
+	for _, file := range files {
+		if file.path == "" {
+			problems = append(problems, fmt.Sprintf("%s: is required for tcp+tls", file.name))
+		} else if _, err := os.Stat(file.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.name, err))
+		}
+	}
+
+	return problems
+}
+
+// Load reads the server key pair and the client CA pool.
+func (c TLSConfig) Load() (*tls.Certificate, *x509.CertPool, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load key pair: %w", err)
+	}
+
+	clientCAs, err := modbus.LoadCertPool(c.ClientCAFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("load client CAs: %w", err)
+	}
+
+	return &cert, clientCAs, nil
+}
+
+type UnitConfig struct {
+	Id   uint8  `json:"id"`
+	Seed string `json:"seed"`
+	// Snapshot overrides Config.Snapshot for this unit.
+	Snapshot string `json:"snapshot"`
+	// Gateway overrides Config.Gateway for this unit. The seed is optional
+	// for forwarded units, it then starts empty.
+	Gateway *GatewayConfig `json:"gateway,omitempty"`
+}
+
+func DefaultConfig() Config {
+	return Config{
+		URL:                  DefaultURL,
+		Serial:               DefaultSerialConfig(),
+		Timeout:              Duration(DefaultTimeout),
+		MaxClients:           DefaultMaxClients,
+		Seed:                 DefaultSeed,
+		UnitIds:              []uint8{1},
+		UnknownUnitException: UnknownUnitIllegalFunction,
+		SimulatorInterval:    Duration(DefaultSimulatorInterval),
+		LogFormat:            logging.LogFormatText,
+		LogViewLines:         DefaultLogViewLines,
+		Capture: CaptureConfig{
+			Format: capture.CaptureFormatText,
+		},
+	}
+}
+
+// ReadConfig reads the config file on top of the default config, so any
+// setting missing from the file keeps its default value.
+func ReadConfig(filename string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Config{}, fmt.Errorf("read file: %w", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("unmarshall config file %s: %w", filename, err)
+	}
+
+	return config, nil
+}
+
+// LoadConfig registers the config flags on the flag set, parses args,
+// reads the config file given by -config (if any), applies the flags that
+// were set explicitly on top of it and validates the result.
+func LoadConfig(flags *flag.FlagSet, args []string) (Config, error) {
+	defaults := DefaultConfig()
+
+	configFile := flags.String("config", "", "path to JSON config file")
+	url := flags.String("url", defaults.URL, "listen url, e.g. tcp://0.0.0.0:502 or rtu:///dev/ttyUSB0")
+	baudRate := flags.Int("baud-rate", defaults.Serial.BaudRate, "serial baud rate (rtu only)")
+	dataBits := flags.Int("data-bits", defaults.Serial.DataBits, "serial data bits (rtu only)")
+	parity := flags.String("parity", defaults.Serial.Parity, "serial parity: none, even or odd (rtu only)")
+	stopBits := flags.Int("stop-bits", defaults.Serial.StopBits, "serial stop bits (rtu only)")
+	tlsCert := flags.String("tls-cert", defaults.TLS.CertFile, "server certificate PEM file (tcp+tls only)")
+	tlsKey := flags.String("tls-key", defaults.TLS.KeyFile, "server private key PEM file (tcp+tls only)")
+	tlsClientCA := flags.String("tls-client-ca", defaults.TLS.ClientCAFile, "PEM file of the CAs client certificates must be signed by (tcp+tls only)")
+	writeRoles := flags.String("write-roles", strings.Join(defaults.WriteRoles, ","), "comma separated client certificate roles allowed to write, empty allows everyone")
+	timeout := flags.Duration("timeout", time.Duration(defaults.Timeout), "idle client connection timeout")
+	maxClients := flags.Uint("max-clients", defaults.MaxClients, "maximum number of concurrent clients")
+	seed := flags.String("seed", defaults.Seed, "path to seed file")
+	unitIds := flags.String("unit-ids", formatUnitIds(defaults.UnitIds), "comma separated list of accepted unit ids")
+	units := make([]UnitConfig, 0)
+	flags.Func("unit", "unit id and its seed as id=path, may be repeated, e.g. -unit 1=pump.json -unit 2=valve.json", func(value string) error {
+		unit, err := parseUnit(value)
+		if err != nil {
+			return err
+		}
+		units = append(units, unit)
+		return nil
+	})
+	unknownUnitException := flags.String("unknown-unit-exception", defaults.UnknownUnitException, "exception for unknown unit ids: illegal-function, gateway-path-unavailable or gateway-target-failed")
+	snapshot := flags.String("snapshot", defaults.Snapshot, "snapshot path, {unit} is replaced with the unit id")
+	snapshotInterval := flags.Duration("snapshot-interval", time.Duration(defaults.SnapshotInterval), "how often to save the snapshot, 0 saves only on demand and on shutdown")
+	simulatorInterval := flags.Duration("simulator-interval", time.Duration(defaults.SimulatorInterval), "activity simulator update interval")
+	logDestination := flags.String("log", defaults.Log, "log destination: stdout, stderr or file path")
+	logFormat := flags.String("log-format", defaults.LogFormat, "log format: text or json")
+	logMaxSize := flags.Int("log-max-size", defaults.LogRotation.MaxSizeMB, "rotate the log file at this size in megabytes, 0 never rotates")
+	logMaxAge := flags.Duration("log-max-age", time.Duration(defaults.LogRotation.MaxAge), "remove rotated log files older than this, 0 keeps them")
+	logMaxBackups := flags.Int("log-max-backups", defaults.LogRotation.MaxBackups, "number of rotated log files kept, 0 keeps them all")
+	logCompress := flags.Bool("log-compress", defaults.LogRotation.Compress, "gzip rotated log files")
+	logViewLines := flags.Int("log-view-lines", defaults.LogViewLines, "number of lines kept by the GUI log view")
+	logLevel := flags.String("log-level", defaults.LogLevel, "lowest level logged: debug, info, warn or error, optionally per component, e.g. info,handler=debug")
+	upstream := flags.String("upstream", defaults.Gateway.URL, "forward every unit to this upstream device, e.g. tcp://192.168.0.10:502 or rtu:///dev/ttyUSB1")
+	upstreamCache := flags.Duration("upstream-cache", time.Duration(defaults.Gateway.Cache), "how long upstream reads are reused, 0 disables caching")
+	rateLimit := flags.Float64("rate-limit", defaults.RateLimit.Rate, "requests per second each client may send, 0 disables the limit")
+	rateBurst := flags.Uint("rate-burst", defaults.RateLimit.Burst, "requests each client may send at once, 0 allows a second's worth")
+	metrics := flags.String("metrics", defaults.Metrics, "serve Prometheus metrics at /metrics on this address, e.g. localhost:9502")
+	metricsWrites := flags.Bool("metrics-writes", defaults.MetricsWrites, "count the writes of every coil and holding register by address in the metrics")
+	capture := flags.String("capture", defaults.Capture.File, "write every frame sent or received to this file")
+	captureFormat := flags.String("capture-format", defaults.Capture.Format, "capture file format: text or pcap")
+	record := flags.String("record", defaults.Record, "record every request answered by the server to this file for replay")
+	faults := flags.Bool("faults", defaults.Faults.Enabled, "inject the faults of the config file from startup on")
+	accessDefault := flags.String("access-default", defaults.Access.Default, "access of the clients no access rule decides for: read-only (when empty), read-write or none")
+
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	config := defaults
+	if *configFile != "" {
+		read, err := ReadConfig(*configFile)
+		if err != nil {
+			return Config{}, fmt.Errorf("read config: %w", err)
+		}
+		config = read
+		config.File = *configFile
+	}
+
+	var overrideErr error
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			config.URL = *url
+		case "baud-rate":
+			config.Serial.BaudRate = *baudRate
+		case "data-bits":
+			config.Serial.DataBits = *dataBits
+		case "parity":
+			config.Serial.Parity = *parity
+		case "stop-bits":
+			config.Serial.StopBits = *stopBits
+		case "tls-cert":
+			config.TLS.CertFile = *tlsCert
+		case "tls-key":
+			config.TLS.KeyFile = *tlsKey
+		case "tls-client-ca":
+			config.TLS.ClientCAFile = *tlsClientCA
+		case "write-roles":
+			config.WriteRoles = parseRoles(*writeRoles)
+		case "timeout":
+			config.Timeout = Duration(*timeout)
+		case "max-clients":
+			config.MaxClients = *maxClients
+		case "seed":
+			config.Seed = *seed
+		case "unit-ids":
+			parsed, err := parseUnitIds(*unitIds)
+			if err != nil {
+				overrideErr = fmt.Errorf("-unit-ids: %w", err)
+				return
+			}
+			config.UnitIds = parsed
+		case "unit":
+			config.Units = units
+		case "unknown-unit-exception":
+			config.UnknownUnitException = *unknownUnitException
+		case "snapshot":
+			config.Snapshot = *snapshot
+		case "snapshot-interval":
+			config.SnapshotInterval = Duration(*snapshotInterval)
+		case "simulator-interval":
+			config.SimulatorInterval = Duration(*simulatorInterval)
+		case "log":
+			config.Log = *logDestination
+		case "log-format":
+			config.LogFormat = *logFormat
+		case "log-level":
+			config.LogLevel = *logLevel
+		case "log-max-size":
+			config.LogRotation.MaxSizeMB = *logMaxSize
+		case "log-max-age":
+			config.LogRotation.MaxAge = Duration(*logMaxAge)
+		case "log-max-backups":
+			config.LogRotation.MaxBackups = *logMaxBackups
+		case "log-compress":
+			config.LogRotation.Compress = *logCompress
+		case "log-view-lines":
+			config.LogViewLines = *logViewLines
+		case "upstream":
+			config.Gateway.URL = *upstream
+		case "upstream-cache":
+			config.Gateway.Cache = Duration(*upstreamCache)
+		case "rate-limit":
+			config.RateLimit.Rate = *rateLimit
+		case "rate-burst":
+			config.RateLimit.Burst = *rateBurst
+		case "metrics":
+			config.Metrics = *metrics
+		case "metrics-writes":
+			config.MetricsWrites = *metricsWrites
+		case "capture":
+			config.Capture.File = *capture
+		case "capture-format":
+			config.Capture.Format = *captureFormat
+		case "record":
+			config.Record = *record
+		case "faults":
+			config.Faults.Enabled = *faults
+		case "access-default":
+			config.Access.Default = *accessDefault
+			config.AccessDefault = *accessDefault
+		}
+	})
+
+	if overrideErr != nil {
+		return Config{}, overrideErr
+	}
+
+	if err := config.Validate(); err != nil {
+		return Config{}, err
+	}
+
+	return config, nil
+}
+
+// Validate checks every setting and reports all problems at once.
+func (c Config) Validate() error {
+	problems := make([]string, 0)
+
+	if err := validateListenURL(c.URL); err != nil {
+		problems = append(problems, fmt.Sprintf("url: %v", err))
+	}
+
+	if strings.HasPrefix(c.URL, "rtu://") {
+		for _, problem := range c.Serial.Validate() {
+			problems = append(problems, "serial."+problem)
+		}
+	}
+
+	if strings.HasPrefix(c.URL, "tcp+tls://") {
+		for _, problem := range c.TLS.Validate() {
+			problems = append(problems, "tls."+problem)
+		}
+	} else if len(c.WriteRoles) != 0 {
+		problems = append(problems, "write_roles: client roles come from certificates and require a tcp+tls url")
+	}
+
+	for i, role := range c.WriteRoles {
+		if role == "" {
+			problems = append(problems, fmt.Sprintf("write_roles[%d]: role is empty", i))
+		}
+	}
+
+	if c.Timeout <= 0 {
+		problems = append(problems, fmt.Sprintf("timeout: must be positive, got %v", time.Duration(c.Timeout)))
+	}
+
+	if c.MaxClients == 0 {
+		problems = append(problems, "max_clients: must be at least 1")
+	}
+
+	units := c.ResolveUnits()
+	if len(units) == 0 {
+		problems = append(problems, "units: at least one unit is required")
+	}
+
+	seen := make(map[uint8]bool)
+	for i, unit := range units {
+		section := fmt.Sprintf("units[%d]", i)
+		if len(c.Units) == 0 {
+			section = "unit_ids"
+		}
+
+		if unit.Id == 0 {
+			problems = append(problems, fmt.Sprintf("%s: 0 is the broadcast address and can not be served", section))
+		}
+
+		if seen[unit.Id] {
+			problems = append(problems, fmt.Sprintf("%s: unit id %d is listed more than once", section, unit.Id))
+		}
+		seen[unit.Id] = true
+
+		if unit.Seed == "" {
+			if unit.Gateway == nil {
+				problems = append(problems, fmt.Sprintf("%s: seed path is empty", section))
+			}
+		} else if _, err := os.Stat(unit.Seed); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: seed: %v", section, err))
+		}
+	}
+
+	if c.SnapshotInterval < 0 {
+		problems = append(problems, fmt.Sprintf("snapshot_interval: must not be negative, got %v", time.Duration(c.SnapshotInterval)))
+	}
+
+	snapshots := make(map[string]uint8)
+	for _, unit := range units {
+		if unit.Snapshot == "" {
+			continue
+		}
+
+		if other, ok := snapshots[unit.Snapshot]; ok {
+			problems = append(problems, fmt.Sprintf(
+				"snapshot: units %d and %d would share snapshot %s, use {unit} in the path",
+				other, unit.Id, unit.Snapshot,
+			))
+		}
+		snapshots[unit.Snapshot] = unit.Id
+	}
+
+	if _, ok := unknownUnitExceptions[c.UnknownUnitException]; !ok {
+		problems = append(problems, fmt.Sprintf(
+			"unknown_unit_exception: %q is not one of %s, %s, %s",
+			c.UnknownUnitException,
+			UnknownUnitIllegalFunction, UnknownUnitGatewayPathUnavailable, UnknownUnitGatewayTargetFailed,
+		))
+	}
+
+	if c.SimulatorInterval <= 0 {
+		problems = append(problems, fmt.Sprintf("simulator_interval: must be positive, got %v", time.Duration(c.SimulatorInterval)))
+	}
+
+	for _, problem := range c.DeviceIdentification.Validate() {
+		problems = append(problems, "device_identification."+problem.String())
+	}
+
+	if c.Gateway.URL != "" {
+		for _, problem := range c.Gateway.Validate() {
+			problems = append(problems, "gateway."+problem)
+		}
+	}
+
+	for _, problem := range c.Faults.Validate() {
+		problems = append(problems, "faults."+problem)
+	}
+
+	if c.Metrics != "" {
+		if _, port, err := net.SplitHostPort(c.Metrics); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics: %v", err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics: port %q is not a number between 0 and 65535", port))
+		}
+	}
+
+	if c.LogFormat != logging.LogFormatText && c.LogFormat != logging.LogFormatJSON {
+		problems = append(problems, fmt.Sprintf("log_format: %q is not one of %s, %s", c.LogFormat, logging.LogFormatText, logging.LogFormatJSON))
+	}
+
+	if _, err := logging.ParseLogLevels(c.LogLevel, LogComponents); err != nil {
+		problems = append(problems, fmt.Sprintf("log_level: %v", err))
+	}
+
+	for _, problem := range c.LogRotation.Validate() {
+		problems = append(problems, "log_rotation."+problem)
+	}
+
+	if c.LogRotation.MaxSizeMB != 0 && (c.Log == "" || c.Log == LogDestinationStdout || c.Log == LogDestinationStderr) {
+		problems = append(problems, "log_rotation: requires the log to go to a file")
+	}
+
+	if c.LogViewLines < 1 {
+		problems = append(problems, fmt.Sprintf("log_view_lines: must be at least 1, got %d", c.LogViewLines))
+	}
+
+	for _, problem := range c.Capture.Validate() {
+		problems = append(problems, "capture."+problem)
+	}
+
+	for _, problem := range c.RateLimit.Validate() {
+		problems = append(problems, "rate_limit."+problem)
+	}
+
+	for _, problem := range c.Access.Validate() {
+		problems = append(problems, "access."+problem)
+	}
+
+	upstreams := make(map[string]UnitConfig)
+	for i, unit := range units {
+		if unit.Gateway == nil {
+			continue
+		}
+
+		if len(c.Units) != 0 && c.Units[i].Gateway != nil {
+			for _, problem := range unit.Gateway.Validate() {
+				problems = append(problems, fmt.Sprintf("units[%d].gateway.%s", i, problem))
+			}
+		}
+
+		// units forwarded to the same device share its connection
+		other, ok := upstreams[unit.Gateway.URL]
+		if ok && !reflect.DeepEqual(other.Gateway.UpstreamConfig, unit.Gateway.UpstreamConfig) {
+			problems = append(problems, fmt.Sprintf(
+				"gateway: units %d and %d reach upstream %s with different serial, tls or timeout settings",
+				other.Id, unit.Id, unit.Gateway.URL,
+			))
+		}
+		upstreams[unit.Gateway.URL] = unit
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("%w:\n  %s", ErrInvalidConfig, strings.Join(problems, "\n  "))
+	}
+
+	return nil
+}
+
+// ResolveUnits returns the served units, either listed explicitly or built
+// from UnitIds sharing the same seed file, with snapshot paths resolved.
+func (c Config) ResolveUnits() []UnitConfig {
+	units := make([]UnitConfig, 0, len(c.UnitIds))
+	if len(c.Units) != 0 {
+		units = append(units, c.Units...)
+	} else {
+		for _, id := range c.UnitIds {
+			units = append(units, UnitConfig{Id: id, Seed: c.Seed})
+		}
+	}
+
+	for i := range units {
+		if units[i].Snapshot == "" {
+			units[i].Snapshot = c.Snapshot
+		}
+		units[i].Snapshot = strings.ReplaceAll(units[i].Snapshot, "{unit}", strconv.Itoa(int(units[i].Id)))
+
+		if units[i].Gateway == nil && c.Gateway.URL != "" {
+			gateway := c.Gateway
+			units[i].Gateway = &gateway
+		}
+	}
+
+	return units
+}
+
+// UnknownUnitError returns the modbus error answered for unknown unit ids.
+func (c Config) UnknownUnitError() error {
+	if err, ok := unknownUnitExceptions[c.UnknownUnitException]; ok {
+		return err
+	}
+	return modbus.ErrIllegalFunction
+}
+
+func validateListenURL(url string) error {
+	parts := strings.SplitN(url, "://", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("%q should look like %q", url, DefaultURL)
+	}
+
+	switch parts[0] {
+	case "tcp", "tcp+tls":
+	case "rtu":
+		if parts[1] == "" {
+			return fmt.Errorf("%q should name a serial port, e.g. rtu:///dev/ttyUSB0", url)
+		}
+		return nil
+	default:
+		return fmt.Errorf("transport %q is not supported, expected tcp, tcp+tls or rtu", parts[0])
+	}
+
+	if _, port, err := net.SplitHostPort(parts[1]); err != nil {
+		return fmt.Errorf("%q: %v", parts[1], err)
+	} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("port %q is not a number between 0 and 65535", port)
+	}
+
+	return nil
+}
+
+func parseUnitIds(input string) ([]uint8, error) {
+	result := make([]uint8, 0)
+	for _, chunk := range strings.Split(input, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(chunk), 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("unit id %q is not a number between 0 and 255", chunk)
+		}
+		result = append(result, uint8(id))
+	}
+	return result, nil
+}
+
+func parseRoles(input string) []string {
+	result := make([]string, 0)
+	for _, chunk := range strings.Split(input, ",") {
+		if role := strings.TrimSpace(chunk); role != "" {
+			result = append(result, role)
+		}
+	}
+	return result
+}
+
+func parseUnit(input string) (UnitConfig, error) {
+	parts := strings.SplitN(input, "=", 2)
+	if len(parts) != 2 {
+		return UnitConfig{}, fmt.Errorf("%q should look like 1=seed.json", input)
+	}
+
+	ids, err := parseUnitIds(parts[0])
+	if err != nil || len(ids) != 1 {
+		return UnitConfig{}, fmt.Errorf("unit id %q is not a number between 0 and 255", parts[0])
+	}
+
+	return UnitConfig{Id: ids[0], Seed: parts[1]}, nil
+}
+
+func formatUnitIds(ids []uint8) string {
+	chunks := make([]string, 0, len(ids))
+	for _, id := range ids {
+		chunks = append(chunks, strconv.Itoa(int(id)))
+	}
+	return strings.Join(chunks, ",")
+}
+
+// Logger creates the logger of the configured format and levels. The config
+// must be valid.
+func (c Config) Logger() *logging.Logger {
+	levels, _ := logging.ParseLogLevels(c.LogLevel, LogComponents)
+	return logging.NewLogger(c.LogFormat, levels)
+}
+
+// OpenLogDestination opens the configured log destination. It returns nil
+// if the log destination is not set. Log files are rotated as configured,
+// the failures of the rotation are logged to logger.
+func OpenLogDestination(destination string, rotation LogRotationConfig, logger *logging.Logger) (io.WriteCloser, error) {
+	switch destination {
+	case "":
+		return nil, nil
+
+	case LogDestinationStdout:
+		return nopCloser{os.Stdout}, nil
+
+	case LogDestinationStderr:
+		return nopCloser{os.Stderr}, nil
+	}
+
+	if rotation.MaxSizeMB != 0 {
+		return OpenRotatingFile(destination, rotation, logger)
+	}
+
+	file, err := os.OpenFile(destination, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open log file: %w", err)
+	}
+
+	return file, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
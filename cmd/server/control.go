@@ -1,10 +1,11 @@
 package main
 
-import "log"
+import "github.com/aveplen/mirea-modbus/internal/logging"
 
 type ServerManagerInterface interface {
 	StartServer() error
 	StopServer() error
+	Diagnostics() *Diagnostics
 }
 
 type ActivitySimulator interface {
@@ -12,38 +13,72 @@ type ActivitySimulator interface {
 	StopSimulation()
 }
 
+type SnapshotSaver interface {
+	SaveSnapshots() error
+}
+
+type RateLimiter interface {
+	Stats() []RateLimitStat
+	ClearStats()
+}
+
+type AccessReloader interface {
+	ReloadAccess() error
+}
+
+type FaultInjector interface {
+	Enabled() bool
+	SetEnabled(enabled bool)
+	RuleCount() int
+}
+
 type MainViewModel struct {
 	serverManager     ServerManagerInterface
 	activitySimulator ActivitySimulator
+	snapshotSaver     SnapshotSaver
+	faultInjector     FaultInjector
+	accessReloader    AccessReloader
+	rateLimiter       RateLimiter
+	logger            *logging.Logger
 }
 
 func NewMainViewModel(
 	serverManager ServerManagerInterface,
 	activitySimulator ActivitySimulator,
+	snapshotSaver SnapshotSaver,
+	faultInjector FaultInjector,
+	accessReloader AccessReloader,
+	rateLimiter RateLimiter,
+	logger *logging.Logger,
 ) *MainViewModel {
 	return &MainViewModel{
 		serverManager:     serverManager,
 		activitySimulator: activitySimulator,
+		snapshotSaver:     snapshotSaver,
+		faultInjector:     faultInjector,
+		accessReloader:    accessReloader,
+		rateLimiter:       rateLimiter,
+		logger:            logger,
 	}
 }
 
 func (m *MainViewModel) StartServer() bool {
 	if err := m.serverManager.StartServer(); err != nil {
-		log.Printf("Could not start server, reason: %v", err)
+		m.logger.Error("Could not start server", logging.FieldError(err))
 		return false
 	}
 
-	log.Println("Server started successfuly")
+	m.logger.Info("Server started")
 	return true
 }
 
 func (m *MainViewModel) StopServer() bool {
 	if err := m.serverManager.StopServer(); err != nil {
-		log.Printf("Could not stop server, reason: %v", err)
+		m.logger.Error("Could not stop server", logging.FieldError(err))
 		return false
 	}
 
-	log.Println("Server stopped successfuly")
+	m.logger.Info("Server stopped")
 	return true
 }
 
@@ -54,3 +89,53 @@ func (m *MainViewModel) StartSimulation() {
 func (m *MainViewModel) StopSimulation() {
 	m.activitySimulator.StopSimulation()
 }
+
+func (m *MainViewModel) SaveSnapshot() bool {
+	if err := m.snapshotSaver.SaveSnapshots(); err != nil {
+		m.logger.Error("Could not save snapshot", logging.FieldError(err))
+		return false
+	}
+
+	return true
+}
+
+func (m *MainViewModel) DiagnosticCounters() DiagnosticCounters {
+	return m.serverManager.Diagnostics().Counters()
+}
+
+func (m *MainViewModel) RateLimitStats() []RateLimitStat {
+	return m.rateLimiter.Stats()
+}
+
+func (m *MainViewModel) ClearDiagnostics() {
+	m.serverManager.Diagnostics().Clear()
+	m.rateLimiter.ClearStats()
+	m.logger.Info("Diagnostic counters cleared")
+}
+
+func (m *MainViewModel) ReloadAccess() bool {
+	if err := m.accessReloader.ReloadAccess(); err != nil {
+		m.logger.Error("Could not reload access rules", logging.FieldError(err))
+		return false
+	}
+
+	return true
+}
+
+func (m *MainViewModel) FaultInjectionEnabled() bool {
+	return m.faultInjector.Enabled()
+}
+
+func (m *MainViewModel) SetFaultInjection(enabled bool) {
+	ToggleFaultInjection(m.faultInjector, enabled, m.logger)
+}
+
+// ToggleFaultInjection turns fault injection on or off and logs it.
+func ToggleFaultInjection(faultInjector FaultInjector, enabled bool, logger *logging.Logger) {
+	faultInjector.SetEnabled(enabled)
+	if enabled {
+		logger.Info("Fault injection enabled", logging.Field("rules", faultInjector.RuleCount()))
+	} else {
+		logger.Info("Fault injection disabled")
+	}
+}
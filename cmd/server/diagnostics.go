@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	DiagReturnQueryData             uint16 = 0x00
+	DiagRestartCommunications       uint16 = 0x01
+	DiagReturnDiagnosticRegister    uint16 = 0x02
+	DiagClearCounters               uint16 = 0x0A
+	DiagReturnBusMessageCount       uint16 = 0x0B
+	DiagReturnBusCommErrorCount     uint16 = 0x0C
+	DiagReturnBusExceptionCount     uint16 = 0x0D
+	DiagReturnServerMessageCount    uint16 = 0x0E
+	DiagReturnServerNoResponseCount uint16 = 0x0F
+	DiagReturnServerNAKCount        uint16 = 0x10
+	DiagReturnServerBusyCount       uint16 = 0x11
+	DiagReturnBusCharOverrunCount   uint16 = 0x12
+	DiagClearOverrunCounter         uint16 = 0x14
+)
+
+// DiagnosticCounters are the counters of the Modbus serial line spec. They
+// are 16 bit and wrap around, as the spec asks for.
+type DiagnosticCounters struct {
+	// BusMessages counts the frames seen on the link, including the ones
+	// addressed to other slaves.
+	BusMessages uint16
+	// BusCommErrors counts the frames dropped for a bad CRC or a malformed
+	// MBAP header.
+	BusCommErrors uint16
+	// BusExceptions counts the exception responses sent.
+	BusExceptions uint16
+	// ServerMessages counts the requests addressed to the server,
+	// broadcasts included.
+	ServerMessages uint16
+	// ServerNoResponses counts the requests addressed to the server that
+	// got no response: broadcasts, malformed requests and the responses
+	// dropped by fault injection.
+	ServerNoResponses uint16
+	// ServerNAKs counts Negative Acknowledge exceptions, which are never
+	// sent since no program commands are served.
+	ServerNAKs uint16
+	// ServerBusy counts Server Device Busy exceptions.
+	ServerBusy uint16
+	// BusCharOverruns counts the frames longer than the link allows.
+	BusCharOverruns uint16
+	// CommEvents is the counter returned by Get Comm Event Counter (0x0B):
+	// requests completed without an exception, the diagnostics themselves
+	// excluded.
+	CommEvents uint16
+}
+
+// Diagnostics keeps the counters of a listener, updated by the transport
+// and the dispatcher. It is safe for concurrent use.
+type Diagnostics struct {
+	lock     sync.Mutex
+	counters DiagnosticCounters
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{}
+}
+
+// Counters returns a copy of the counters.
+func (d *Diagnostics) Counters() DiagnosticCounters {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.counters
+}
+
+// Clear resets every counter.
+func (d *Diagnostics) Clear() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.counters = DiagnosticCounters{}
+}
+
+func (d *Diagnostics) update(f func(c *DiagnosticCounters)) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	f(&d.counters)
+}
+
+func (d *Diagnostics) BusMessage() {
+	d.update(func(c *DiagnosticCounters) { c.BusMessages++ })
+}
+
+func (d *Diagnostics) BusCommError() {
+	d.update(func(c *DiagnosticCounters) { c.BusCommErrors++ })
+}
+
+func (d *Diagnostics) BusCharOverrun() {
+	d.update(func(c *DiagnosticCounters) { c.BusCharOverruns++ })
+}
+
+// serverMessage counts a request addressed to the server before it is
+// handled, so that, like the bus message count, the count returned by
+// Diagnostics includes the request itself.
+func (d *Diagnostics) serverMessage() {
+	d.update(func(c *DiagnosticCounters) { c.ServerMessages++ })
+}
+
+// request counts a request addressed to the server by its outcome: err is
+// the handler error, answered tells whether a response was sent.
+func (d *Diagnostics) request(functionCode uint8, err error, answered bool) {
+	d.update(func(c *DiagnosticCounters) {
+		switch {
+		case !answered:
+			c.ServerNoResponses++
+
+		case err != nil:
+			c.BusExceptions++
+			if errors.Is(err, modbus.ErrServerDeviceBusy) {
+				c.ServerBusy++
+			}
+
+		case functionCode != fcDiagnostics && functionCode != fcGetCommEventCounter:
+			c.CommEvents++
+		}
+	})
+}
+
+// DiagnosticCounter is a single named counter.
+type DiagnosticCounter struct {
+	Name  string
+	Value uint16
+}
+
+// List returns the counters in the order of their sub-functions.
+func (c DiagnosticCounters) List() []DiagnosticCounter {
+	return []DiagnosticCounter{
+		{"Bus messages", c.BusMessages},
+		{"Bus communication errors", c.BusCommErrors},
+		{"Bus exceptions", c.BusExceptions},
+		{"Server messages", c.ServerMessages},
+		{"Server no responses", c.ServerNoResponses},
+		{"Server NAKs", c.ServerNAKs},
+		{"Server busy", c.ServerBusy},
+		{"Bus character overruns", c.BusCharOverruns},
+		{"Comm events", c.CommEvents},
+	}
+}
+
+func (c DiagnosticCounters) String() string {
+	counters := make([]string, 0, 9)
+	for _, counter := range c.List() {
+		counters = append(counters, fmt.Sprintf("%s: %d", counter.Name, counter.Value))
+	}
+	return strings.Join(counters, ", ")
+}
+
+// answer answers a Diagnostics (0x08) or Get Comm Event Counter (0x0B)
+// request.
+func (d *Diagnostics) answer(req *DiagnosticsRequest) ([]byte, error) {
+	if req.FunctionCode == fcGetCommEventCounter {
+		return d.commEventCounter(req.Payload)
+	}
+	return d.diagnose(req.Payload)
+}
+
+// diagnose answers a Diagnostics (0x08) request: the sub-function and its
+// data, which is echoed or replaced by a counter.
+func (d *Diagnostics) diagnose(payload []byte) ([]byte, error) {
+	if len(payload) < 4 || len(payload)%2 != 0 {
+		return nil, modbus.ErrProtocolError
+	}
+
+	subFunction := binary.BigEndian.Uint16(payload[0:2])
+	data := binary.BigEndian.Uint16(payload[2:4])
+
+	switch subFunction {
+	case DiagReturnQueryData:
+		return payload, nil
+
+	case DiagRestartCommunications:
+		if len(payload) != 4 || data != 0x0000 && data != 0xFF00 {
+			return nil, modbus.ErrIllegalDataValue
+		}
+		d.Clear()
+		return payload, nil
+	}
+
+	counters := d.Counters()
+	var value uint16
+	var clear func(c *DiagnosticCounters)
+	switch subFunction {
+	case DiagClearCounters:
+		clear = func(c *DiagnosticCounters) { *c = DiagnosticCounters{} }
+	case DiagClearOverrunCounter:
+		clear = func(c *DiagnosticCounters) { c.BusCharOverruns = 0 }
+
+	// the server defines no diagnostic register bits
+	case DiagReturnDiagnosticRegister:
+		value = 0
+	case DiagReturnBusMessageCount:
+		value = counters.BusMessages
+	case DiagReturnBusCommErrorCount:
+		value = counters.BusCommErrors
+	case DiagReturnBusExceptionCount:
+		value = counters.BusExceptions
+	case DiagReturnServerMessageCount:
+		value = counters.ServerMessages
+	case DiagReturnServerNoResponseCount:
+		value = counters.ServerNoResponses
+	case DiagReturnServerNAKCount:
+		value = counters.ServerNAKs
+	case DiagReturnServerBusyCount:
+		value = counters.ServerBusy
+	case DiagReturnBusCharOverrunCount:
+		value = counters.BusCharOverruns
+	default:
+		return nil, modbus.ErrIllegalFunction
+	}
+
+	if len(payload) != 4 || data != 0 {
+		return nil, modbus.ErrIllegalDataValue
+	}
+
+	if clear != nil {
+		d.update(clear)
+		return payload, nil
+	}
+
+	res := make([]byte, 4)
+	binary.BigEndian.PutUint16(res[0:2], subFunction)
+	binary.BigEndian.PutUint16(res[2:4], value)
+	return res, nil
+}
+
+// commEventCounter answers Get Comm Event Counter (0x0B): the status word,
+// never busy, and the event counter.
+func (d *Diagnostics) commEventCounter(payload []byte) ([]byte, error) {
+	if len(payload) != 0 {
+		return nil, modbus.ErrProtocolError
+	}
+
+	res := make([]byte, 4)
+	binary.BigEndian.PutUint16(res[2:4], d.Counters().CommEvents)
+	return res, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// newDiagnosticsDispatcher serves holding register 100 and input register
+// 30 of unit 1 behind rate limiting, access control and authorization, the
+// chain of the server without fault injection.
+func newDiagnosticsDispatcher(t *testing.T, access AccessConfig, rateLimit RateLimitConfig, writeRoles []string) *RequestDispatcher {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		InputRegisters:   []Register{{addr: 30}},
+		HoldingRegisters: []Register{{addr: 100}},
+	})
+	router := NewUnitRouter(modbus.ErrGWPathUnavailable, logger)
+	router.AddUnit(1, NewAdapterHandler(NewModbusHandler(service, nil, logger), logger))
+
+	accessControl, err := NewAccessControlMiddleware(NewAuthorizationMiddleware(router, writeRoles, logger), access, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := NewFallbackMiddleware(NewRateLimitMiddleware(accessControl, rateLimit, logger), logger)
+
+	return NewRequestDispatcher(chain, NewDiagnostics(), nil, nil, logger)
+}
+
+// diagnose sends a Diagnostics request with a single data word to unit 1.
+func diagnose(t *testing.T, dispatcher *RequestDispatcher, clientAddr string, clientRole string, subFunction uint16, data uint16) pdu {
+	t.Helper()
+
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint16(payload[0:2], subFunction)
+	binary.BigEndian.PutUint16(payload[2:4], data)
+
+	res, err := dispatcher.Dispatch(clientAddr, clientRole, pdu{unitId: 1, functionCode: fcDiagnostics, payload: payload})
+	if err != nil {
+		t.Fatalf("sub-function 0x%02X: %v", subFunction, err)
+	}
+	return res
+}
+
+// diagnosticCounter reads a counter with its sub-function.
+func diagnosticCounter(t *testing.T, dispatcher *RequestDispatcher, subFunction uint16) uint16 {
+	t.Helper()
+
+	res := diagnose(t, dispatcher, "192.0.2.1:5000", "", subFunction, 0)
+	if res.functionCode != fcDiagnostics || len(res.payload) != 4 {
+		t.Fatalf("sub-function 0x%02X answered %+v", subFunction, res)
+	}
+	if got := binary.BigEndian.Uint16(res.payload[0:2]); got != subFunction {
+		t.Fatalf("sub-function 0x%02X answered for 0x%02X", got, subFunction)
+	}
+	return binary.BigEndian.Uint16(res.payload[2:4])
+}
+
+func exceptionPDU(functionCode uint8, code uint8) pdu {
+	return pdu{unitId: 1, functionCode: 0x80 | functionCode, payload: []byte{code}}
+}
+
+func TestDiagnosticCounters(t *testing.T) {
+	dispatcher := newDiagnosticsDispatcher(t, AccessConfig{Default: ClientAccessReadWrite}, RateLimitConfig{
+		FunctionCodes: []FunctionRateLimit{{FunctionCode: fcReadInputRegisters, Rate: 0.001, Burst: 1}},
+	}, nil)
+	diagnostics := dispatcher.Diagnostics()
+
+	requests := []struct {
+		name string
+		req  pdu
+		err  error
+	}{
+		{"answered", pdu{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 1}}, nil},
+		{"exception", pdu{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 200, 0x00, 1}}, nil},
+		{"answered before the limit", pdu{unitId: 1, functionCode: fcReadInputRegisters, payload: []byte{0x00, 30, 0x00, 1}}, nil},
+		{"busy", pdu{unitId: 1, functionCode: fcReadInputRegisters, payload: []byte{0x00, 30, 0x00, 1}}, nil},
+		{"malformed", pdu{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00}}, modbus.ErrProtocolError},
+	}
+	for _, request := range requests {
+		if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", request.req); !errors.Is(err, request.err) {
+			t.Fatalf("%s request: got %v, want %v", request.name, err, request.err)
+		}
+	}
+	dispatcher.Broadcast("192.0.2.1:5000", []uint8{1}, pdu{functionCode: fcWriteSingleRegister, payload: []byte{0x00, 100, 0x00, 1}})
+
+	// counted by the transport
+	for i := 0; i < 3; i++ {
+		diagnostics.BusMessage()
+	}
+	diagnostics.BusCommError()
+	diagnostics.BusCharOverrun()
+
+	counters := []struct {
+		subFunction uint16
+		want        uint16
+	}{
+		{DiagReturnDiagnosticRegister, 0},
+		{DiagReturnBusMessageCount, 3},
+		{DiagReturnBusCommErrorCount, 1},
+		{DiagReturnBusExceptionCount, 2},
+		// the six requests above and the five reads of counters, this one
+		// included
+		{DiagReturnServerMessageCount, 11},
+		{DiagReturnServerNoResponseCount, 2},
+		{DiagReturnServerNAKCount, 0},
+		{DiagReturnServerBusyCount, 1},
+		{DiagReturnBusCharOverrunCount, 1},
+	}
+	for _, counter := range counters {
+		if got := diagnosticCounter(t, dispatcher, counter.subFunction); got != counter.want {
+			t.Errorf("sub-function 0x%02X: got %d, want %d", counter.subFunction, got, counter.want)
+		}
+	}
+
+	// the diagnostics themselves are no comm events
+	res, err := dispatcher.Dispatch("192.0.2.1:5000", "", pdu{unitId: 1, functionCode: fcGetCommEventCounter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (pdu{unitId: 1, functionCode: fcGetCommEventCounter, payload: []byte{0x00, 0x00, 0x00, 2}}); !reflect.DeepEqual(res, want) {
+		t.Errorf("comm event counter answered %+v, want %+v", res, want)
+	}
+	if got := diagnostics.Counters().BusExceptions; got != 2 {
+		t.Errorf("diagnostics counted as %d exceptions, want 2", got)
+	}
+}
+
+func TestDiagnosticSubFunctions(t *testing.T) {
+	dispatcher := newDiagnosticsDispatcher(t, AccessConfig{Default: ClientAccessReadWrite}, RateLimitConfig{}, nil)
+	diagnostics := dispatcher.Diagnostics()
+
+	res := diagnose(t, dispatcher, "192.0.2.1:5000", "", DiagReturnQueryData, 0xA537)
+	if want := (pdu{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0x00, 0x00, 0xA5, 0x37}}); !reflect.DeepEqual(res, want) {
+		t.Errorf("query data echoed %+v, want %+v", res, want)
+	}
+
+	// longer data is echoed as a whole
+	payload := []byte{0x00, 0x00, 0x01, 0x02, 0x03, 0x04}
+	res, err := dispatcher.Dispatch("192.0.2.1:5000", "", pdu{unitId: 1, functionCode: fcDiagnostics, payload: payload})
+	if err != nil || !reflect.DeepEqual(res.payload, payload) {
+		t.Errorf("query data echoed %+v, %v", res, err)
+	}
+
+	diagnostics.BusCharOverrun()
+	if res := diagnose(t, dispatcher, "192.0.2.1:5000", "", DiagClearOverrunCounter, 0); res.functionCode != fcDiagnostics {
+		t.Errorf("clear overrun counter answered %+v", res)
+	}
+	if got := diagnostics.Counters().BusCharOverruns; got != 0 {
+		t.Errorf("overrun counter %d after clearing it", got)
+	}
+	if got := diagnostics.Counters().ServerMessages; got != 3 {
+		t.Errorf("clearing the overrun counter cleared the server message counter to %d", got)
+	}
+
+	if res := diagnose(t, dispatcher, "192.0.2.1:5000", "", DiagClearCounters, 0); res.functionCode != fcDiagnostics {
+		t.Errorf("clear counters answered %+v", res)
+	}
+	// only this read is left
+	if got := diagnosticCounter(t, dispatcher, DiagReturnServerMessageCount); got != 1 {
+		t.Errorf("server messages %d after clearing the counters, want 1", got)
+	}
+
+	if res := diagnose(t, dispatcher, "192.0.2.1:5000", "", DiagRestartCommunications, 0xFF00); res.functionCode != fcDiagnostics {
+		t.Errorf("restart communications answered %+v", res)
+	}
+	if got := diagnosticCounter(t, dispatcher, DiagReturnServerMessageCount); got != 1 {
+		t.Errorf("server messages %d after restarting communications, want 1", got)
+	}
+
+	exceptions := []struct {
+		name        string
+		subFunction uint16
+		data        uint16
+		want        pdu
+	}{
+		{"restart with unknown data", DiagRestartCommunications, 0x1234, exceptionPDU(fcDiagnostics, 0x03)},
+		{"counter with data", DiagReturnBusMessageCount, 1, exceptionPDU(fcDiagnostics, 0x03)},
+		{"unknown sub-function", 0x03, 0, exceptionPDU(fcDiagnostics, 0x01)},
+	}
+	for _, test := range exceptions {
+		if got := diagnose(t, dispatcher, "192.0.2.1:5000", "", test.subFunction, test.data); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: answered %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	malformed := []pdu{
+		{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0x00, 0x00}},
+		{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0x00, 0x00, 0x00}},
+		{unitId: 1, functionCode: fcGetCommEventCounter, payload: []byte{0x00}},
+	}
+	for _, req := range malformed {
+		if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); !errors.Is(err, modbus.ErrProtocolError) {
+			t.Errorf("function code 0x%02X with %d bytes: got %v, want %v", req.functionCode, len(req.payload), err, modbus.ErrProtocolError)
+		}
+	}
+}
+
+// Clearing the counters goes through the handler chain like a write, so
+// clients that may only read can't wipe them.
+func TestDiagnosticsChain(t *testing.T) {
+	dispatcher := newDiagnosticsDispatcher(t,
+		AccessConfig{Rules: []AccessRule{
+			{Clients: []string{"192.0.2.2"}, Allow: []string{OperationWrite}},
+			{Clients: []string{"192.0.2.3"}, Deny: []string{OperationRead}},
+		}},
+		RateLimitConfig{FunctionCodes: []FunctionRateLimit{{FunctionCode: fcDiagnostics, Rate: 0.001, Burst: 2}}},
+		nil,
+	)
+	diagnostics := dispatcher.Diagnostics()
+
+	tests := []struct {
+		name        string
+		clientAddr  string
+		subFunction uint16
+		want        pdu
+	}{
+		{"read-only client reads", "192.0.2.1:5000", DiagReturnQueryData, pdu{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0, 0, 0, 0}}},
+		{"read-only client clears", "192.0.2.1:5000", DiagClearCounters, exceptionPDU(fcDiagnostics, 0x01)},
+		{"rate limited", "192.0.2.1:5000", DiagReturnQueryData, exceptionPDU(fcDiagnostics, 0x06)},
+		{"denied client reads", "192.0.2.3:5000", DiagReturnQueryData, exceptionPDU(fcDiagnostics, 0x01)},
+		{"denied client restarts", "192.0.2.3:5000", DiagRestartCommunications, exceptionPDU(fcDiagnostics, 0x01)},
+	}
+	for _, test := range tests {
+		if got := diagnose(t, dispatcher, test.clientAddr, "", test.subFunction, 0); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: answered %+v, want %+v", test.name, got, test.want)
+		}
+	}
+	if got := diagnostics.Counters().ServerMessages; got != uint16(len(tests)) {
+		t.Fatalf("counters cleared by a client that may only read, %d server messages left", got)
+	}
+
+	res, err := dispatcher.Dispatch("192.0.2.1:5000", "", pdu{unitId: 1, functionCode: fcGetCommEventCounter})
+	if err != nil || res.functionCode != fcGetCommEventCounter {
+		t.Errorf("comm event counter limited by the limit of diagnostics: %+v, %v", res, err)
+	}
+
+	if res := diagnose(t, dispatcher, "192.0.2.2:5000", "", DiagClearCounters, 0); res.functionCode != fcDiagnostics {
+		t.Errorf("clear counters by a client that may write answered %+v", res)
+	}
+	if got := diagnostics.Counters().ServerMessages; got != 0 {
+		t.Errorf("%d server messages after clearing the counters", got)
+	}
+
+	// only units that are served answer
+	res, err = dispatcher.Dispatch("192.0.2.2:5000", "", pdu{unitId: 2, functionCode: fcGetCommEventCounter})
+	if want := (pdu{unitId: 2, functionCode: 0x80 | fcGetCommEventCounter, payload: []byte{0x0A}}); err != nil || !reflect.DeepEqual(res, want) {
+		t.Errorf("unknown unit answered %+v, %v, want %+v", res, err, want)
+	}
+}
+
+func TestDiagnosticsWriteRoles(t *testing.T) {
+	dispatcher := newDiagnosticsDispatcher(t, AccessConfig{Default: ClientAccessReadWrite}, RateLimitConfig{}, []string{"operator"})
+
+	if got := diagnose(t, dispatcher, "192.0.2.1:5000", "viewer", DiagClearCounters, 0); !reflect.DeepEqual(got, exceptionPDU(fcDiagnostics, 0x01)) {
+		t.Errorf("clear counters without a write role answered %+v", got)
+	}
+	if got := diagnose(t, dispatcher, "192.0.2.1:5000", "viewer", DiagReturnServerMessageCount, 0); got.functionCode != fcDiagnostics {
+		t.Errorf("counter read without a write role answered %+v", got)
+	}
+	if got := diagnose(t, dispatcher, "192.0.2.1:5000", "operator", DiagClearCounters, 0); got.functionCode != fcDiagnostics {
+		t.Errorf("clear counters with a write role answered %+v", got)
+	}
+}
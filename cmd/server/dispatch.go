@@ -0,0 +1,708 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/aveplen/mirea-modbus/internal/recording"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	fcReadCoils              uint8 = 0x01
+	fcReadDiscreteInputs     uint8 = 0x02
+	fcReadHoldingRegisters   uint8 = 0x03
+	fcReadInputRegisters     uint8 = 0x04
+	fcWriteSingleCoil        uint8 = 0x05
+	fcWriteSingleRegister    uint8 = 0x06
+	fcDiagnostics            uint8 = 0x08
+	fcGetCommEventCounter    uint8 = 0x0B
+	fcWriteMultipleCoils     uint8 = 0x0F
+	fcWriteMultipleRegisters uint8 = 0x10
+
+	fcMaskWriteRegister          uint8 = 0x16
+	fcReadWriteMultipleRegisters uint8 = 0x17
+	fcEncapsulatedInterface      uint8 = 0x2B
+)
+
+// chainFunctionCodes are the function codes that go through the handler
+// chain, every one the server answers.
+var chainFunctionCodes = []uint8{
+	fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters, fcReadInputRegisters,
+	fcWriteSingleCoil, fcWriteSingleRegister, fcDiagnostics, fcGetCommEventCounter,
+	fcWriteMultipleCoils, fcWriteMultipleRegisters, fcMaskWriteRegister,
+	fcReadWriteMultipleRegisters, fcEncapsulatedInterface,
+}
+
+// boolFunctionCodes returns the codes a coil request may have been sent
+// with.
+func boolFunctionCodes(read uint8, isWrite bool, quantity uint16) []uint8 {
+	switch {
+	case !isWrite:
+		return []uint8{read}
+	case quantity == 1:
+		return []uint8{fcWriteSingleCoil, fcWriteMultipleCoils}
+	}
+	return []uint8{fcWriteMultipleCoils}
+}
+
+// registerFunctionCodes returns the codes a holding register request may
+// have been sent with.
+func registerFunctionCodes(read uint8, isWrite bool, quantity uint16) []uint8 {
+	switch {
+	case !isWrite:
+		return []uint8{read}
+	case quantity == 1:
+		return []uint8{fcWriteSingleRegister, fcWriteMultipleRegisters}
+	}
+	return []uint8{fcWriteMultipleRegisters}
+}
+
+// MaskWriteRegisterRequest is a Mask Write Register (0x16) request: the
+// holding register at Addr becomes (current AND AndMask) OR (OrMask AND NOT
+// AndMask).
+type MaskWriteRegisterRequest struct {
+	ClientAddr string
+	ClientRole string
+	UnitId     uint8
+	Addr       uint16
+	AndMask    uint16
+	OrMask     uint16
+}
+
+// ReadWriteRegistersRequest is a Read/Write Multiple Registers (0x17)
+// request: Args are written to the holding registers at WriteAddr, then
+// ReadQuantity holding registers are read from ReadAddr.
+type ReadWriteRegistersRequest struct {
+	ClientAddr   string
+	ClientRole   string
+	UnitId       uint8
+	ReadAddr     uint16
+	ReadQuantity uint16
+	WriteAddr    uint16
+	Args         []uint16
+}
+
+// DeviceIdentificationRequest is a Read Device Identification (0x2B/0x0E)
+// request: the objects of the category given by ReadDeviceIdCode, from
+// ObjectId on, or only ObjectId for individual access.
+type DeviceIdentificationRequest struct {
+	ClientAddr       string
+	ClientRole       string
+	UnitId           uint8
+	ReadDeviceIdCode uint8
+	ObjectId         uint8
+}
+
+// DiagnosticsRequest is a Diagnostics (0x08) or Get Comm Event Counter
+// (0x0B) request. The counters describe the listener rather than a unit, so
+// the request carries the ones of the listener it came in on, and the unit
+// answers from them.
+type DiagnosticsRequest struct {
+	ClientAddr   string
+	ClientRole   string
+	UnitId       uint8
+	FunctionCode uint8
+	// SubFunction is the Diagnostics sub-function, zero for Get Comm Event
+	// Counter.
+	SubFunction uint16
+	Payload     []byte
+	Diagnostics *Diagnostics
+}
+
+// IsWrite tells whether the request clears counters, which access control
+// and authorization treat as a write.
+func (r *DiagnosticsRequest) IsWrite() bool {
+	if r.FunctionCode != fcDiagnostics {
+		return false
+	}
+
+	switch r.SubFunction {
+	case DiagRestartCommunications, DiagClearCounters, DiagClearOverrunCounter:
+		return true
+	}
+	return false
+}
+
+// RequestHandler is modbus.RequestHandler extended with the function codes
+// the library doesn't know. Every handler of the chain implements it.
+type RequestHandler interface {
+	modbus.RequestHandler
+	HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error
+	HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error)
+	HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error)
+	HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error)
+}
+
+// pdu is a request or a response without its transport framing: the unit
+// id, the function code and the data that follows it.
+type pdu struct {
+	unitId       uint8
+	functionCode uint8
+	payload      []byte
+}
+
+// exceptionCode maps an error returned by the handler chain to the
+// exception code of the response. Unlike the library, wrapped errors are
+// recognized too.
+func exceptionCode(err error) uint8 {
+	if e, ok := modbusclient.FindException(err); ok {
+		return e.Code
+	}
+	return 0x04
+}
+
+// exceptionError maps an exception code to the library error for it.
+func exceptionError(code uint8) error {
+	if e, ok := modbusclient.ExceptionByCode(code); ok {
+		return e.Err
+	}
+	return modbus.ErrServerDeviceFailure
+}
+
+// isException reports whether the error is an exception response.
+func isException(err error) bool {
+	_, ok := modbusclient.FindException(err)
+	return ok
+}
+
+// RequestDispatcher decodes request PDUs, calls the handler chain and
+// encodes the responses. It does what the library server does internally,
+// for the transports the library doesn't offer. Diagnostics (0x08) and Get
+// Comm Event Counter (0x0B) are answered from the counters the dispatcher
+// keeps, once the handler chain lets them through like any other request.
+//
+// Every answered or dropped request is counted in the metrics with its
+// function code and result, whichever part of the chain answered it. Those
+// the client can replay are recorded too, with the response or the
+// exception they got, except dropped ones which have no answer to compare
+// with. Broadcasts are neither counted nor recorded.
+type RequestDispatcher struct {
+	handler     RequestHandler
+	diagnostics *Diagnostics
+	metrics     *Metrics
+	recorder    *RequestRecorder
+	logger      *logging.Logger
+}
+
+func NewRequestDispatcher(handler RequestHandler, diagnostics *Diagnostics, metrics *Metrics, recorder *RequestRecorder, logger *logging.Logger) *RequestDispatcher {
+	return &RequestDispatcher{
+		handler:     handler,
+		diagnostics: diagnostics,
+		metrics:     metrics,
+		recorder:    recorder,
+		logger:      logger,
+	}
+}
+
+// Diagnostics returns the counters of the dispatcher.
+func (d *RequestDispatcher) Diagnostics() *Diagnostics {
+	return d.diagnostics
+}
+
+// Dispatch handles a single request. Handler errors are turned into
+// exception responses. It returns modbus.ErrProtocolError for malformed
+// requests and ErrDropResponse for requests the handler chain chose not to
+// answer, which the transport should drop instead of answering.
+func (d *RequestDispatcher) Dispatch(clientAddr string, clientRole string, req pdu) (pdu, error) {
+	d.diagnostics.serverMessage()
+	start := time.Now()
+	var decoded recording.RecordedRequest
+	payload, err := d.handle(clientAddr, clientRole, req, &decoded)
+	if errors.Is(err, modbus.ErrProtocolError) {
+		d.diagnostics.request(req.functionCode, err, false)
+		return pdu{}, err
+	}
+
+	d.count(req, decoded, err, time.Since(start))
+	if errors.Is(err, ErrDropResponse) {
+		d.diagnostics.request(req.functionCode, err, false)
+		return pdu{}, err
+	}
+	d.diagnostics.request(req.functionCode, err, true)
+	d.record(start, decoded, err)
+
+	if err != nil {
+		return pdu{
+			unitId:       req.unitId,
+			functionCode: 0x80 | req.functionCode,
+			payload:      []byte{exceptionCode(err)},
+		}, nil
+	}
+
+	return pdu{
+		unitId:       req.unitId,
+		functionCode: req.functionCode,
+		payload:      payload,
+	}, nil
+}
+
+// Broadcast applies a request sent to unit id 0 to every unit. Broadcasts
+// are never answered.
+func (d *RequestDispatcher) Broadcast(clientAddr string, unitIds []uint8, req pdu) {
+	d.diagnostics.serverMessage()
+	for _, id := range unitIds {
+		req.unitId = id
+		d.handle(clientAddr, "", req, &recording.RecordedRequest{})
+	}
+	d.diagnostics.request(req.functionCode, nil, false)
+}
+
+// count counts a request in the metrics, with the addresses it wrote.
+func (d *RequestDispatcher) count(req pdu, decoded recording.RecordedRequest, err error, duration time.Duration) {
+	d.metrics.request(req.functionCode, req.unitId, err, duration)
+	if err != nil {
+		return
+	}
+
+	switch decoded.FunctionCode {
+	case fcWriteSingleCoil, fcWriteMultipleCoils:
+		d.metrics.write(req.unitId, coilsSection.name, decoded.Addr, int(decoded.Quantity))
+
+	case fcWriteSingleRegister, fcWriteMultipleRegisters, fcMaskWriteRegister:
+		d.metrics.write(req.unitId, holdingRegistersSection.name, decoded.Addr, int(decoded.Quantity))
+
+	case fcReadWriteMultipleRegisters:
+		d.metrics.write(req.unitId, holdingRegistersSection.name, decoded.WriteAddr, len(decoded.Registers))
+	}
+}
+
+// record records a request decoded by handle, with the exception it was
+// answered with if err is set.
+func (d *RequestDispatcher) record(at time.Time, decoded recording.RecordedRequest, err error) {
+	// handle sets the function code once the request is decoded
+	if decoded.FunctionCode == 0 || !d.recorder.Recording() {
+		return
+	}
+
+	if err != nil {
+		decoded.Response = recording.RecordedResponse{Exception: exceptionCode(err)}
+	}
+	d.recorder.Record(at, decoded)
+}
+
+// handle decodes the request and calls the handler chain with it. The
+// decoded request is stored in decoded, with the response on success.
+func (d *RequestDispatcher) handle(clientAddr string, clientRole string, req pdu, decoded *recording.RecordedRequest) ([]byte, error) {
+	switch req.functionCode {
+	case fcDiagnostics, fcGetCommEventCounter:
+		var subFunction uint16
+		if req.functionCode == fcDiagnostics {
+			if len(req.payload) < 4 || len(req.payload)%2 != 0 {
+				return nil, modbus.ErrProtocolError
+			}
+			subFunction = binary.BigEndian.Uint16(req.payload[0:2])
+		} else if len(req.payload) != 0 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		return d.handler.HandleDiagnostics(&DiagnosticsRequest{
+			ClientAddr:   clientAddr,
+			ClientRole:   clientRole,
+			UnitId:       req.unitId,
+			FunctionCode: req.functionCode,
+			SubFunction:  subFunction,
+			Payload:      req.payload,
+			Diagnostics:  d.diagnostics,
+		})
+
+	case fcReadCoils, fcReadDiscreteInputs:
+		addr, quantity, err := decodeRange(req.payload, 2000)
+		if err != nil {
+			return nil, err
+		}
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: quantity}
+
+		var coils []bool
+		if req.functionCode == fcReadCoils {
+			coils, err = d.handler.HandleCoils(&modbus.CoilsRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		} else {
+			coils, err = d.handler.HandleDiscreteInputs(&modbus.DiscreteInputsRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(coils) != int(quantity) {
+			d.wrongCount(clientAddr, req, len(coils), int(quantity))
+			return nil, modbus.ErrServerDeviceFailure
+		}
+
+		decoded.Response.Coils = coils
+		bytes := encodeBools(coils)
+		return append([]byte{uint8(len(bytes))}, bytes...), nil
+
+	case fcReadHoldingRegisters, fcReadInputRegisters:
+		addr, quantity, err := decodeRange(req.payload, 125)
+		if err != nil {
+			return nil, err
+		}
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: quantity}
+
+		var registers []uint16
+		if req.functionCode == fcReadHoldingRegisters {
+			registers, err = d.handler.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		} else {
+			registers, err = d.handler.HandleInputRegisters(&modbus.InputRegistersRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     req.unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if len(registers) != int(quantity) {
+			d.wrongCount(clientAddr, req, len(registers), int(quantity))
+			return nil, modbus.ErrServerDeviceFailure
+		}
+
+		decoded.Response.Registers = registers
+		bytes := encodeRegisters(registers)
+		return append([]byte{uint8(len(bytes))}, bytes...), nil
+
+	case fcWriteSingleCoil:
+		if len(req.payload) != 4 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		addr := binary.BigEndian.Uint16(req.payload[0:2])
+		value := binary.BigEndian.Uint16(req.payload[2:4])
+		if value != 0xFF00 && value != 0x0000 {
+			return nil, modbus.ErrIllegalDataValue
+		}
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: 1, Coils: []bool{value == 0xFF00}}
+
+		_, err := d.handler.HandleCoils(&modbus.CoilsRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   1,
+			IsWrite:    true,
+			Args:       []bool{value == 0xFF00},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return req.payload, nil
+
+	case fcWriteSingleRegister:
+		if len(req.payload) != 4 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		addr := binary.BigEndian.Uint16(req.payload[0:2])
+		value := binary.BigEndian.Uint16(req.payload[2:4])
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: 1, Registers: []uint16{value}}
+
+		_, err := d.handler.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   1,
+			IsWrite:    true,
+			Args:       []uint16{value},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return req.payload, nil
+
+	case fcWriteMultipleCoils:
+		addr, quantity, values, err := decodeWrite(req.payload, 0x7B0, func(quantity uint16) int {
+			return (int(quantity) + 7) / 8
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		coils := decodeBools(quantity, values)
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: quantity, Coils: coils}
+
+		_, err = d.handler.HandleCoils(&modbus.CoilsRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   quantity,
+			IsWrite:    true,
+			Args:       coils,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return req.payload[0:4], nil
+
+	case fcWriteMultipleRegisters:
+		addr, quantity, values, err := decodeWrite(req.payload, 0x7B, func(quantity uint16) int {
+			return 2 * int(quantity)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		registers := decodeRegisters(values)
+		*decoded = recording.RecordedRequest{FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: addr, Quantity: quantity, Registers: registers}
+
+		_, err = d.handler.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			UnitId:     req.unitId,
+			Addr:       addr,
+			Quantity:   quantity,
+			IsWrite:    true,
+			Args:       registers,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return req.payload[0:4], nil
+
+	case fcMaskWriteRegister:
+		if len(req.payload) != 6 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		mask := &MaskWriteRegisterRequest{
+			ClientAddr: clientAddr,
+			ClientRole: clientRole,
+			UnitId:     req.unitId,
+			Addr:       binary.BigEndian.Uint16(req.payload[0:2]),
+			AndMask:    binary.BigEndian.Uint16(req.payload[2:4]),
+			OrMask:     binary.BigEndian.Uint16(req.payload[4:6]),
+		}
+		*decoded = recording.RecordedRequest{
+			FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: mask.Addr, Quantity: 1,
+			Registers: []uint16{mask.AndMask, mask.OrMask},
+		}
+
+		err := d.handler.HandleMaskWriteRegister(mask)
+		if err != nil {
+			return nil, err
+		}
+
+		return req.payload, nil
+
+	case fcReadWriteMultipleRegisters:
+		if len(req.payload) < 10 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		readAddr, readQuantity, err := decodeRange(req.payload[0:4], 0x7D)
+		if err != nil {
+			return nil, err
+		}
+
+		writeAddr, _, values, err := decodeWrite(req.payload[4:], 0x79, func(quantity uint16) int {
+			return 2 * int(quantity)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		args := decodeRegisters(values)
+		*decoded = recording.RecordedRequest{
+			FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: readAddr, Quantity: readQuantity,
+			WriteAddr: writeAddr, Registers: args,
+		}
+
+		registers, err := d.handler.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+			ClientAddr:   clientAddr,
+			ClientRole:   clientRole,
+			UnitId:       req.unitId,
+			ReadAddr:     readAddr,
+			ReadQuantity: readQuantity,
+			WriteAddr:    writeAddr,
+			Args:         args,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if len(registers) != int(readQuantity) {
+			d.wrongCount(clientAddr, req, len(registers), int(readQuantity))
+			return nil, modbus.ErrServerDeviceFailure
+		}
+
+		decoded.Response.Registers = registers
+		bytes := encodeRegisters(registers)
+		return append([]byte{uint8(len(bytes))}, bytes...), nil
+
+	case fcEncapsulatedInterface:
+		if len(req.payload) == 0 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		// Read Device Identification is the only MEI type served
+		if req.payload[0] != meiReadDeviceIdentification {
+			return nil, modbus.ErrIllegalFunction
+		}
+
+		if len(req.payload) != 3 {
+			return nil, modbus.ErrProtocolError
+		}
+
+		code := req.payload[1]
+		if code < ReadDeviceIdBasic || code > ReadDeviceIdIndividual {
+			return nil, modbus.ErrIllegalDataValue
+		}
+		*decoded = recording.RecordedRequest{
+			FunctionCode: req.functionCode, UnitId: req.unitId, ClientAddr: clientAddr, Addr: uint16(req.payload[2]),
+			ReadDeviceIdCode: code,
+		}
+
+		result, err := d.handler.HandleDeviceIdentification(&DeviceIdentificationRequest{
+			ClientAddr:       clientAddr,
+			ClientRole:       clientRole,
+			UnitId:           req.unitId,
+			ReadDeviceIdCode: code,
+			ObjectId:         req.payload[2],
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Objects {
+			decoded.Response.Objects = append(decoded.Response.Objects, recording.RecordedObject{Id: object.Id, Value: object.Value})
+		}
+		decoded.Response.MoreFollows = result.MoreFollows
+		return encodeIdentification(code, result), nil
+	}
+
+	return nil, modbus.ErrIllegalFunction
+}
+
+// wrongCount logs a handler answering a read with the wrong number of
+// values, which is a bug of the handler chain.
+func (d *RequestDispatcher) wrongCount(clientAddr string, req pdu, count int, expected int) {
+	d.logger.Error(
+		"Handler returned the wrong number of values", logging.FieldFunctionCode(req.functionCode), logging.FieldUnitId(req.unitId),
+		logging.FieldClientAddr(clientAddr), logging.FieldCount(count), logging.Field("expected", expected),
+	)
+}
+
+// decodeRange decodes the address and quantity of a read request.
+func decodeRange(payload []byte, maxQuantity uint16) (uint16, uint16, error) {
+	if len(payload) != 4 {
+		return 0, 0, modbus.ErrProtocolError
+	}
+
+	addr := binary.BigEndian.Uint16(payload[0:2])
+	quantity := binary.BigEndian.Uint16(payload[2:4])
+	if quantity == 0 || quantity > maxQuantity {
+		return 0, 0, modbus.ErrIllegalDataValue
+	}
+
+	if uint32(addr)+uint32(quantity)-1 > 0xFFFF {
+		return 0, 0, modbus.ErrIllegalDataAddress
+	}
+
+	return addr, quantity, nil
+}
+
+// decodeWrite decodes the address, quantity and values of a multiple write
+// request, checking the byte count against the quantity.
+func decodeWrite(payload []byte, maxQuantity uint16, byteCount func(uint16) int) (uint16, uint16, []byte, error) {
+	if len(payload) < 6 {
+		return 0, 0, nil, modbus.ErrProtocolError
+	}
+
+	addr, quantity, err := decodeRange(payload[0:4], maxQuantity)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+
+	expected := byteCount(quantity)
+	if int(payload[4]) != expected {
+		return 0, 0, nil, modbus.ErrIllegalDataValue
+	}
+
+	if len(payload)-5 != expected {
+		return 0, 0, nil, modbus.ErrProtocolError
+	}
+
+	return addr, quantity, payload[5:], nil
+}
+
+// encodeIdentification encodes a Read Device Identification response after
+// the function code.
+func encodeIdentification(code uint8, result IdentificationResult) []byte {
+	var moreFollows uint8
+	if result.MoreFollows {
+		moreFollows = 0xFF
+	}
+
+	bytes := []byte{
+		meiReadDeviceIdentification, code, result.ConformityLevel,
+		moreFollows, result.NextObjectId, uint8(len(result.Objects)),
+	}
+	for _, object := range result.Objects {
+		bytes = append(bytes, object.Id, uint8(len(object.Value)))
+		bytes = append(bytes, object.Value...)
+	}
+	return bytes
+}
+
+func encodeBools(values []bool) []byte {
+	result := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value {
+			result[i/8] |= 1 << (i % 8)
+		}
+	}
+	return result
+}
+
+func decodeBools(quantity uint16, bytes []byte) []bool {
+	result := make([]bool, quantity)
+	for i := range result {
+		result[i] = bytes[i/8]&(1<<(i%8)) != 0
+	}
+	return result
+}
+
+func encodeRegisters(values []uint16) []byte {
+	result := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(result[2*i:], value)
+	}
+	return result
+}
+
+func decodeRegisters(bytes []byte) []uint16 {
+	result := make([]uint16, len(bytes)/2)
+	for i := range result {
+		result[i] = binary.BigEndian.Uint16(bytes[2*i:])
+	}
+	return result
+}
@@ -1,18 +1,19 @@
 package main
 
 import (
-	"log"
-
+	"github.com/aveplen/mirea-modbus/internal/logging"
 	"github.com/simonvetter/modbus"
 )
 
 type FallbackMiddleware struct {
-	base modbus.RequestHandler
+	base   RequestHandler
+	logger *logging.Logger
 }
 
-func NewFallbackMiddleware(base modbus.RequestHandler) *FallbackMiddleware {
+func NewFallbackMiddleware(base RequestHandler, logger *logging.Logger) *FallbackMiddleware {
 	middleware := &FallbackMiddleware{
-		base: base,
+		base:   base,
+		logger: logger,
 	}
 
 	return middleware
@@ -20,40 +21,62 @@ func NewFallbackMiddleware(base modbus.RequestHandler) *FallbackMiddleware {
 
 func (h *FallbackMiddleware) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
 	coils, err := h.base.HandleCoils(req)
-	if coils != nil {
+	if coils != nil || err != nil {
 		return coils, err
 	}
 
-	log.Printf("HandleCoils returned 'nil' instead of coils, falling back to []bool{false}")
+	h.logger.Debug("HandleCoils returned 'nil' instead of coils, falling back to []bool{false}", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
 	return []bool{false}, err
 }
 
 func (h *FallbackMiddleware) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
 	inputs, err := h.base.HandleDiscreteInputs(req)
-	if inputs != nil {
+	if inputs != nil || err != nil {
 		return inputs, err
 	}
 
-	log.Printf("HandleDiscreteInputs returned 'nil' instead of inputs, falling back to []bool{false}")
+	h.logger.Debug("HandleDiscreteInputs returned 'nil' instead of inputs, falling back to []bool{false}", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
 	return []bool{false}, err
 }
 
 func (h *FallbackMiddleware) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
 	registers, err := h.base.HandleHoldingRegisters(req)
-	if registers != nil {
+	if registers != nil || err != nil {
 		return registers, err
 	}
 
-	log.Printf("HandleHoldingRegisters returned 'nil' instead of registers, falling back to []uint16{0}")
+	h.logger.Debug("HandleHoldingRegisters returned 'nil' instead of registers, falling back to []uint16{0}", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
 	return []uint16{0}, err
 }
 
 func (h *FallbackMiddleware) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
 	registers, err := h.base.HandleInputRegisters(req)
-	if registers != nil {
+	if registers != nil || err != nil {
 		return registers, err
 	}
 
-	log.Printf("HandleInputRegisters returned 'nil' instead of registers, falling back to []uint16{0}")
+	h.logger.Debug("HandleInputRegisters returned 'nil' instead of registers, falling back to []uint16{0}", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
 	return []uint16{0}, err
 }
+
+func (h *FallbackMiddleware) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	return h.base.HandleMaskWriteRegister(req)
+}
+
+func (h *FallbackMiddleware) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	registers, err := h.base.HandleReadWriteRegisters(req)
+	if registers != nil || err != nil {
+		return registers, err
+	}
+
+	h.logger.Debug("HandleReadWriteRegisters returned 'nil' instead of registers, falling back to zeros", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+	return make([]uint16, req.ReadQuantity), nil
+}
+
+func (h *FallbackMiddleware) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	return h.base.HandleDeviceIdentification(req)
+}
+
+func (h *FallbackMiddleware) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	return h.base.HandleDiagnostics(req)
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/simonvetter/modbus"
+)
+
+// ErrDropResponse is returned by the handler chain when the request must
+// not be answered at all, so the client runs into its timeout.
+var ErrDropResponse = errors.New("response dropped")
+
+// FaultsConfig describes the faults injected into the answers of the
+// server, to test how clients cope with slow, busy or silent devices.
+type FaultsConfig struct {
+	// Enabled injects faults from startup on. They can be toggled at
+	// runtime either way.
+	Enabled bool `json:"enabled"`
+	// Seed seeds the random choices, so that a run can be repeated. Zero
+	// seeds from the clock.
+	Seed int64 `json:"seed"`
+	// Rules are tried in order, the first one that matches a request and
+	// fires is applied.
+	Rules []FaultRule `json:"rules"`
+}
+
+// FaultRule tells which requests are affected and what happens to them.
+type FaultRule struct {
+	// Name identifies the rule in the log, its index is used when empty.
+	Name string `json:"name"`
+
+	// FunctionCodes limits the rule to these function codes. A write of a
+	// single coil or register matches both its single and multiple write
+	// codes, the handler chain can't tell them apart.
+	FunctionCodes []uint8 `json:"function_codes"`
+	// UnitIds limits the rule to these units.
+	UnitIds []uint8 `json:"unit_ids"`
+	// Ranges limits the rule to requests touching one of these address
+	// ranges. Read Device Identification and the diagnostics never match a
+	// rule with ranges.
+	Ranges []AddressRange `json:"ranges"`
+
+	// Probability is the chance a matching request is affected, zero
+	// affects every one.
+	Probability float64 `json:"probability"`
+	// Every affects only every n-th matching request.
+	Every uint `json:"every"`
+	// Period and Active make the rule active for the first Active of every
+	// Period, counted from the moment faults were enabled, e.g. a 5s outage
+	// every minute. Zero period keeps the rule always active.
+	Period Duration `json:"period"`
+	Active Duration `json:"active"`
+
+	// Latency delays the answer, plus a random part up to Jitter.
+	Latency Duration `json:"latency"`
+	Jitter  Duration `json:"jitter"`
+	// Exceptions answers with one of these exception codes, picked at random
+	// or, with Cycle, in turn.
+	Exceptions []uint8 `json:"exceptions"`
+	Cycle      bool    `json:"cycle"`
+	// Drop leaves the request unanswered.
+	Drop bool `json:"drop"`
+}
+
+// Validate reports the problems of the fault injection settings.
+func (c FaultsConfig) Validate() []string {
+	problems := make([]string, 0)
+	for i, rule := range c.Rules {
+		if !rule.Drop && len(rule.Exceptions) == 0 && rule.Latency == 0 && rule.Jitter == 0 {
+			problems = append(problems, fmt.Sprintf("rules[%d]: does nothing, set latency, jitter, exceptions or drop", i))
+		}
+
+		for _, problem := range rule.Validate() {
+			problems = append(problems, fmt.Sprintf("rules[%d].%s", i, problem))
+		}
+	}
+	return problems
+}
+
+// Validate reports the problems of the rule.
+func (r FaultRule) Validate() []string {
+	problems := make([]string, 0)
+
+	for i, code := range r.FunctionCodes {
+		if !containsUint8(chainFunctionCodes, code) {
+			problems = append(problems, fmt.Sprintf("function_codes[%d]: 0x%02X is not a function code faults can be injected into", i, code))
+		}
+	}
+
+	for i, id := range r.UnitIds {
+		if id == 0 {
+			problems = append(problems, fmt.Sprintf("unit_ids[%d]: broadcasts are never answered", i))
+		}
+	}
+
+	for i, rng := range r.Ranges {
+		for _, problem := range rng.Validate() {
+			problems = append(problems, fmt.Sprintf("ranges[%d].%s", i, problem))
+		}
+	}
+
+	if r.Probability < 0 || r.Probability > 1 {
+		problems = append(problems, fmt.Sprintf("probability: must be between 0 and 1, got %v", r.Probability))
+	}
+
+	if r.Period < 0 {
+		problems = append(problems, fmt.Sprintf("period: must not be negative, got %v", time.Duration(r.Period)))
+	}
+
+	if r.Period > 0 && (r.Active <= 0 || r.Active > r.Period) {
+		problems = append(problems, fmt.Sprintf("active: must be positive and at most the period, got %v", time.Duration(r.Active)))
+	} else if r.Period == 0 && r.Active != 0 {
+		problems = append(problems, "active: requires a period")
+	}
+
+	if r.Latency < 0 {
+		problems = append(problems, fmt.Sprintf("latency: must not be negative, got %v", time.Duration(r.Latency)))
+	}
+
+	if r.Jitter < 0 {
+		problems = append(problems, fmt.Sprintf("jitter: must not be negative, got %v", time.Duration(r.Jitter)))
+	}
+
+	for i, code := range r.Exceptions {
+		if _, ok := modbusclient.ExceptionByCode(code); !ok {
+			problems = append(problems, fmt.Sprintf("exceptions[%d]: 0x%02X is not a known exception code", i, code))
+		}
+	}
+
+	if r.Drop && len(r.Exceptions) != 0 {
+		problems = append(problems, "drop: a dropped request can not be answered with an exception")
+	}
+
+	return problems
+}
+
+// faultRequest is what the rules are matched against.
+type faultRequest struct {
+	clientAddr string
+	unitId     uint8
+	// functionCodes are the codes the request may have been sent with.
+	functionCodes []uint8
+	table         string
+	// spans are the addresses the request touches, two for Read/Write
+	// Multiple Registers.
+	spans []addressSpan
+}
+
+type addressSpan struct {
+	addr     uint16
+	quantity uint16
+}
+
+// faultRule is a rule with the state of its schedule.
+type faultRule struct {
+	FaultRule
+	name  string
+	count uint
+	next  int
+}
+
+func (r *faultRule) matches(req faultRequest) bool {
+	if len(r.UnitIds) != 0 && !containsUint8(r.UnitIds, req.unitId) {
+		return false
+	}
+
+	if len(r.FunctionCodes) != 0 {
+		found := false
+		for _, code := range req.functionCodes {
+			found = found || containsUint8(r.FunctionCodes, code)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(r.Ranges) == 0 {
+		return true
+	}
+
+	for _, span := range req.spans {
+		last := uint32(span.addr) + uint32(span.quantity) - 1
+		for _, rng := range r.Ranges {
+			if rng.Table == req.table && uint32(rng.Start) <= last && rng.End >= span.addr {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// faultRandom makes the random choices of the rules, a seeded *rand.Rand
+// outside tests.
+type faultRandom interface {
+	Float64() float64
+	Int63n(n int64) int64
+	Intn(n int) int
+}
+
+// FaultInjectionMiddleware delays, fails or drops the requests matched by
+// the fault rules while enabled, and passes everything else through.
+type FaultInjectionMiddleware struct {
+	base   RequestHandler
+	logger *logging.Logger
+	// now and sleep are the clock of the schedules and the delay of the
+	// answers, replaced in tests.
+	now   func() time.Time
+	sleep func(time.Duration)
+
+	lock    sync.Mutex
+	rules   []*faultRule
+	random  faultRandom
+	enabled bool
+	since   time.Time
+}
+
+func NewFaultInjectionMiddleware(base RequestHandler, config FaultsConfig, logger *logging.Logger) *FaultInjectionMiddleware {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	middleware := &FaultInjectionMiddleware{
+		base:   base,
+		logger: logger,
+		now:    time.Now,
+		sleep:  time.Sleep,
+		rules:  make([]*faultRule, 0, len(config.Rules)),
+		random: rand.New(rand.NewSource(seed)),
+	}
+
+	for i, rule := range config.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		middleware.rules = append(middleware.rules, &faultRule{FaultRule: rule, name: name})
+	}
+
+	middleware.SetEnabled(config.Enabled)
+	return middleware
+}
+
+// Enabled tells whether faults are being injected.
+func (h *FaultInjectionMiddleware) Enabled() bool {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.enabled
+}
+
+// SetEnabled turns fault injection on or off. Turning it on restarts the
+// schedules and counters of every rule.
+func (h *FaultInjectionMiddleware) SetEnabled(enabled bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if enabled && !h.enabled {
+		h.since = h.now()
+		for _, rule := range h.rules {
+			rule.count = 0
+			rule.next = 0
+		}
+	}
+	h.enabled = enabled
+}
+
+// RuleCount returns the number of configured rules.
+func (h *FaultInjectionMiddleware) RuleCount() int {
+	return len(h.rules)
+}
+
+// injectedFault is what a rule does to a single request.
+type injectedFault struct {
+	rule    string
+	latency time.Duration
+	err     error
+}
+
+// fault picks the rule applied to the request, if any.
+func (h *FaultInjectionMiddleware) fault(req faultRequest) *injectedFault {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if !h.enabled {
+		return nil
+	}
+
+	elapsed := h.now().Sub(h.since)
+	for _, rule := range h.rules {
+		if !rule.matches(req) {
+			continue
+		}
+
+		if rule.Period > 0 && elapsed%time.Duration(rule.Period) >= time.Duration(rule.Active) {
+			continue
+		}
+
+		rule.count++
+		if rule.Every > 1 && rule.count%rule.Every != 0 {
+			continue
+		}
+
+		if rule.Probability > 0 && h.random.Float64() >= rule.Probability {
+			continue
+		}
+
+		latency := time.Duration(rule.Latency)
+		if rule.Jitter > 0 {
+			latency += time.Duration(h.random.Int63n(int64(rule.Jitter) + 1))
+		}
+
+		var err error
+		switch {
+		case rule.Drop:
+			err = ErrDropResponse
+
+		case len(rule.Exceptions) != 0:
+			i := 0
+			if rule.Cycle {
+				i = rule.next
+				rule.next = (rule.next + 1) % len(rule.Exceptions)
+			} else if len(rule.Exceptions) > 1 {
+				i = h.random.Intn(len(rule.Exceptions))
+			}
+			err = exceptionError(rule.Exceptions[i])
+		}
+
+		return &injectedFault{rule: rule.name, latency: latency, err: err}
+	}
+
+	return nil
+}
+
+// inject applies the fault picked for the request. A nil error lets the
+// request through to the base handler.
+func (h *FaultInjectionMiddleware) inject(req faultRequest) error {
+	fault := h.fault(req)
+	if fault == nil {
+		return nil
+	}
+
+	var effects []string
+	if fault.latency > 0 {
+		effects = append(effects, fmt.Sprintf("latency %v", fault.latency))
+	}
+	if errors.Is(fault.err, ErrDropResponse) {
+		effects = append(effects, "no response")
+	} else if fault.err != nil {
+		effects = append(effects, fmt.Sprintf("exception 0x%02X", exceptionCode(fault.err)))
+	}
+	fields := []logging.LogField{logging.Field("rule", fault.rule), logging.FieldFunctionCode(req.functionCodes[0]), logging.FieldUnitId(req.unitId)}
+	fields = append(fields, logging.FieldClientAddr(req.clientAddr))
+	if len(req.spans) != 0 {
+		fields = append(fields, logging.FieldAddr(req.spans[0].addr), logging.FieldCount(int(req.spans[0].quantity)))
+	}
+	h.logger.Info("Inject fault", append(fields, logging.Field("effects", strings.Join(effects, ", ")))...)
+
+	h.sleep(fault.latency)
+	return fault.err
+}
+
+func (h *FaultInjectionMiddleware) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: boolFunctionCodes(fcReadCoils, req.IsWrite, req.Quantity),
+		table:         coilsSection.name,
+		spans:         []addressSpan{{req.Addr, req.Quantity}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleCoils(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{fcReadDiscreteInputs},
+		table:         discreteInputsSection.name,
+		spans:         []addressSpan{{req.Addr, req.Quantity}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleDiscreteInputs(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: registerFunctionCodes(fcReadHoldingRegisters, req.IsWrite, req.Quantity),
+		table:         holdingRegistersSection.name,
+		spans:         []addressSpan{{req.Addr, req.Quantity}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleHoldingRegisters(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{fcReadInputRegisters},
+		table:         inputRegistersSection.name,
+		spans:         []addressSpan{{req.Addr, req.Quantity}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleInputRegisters(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{fcMaskWriteRegister},
+		table:         holdingRegistersSection.name,
+		spans:         []addressSpan{{req.Addr, 1}},
+	})
+	if err != nil {
+		return err
+	}
+	return h.base.HandleMaskWriteRegister(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{fcReadWriteMultipleRegisters},
+		table:         holdingRegistersSection.name,
+		spans: []addressSpan{
+			{req.ReadAddr, req.ReadQuantity},
+			{req.WriteAddr, uint16(len(req.Args))},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleReadWriteRegisters(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{fcEncapsulatedInterface},
+	})
+	if err != nil {
+		return IdentificationResult{}, err
+	}
+	return h.base.HandleDeviceIdentification(req)
+}
+
+func (h *FaultInjectionMiddleware) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	err := h.inject(faultRequest{
+		unitId:        req.UnitId,
+		clientAddr:    req.ClientAddr,
+		functionCodes: []uint8{req.FunctionCode},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return h.base.HandleDiagnostics(req)
+}
+
+func containsUint8(values []uint8, value uint8) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// scriptedRandom returns the queued values in order instead of random ones.
+type scriptedRandom struct {
+	t      *testing.T
+	floats []float64
+	ints   []int64
+	// bounds are the arguments of Int63n and Intn, in order.
+	bounds []int64
+}
+
+func (r *scriptedRandom) Float64() float64 {
+	if len(r.floats) == 0 {
+		r.t.Fatal("no random float queued")
+	}
+	f := r.floats[0]
+	r.floats = r.floats[1:]
+	return f
+}
+
+func (r *scriptedRandom) Int63n(n int64) int64 {
+	if len(r.ints) == 0 {
+		r.t.Fatal("no random int queued")
+	}
+	i := r.ints[0]
+	r.ints = r.ints[1:]
+	r.bounds = append(r.bounds, n)
+	return i
+}
+
+func (r *scriptedRandom) Intn(n int) int {
+	return int(r.Int63n(int64(n)))
+}
+
+// testFaults is a fault injection middleware serving coil 10, input register
+// 30 and holding registers 100 to 109 of units 1 and 2.
+type testFaults struct {
+	*FaultInjectionMiddleware
+	clock  *testClock
+	random *scriptedRandom
+	// sleeps are the latencies injected.
+	sleeps []time.Duration
+}
+
+func newTestFaults(t *testing.T, rules ...FaultRule) *testFaults {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	router := NewUnitRouter(nil, logger)
+	for _, unitId := range []uint8{1, 2} {
+		holding := make([]Register, 0, 10)
+		for addr := uint16(100); addr < 110; addr++ {
+			holding = append(holding, Register{addr: addr})
+		}
+		service := NewModbusService(Dump{
+			Coils:            []Coil{{addr: 10}},
+			InputRegisters:   []Register{{addr: 30}},
+			HoldingRegisters: holding,
+		})
+		router.AddUnit(unitId, NewAdapterHandler(NewModbusHandler(service, nil, logger), logger))
+	}
+
+	faults := &testFaults{
+		FaultInjectionMiddleware: NewFaultInjectionMiddleware(router, FaultsConfig{Rules: rules}, logger),
+		clock:                    &testClock{at: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	faults.random = &scriptedRandom{t: t}
+	faults.FaultInjectionMiddleware.random = faults.random
+	faults.now = faults.clock.now
+	faults.sleep = func(d time.Duration) {
+		faults.sleeps = append(faults.sleeps, d)
+	}
+	faults.SetEnabled(true)
+	return faults
+}
+
+func readHoldingFault(t *testing.T, faults *testFaults, unitId uint8, addr uint16, quantity uint16) error {
+	t.Helper()
+
+	_, err := faults.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: unitId, Addr: addr, Quantity: quantity})
+	if err != nil && !errors.Is(err, modbus.ErrServerDeviceFailure) && !errors.Is(err, ErrDropResponse) {
+		t.Fatalf("read %d registers at %d: %v", quantity, addr, err)
+	}
+	return err
+}
+
+// faulted tells which of n reads of holding register 100 of unit 1 were
+// failed.
+func faulted(t *testing.T, faults *testFaults, n int) []bool {
+	t.Helper()
+
+	got := make([]bool, 0, n)
+	for i := 0; i < n; i++ {
+		got = append(got, readHoldingFault(t, faults, 1, 100, 1) != nil)
+	}
+	return got
+}
+
+func TestFaultRuleMatching(t *testing.T) {
+	fail := []uint8{0x04}
+	holding := holdingRegistersSection.name
+
+	tests := []struct {
+		name string
+		rule FaultRule
+		send func(h *FaultInjectionMiddleware) error
+		want bool
+	}{
+		{
+			"any request", FaultRule{Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleInputRegisters(&modbus.InputRegistersRequest{UnitId: 1, Addr: 30, Quantity: 1})
+				return err
+			},
+			true,
+		},
+		{
+			"function code", FaultRule{FunctionCodes: []uint8{fcReadHoldingRegisters}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 1})
+				return err
+			},
+			true,
+		},
+		{
+			"other function code", FaultRule{FunctionCodes: []uint8{fcReadHoldingRegisters}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleInputRegisters(&modbus.InputRegistersRequest{UnitId: 1, Addr: 30, Quantity: 1})
+				return err
+			},
+			false,
+		},
+		{
+			"single write matches multiple write code", FaultRule{FunctionCodes: []uint8{fcWriteMultipleCoils}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleCoils(&modbus.CoilsRequest{UnitId: 1, Addr: 10, Quantity: 1, IsWrite: true, Args: []bool{true}})
+				return err
+			},
+			true,
+		},
+		{
+			"multiple write doesn't match single write code", FaultRule{FunctionCodes: []uint8{fcWriteSingleRegister}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+					UnitId: 1, Addr: 100, Quantity: 2, IsWrite: true, Args: []uint16{1, 2},
+				})
+				return err
+			},
+			false,
+		},
+		{
+			"other unit", FaultRule{UnitIds: []uint8{2}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 1})
+				return err
+			},
+			false,
+		},
+		{
+			"request overlaps the range", FaultRule{Ranges: []AddressRange{{Table: holding, Start: 105, End: 107}}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 6})
+				return err
+			},
+			true,
+		},
+		{
+			"request ends before the range", FaultRule{Ranges: []AddressRange{{Table: holding, Start: 105, End: 107}}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 5})
+				return err
+			},
+			false,
+		},
+		{
+			"request starts after the range", FaultRule{Ranges: []AddressRange{{Table: holding, Start: 105, End: 107}}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 108, Quantity: 2})
+				return err
+			},
+			false,
+		},
+		{
+			"range of another table", FaultRule{Ranges: []AddressRange{{Table: inputRegistersSection.name, Start: 100, End: 109}}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 1})
+				return err
+			},
+			false,
+		},
+		{
+			"write span of read/write multiple", FaultRule{Ranges: []AddressRange{{Table: holding, Start: 108, End: 108}}, Exceptions: fail},
+			func(h *FaultInjectionMiddleware) error {
+				_, err := h.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+					UnitId: 1, ReadAddr: 100, ReadQuantity: 2, WriteAddr: 107, Args: []uint16{1, 2},
+				})
+				return err
+			},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			faults := newTestFaults(t, test.rule)
+
+			err := test.send(faults.FaultInjectionMiddleware)
+			if err != nil && !errors.Is(err, modbus.ErrServerDeviceFailure) {
+				t.Fatal(err)
+			}
+			if got := err != nil; got != test.want {
+				t.Errorf("faulted %v, want %v", got, test.want)
+			}
+		})
+	}
+
+	// Read Device Identification has no addresses to match ranges
+	faults := newTestFaults(t, FaultRule{Ranges: []AddressRange{{Table: holding, Start: 0, End: 65535}}, Exceptions: fail})
+	if fault := faults.fault(faultRequest{unitId: 1, functionCodes: []uint8{fcEncapsulatedInterface}}); fault != nil {
+		t.Errorf("device identification matched a rule with ranges: %+v", fault)
+	}
+}
+
+func TestFaultDisabled(t *testing.T) {
+	faults := newTestFaults(t, FaultRule{Exceptions: []uint8{0x04}})
+
+	faults.SetEnabled(false)
+	if got := faulted(t, faults, 1); got[0] {
+		t.Error("fault injected while disabled")
+	}
+
+	faults.SetEnabled(true)
+	if got := faulted(t, faults, 1); !got[0] {
+		t.Error("no fault injected once enabled again")
+	}
+}
+
+func TestFaultProbability(t *testing.T) {
+	faults := newTestFaults(t,
+		FaultRule{Name: "unlikely", Probability: 0.25, Drop: true},
+		FaultRule{Name: "likely", Probability: 0.5, Exceptions: []uint8{0x04}},
+	)
+
+	// a rule that doesn't fire leaves the request to the next one
+	faults.random.floats = []float64{0.1, 0.3, 0.4, 0.25, 0.49, 0.25, 0.5, 0.9, 0.7}
+	tests := []struct {
+		name string
+		want error
+	}{
+		{"below the first", ErrDropResponse},
+		{"below the second", modbus.ErrServerDeviceFailure},
+		{"at the first", modbus.ErrServerDeviceFailure},
+		{"at each probability", nil},
+		{"above both", nil},
+	}
+
+	for _, test := range tests {
+		if err := readHoldingFault(t, faults, 1, 100, 1); !errors.Is(err, test.want) && !(err == nil && test.want == nil) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.want)
+		}
+	}
+	if len(faults.random.floats) != 0 {
+		t.Errorf("%d random floats left", len(faults.random.floats))
+	}
+}
+
+func TestFaultEvery(t *testing.T) {
+	faults := newTestFaults(t, FaultRule{Every: 3, Exceptions: []uint8{0x04}})
+
+	want := []bool{false, false, true, false, false, true, false}
+	if got := faulted(t, faults, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("faulted %v, want %v", got, want)
+	}
+
+	// enabling restarts the count
+	faults.SetEnabled(false)
+	faults.SetEnabled(true)
+	if got := faulted(t, faults, 3); !reflect.DeepEqual(got, want[:3]) {
+		t.Errorf("faulted %v after enabling again, want %v", got, want[:3])
+	}
+}
+
+func TestFaultSchedule(t *testing.T) {
+	faults := newTestFaults(t, FaultRule{Period: Duration(10 * time.Second), Active: Duration(2 * time.Second), Exceptions: []uint8{0x04}})
+
+	steps := []struct {
+		advance time.Duration
+		want    bool
+	}{
+		{0, true},
+		{1999 * time.Millisecond, true},
+		{time.Millisecond, false},
+		{7999 * time.Millisecond, false},
+		{time.Millisecond, true},
+		{2 * time.Second, false},
+	}
+
+	for _, step := range steps {
+		faults.clock.advance(step.advance)
+		elapsed := faults.clock.now().Sub(faults.since)
+		if got := faulted(t, faults, 1)[0]; got != step.want {
+			t.Errorf("%v after enabling: faulted %v, want %v", elapsed, got, step.want)
+		}
+	}
+
+	// the schedule starts over when enabled again
+	faults.SetEnabled(false)
+	faults.SetEnabled(true)
+	if got := faulted(t, faults, 1)[0]; !got {
+		t.Error("not faulted right after enabling again")
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	faults := newTestFaults(t,
+		FaultRule{FunctionCodes: []uint8{fcReadHoldingRegisters}, Latency: Duration(100 * time.Millisecond), Jitter: Duration(50 * time.Millisecond)},
+		FaultRule{FunctionCodes: []uint8{fcReadInputRegisters}, Latency: Duration(time.Second)},
+	)
+	faults.random.ints = []int64{int64(20 * time.Millisecond)}
+
+	// a delayed request is still answered
+	if err := readHoldingFault(t, faults, 1, 100, 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := faults.HandleInputRegisters(&modbus.InputRegistersRequest{UnitId: 1, Addr: 30, Quantity: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []time.Duration{120 * time.Millisecond, time.Second}; !reflect.DeepEqual(faults.sleeps, want) {
+		t.Errorf("slept %v, want %v", faults.sleeps, want)
+	}
+	// the jitter may be anything up to and including its maximum
+	if want := []int64{int64(50*time.Millisecond) + 1}; !reflect.DeepEqual(faults.random.bounds, want) {
+		t.Errorf("jitter drawn below %v, want below %v", faults.random.bounds, want)
+	}
+}
+
+func TestFaultDrop(t *testing.T) {
+	faults := newTestFaults(t, FaultRule{Latency: Duration(time.Second), Drop: true})
+
+	_, err := faults.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+		UnitId: 1, Addr: 100, Quantity: 1, IsWrite: true, Args: []uint16{0x1234},
+	})
+	if !errors.Is(err, ErrDropResponse) {
+		t.Fatalf("got %v, want %v", err, ErrDropResponse)
+	}
+	if want := []time.Duration{time.Second}; !reflect.DeepEqual(faults.sleeps, want) {
+		t.Errorf("slept %v, want %v", faults.sleeps, want)
+	}
+
+	// the dropped write never reached the registers
+	faults.SetEnabled(false)
+	values, err := faults.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: 100, Quantity: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != 0 {
+		t.Errorf("dropped write applied, register is 0x%04X", values[0])
+	}
+}
+
+func TestFaultExceptions(t *testing.T) {
+	exceptions := []uint8{0x04, 0x06, 0x0B}
+	want := []error{modbus.ErrServerDeviceFailure, modbus.ErrServerDeviceBusy, modbus.ErrGWTargetFailedToRespond}
+
+	random := newTestFaults(t, FaultRule{Exceptions: exceptions})
+	random.random.ints = []int64{2, 0, 1}
+	cycle := newTestFaults(t, FaultRule{Exceptions: exceptions, Cycle: true})
+
+	for i, faults := range []*testFaults{random, cycle} {
+		got := make([]error, 0, len(want))
+		for j := 0; j < len(want); j++ {
+			_, err := faults.HandleInputRegisters(&modbus.InputRegistersRequest{UnitId: 1, Addr: 30, Quantity: 1})
+			got = append(got, err)
+		}
+
+		expected := want
+		if i == 0 {
+			expected = []error{want[2], want[0], want[1]}
+		}
+		for j := range expected {
+			if !errors.Is(got[j], expected[j]) {
+				t.Errorf("cycle %v, request %d: got %v, want %v", i == 1, j+1, got[j], expected[j])
+			}
+		}
+	}
+
+	if want := []int64{3, 3, 3}; !reflect.DeepEqual(random.random.bounds, want) {
+		t.Errorf("exceptions drawn below %v, want below %v", random.random.bounds, want)
+	}
+}
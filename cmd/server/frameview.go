@@ -0,0 +1,137 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/lxn/walk"
+	d "github.com/lxn/walk/declarative"
+)
+
+// frameViewFrames is how many frames the frame view keeps for display and
+// saving.
+const frameViewFrames = 500
+
+// FrameView shows the hex dump of the frames captured while its capture
+// check box is checked.
+type FrameView struct {
+	TextEdit        *d.TextEdit
+	CaptureCheckBox *d.CheckBox
+	frameEdit       *walk.TextEdit
+	captureCheckBox *walk.CheckBox
+	logger          *logging.Logger
+
+	lock    sync.Mutex
+	enabled bool
+	// frames grows to a quarter more than frameViewFrames before the oldest
+	// are dropped and the text edit is rebuilt, so neither grows much.
+	frames []capture.CapturedFrame
+}
+
+func (c *FrameView) Record(frame capture.CapturedFrame) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !c.enabled {
+		return
+	}
+
+	c.frames = append(c.frames, frame)
+	if len(c.frames) >= frameViewFrames+frameViewFrames/4 {
+		c.frames = append(c.frames[:0], c.frames[len(c.frames)-frameViewFrames:]...)
+		c.render()
+		return
+	}
+
+	c.frameEdit.AppendText(capture.FormatFrame(frame))
+	c.frameEdit.SetTextSelection(len(c.frameEdit.Text())+1, 0)
+}
+
+func (c *FrameView) render() {
+	var text strings.Builder
+	for _, frame := range c.frames {
+		text.WriteString(capture.FormatFrame(frame))
+	}
+
+	c.frameEdit.SetText(text.String())
+	c.frameEdit.SetTextSelection(len(c.frameEdit.Text())+1, 0)
+}
+
+// ToggleCapture starts or stops keeping frames, those kept stay shown.
+func (c *FrameView) ToggleCapture() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.enabled = c.captureCheckBox.Checked()
+}
+
+func (c *FrameView) ClearFrames() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.frames = nil
+	c.frameEdit.SetText("")
+}
+
+// SaveFrames writes the frames kept to a pcap or text capture file picked
+// by the user.
+func (c *FrameView) SaveFrames() {
+	c.lock.Lock()
+	frames := append([]capture.CapturedFrame(nil), c.frames...)
+	c.lock.Unlock()
+
+	dialog := &walk.FileDialog{
+		Title:  "Save frames",
+		Filter: "pcap files (*.pcap)|*.pcap|Text files (*.txt)|*.txt",
+	}
+
+	ok, err := dialog.ShowSave(c.frameEdit.Form())
+	if err != nil {
+		c.logger.Error("Could not open save dialog", logging.FieldError(err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	path, format, ext := dialog.FilePath, capture.CaptureFormatPcap, ".pcap"
+	if dialog.FilterIndex == 2 {
+		format, ext = capture.CaptureFormatText, ".txt"
+	}
+	if filepath.Ext(path) == "" {
+		path += ext
+	}
+
+	if err := capture.WriteCaptureFile(path, format, frames); err != nil {
+		c.logger.Error("Could not save frames", logging.Field("path", path), logging.FieldError(err))
+		return
+	}
+
+	c.logger.Info("Saved frames", logging.Field("path", path), logging.FieldCount(len(frames)))
+}
+
+func NewFrameView(logger *logging.Logger) *FrameView {
+	fv := &FrameView{logger: logger}
+
+	fv.TextEdit = &d.TextEdit{
+		AssignTo: &fv.frameEdit,
+		ReadOnly: true,
+		VScroll:  true,
+		HScroll:  true,
+		MinSize:  d.Size{Height: 250},
+		Font:     d.Font{Family: "Consolas", PointSize: 9},
+	}
+
+	fv.CaptureCheckBox = &d.CheckBox{
+		AssignTo:         &fv.captureCheckBox,
+		Text:             "Capture",
+		OnCheckedChanged: fv.ToggleCapture,
+	}
+
+	return fv
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// gatewayCacheSize is how many reads the cache of a unit holds before
+// expired ones are dropped.
+const gatewayCacheSize = 1024
+
+// GatewayConfig forwards the requests of a unit to an upstream device, so
+// the simulator can be put in front of real hardware to patch its values or
+// inject faults.
+type GatewayConfig struct {
+	UpstreamConfig
+	// UnitId is the unit id of the upstream device, zero keeps the unit id
+	// of the request.
+	UnitId uint8 `json:"unit_id"`
+	// Forward limits forwarding to these address ranges, the other
+	// addresses are served from the seed of the unit. Empty forwards every
+	// address, and Read Device Identification too.
+	Forward []AddressRange `json:"forward"`
+	// Overrides are served from the seed of the unit even within forwarded
+	// ranges.
+	Overrides []AddressRange `json:"overrides"`
+	// Cache is how long upstream reads are answered again without asking
+	// the device, zero disables caching. Writes forwarded by the unit drop
+	// its cache.
+	Cache Duration `json:"cache"`
+}
+
+// AddressRange is a range of addresses of one data table, from Start to End
+// inclusive. Table is named like the seed sections: "coils",
+// "discrete_inputs", "holding_registers" or "input_registers".
+type AddressRange struct {
+	Table string `json:"table"`
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+}
+
+func (r AddressRange) contains(table string, addr uint16) bool {
+	return r.Table == table && addr >= r.Start && addr <= r.End
+}
+
+// Validate reports the problems of the range.
+func (r AddressRange) Validate() []string {
+	problems := make([]string, 0)
+
+	switch r.Table {
+	case coilsSection.name, discreteInputsSection.name, holdingRegistersSection.name, inputRegistersSection.name:
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"table: %q is not one of %s, %s, %s, %s",
+			r.Table,
+			coilsSection.name, discreteInputsSection.name, holdingRegistersSection.name, inputRegistersSection.name,
+		))
+	}
+
+	if r.End < r.Start {
+		problems = append(problems, fmt.Sprintf("end: 0x%X is before start 0x%X", r.End, r.Start))
+	}
+
+	return problems
+}
+
+// Validate reports the problems of the gateway settings.
+func (c GatewayConfig) Validate() []string {
+	problems := c.UpstreamConfig.Validate()
+
+	ranges := []struct {
+		name   string
+		ranges []AddressRange
+	}{
+		{"forward", c.Forward},
+		{"overrides", c.Overrides},
+	}
+
+	for _, list := range ranges {
+		for i, r := range list.ranges {
+			for _, problem := range r.Validate() {
+				problems = append(problems, fmt.Sprintf("%s[%d].%s", list.name, i, problem))
+			}
+		}
+	}
+
+	if c.Cache < 0 {
+		problems = append(problems, fmt.Sprintf("cache: must not be negative, got %v", time.Duration(c.Cache)))
+	}
+
+	return problems
+}
+
+// GatewayHandler serves a unit from an upstream device. Every request is
+// split into runs of consecutive addresses that are either forwarded or
+// served by the local handler of the unit, as told by the forward ranges
+// and overrides, and the results are joined back together.
+type GatewayHandler struct {
+	local    RequestHandler
+	upstream *Upstream
+	config   GatewayConfig
+	cache    *gatewayCache
+	logger   *logging.Logger
+}
+
+func NewGatewayHandler(local RequestHandler, upstream *Upstream, config GatewayConfig, logger *logging.Logger) *GatewayHandler {
+	return &GatewayHandler{
+		local:    local,
+		upstream: upstream,
+		config:   config,
+		cache:    newGatewayCache(time.Duration(config.Cache)),
+		logger:   logger,
+	}
+}
+
+// addressRun is a part of a request, offset items from its start, served
+// by a single side of the gateway.
+type addressRun struct {
+	addr     uint16
+	quantity uint16
+	offset   int
+	local    bool
+}
+
+func (h *GatewayHandler) isLocal(table string, addr uint16) bool {
+	for _, r := range h.config.Overrides {
+		if r.contains(table, addr) {
+			return true
+		}
+	}
+
+	if len(h.config.Forward) == 0 {
+		return false
+	}
+
+	for _, r := range h.config.Forward {
+		if r.contains(table, addr) {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *GatewayHandler) runs(table string, addr uint16, quantity uint16) []addressRun {
+	runs := make([]addressRun, 0, 1)
+	for i := 0; i < int(quantity); i++ {
+		current := addr + uint16(i)
+		local := h.isLocal(table, current)
+
+		if len(runs) != 0 && runs[len(runs)-1].local == local {
+			runs[len(runs)-1].quantity++
+			continue
+		}
+		runs = append(runs, addressRun{addr: current, quantity: 1, offset: i, local: local})
+	}
+	return runs
+}
+
+// where tells whether any address of the range is served locally and
+// whether any is forwarded.
+func (h *GatewayHandler) where(table string, addr uint16, quantity uint16) (bool, bool) {
+	var local, forwarded bool
+	for _, run := range h.runs(table, addr, quantity) {
+		local = local || run.local
+		forwarded = forwarded || !run.local
+	}
+	return local, forwarded
+}
+
+func (h *GatewayHandler) unitId(requested uint8) uint8 {
+	if h.config.UnitId != 0 {
+		return h.config.UnitId
+	}
+	return requested
+}
+
+func (h *GatewayHandler) logForward(fc uint8, unitId uint8, addr uint16, quantity uint16) {
+	h.logger.Info(
+		"Forward to upstream", logging.Field("upstream", h.upstream.URL()), logging.FieldFunctionCode(fc),
+		logging.FieldUnitId(h.unitId(unitId)), logging.FieldAddr(addr), logging.FieldCount(int(quantity)),
+	)
+}
+
+// readRuns reads every run from its side, forwarded ones through the cache.
+func readRuns[T bool | uint16](
+	h *GatewayHandler,
+	table string,
+	fc uint8,
+	unitId uint8,
+	addr uint16,
+	quantity uint16,
+	local func(addr uint16, quantity uint16) ([]T, error),
+	upstream func(unitId uint8, addr uint16, quantity uint16) ([]T, error),
+) ([]T, error) {
+	result := make([]T, 0, quantity)
+	for _, run := range h.runs(table, addr, quantity) {
+		if run.local {
+			values, err := local(run.addr, run.quantity)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, values...)
+			continue
+		}
+
+		key := gatewayCacheKey{fc: fc, unitId: unitId, addr: run.addr, quantity: run.quantity}
+		if cached, ok := h.cache.get(key); ok {
+			h.logger.Debug("Answer from upstream cache", logging.FieldFunctionCode(fc), logging.FieldUnitId(unitId), logging.FieldAddr(run.addr), logging.FieldCount(int(run.quantity)))
+			result = append(result, cached.([]T)...)
+			continue
+		}
+
+		h.logForward(fc, unitId, run.addr, run.quantity)
+		values, err := upstream(h.unitId(unitId), run.addr, run.quantity)
+		if err != nil {
+			return nil, err
+		}
+		h.cache.put(key, values)
+		result = append(result, values...)
+	}
+	return result, nil
+}
+
+// writeRuns writes the values to their side. Writes can't be undone on
+// the device, so a write of both local and forwarded addresses is rejected
+// with Illegal Data Address rather than left half done when a side fails.
+func writeRuns[T bool | uint16](
+	h *GatewayHandler,
+	table string,
+	fc uint8,
+	unitId uint8,
+	addr uint16,
+	values []T,
+	local func(addr uint16, values []T) error,
+	upstream func(unitId uint8, addr uint16, values []T) error,
+) error {
+	runs := h.runs(table, addr, uint16(len(values)))
+	if len(runs) > 1 {
+		h.logger.Warn(
+			"Rejecting write of local and forwarded addresses", logging.FieldFunctionCode(fc),
+			logging.FieldUnitId(unitId), logging.FieldAddr(addr), logging.FieldCount(len(values)),
+		)
+		return modbus.ErrIllegalDataAddress
+	}
+
+	for _, run := range runs {
+		part := values[run.offset : run.offset+int(run.quantity)]
+		if run.local {
+			if err := local(run.addr, part); err != nil {
+				return err
+			}
+			continue
+		}
+
+		h.logForward(fc, unitId, run.addr, run.quantity)
+		err := upstream(h.unitId(unitId), run.addr, part)
+		h.cache.clear()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *GatewayHandler) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	local := func(addr uint16, quantity uint16, args []bool) ([]bool, error) {
+		return h.local.HandleCoils(&modbus.CoilsRequest{
+			ClientAddr: req.ClientAddr,
+			ClientRole: req.ClientRole,
+			UnitId:     req.UnitId,
+			Addr:       addr,
+			Quantity:   quantity,
+			IsWrite:    req.IsWrite,
+			Args:       args,
+		})
+	}
+
+	if req.IsWrite {
+		fc := fcWriteMultipleCoils
+		if req.Quantity == 1 {
+			fc = fcWriteSingleCoil
+		}
+
+		return nil, writeRuns(h, coilsSection.name, fc, req.UnitId, req.Addr, req.Args[:req.Quantity],
+			func(addr uint16, values []bool) error {
+				_, err := local(addr, uint16(len(values)), values)
+				return err
+			},
+			h.upstream.WriteCoils,
+		)
+	}
+
+	return readRuns(h, coilsSection.name, fcReadCoils, req.UnitId, req.Addr, req.Quantity,
+		func(addr uint16, quantity uint16) ([]bool, error) {
+			return local(addr, quantity, nil)
+		},
+		func(unitId uint8, addr uint16, quantity uint16) ([]bool, error) {
+			return h.upstream.ReadBools(unitId, fcReadCoils, addr, quantity)
+		},
+	)
+}
+
+func (h *GatewayHandler) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	return readRuns(h, discreteInputsSection.name, fcReadDiscreteInputs, req.UnitId, req.Addr, req.Quantity,
+		func(addr uint16, quantity uint16) ([]bool, error) {
+			return h.local.HandleDiscreteInputs(&modbus.DiscreteInputsRequest{
+				ClientAddr: req.ClientAddr,
+				ClientRole: req.ClientRole,
+				UnitId:     req.UnitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		},
+		func(unitId uint8, addr uint16, quantity uint16) ([]bool, error) {
+			return h.upstream.ReadBools(unitId, fcReadDiscreteInputs, addr, quantity)
+		},
+	)
+}
+
+func (h *GatewayHandler) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if req.IsWrite {
+		fc := fcWriteMultipleRegisters
+		if req.Quantity == 1 {
+			fc = fcWriteSingleRegister
+		}
+
+		return nil, writeRuns(h, holdingRegistersSection.name, fc, req.UnitId, req.Addr, req.Args[:req.Quantity],
+			func(addr uint16, values []uint16) error {
+				_, err := h.local.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+					ClientAddr: req.ClientAddr,
+					ClientRole: req.ClientRole,
+					UnitId:     req.UnitId,
+					Addr:       addr,
+					Quantity:   uint16(len(values)),
+					IsWrite:    true,
+					Args:       values,
+				})
+				return err
+			},
+			h.upstream.WriteRegisters,
+		)
+	}
+
+	return h.readHoldingRegisters(req.ClientAddr, req.ClientRole, req.UnitId, req.Addr, req.Quantity)
+}
+
+func (h *GatewayHandler) readHoldingRegisters(clientAddr string, clientRole string, unitId uint8, addr uint16, quantity uint16) ([]uint16, error) {
+	return readRuns(h, holdingRegistersSection.name, fcReadHoldingRegisters, unitId, addr, quantity,
+		func(addr uint16, quantity uint16) ([]uint16, error) {
+			return h.local.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+				ClientAddr: clientAddr,
+				ClientRole: clientRole,
+				UnitId:     unitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		},
+		func(unitId uint8, addr uint16, quantity uint16) ([]uint16, error) {
+			return h.upstream.ReadRegisters(unitId, fcReadHoldingRegisters, addr, quantity)
+		},
+	)
+}
+
+func (h *GatewayHandler) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	return readRuns(h, inputRegistersSection.name, fcReadInputRegisters, req.UnitId, req.Addr, req.Quantity,
+		func(addr uint16, quantity uint16) ([]uint16, error) {
+			return h.local.HandleInputRegisters(&modbus.InputRegistersRequest{
+				ClientAddr: req.ClientAddr,
+				ClientRole: req.ClientRole,
+				UnitId:     req.UnitId,
+				Addr:       addr,
+				Quantity:   quantity,
+			})
+		},
+		func(unitId uint8, addr uint16, quantity uint16) ([]uint16, error) {
+			return h.upstream.ReadRegisters(unitId, fcReadInputRegisters, addr, quantity)
+		},
+	)
+}
+
+func (h *GatewayHandler) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	if h.isLocal(holdingRegistersSection.name, req.Addr) {
+		return h.local.HandleMaskWriteRegister(req)
+	}
+
+	h.logForward(fcMaskWriteRegister, req.UnitId, req.Addr, 1)
+	defer h.cache.clear()
+	return h.upstream.MaskWriteRegister(h.unitId(req.UnitId), req.Addr, req.AndMask, req.OrMask)
+}
+
+// HandleReadWriteRegisters forwards the request as it is when both ranges
+// are forwarded. Otherwise the write is done first, then the read, as the
+// function code asks for, but not atomically. Like any write, the write
+// range must be either all local or all forwarded.
+func (h *GatewayHandler) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	table := holdingRegistersSection.name
+	writeLocal, writeForwarded := h.where(table, req.WriteAddr, uint16(len(req.Args)))
+	readLocal, readForwarded := h.where(table, req.ReadAddr, req.ReadQuantity)
+
+	switch {
+	case !writeForwarded && !readForwarded:
+		return h.local.HandleReadWriteRegisters(req)
+
+	case !writeLocal && !readLocal:
+		h.logForward(fcReadWriteMultipleRegisters, req.UnitId, req.ReadAddr, req.ReadQuantity)
+		defer h.cache.clear()
+		return h.upstream.ReadWriteRegisters(h.unitId(req.UnitId), req.ReadAddr, req.ReadQuantity, req.WriteAddr, req.Args)
+	}
+
+	err := writeRuns(h, table, fcWriteMultipleRegisters, req.UnitId, req.WriteAddr, req.Args,
+		func(addr uint16, values []uint16) error {
+			_, err := h.local.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+				ClientAddr: req.ClientAddr,
+				ClientRole: req.ClientRole,
+				UnitId:     req.UnitId,
+				Addr:       addr,
+				Quantity:   uint16(len(values)),
+				IsWrite:    true,
+				Args:       values,
+			})
+			return err
+		},
+		h.upstream.WriteRegisters,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.readHoldingRegisters(req.ClientAddr, req.ClientRole, req.UnitId, req.ReadAddr, req.ReadQuantity)
+}
+
+// HandleDeviceIdentification forwards the request when the whole unit is
+// forwarded, so the gateway identifies as the device behind it.
+func (h *GatewayHandler) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	if len(h.config.Forward) != 0 {
+		return h.local.HandleDeviceIdentification(req)
+	}
+
+	h.logger.Info(
+		"Forward to upstream", logging.Field("upstream", h.upstream.URL()), logging.FieldFunctionCode(fcEncapsulatedInterface),
+		logging.FieldUnitId(h.unitId(req.UnitId)), logging.Field("object_id", fmt.Sprintf("0x%02X", req.ObjectId)),
+	)
+	return h.upstream.ReadDeviceIdentification(h.unitId(req.UnitId), req.ReadDeviceIdCode, req.ObjectId)
+}
+
+// HandleDiagnostics answers locally, the counters are the ones of the
+// listener and not of the device behind it.
+func (h *GatewayHandler) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	return h.local.HandleDiagnostics(req)
+}
+
+type gatewayCacheKey struct {
+	fc       uint8
+	unitId   uint8
+	addr     uint16
+	quantity uint16
+}
+
+type gatewayCacheEntry struct {
+	values  interface{}
+	expires time.Time
+}
+
+// gatewayCache keeps upstream reads for ttl. A zero ttl keeps nothing.
+type gatewayCache struct {
+	ttl time.Duration
+	// now is the clock entries expire by, replaced in tests.
+	now func() time.Time
+
+	lock    sync.Mutex
+	entries map[gatewayCacheKey]gatewayCacheEntry
+}
+
+func newGatewayCache(ttl time.Duration) *gatewayCache {
+	return &gatewayCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[gatewayCacheKey]gatewayCacheEntry),
+	}
+}
+
+func (c *gatewayCache) get(key gatewayCacheKey) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	if c.now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.values, true
+}
+
+func (c *gatewayCache) put(key gatewayCacheKey, values interface{}) {
+	if c.ttl == 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := c.now()
+	if len(c.entries) >= gatewayCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= gatewayCacheSize {
+		c.entries = make(map[gatewayCacheKey]gatewayCacheEntry)
+	}
+
+	c.entries[key] = gatewayCacheEntry{values: values, expires: now.Add(c.ttl)}
+}
+
+func (c *gatewayCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.entries = make(map[gatewayCacheKey]gatewayCacheEntry)
+}
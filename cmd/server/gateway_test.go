@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// newTestGateway serves holding registers 100 to 103 from the upstream,
+// except 101 which is overridden, and 104 from the local seed. Forwarded
+// reads are cached for a second of the returned clock.
+func newTestGateway(t *testing.T) (*GatewayHandler, *ModbusService, *ModbusService, *time.Time) {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	upstreamService, upstreamURL := startUpstreamServer(t, Dump{
+		HoldingRegisters: []Register{
+			{addr: 100, value: 0x1000}, {addr: 101, value: 0x1001}, {addr: 102, value: 0x1002},
+			{addr: 103, value: 0x1003}, {addr: 104, value: 0x1004},
+		},
+	})
+	local := NewModbusService(Dump{
+		HoldingRegisters: []Register{{addr: 101, value: 0xAAAA}, {addr: 104, value: 0xBBBB}},
+	})
+
+	config := GatewayConfig{
+		UpstreamConfig: UpstreamConfig{URL: upstreamURL},
+		Forward:        []AddressRange{{Table: holdingRegistersSection.name, Start: 100, End: 103}},
+		Overrides:      []AddressRange{{Table: holdingRegistersSection.name, Start: 101, End: 101}},
+		Cache:          Duration(time.Second),
+	}
+	upstream := NewUpstream(config.UpstreamConfig, nil, logger)
+	t.Cleanup(func() { upstream.Close() })
+
+	gateway := NewGatewayHandler(NewAdapterHandler(NewModbusHandler(local, nil, logger), logger), upstream, config, logger)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	gateway.cache.now = func() time.Time { return now }
+
+	return gateway, upstreamService, local, &now
+}
+
+func readHolding(t *testing.T, gateway *GatewayHandler, addr uint16, quantity uint16) []uint16 {
+	t.Helper()
+
+	values, err := gateway.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{UnitId: 1, Addr: addr, Quantity: quantity})
+	if err != nil {
+		t.Fatalf("read %d registers at %d: %v", quantity, addr, err)
+	}
+	return values
+}
+
+func writeHolding(gateway *GatewayHandler, addr uint16, values ...uint16) error {
+	_, err := gateway.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+		UnitId: 1, Addr: addr, Quantity: uint16(len(values)), IsWrite: true, Args: values,
+	})
+	return err
+}
+
+func TestGatewaySplitsReads(t *testing.T) {
+	gateway, _, _, _ := newTestGateway(t)
+
+	got := readHolding(t, gateway, 100, 5)
+	want := []uint16{0x1000, 0xAAAA, 0x1002, 0x1003, 0xBBBB}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %04X, want %04X", got, want)
+	}
+}
+
+func TestGatewayWrites(t *testing.T) {
+	gateway, upstream, local, _ := newTestGateway(t)
+
+	if err := writeHolding(gateway, 102, 0x2002, 0x2003); err != nil {
+		t.Fatalf("forwarded write: %v", err)
+	}
+	if err := writeHolding(gateway, 101, 0x2001); err != nil {
+		t.Fatalf("overridden write: %v", err)
+	}
+
+	if got, _ := upstream.GetHoldingRegisterRange(100, 5); !reflect.DeepEqual(got, []uint16{0x1000, 0x1001, 0x2002, 0x2003, 0x1004}) {
+		t.Errorf("upstream registers %04X", got)
+	}
+	if got, _ := local.GetHoldingRegister(101); got != 0x2001 {
+		t.Errorf("local register 101 is 0x%04X, want 0x2001", got)
+	}
+}
+
+// A write of both local and forwarded addresses could be left half done,
+// so neither side is written.
+func TestGatewayRejectsMixedWrites(t *testing.T) {
+	gateway, upstream, local, _ := newTestGateway(t)
+
+	for _, addr := range []uint16{100, 101, 103} {
+		err := writeHolding(gateway, addr, 0xFFFF, 0xFFFF)
+		if !errors.Is(err, modbus.ErrIllegalDataAddress) {
+			t.Errorf("write at %d: got %v, want %v", addr, err, modbus.ErrIllegalDataAddress)
+		}
+	}
+
+	if got, _ := upstream.GetHoldingRegisterRange(100, 5); !reflect.DeepEqual(got, []uint16{0x1000, 0x1001, 0x1002, 0x1003, 0x1004}) {
+		t.Errorf("upstream registers %04X", got)
+	}
+	if got, _ := local.GetHoldingRegisterRange(104, 1); got[0] != 0xBBBB {
+		t.Errorf("local register 104 is 0x%04X, want 0xBBBB", got[0])
+	}
+}
+
+func TestGatewayCache(t *testing.T) {
+	gateway, upstream, _, now := newTestGateway(t)
+
+	readHolding(t, gateway, 100, 1)
+	upstream.SetHoldingRegister(100, 0x3000)
+
+	*now = now.Add(time.Second)
+	if got := readHolding(t, gateway, 100, 1); got[0] != 0x1000 {
+		t.Errorf("cached read got 0x%04X, want 0x1000", got[0])
+	}
+
+	*now = now.Add(time.Nanosecond)
+	if got := readHolding(t, gateway, 100, 1); got[0] != 0x3000 {
+		t.Errorf("expired read got 0x%04X, want 0x3000", got[0])
+	}
+
+	// local reads aren't cached
+	if err := writeHolding(gateway, 101, 0x3001); err != nil {
+		t.Fatal(err)
+	}
+	if got := readHolding(t, gateway, 101, 1); got[0] != 0x3001 {
+		t.Errorf("local read got 0x%04X, want 0x3001", got[0])
+	}
+}
+
+func TestGatewayWriteClearsCache(t *testing.T) {
+	gateway, upstream, _, _ := newTestGateway(t)
+
+	readHolding(t, gateway, 100, 1)
+	readHolding(t, gateway, 102, 2)
+	upstream.SetHoldingRegister(100, 0x3000)
+
+	// the write of another address drops every cached read, the device may
+	// tie its registers together
+	if err := writeHolding(gateway, 103, 0x3003); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readHolding(t, gateway, 100, 1); got[0] != 0x3000 {
+		t.Errorf("read after a write got 0x%04X, want 0x3000", got[0])
+	}
+	if got := readHolding(t, gateway, 102, 2); !reflect.DeepEqual(got, []uint16{0x1002, 0x3003}) {
+		t.Errorf("read after a write got %04X", got)
+	}
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	_, upstreamURL := startUpstreamServer(t, Dump{HoldingRegisters: []Register{{addr: 100}}})
+	upstream := NewUpstream(UpstreamConfig{URL: upstreamURL}, nil, logger)
+	defer upstream.Close()
+
+	// exceptions of the device are passed on
+	_, err := upstream.ReadRegisters(1, fcReadHoldingRegisters, 200, 1)
+	if !errors.Is(err, modbus.ErrIllegalDataAddress) {
+		t.Errorf("read of an unknown address: got %v, want %v", err, modbus.ErrIllegalDataAddress)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "tcp://" + listener.Addr().String()
+	listener.Close()
+
+	unreachable := NewUpstream(UpstreamConfig{URL: closedURL, Timeout: Duration(time.Second)}, nil, logger)
+	defer unreachable.Close()
+
+	_, err = unreachable.ReadRegisters(1, fcReadHoldingRegisters, 100, 1)
+	if !errors.Is(err, modbus.ErrGWPathUnavailable) {
+		t.Errorf("read from an unreachable device: got %v, want %v", err, modbus.ErrGWPathUnavailable)
+	}
+}
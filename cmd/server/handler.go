@@ -2,144 +2,167 @@ package main
 
 import (
 	"fmt"
-	"log"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
 )
 
 type ModbusHandler struct {
-	service *ModbusService
+	service        *ModbusService
+	identification *DeviceIdentification
+	logger         *logging.Logger
 }
 
-func NewModbusHandler(service *ModbusService) *ModbusHandler {
+func NewModbusHandler(service *ModbusService, identification *DeviceIdentification, logger *logging.Logger) *ModbusHandler {
 	return &ModbusHandler{
-		service: service,
+		service:        service,
+		identification: identification,
+		logger:         logger,
 	}
 }
 
 func (h *ModbusHandler) ReadCoils0x01(addr uint16, cnt int) ([]bool, error) {
-	log.Printf("Call function 0x01 (read coils), addr: 0x%X, cnt: %d", addr, cnt)
-
-	result := make([]bool, 0, cnt)
-	for a := addr; a < addr+uint16(cnt); a++ {
-		coil, err := h.service.GetCoil(a)
-		if err != nil {
-			log.Printf("Could not get coil at addr: 0x%X, reason: %v", addr, err)
-			return nil, fmt.Errorf("get coil at addr 0x%X: %w", a, err)
-		}
+	h.logger.Debug("Call read coils", logging.FieldFunctionCode(fcReadCoils), logging.FieldAddr(addr), logging.FieldCount(cnt))
 
-		result = append(result, coil)
+	result, err := h.service.GetCoilRange(addr, cnt)
+	if err != nil {
+		h.logger.Debug("Could not get coils", logging.FieldAddr(addr), logging.FieldCount(cnt), logging.FieldError(err))
+		return nil, fmt.Errorf("get %d coils at addr 0x%X: %w", cnt, addr, err)
 	}
 
-	log.Printf("Successfuly read %d coils at addr: 0x%X", cnt, addr)
+	h.logger.Debug("Successfuly read coils", logging.FieldAddr(addr), logging.FieldCount(cnt))
 	return result, nil
 }
 
 func (h *ModbusHandler) ReadDiscreteInputs0x02(addr uint16, cnt int) ([]bool, error) {
-	log.Printf("Call function 0x02 (read discrete inputs), addr: 0x%X, cnt: %d", addr, cnt)
-	log.Printf("Discrete inputs: %v", h.service.discreteInputs)
-
-	result := make([]bool, 0, cnt)
-	for a := addr; a < addr+uint16(cnt); a++ {
-		dis, err := h.service.GetDiscreteInputs(a)
-		if err != nil {
-			log.Printf("Could not get discrete input at addr: 0x%X, reason: %v", addr, err)
-			return nil, fmt.Errorf("get discrete input at addr 0x%X: %w", a, err)
-		}
-
-		result = append(result, dis)
+	h.logger.Debug("Call read discrete inputs", logging.FieldFunctionCode(fcReadDiscreteInputs), logging.FieldAddr(addr), logging.FieldCount(cnt))
+
+	result, err := h.service.GetDiscreteInputRange(addr, cnt)
+	if err != nil {
+		h.logger.Debug("Could not get discrete inputs", logging.FieldAddr(addr), logging.FieldCount(cnt), logging.FieldError(err))
+		return nil, fmt.Errorf("get %d discrete inputs at addr 0x%X: %w", cnt, addr, err)
 	}
 
-	log.Printf("Successfuly read %d discrete inputs at addr: 0x%X", cnt, addr)
+	h.logger.Debug("Successfuly read discrete inputs", logging.FieldAddr(addr), logging.FieldCount(cnt))
 	return result, nil
 }
 
 func (h *ModbusHandler) ReadHoldingRegisters0x03(addr uint16, cnt int) ([]uint16, error) {
-	log.Printf("Call function 0x03 (read holding registers), addr: 0x%X, cnt: %d", addr, cnt)
+	h.logger.Debug("Call read holding registers", logging.FieldFunctionCode(fcReadHoldingRegisters), logging.FieldAddr(addr), logging.FieldCount(cnt))
 
-	result := make([]uint16, 0, cnt)
-	for a := addr; a < addr+uint16(cnt); a++ {
-		reg, err := h.service.GetHoldingRegister(a)
-		if err != nil {
-			log.Printf("Could not get holding register at addr: 0x%X, reason: %v", addr, err)
-			return nil, fmt.Errorf("get register at addr 0x%X: %w", a, err)
-		}
-
-		result = append(result, reg)
+	result, err := h.service.GetHoldingRegisterRange(addr, cnt)
+	if err != nil {
+		h.logger.Debug("Could not get holding registers", logging.FieldAddr(addr), logging.FieldCount(cnt), logging.FieldError(err))
+		return nil, fmt.Errorf("get %d registers at addr 0x%X: %w", cnt, addr, err)
 	}
 
-	log.Printf("Successfuly read %d holding registers at addr: 0x%X", cnt, addr)
+	h.logger.Debug("Successfuly read holding registers", logging.FieldAddr(addr), logging.FieldCount(cnt))
 	return result, nil
 }
 
 func (h *ModbusHandler) ReadInputRegisters0x04(addr uint16, cnt int) ([]uint16, error) {
-	log.Printf("Call function 0x04 (read input registers), addr: 0x%X, cnt: %d", addr, cnt)
-
-	result := make([]uint16, 0, cnt)
-	for a := addr; a < addr+uint16(cnt); a++ {
-		inputReg, err := h.service.GetInputRegister(a)
-		if err != nil {
-			log.Printf("Could not get input register at addr: 0x%X, reason: %v", addr, err)
-			return nil, fmt.Errorf("get input register at addr 0x%X: %w", a, err)
-		}
+	h.logger.Debug("Call read input registers", logging.FieldFunctionCode(fcReadInputRegisters), logging.FieldAddr(addr), logging.FieldCount(cnt))
 
-		result = append(result, inputReg)
+	result, err := h.service.GetInputRegisterRange(addr, cnt)
+	if err != nil {
+		h.logger.Debug("Could not get input registers", logging.FieldAddr(addr), logging.FieldCount(cnt), logging.FieldError(err))
+		return nil, fmt.Errorf("get %d input registers at addr 0x%X: %w", cnt, addr, err)
 	}
 
-	log.Printf("Successfuly read %d input registers at addr: 0x%X", cnt, addr)
+	h.logger.Debug("Successfuly read input registers", logging.FieldAddr(addr), logging.FieldCount(cnt))
 	return result, nil
 }
 
 func (h *ModbusHandler) WriteSingleCoil0x05(addr uint16, value bool) error {
-	log.Printf("Call function 0x05 (write single coil), addr: 0x%X, value: %v", addr, value)
+	h.logger.Debug("Call write single coil", logging.FieldFunctionCode(fcWriteSingleCoil), logging.FieldAddr(addr), logging.Field("value", value))
 
 	if err := h.service.SetCoil(addr, value); err != nil {
-		log.Printf("Could not write coil at addr: 0x%X, reason: %v", addr, err)
+		h.logger.Debug("Could not write coil", logging.FieldAddr(addr), logging.FieldError(err))
 		return fmt.Errorf("set coil at addr 0x%X: %w", addr, err)
 	}
 
-	log.Printf("Successfuly written %v to coil at addr: 0x%X", value, addr)
+	h.logger.Debug("Successfuly written coil", logging.FieldAddr(addr), logging.Field("value", value))
 	return nil
 }
 
 func (h *ModbusHandler) WriteSingleRegister0x06(addr uint16, value uint16) error {
-	log.Printf("Call function 0x06 (write single register), addr: 0x%X, value: %d", addr, value)
+	h.logger.Debug("Call write single register", logging.FieldFunctionCode(fcWriteSingleRegister), logging.FieldAddr(addr), logging.Field("value", value))
 
 	if err := h.service.SetHoldingRegister(addr, value); err != nil {
-		log.Printf("Could not write register at addr: 0x%X, reason: %v", addr, err)
+		h.logger.Debug("Could not write register", logging.FieldAddr(addr), logging.FieldError(err))
 		return fmt.Errorf("set register at addr 0x%X: %w", addr, err)
 	}
 
-	log.Printf("Successfuly written %v to register at addr: 0x%X", value, addr)
+	h.logger.Debug("Successfuly written register", logging.FieldAddr(addr), logging.Field("value", value))
 	return nil
 }
 
 func (h *ModbusHandler) WriteMultipleRegisters0x10(addr uint16, values []uint16) error {
-	log.Printf("Call function 0x10 (write multiple registers), addr: 0x%X, values: %v", addr, values)
-
-	for i, value := range values {
-		a := addr + uint16(i)
+	h.logger.Debug("Call write multiple registers", logging.FieldFunctionCode(fcWriteMultipleRegisters), logging.FieldAddr(addr), logging.FieldCount(len(values)), logging.Field("values", values))
 
-		if err := h.service.SetHoldingRegister(a, value); err != nil {
-			log.Printf("Could not write multple registers at addr: 0x%X, reason: %v", addr, err)
-			return fmt.Errorf("set register at addr 0x%X: %w", a, err)
-		}
+	if err := h.service.SetHoldingRegisterRange(addr, values); err != nil {
+		h.logger.Debug("Could not write multiple registers", logging.FieldAddr(addr), logging.FieldCount(len(values)), logging.FieldError(err))
+		return fmt.Errorf("set %d registers at addr 0x%X: %w", len(values), addr, err)
 	}
 
-	log.Printf("Successfuly written %v to registers at addr: 0x%X", values, addr)
+	h.logger.Debug("Successfuly written registers", logging.FieldAddr(addr), logging.FieldCount(len(values)), logging.Field("values", values))
 	return nil
 }
 
 func (h *ModbusHandler) WriteMultipleCoils0x0F(addr uint16, coils []bool) error {
-	log.Printf("Call function 0x0F (write multiple coils), addr: 0x%X, values: %v", addr, coils)
+	h.logger.Debug("Call write multiple coils", logging.FieldFunctionCode(fcWriteMultipleCoils), logging.FieldAddr(addr), logging.FieldCount(len(coils)), logging.Field("values", coils))
 
-	for i, coil := range coils {
-		a := addr + uint16(i)
+	if err := h.service.SetCoilRange(addr, coils); err != nil {
+		h.logger.Debug("Could not write coils", logging.FieldAddr(addr), logging.FieldCount(len(coils)), logging.FieldError(err))
+		return fmt.Errorf("set %d coils at addr 0x%X: %w", len(coils), addr, err)
+	}
+
+	h.logger.Debug("Successfuly written coils", logging.FieldAddr(addr), logging.FieldCount(len(coils)), logging.Field("values", coils))
+	return nil
+}
+
+func (h *ModbusHandler) MaskWriteRegister0x16(addr uint16, andMask uint16, orMask uint16) error {
+	h.logger.Debug("Call mask write register", logging.FieldFunctionCode(fcMaskWriteRegister), logging.FieldAddr(addr), logging.Field("and_mask", fmt.Sprintf("0x%04X", andMask)), logging.Field("or_mask", fmt.Sprintf("0x%04X", orMask)))
 
-		if err := h.service.SetCoil(a, coil); err != nil {
-			log.Printf("Could not write coils at addr: 0x%X, reason: %v", addr, err)
-			return fmt.Errorf("set coil at addr 0x%X: %w", a, err)
-		}
+	if err := h.service.MaskWriteHoldingRegister(addr, andMask, orMask); err != nil {
+		h.logger.Debug("Could not mask write register", logging.FieldAddr(addr), logging.FieldError(err))
+		return fmt.Errorf("mask write register at addr 0x%X: %w", addr, err)
 	}
 
-	log.Printf("Successfuly written %v to coils at addr: 0x%X", coils, addr)
+	h.logger.Debug("Successfuly mask written register", logging.FieldAddr(addr))
 	return nil
 }
+
+func (h *ModbusHandler) ReadWriteMultipleRegisters0x17(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	h.logger.Debug(
+		"Call read/write multiple registers", logging.FieldFunctionCode(fcReadWriteMultipleRegisters),
+		logging.FieldAddr(readAddr), logging.FieldCount(readCnt), logging.Field("write_addr", writeAddr), logging.Field("values", values),
+	)
+
+	result, err := h.service.ReadWriteHoldingRegisterRange(readAddr, readCnt, writeAddr, values)
+	if err != nil {
+		h.logger.Debug("Could not read/write registers", logging.FieldAddr(readAddr), logging.Field("write_addr", writeAddr), logging.FieldError(err))
+		return nil, fmt.Errorf("write %d registers at addr 0x%X, read %d registers at addr 0x%X: %w", len(values), writeAddr, readCnt, readAddr, err)
+	}
+
+	h.logger.Debug(
+		"Successfuly written and read registers",
+		logging.FieldAddr(readAddr), logging.FieldCount(readCnt), logging.Field("write_addr", writeAddr), logging.Field("values", values),
+	)
+	return result, nil
+}
+
+func (h *ModbusHandler) ReadDeviceIdentification0x2B(code uint8, objectId uint8) (IdentificationResult, error) {
+	h.logger.Debug(
+		"Call read device identification", logging.FieldFunctionCode(fcEncapsulatedInterface),
+		logging.Field("read_device_id_code", fmt.Sprintf("0x%02X", code)), logging.Field("object_id", fmt.Sprintf("0x%02X", objectId)),
+	)
+
+	result, err := h.identification.Read(code, objectId)
+	if err != nil {
+		h.logger.Debug("Could not read device identification", logging.Field("object_id", fmt.Sprintf("0x%02X", objectId)), logging.FieldError(err))
+		return IdentificationResult{}, fmt.Errorf("read device identification 0x%02X from object 0x%02X: %w", code, objectId, err)
+	}
+
+	h.logger.Debug("Successfuly read identification objects", logging.Field("object_id", fmt.Sprintf("0x%02X", objectId)), logging.FieldCount(len(result.Objects)))
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// RunHeadless starts the server without any GUI, logs to stdout (unless
+// the config says otherwise) and blocks until SIGINT or SIGTERM is received,
+// then shuts everything down. On unix SIGUSR1 saves a snapshot on demand,
+// SIGUSR2 toggles fault injection and SIGHUP reloads the access rules.
+func RunHeadless(app *App, simulate bool) error {
+	logger := app.logger()
+	logOutput, err := OpenLogDestination(app.Config.Log, app.Config.LogRotation, logger)
+	if err != nil {
+		return fmt.Errorf("open log destination: %w", err)
+	}
+
+	if logOutput == nil {
+		logOutput = nopCloser{os.Stdout}
+	}
+	defer logOutput.Close()
+	app.Logger.SetOutputs(logOutput)
+	app.Logger.RedirectStandardLog("server")
+
+	if err := app.StartCapture(); err != nil {
+		return fmt.Errorf("start capture: %w", err)
+	}
+	defer app.StopCapture()
+
+	if err := app.StartRecording(); err != nil {
+		return fmt.Errorf("start recording: %w", err)
+	}
+	defer app.StopRecording()
+
+	// the metrics are started first, nothing is left running if they fail
+	if err := app.StartMetrics(); err != nil {
+		return fmt.Errorf("start metrics: %w", err)
+	}
+	defer app.StopMetrics()
+
+	if err := app.ServerManager.StartServer(); err != nil {
+		return fmt.Errorf("start server: %w", err)
+	}
+	logger.Info("Server started")
+	app.LogUnits()
+	app.Snapshotter.Start()
+
+	if simulate {
+		app.Simulator.StartSimulation()
+		logger.Info("Activity simulation started")
+	}
+
+	signals := make(chan os.Signal, 1)
+	notify := []os.Signal{os.Interrupt, syscall.SIGTERM}
+	for _, list := range [][]os.Signal{snapshotSignals, faultSignals, reloadSignals} {
+		notify = append(notify, list...)
+	}
+	signal.Notify(signals, notify...)
+	defer signal.Stop(signals)
+
+	for sig := range signals {
+		if isSignal(sig, snapshotSignals) {
+			logger.Info("Saving snapshot", logging.Field("signal", sig.String()))
+			app.Snapshotter.SaveSnapshots()
+			continue
+		}
+
+		if isSignal(sig, faultSignals) {
+			logger.Info("Toggling fault injection", logging.Field("signal", sig.String()))
+			ToggleFaultInjection(app.Faults, !app.Faults.Enabled(), logger)
+			continue
+		}
+
+		if isSignal(sig, reloadSignals) {
+			logger.Info("Reloading access rules", logging.Field("signal", sig.String()))
+			if err := app.ReloadAccess(); err != nil {
+				logger.Error("Could not reload access rules", logging.FieldError(err))
+			}
+			continue
+		}
+
+		logger.Info("Shutting down", logging.Field("signal", sig.String()))
+		break
+	}
+
+	if simulate {
+		app.Simulator.StopSimulation()
+	}
+
+	// every step is taken even if an earlier one fails, the snapshot is
+	// worth saving whatever happened to the listener
+	var errs shutdownError
+	if err := app.ServerManager.StopServer(); err != nil {
+		errs = append(errs, fmt.Errorf("stop server: %w", err))
+	}
+	logger.Info("Diagnostic counters", logging.Field("counters", app.ServerManager.Diagnostics().Counters()))
+	if stats := app.RateLimit.Stats(); len(stats) != 0 {
+		logger.Info("Rate limit counters", logging.Field("clients", stats))
+	}
+	app.CloseUpstreams()
+
+	if err := app.Snapshotter.Stop(); err != nil {
+		errs = append(errs, fmt.Errorf("save snapshot: %w", err))
+	}
+
+	if len(errs) != 0 {
+		return errs
+	}
+
+	logger.Info("Server stopped")
+	return nil
+}
+
+// shutdownError holds the errors of the shutdown steps that failed.
+type shutdownError []error
+
+func (e shutdownError) Error() string {
+	messages := make([]string, 0, len(e))
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap lets errors.Is and errors.As look into every error.
+func (e shutdownError) Unwrap() []error {
+	return e
+}
+
+func isSignal(sig os.Signal, signals []os.Signal) bool {
+	for _, s := range signals {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
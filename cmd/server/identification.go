@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	ReadDeviceIdBasic      uint8 = 0x01
+	ReadDeviceIdRegular    uint8 = 0x02
+	ReadDeviceIdExtended   uint8 = 0x03
+	ReadDeviceIdIndividual uint8 = 0x04
+
+	ObjectVendorName          uint8 = 0x00
+	ObjectProductCode         uint8 = 0x01
+	ObjectMajorMinorRevision  uint8 = 0x02
+	ObjectVendorUrl           uint8 = 0x03
+	ObjectProductName         uint8 = 0x04
+	ObjectModelName           uint8 = 0x05
+	ObjectUserApplicationName uint8 = 0x06
+
+	// Conformity levels with both stream and individual access.
+	ConformityBasic    uint8 = 0x81
+	ConformityRegular  uint8 = 0x82
+	ConformityExtended uint8 = 0x83
+
+	DefaultVendorName         = "MIREA"
+	DefaultProductCode        = "mirea-modbus"
+	DefaultMajorMinorRevision = "1.0"
+
+	// identificationSpace is what is left of a response PDU for the
+	// objects: 253 bytes minus function code, MEI type, read device id
+	// code, conformity level, more follows, next object id and number of
+	// objects.
+	identificationSpace = 253 - 7
+	// identificationMaxValue is the longest value that fits a response
+	// next to its id and length.
+	identificationMaxValue = identificationSpace - 2
+
+	meiReadDeviceIdentification uint8 = 0x0E
+)
+
+var (
+	ErrObjectTooLong   = errors.New("identification object too long")
+	ErrObjectIdInvalid = errors.New("identification object id not in 0x80..0xFF")
+)
+
+// DeviceIdentification holds the objects answered to Read Device
+// Identification (0x2B/0x0E). Missing basic objects fall back to defaults,
+// the others are left out. Extended maps private object ids (0x80..0xFF,
+// hex or decimal) to their values.
+type DeviceIdentification struct {
+	VendorName          string            `json:"vendor_name,omitempty"`
+	ProductCode         string            `json:"product_code,omitempty"`
+	MajorMinorRevision  string            `json:"major_minor_revision,omitempty"`
+	VendorUrl           string            `json:"vendor_url,omitempty"`
+	ProductName         string            `json:"product_name,omitempty"`
+	ModelName           string            `json:"model_name,omitempty"`
+	UserApplicationName string            `json:"user_application_name,omitempty"`
+	Extended            map[string]string `json:"extended,omitempty"`
+}
+
+// IdentificationObject is a single object of a response.
+type IdentificationObject struct {
+	Id    uint8
+	Value string
+}
+
+// IdentificationResult is the answer to a Read Device Identification
+// request. When MoreFollows is set, the client asks again starting from
+// NextObjectId.
+type IdentificationResult struct {
+	ConformityLevel uint8
+	MoreFollows     bool
+	NextObjectId    uint8
+	Objects         []IdentificationObject
+}
+
+// Validate reports the problems of the objects, located by their field
+// name.
+func (d *DeviceIdentification) Validate() []SeedProblem {
+	problems := make([]SeedProblem, 0)
+
+	for _, object := range d.standardObjects() {
+		if len(object.value) > identificationMaxValue {
+			problems = append(problems, SeedProblem{
+				Path: object.name,
+				Err:  fmt.Errorf("%d bytes, at most %d fit a response: %w", len(object.value), identificationMaxValue, ErrObjectTooLong),
+			})
+		}
+	}
+
+	keys := make([]string, 0, len(d.Extended))
+	for key := range d.Extended {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	seen := make(map[uint8]string)
+	for _, key := range keys {
+		path := fmt.Sprintf("extended[%q]", key)
+
+		id, err := parseObjectId(key)
+		if err != nil {
+			problems = append(problems, SeedProblem{Path: path, Err: err})
+			continue
+		}
+
+		if other, ok := seen[id]; ok {
+			problems = append(problems, SeedProblem{Path: path, Err: fmt.Errorf("object 0x%02X is also declared as %q", id, other)})
+		}
+		seen[id] = key
+
+		if value := d.Extended[key]; len(value) > identificationMaxValue {
+			problems = append(problems, SeedProblem{
+				Path: path,
+				Err:  fmt.Errorf("%d bytes, at most %d fit a response: %w", len(value), identificationMaxValue, ErrObjectTooLong),
+			})
+		}
+	}
+
+	return problems
+}
+
+// Read selects the objects for a request. Stream access (basic, regular,
+// extended) answers the objects of the category from objectId on, as many
+// as fit a response; an objectId that doesn't match an object of the
+// category restarts from the first one. Individual access answers a single
+// object.
+func (d *DeviceIdentification) Read(code uint8, objectId uint8) (IdentificationResult, error) {
+	objects := d.objects()
+	result := IdentificationResult{
+		ConformityLevel: d.conformityLevel(),
+	}
+
+	if code == ReadDeviceIdIndividual {
+		for _, object := range objects {
+			if object.Id == objectId {
+				result.Objects = []IdentificationObject{object}
+				return result, nil
+			}
+		}
+		return IdentificationResult{}, fmt.Errorf("object 0x%02X: %w", objectId, modbus.ErrIllegalDataAddress)
+	}
+
+	var last uint8
+	switch code {
+	case ReadDeviceIdBasic:
+		last = ObjectMajorMinorRevision
+	case ReadDeviceIdRegular:
+		last = 0x7F
+	case ReadDeviceIdExtended:
+		last = 0xFF
+	default:
+		return IdentificationResult{}, fmt.Errorf("read device id code 0x%02X: %w", code, modbus.ErrIllegalDataValue)
+	}
+
+	category := make([]IdentificationObject, 0, len(objects))
+	start := 0
+	for _, object := range objects {
+		if object.Id > last {
+			break
+		}
+		if object.Id == objectId {
+			start = len(category)
+		}
+		category = append(category, object)
+	}
+
+	space := identificationSpace
+	for _, object := range category[start:] {
+		if 2+len(object.Value) > space {
+			result.MoreFollows = true
+			result.NextObjectId = object.Id
+			break
+		}
+
+		space -= 2 + len(object.Value)
+		result.Objects = append(result.Objects, object)
+	}
+
+	return result, nil
+}
+
+type namedObject struct {
+	name  string
+	id    uint8
+	value string
+}
+
+func (d *DeviceIdentification) standardObjects() []namedObject {
+	return []namedObject{
+		{"vendor_name", ObjectVendorName, d.VendorName},
+		{"product_code", ObjectProductCode, d.ProductCode},
+		{"major_minor_revision", ObjectMajorMinorRevision, d.MajorMinorRevision},
+		{"vendor_url", ObjectVendorUrl, d.VendorUrl},
+		{"product_name", ObjectProductName, d.ProductName},
+		{"model_name", ObjectModelName, d.ModelName},
+		{"user_application_name", ObjectUserApplicationName, d.UserApplicationName},
+	}
+}
+
+// objects returns every object sorted by id, with the basic objects
+// defaulted. Invalid extended ids are skipped, Validate reports them.
+func (d *DeviceIdentification) objects() []IdentificationObject {
+	defaults := map[uint8]string{
+		ObjectVendorName:         DefaultVendorName,
+		ObjectProductCode:        DefaultProductCode,
+		ObjectMajorMinorRevision: DefaultMajorMinorRevision,
+	}
+
+	result := make([]IdentificationObject, 0, 7+len(d.Extended))
+	for _, object := range d.standardObjects() {
+		value := object.value
+		if value == "" {
+			value = defaults[object.id]
+		}
+		if value != "" {
+			result = append(result, IdentificationObject{Id: object.id, Value: value})
+		}
+	}
+
+	for key, value := range d.Extended {
+		if id, err := parseObjectId(key); err == nil {
+			result = append(result, IdentificationObject{Id: id, Value: value})
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Id < result[j].Id
+	})
+	return result
+}
+
+func (d *DeviceIdentification) conformityLevel() uint8 {
+	if len(d.Extended) != 0 {
+		return ConformityExtended
+	}
+
+	if d.VendorUrl != "" || d.ProductName != "" || d.ModelName != "" || d.UserApplicationName != "" {
+		return ConformityRegular
+	}
+
+	return ConformityBasic
+}
+
+// parseObjectId parses the id of an extended object, e.g. "0x80" or "128".
+func parseObjectId(key string) (uint8, error) {
+	id, err := strconv.ParseUint(key, 0, 8)
+	if err != nil || id < 0x80 {
+		return 0, fmt.Errorf("%q: %w", key, ErrObjectIdInvalid)
+	}
+	return uint8(id), nil
+}
@@ -1,10 +1,18 @@
 package main
 
+import "github.com/aveplen/mirea-modbus/internal/logging"
+
+// LogWriter hands every log line with its level to append, e.g. to the GUI
+// log view.
 type LogWriter struct {
-	append func(value string)
+	append func(level logging.LogLevel, value string)
 }
 
 func (w *LogWriter) Write(p []byte) (int, error) {
-	w.append(string(p))
+	return w.WriteLevel(logging.LevelInfo, p)
+}
+
+func (w *LogWriter) WriteLevel(level logging.LogLevel, p []byte) (int, error) {
+	w.append(level, string(p))
 	return len(p), nil
 }
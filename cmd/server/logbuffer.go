@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// logLine is a line of the log view with the level it was logged at.
+type logLine struct {
+	level logging.LogLevel
+	text  string
+}
+
+// logBuffer keeps the last lines logged, the oldest line is dropped for
+// every line added once it is full.
+type logBuffer struct {
+	lock  sync.Mutex
+	lines []logLine
+	// start is the index of the oldest line.
+	start int
+	count int
+}
+
+func newLogBuffer(capacity int) *logBuffer {
+	return &logBuffer{
+		lines: make([]logLine, capacity),
+	}
+}
+
+func (b *logBuffer) Add(line logLine) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.count < len(b.lines) {
+		b.lines[(b.start+b.count)%len(b.lines)] = line
+		b.count++
+		return
+	}
+
+	b.lines[b.start] = line
+	b.start = (b.start + 1) % len(b.lines)
+}
+
+// Lines returns the lines kept, oldest first.
+func (b *logBuffer) Lines() []logLine {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	lines := make([]logLine, 0, b.count)
+	for i := 0; i < b.count; i++ {
+		lines = append(lines, b.lines[(b.start+i)%len(b.lines)])
+	}
+	return lines
+}
+
+func (b *logBuffer) Clear() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.start = 0
+	b.count = 0
+}
+
+// Export writes the lines kept to a file, whatever their level, and
+// returns how many were written.
+func (b *logBuffer) Export(path string) (int, error) {
+	lines := b.Lines()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, fmt.Errorf("create file: %w", err)
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for _, line := range lines {
+		writer.WriteString(line.text)
+		writer.WriteString("\n")
+	}
+
+	if err := writer.Flush(); err != nil {
+		return 0, fmt.Errorf("write file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("close file: %w", err)
+	}
+
+	return len(lines), nil
+}
@@ -0,0 +1,9 @@
+package main
+
+// LogComponents are the parts of the server with their own log level. Lines
+// logged with the log package belong to the server component.
+var LogComponents = []string{
+	"server", "listener", "simulator", "upstream", "adapter", "handler",
+	"gateway", "router", "authorization", "access", "faults", "ratelimit",
+	"fallback",
+}
@@ -1,28 +1,149 @@
+//go:build windows
+
 package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/aveplen/mirea-modbus/internal/logging"
 	"github.com/lxn/walk"
 	d "github.com/lxn/walk/declarative"
 )
 
 type LogView struct {
-	TextEdit *d.TextEdit
-	logEdit  *walk.TextEdit
+	TextEdit      *d.TextEdit
+	LevelComboBox *d.ComboBox
+	logEdit       *walk.TextEdit
+	levelComboBox *walk.ComboBox
+	logger        *logging.Logger
+
+	// buffer keeps the last lines, so the view can be filtered again when
+	// the level changes and exported. Lines logged before the window is
+	// created wait there too.
+	buffer *logBuffer
+
+	lock     sync.Mutex
+	level    logging.LogLevel
+	rendered bool
+	// shown is the number of lines in the text edit. It is rebuilt from the
+	// buffer once it holds a quarter more lines than the buffer, so the
+	// text edit never grows much beyond the buffer.
+	shown   int
+	maxShow int
 }
 
-func (c *LogView) Append(value string) {
-	c.logEdit.AppendText(fmt.Sprintf("\r\n%v", value))
+func (c *LogView) Append(level logging.LogLevel, value string) {
+	line := logLine{level: level, text: strings.TrimRight(value, "\r\n")}
+	c.buffer.Add(line)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.logEdit == nil {
+		return
+	}
+
+	if !c.rendered || c.shown >= c.maxShow {
+		c.render()
+		return
+	}
+
+	if line.level < c.level {
+		return
+	}
+
+	c.logEdit.AppendText(fmt.Sprintf("\r\n%v", line.text))
 	c.logEdit.SetTextSelection(len(c.logEdit.Text())+1, 0)
+	c.shown++
+}
+
+// render replaces the text with the lines of the buffer at the level or
+// above.
+func (c *LogView) render() {
+	var text strings.Builder
+	shown := 0
+	for _, line := range c.buffer.Lines() {
+		if line.level >= c.level {
+			text.WriteString("\r\n")
+			text.WriteString(line.text)
+			shown++
+		}
+	}
+
+	c.logEdit.SetText(text.String())
+	c.logEdit.SetTextSelection(len(c.logEdit.Text())+1, 0)
+	c.shown = shown
+	c.rendered = true
+}
+
+// SetLevel shows only the lines logged at the level or above.
+func (c *LogView) SetLevel() {
+	index := c.levelComboBox.CurrentIndex()
+	if index < 0 || index >= len(logging.LogLevelNames()) {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.level = logging.LogLevel(index)
+	if c.logEdit != nil {
+		c.render()
+	}
 }
 
 func (c *LogView) ClearLog() {
+	c.buffer.Clear()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	c.logEdit.SetText("")
+	c.shown = 0
+	c.rendered = true
 }
 
-func NewLogView() *LogView {
-	lv := &LogView{}
+// ExportLog writes the lines of the buffer to a file picked by the user,
+// whatever the level shown.
+func (c *LogView) ExportLog() {
+	dialog := &walk.FileDialog{
+		Title:  "Export log",
+		Filter: "Log files (*.log)|*.log|All files (*.*)|*.*",
+	}
+
+	ok, err := dialog.ShowSave(c.logEdit.Form())
+	if err != nil {
+		c.logger.Error("Could not open export dialog", logging.FieldError(err))
+		return
+	}
+	if !ok {
+		return
+	}
+
+	path := dialog.FilePath
+	if filepath.Ext(path) == "" {
+		path += ".log"
+	}
+
+	count, err := c.buffer.Export(path)
+	if err != nil {
+		c.logger.Error("Could not export log", logging.Field("path", path), logging.FieldError(err))
+		return
+	}
+
+	c.logger.Info("Exported log", logging.Field("path", path), logging.FieldCount(count))
+}
+
+func NewLogView(lines int, logger *logging.Logger) *LogView {
+	lv := &LogView{
+		logger:  logger,
+		buffer:  newLogBuffer(lines),
+		level:   logging.LevelDebug,
+		maxShow: lines + lines/4,
+	}
 
 	lv.TextEdit = &d.TextEdit{
 		AssignTo: &lv.logEdit,
@@ -30,5 +151,12 @@ func NewLogView() *LogView {
 		HScroll:  true,
 	}
 
+	lv.LevelComboBox = &d.ComboBox{
+		AssignTo:              &lv.levelComboBox,
+		Model:                 logging.LogLevelNames(),
+		CurrentIndex:          int(lv.level),
+		OnCurrentIndexChanged: lv.SetLevel,
+	}
+
 	return lv
 }
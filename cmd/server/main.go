@@ -1,44 +1,89 @@
+//go:build windows
+
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
-	"time"
+	"os"
 
-	"github.com/simonvetter/modbus"
+	"github.com/aveplen/mirea-modbus/internal/logging"
 )
 
 func main() {
-	seed, err := ReadSeed("seed.json")
+	if len(os.Args) > 1 && os.Args[1] == "validate-seed" {
+		os.Exit(RunValidateSeed(os.Args[2:]))
+	}
+
+	headless := flag.Bool("headless", false, "run without GUI, logging to stdout")
+	simulate := flag.Bool("simulate", false, "start activity simulation right away (headless only)")
+
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
 	if err != nil {
-		panic(fmt.Errorf("couls not read seed for modbus handler: %w", err))
+		log.Fatalf("could not load config: %v", err)
 	}
 
-	service := NewModbusService(seed)
-	fallback := NewFallbackMiddleware(
-		NewValidationMiddleware(
-			NewAdapterHandler(
-				NewModbusHandler(service))))
+	app, err := NewApp(config, config.Logger())
+	if err != nil {
+		panic(fmt.Errorf("could not create server app: %w", err))
+	}
 
-	serverManager := NewServerManager(
-		&modbus.ServerConfiguration{
-			URL:        "tcp://localhost:5502",
-			Timeout:    30 * time.Second,
-			MaxClients: 5,
-		},
-		fallback,
-	)
+	if *headless {
+		if err := RunHeadless(app, *simulate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	activitySimulator := NewActivitySimulatorImpl(service, seed)
+	logger := app.logger()
+	viewModel := NewMainViewModel(app.ServerManager, app.Simulator, app.Snapshotter, app.Faults, app, app.RateLimit, logger)
+	view := NewView(app.Slaves, viewModel, config.LogViewLines, logger)
 
-	viewModel := NewMainViewModel(serverManager, activitySimulator)
-	view := NewView(seed, viewModel)
+	for _, slave := range app.Slaves {
+		slave.Service.SubscribeToCoilChanges(view.UpdateCoils(slave.Id))
+		slave.Service.SubscribeToDiscreteInputChages(view.UpdateDiscreteInputs(slave.Id))
+		slave.Service.SubscribeToHoldingRegisterChanges(view.UpdateHoldingRegisters(slave.Id))
+		slave.Service.SubscribeToInputRegisterChanges(view.UpdateInputRegisters(slave.Id))
+	}
 
-	service.SubscribeToCoilChanges(view.UpdateCoils)
-	service.SubscribeToDiscreteInputChages(view.UpdateDiscreteInputs)
-	service.SubscribeToHoldingRegisterChanges(view.UpdateHoldingRegisters)
-	service.SubscribeToInputRegisterChanges(view.UpdateInputRegisters)
-	log.SetOutput(&LogWriter{append: view.AppendLog})
+	logOutput, err := OpenLogDestination(config.Log, config.LogRotation, logger)
+	if err != nil {
+		panic(fmt.Errorf("could not open log destination: %w", err))
+	}
+
+	if logOutput != nil {
+		defer logOutput.Close()
+		app.Logger.SetOutputs(&LogWriter{append: view.AppendLog}, logOutput)
+	} else {
+		app.Logger.SetOutputs(&LogWriter{append: view.AppendLog})
+	}
+	app.Logger.RedirectStandardLog("server")
+
+	app.Capture.AddRecorder(view.Frames)
+	app.LogUnits()
+	app.Snapshotter.Start()
+
+	if err := app.StartCapture(); err != nil {
+		logger.Error("Could not start capture", logging.FieldError(err))
+	}
+
+	if err := app.StartRecording(); err != nil {
+		logger.Error("Could not start recording", logging.FieldError(err))
+	}
+
+	if err := app.StartMetrics(); err != nil {
+		logger.Error("Could not start metrics", logging.FieldError(err))
+	}
 
 	view.MainWindow.Run()
+
+	app.Logger.SetOutputs(os.Stderr)
+	if err := app.Snapshotter.Stop(); err != nil {
+		logger.Error("Could not save snapshot on exit", logging.FieldError(err))
+	}
+	app.StopMetrics()
+	app.StopCapture()
+	app.StopRecording()
+	app.CloseUpstreams()
 }
@@ -0,0 +1,32 @@
+//go:build !windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "validate-seed" {
+		os.Exit(RunValidateSeed(os.Args[2:]))
+	}
+
+	simulate := flag.Bool("simulate", false, "start activity simulation right away")
+
+	config, err := LoadConfig(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		log.Fatalf("could not load config: %v", err)
+	}
+
+	app, err := NewApp(config, config.Logger())
+	if err != nil {
+		panic(fmt.Errorf("could not create server app: %w", err))
+	}
+
+	if err := RunHeadless(app, *simulate); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// metricsLatencyBuckets are the upper bounds of the request latency
+// histogram, in seconds.
+var metricsLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type requestKey struct {
+	functionCode uint8
+	unitId       uint8
+	result       string
+}
+
+type writeKey struct {
+	unitId uint8
+	table  string
+	addr   uint16
+}
+
+type histogram struct {
+	// buckets counts the observations of each bucket alone, they are
+	// summed up when written.
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range metricsLatencyBuckets {
+		if value <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// MetricsSources are read every time the metrics are scraped.
+type MetricsSources struct {
+	Connections    func() int
+	SimulatorTicks func() map[uint8]uint64
+	RateLimit      func() []RateLimitStat
+}
+
+// Metrics collects what the server does and writes it in the Prometheus
+// text format. Requests are counted by the RequestDispatcher, the rest is
+// read from its sources when scraped. It is safe for concurrent use, and
+// counts nothing when nil.
+type Metrics struct {
+	lock      sync.Mutex
+	requests  map[requestKey]uint64
+	durations map[uint8]*histogram
+	// writes is only counted with addressWrites set, it may grow to a
+	// series per address of every unit.
+	writes        map[writeKey]uint64
+	addressWrites bool
+	sources       MetricsSources
+}
+
+// NewMetrics creates the metrics, counting the writes of every address
+// when addressWrites is set.
+func NewMetrics(addressWrites bool) *Metrics {
+	return &Metrics{
+		requests:      make(map[requestKey]uint64),
+		durations:     make(map[uint8]*histogram),
+		writes:        make(map[writeKey]uint64),
+		addressWrites: addressWrites,
+	}
+}
+
+// SetSources sets where the metrics not counted by the middleware come
+// from.
+func (m *Metrics) SetSources(sources MetricsSources) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.sources = sources
+}
+
+// requestResult is "ok", "dropped" or the exception code of the answer.
+func requestResult(err error) string {
+	switch {
+	case err == nil:
+		return "ok"
+	case errors.Is(err, ErrDropResponse):
+		return "dropped"
+	}
+	return fmt.Sprintf("0x%02X", exceptionCode(err))
+}
+
+func (m *Metrics) request(functionCode uint8, unitId uint8, err error, duration time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.requests[requestKey{functionCode, unitId, requestResult(err)}]++
+
+	h, ok := m.durations[functionCode]
+	if !ok {
+		h = &histogram{buckets: make([]uint64, len(metricsLatencyBuckets))}
+		m.durations[functionCode] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+func (m *Metrics) write(unitId uint8, table string, addr uint16, quantity int) {
+	if m == nil || !m.addressWrites {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for i := 0; i < quantity; i++ {
+		m.writes[writeKey{unitId, table, addr + uint16(i)}]++
+	}
+}
+
+// metricLabels formats label pairs as {name="value",...}.
+func metricLabels(pairs ...string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], escaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeMetric(buf *bytes.Buffer, name string, labels string, value float64) {
+	fmt.Fprintf(buf, "%s%s %s\n", name, labels, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// WriteTo writes every metric in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var buf bytes.Buffer
+
+	m.lock.Lock()
+	m.writeRequests(&buf)
+	m.writeDurations(&buf)
+	if m.addressWrites {
+		m.writeWrites(&buf)
+	}
+	sources := m.sources
+	m.lock.Unlock()
+
+	if sources.Connections != nil {
+		writeMetricHeader(&buf, "modbus_client_connections", "gauge", "Client connections currently open.")
+		writeMetric(&buf, "modbus_client_connections", "", float64(sources.Connections()))
+	}
+
+	if sources.SimulatorTicks != nil {
+		ticks := sources.SimulatorTicks()
+		ids := make([]int, 0, len(ticks))
+		for id := range ticks {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+
+		writeMetricHeader(&buf, "modbus_simulator_ticks_total", "counter", "Updates made by the activity simulator.")
+		for _, id := range ids {
+			writeMetric(&buf, "modbus_simulator_ticks_total", metricLabels("unit", strconv.Itoa(id)), float64(ticks[uint8(id)]))
+		}
+	}
+
+	if sources.RateLimit != nil {
+		writeMetricHeader(&buf, "modbus_rate_limit_requests_total", "counter", "Requests let through or refused by rate limiting, by client.")
+		for _, stat := range sources.RateLimit() {
+			writeMetric(&buf, "modbus_rate_limit_requests_total", metricLabels("client", stat.Client, "result", "passed"), float64(stat.Passed))
+			writeMetric(&buf, "modbus_rate_limit_requests_total", metricLabels("client", stat.Client, "result", "limited"), float64(stat.Limited))
+		}
+	}
+
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+func (m *Metrics) writeRequests(buf *bytes.Buffer) {
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].functionCode != keys[j].functionCode {
+			return keys[i].functionCode < keys[j].functionCode
+		}
+		if keys[i].unitId != keys[j].unitId {
+			return keys[i].unitId < keys[j].unitId
+		}
+		return keys[i].result < keys[j].result
+	})
+
+	writeMetricHeader(buf, "modbus_requests_total", "counter", "Requests by function code, unit id and result: ok, dropped or the exception code.")
+	for _, key := range keys {
+		labels := metricLabels(
+			"function", fmt.Sprintf("0x%02X", key.functionCode),
+			"unit", strconv.Itoa(int(key.unitId)),
+			"result", key.result,
+		)
+		writeMetric(buf, "modbus_requests_total", labels, float64(m.requests[key]))
+	}
+}
+
+func (m *Metrics) writeDurations(buf *bytes.Buffer) {
+	codes := make([]int, 0, len(m.durations))
+	for code := range m.durations {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	name := "modbus_request_duration_seconds"
+	writeMetricHeader(buf, name, "histogram", "Time spent handling requests, by function code.")
+	for _, code := range codes {
+		h := m.durations[uint8(code)]
+		function := fmt.Sprintf("0x%02X", code)
+
+		var cumulative uint64
+		for i, bound := range metricsLatencyBuckets {
+			cumulative += h.buckets[i]
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			writeMetric(buf, name+"_bucket", metricLabels("function", function, "le", le), float64(cumulative))
+		}
+		writeMetric(buf, name+"_bucket", metricLabels("function", function, "le", "+Inf"), float64(h.count))
+		writeMetric(buf, name+"_sum", metricLabels("function", function), h.sum)
+		writeMetric(buf, name+"_count", metricLabels("function", function), float64(h.count))
+	}
+}
+
+func (m *Metrics) writeWrites(buf *bytes.Buffer) {
+	keys := make([]writeKey, 0, len(m.writes))
+	for key := range m.writes {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].unitId != keys[j].unitId {
+			return keys[i].unitId < keys[j].unitId
+		}
+		if keys[i].table != keys[j].table {
+			return keys[i].table < keys[j].table
+		}
+		return keys[i].addr < keys[j].addr
+	})
+
+	writeMetricHeader(buf, "modbus_writes_total", "counter", "Successful writes of coils and holding registers, by address.")
+	for _, key := range keys {
+		labels := metricLabels(
+			"unit", strconv.Itoa(int(key.unitId)),
+			"table", key.table,
+			"address", strconv.Itoa(int(key.addr)),
+		)
+		writeMetric(buf, "modbus_writes_total", labels, float64(m.writes[key]))
+	}
+}
+
+// MetricsServer serves the metrics over HTTP at /metrics.
+type MetricsServer struct {
+	address string
+	metrics *Metrics
+	server  *http.Server
+	logger  *logging.Logger
+}
+
+func NewMetricsServer(address string, metrics *Metrics, logger *logging.Logger) *MetricsServer {
+	return &MetricsServer{
+		address: address,
+		metrics: metrics,
+		logger:  logger,
+	}
+}
+
+func (s *MetricsServer) Start() error {
+	listener, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", s.address, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if _, err := s.metrics.WriteTo(w); err != nil {
+			s.logger.Warn("Could not write metrics", logging.FieldClientAddr(r.RemoteAddr), logging.FieldError(err))
+		}
+	})
+
+	s.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("Metrics server stopped", logging.FieldError(err))
+		}
+	}()
+
+	return nil
+}
+
+func (s *MetricsServer) Stop() error {
+	if s.server == nil {
+		return nil
+	}
+
+	err := s.server.Close()
+	s.server = nil
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// newMetricsDispatcher serves unit 1 behind rate limiting, fault injection
+// and access control: holding register 101 can't be written, 0x03 is
+// limited to one request and 0x04 is dropped.
+func newMetricsDispatcher(t *testing.T, metrics *Metrics) *RequestDispatcher {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		Coils:            []Coil{{addr: 10}},
+		InputRegisters:   []Register{{addr: 30}},
+		HoldingRegisters: []Register{{addr: 100}, {addr: 101}},
+	})
+	router := NewUnitRouter(nil, logger)
+	router.AddUnit(1, NewAdapterHandler(NewModbusHandler(service, nil, logger), logger))
+
+	access, err := NewAccessControlMiddleware(router, AccessConfig{
+		Default: ClientAccessReadWrite,
+		Rules: []AccessRule{{
+			Ranges: []AddressRange{{Table: holdingRegistersSection.name, Start: 101, End: 101}},
+			Deny:   []string{OperationWrite},
+		}},
+	}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	faults := NewFaultInjectionMiddleware(access, FaultsConfig{
+		Enabled: true,
+		Rules:   []FaultRule{{FunctionCodes: []uint8{fcReadInputRegisters}, Drop: true}},
+	}, logger)
+	rateLimit := NewRateLimitMiddleware(faults, RateLimitConfig{
+		Rate:          1000,
+		FunctionCodes: []FunctionRateLimit{{FunctionCode: fcReadHoldingRegisters, Rate: 0.001, Burst: 1}},
+	}, logger)
+
+	return NewRequestDispatcher(NewFallbackMiddleware(rateLimit, logger), NewDiagnostics(), metrics, nil, logger)
+}
+
+func scrape(t *testing.T, metrics *Metrics) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestMetricsCountEveryAnswer(t *testing.T) {
+	metrics := NewMetrics(true)
+	dispatcher := newMetricsDispatcher(t, metrics)
+
+	requests := []pdu{
+		// multiple writes of a single item keep their function code
+		{unitId: 1, functionCode: fcWriteMultipleRegisters, payload: []byte{0x00, 100, 0x00, 1, 2, 0x12, 0x34}},
+		{unitId: 1, functionCode: fcWriteMultipleCoils, payload: []byte{0x00, 10, 0x00, 1, 1, 0x01}},
+		{unitId: 1, functionCode: fcWriteSingleRegister, payload: []byte{0x00, 100, 0x00, 0x01}},
+		// denied by access control
+		{unitId: 1, functionCode: fcWriteSingleRegister, payload: []byte{0x00, 101, 0x00, 0x01}},
+		// the second one is answered busy by rate limiting
+		{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 2}},
+		{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 2}},
+		// answered by the dispatcher itself
+		{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0x00, 0x00, 0xAB, 0xCD}},
+	}
+	for _, req := range requests {
+		if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); err != nil {
+			t.Fatalf("dispatch function code 0x%02X: %v", req.functionCode, err)
+		}
+	}
+
+	// dropped by fault injection
+	_, err := dispatcher.Dispatch("192.0.2.1:5000", "", pdu{unitId: 1, functionCode: fcReadInputRegisters, payload: []byte{0x00, 30, 0x00, 1}})
+	if !errors.Is(err, ErrDropResponse) {
+		t.Fatalf("dispatch dropped request: got %v, want %v", err, ErrDropResponse)
+	}
+
+	scraped := scrape(t, metrics)
+	for _, line := range []string{
+		`modbus_requests_total{function="0x03",unit="1",result="0x06"} 1`,
+		`modbus_requests_total{function="0x03",unit="1",result="ok"} 1`,
+		`modbus_requests_total{function="0x04",unit="1",result="dropped"} 1`,
+		`modbus_requests_total{function="0x06",unit="1",result="0x01"} 1`,
+		`modbus_requests_total{function="0x06",unit="1",result="ok"} 1`,
+		`modbus_requests_total{function="0x08",unit="1",result="ok"} 1`,
+		`modbus_requests_total{function="0x0F",unit="1",result="ok"} 1`,
+		`modbus_requests_total{function="0x10",unit="1",result="ok"} 1`,
+		`modbus_request_duration_seconds_count{function="0x03"} 2`,
+		`modbus_writes_total{unit="1",table="coils",address="10"} 1`,
+		`modbus_writes_total{unit="1",table="holding_registers",address="100"} 2`,
+	} {
+		if !strings.Contains(scraped, line+"\n") {
+			t.Errorf("metrics lack %s", line)
+		}
+	}
+
+	if strings.Contains(scraped, `address="101"`) {
+		t.Errorf("denied write counted:\n%s", scraped)
+	}
+}
+
+func TestMetricsAddressWritesOptIn(t *testing.T) {
+	metrics := NewMetrics(false)
+	dispatcher := newMetricsDispatcher(t, metrics)
+
+	req := pdu{unitId: 1, functionCode: fcWriteSingleRegister, payload: []byte{0x00, 100, 0x00, 0x01}}
+	if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); err != nil {
+		t.Fatal(err)
+	}
+
+	scraped := scrape(t, metrics)
+	if !strings.Contains(scraped, `modbus_requests_total{function="0x06",unit="1",result="ok"} 1`) {
+		t.Errorf("write not counted:\n%s", scraped)
+	}
+	if strings.Contains(scraped, "modbus_writes_total") {
+		t.Errorf("writes by address counted without opting in:\n%s", scraped)
+	}
+}
+
+func TestMetricsNil(t *testing.T) {
+	dispatcher := newMetricsDispatcher(t, nil)
+
+	req := pdu{unitId: 1, functionCode: fcWriteSingleRegister, payload: []byte{0x00, 100, 0x00, 0x01}}
+	if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+type DataType string
+
+const (
+	DataTypeUint16  DataType = "uint16"
+	DataTypeInt16   DataType = "int16"
+	DataTypeUint32  DataType = "uint32"
+	DataTypeInt32   DataType = "int32"
+	DataTypeFloat32 DataType = "float32"
+	DataTypeString  DataType = "string"
+)
+
+type ByteOrder string
+
+const (
+	ByteOrderBig    ByteOrder = "big"
+	ByteOrderLittle ByteOrder = "little"
+)
+
+type WordOrder string
+
+const (
+	WordOrderHighFirst WordOrder = "high_first"
+	WordOrderLowFirst  WordOrder = "low_first"
+)
+
+type Access string
+
+const (
+	AccessReadWrite Access = "read-write"
+	AccessReadOnly  Access = "read-only"
+)
+
+var (
+	ErrUnknownDataType  = errors.New("unknown data type")
+	ErrUnknownByteOrder = errors.New("unknown byte order")
+	ErrUnknownWordOrder = errors.New("unknown word order")
+	ErrUnknownAccess    = errors.New("unknown access mode")
+	ErrValueOutOfRange  = errors.New("value out of range")
+	ErrNotForCoils      = errors.New("setting does not apply to coils")
+)
+
+// Point describes a single data point of the register map. A point covers
+// one coil, or one or more consecutive registers depending on its type.
+// Register values are stored raw, the engineering value of a numeric point
+// is raw * Scale.
+type Point struct {
+	Addr uint16 `json:"-"`
+
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Unit        string    `json:"unit,omitempty"`
+	Type        DataType  `json:"type,omitempty"`
+	Length      int       `json:"length,omitempty"`
+	ByteOrder   ByteOrder `json:"byte_order,omitempty"`
+	WordOrder   WordOrder `json:"word_order,omitempty"`
+	Scale       float64   `json:"scale,omitempty"`
+	Access      Access    `json:"access,omitempty"`
+	Min         *float64  `json:"min,omitempty"`
+	Max         *float64  `json:"max,omitempty"`
+}
+
+// PointSet holds the points that carry metadata, per table.
+type PointSet struct {
+	Coils            []*Point
+	DiscreteInputs   []*Point
+	HoldingRegisters []*Point
+	InputRegisters   []*Point
+}
+
+// normalize fills in defaults and checks the settings of a register point.
+func (p *Point) normalize() error {
+	if p.Type == "" {
+		p.Type = DataTypeUint16
+	}
+	if p.ByteOrder == "" {
+		p.ByteOrder = ByteOrderBig
+	}
+	if p.WordOrder == "" {
+		p.WordOrder = WordOrderHighFirst
+	}
+	if p.Scale == 0 {
+		p.Scale = 1
+	}
+	if p.Access == "" {
+		p.Access = AccessReadWrite
+	}
+
+	switch p.Type {
+	case DataTypeUint16, DataTypeInt16, DataTypeUint32, DataTypeInt32, DataTypeFloat32:
+		if p.Length != 0 {
+			return fmt.Errorf("length only applies to strings, got type %s", p.Type)
+		}
+	case DataTypeString:
+		if p.Length < 1 {
+			return fmt.Errorf("string point needs a length of at least 1 register")
+		}
+	default:
+		return fmt.Errorf("%w %q", ErrUnknownDataType, p.Type)
+	}
+
+	if p.ByteOrder != ByteOrderBig && p.ByteOrder != ByteOrderLittle {
+		return fmt.Errorf("%w %q", ErrUnknownByteOrder, p.ByteOrder)
+	}
+
+	if p.WordOrder != WordOrderHighFirst && p.WordOrder != WordOrderLowFirst {
+		return fmt.Errorf("%w %q", ErrUnknownWordOrder, p.WordOrder)
+	}
+
+	if err := p.normalizeAccess(); err != nil {
+		return err
+	}
+
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return fmt.Errorf("min %v is greater than max %v", *p.Min, *p.Max)
+	}
+
+	return nil
+}
+
+// normalizeCoil fills in defaults and checks the settings of a coil point.
+func (p *Point) normalizeCoil() error {
+	if p.Type != "" || p.Length != 0 || p.ByteOrder != "" || p.WordOrder != "" ||
+		p.Scale != 0 || p.Min != nil || p.Max != nil || p.Unit != "" {
+		return fmt.Errorf("type, length, byte_order, word_order, scale, unit, min and max: %w", ErrNotForCoils)
+	}
+
+	if p.Access == "" {
+		p.Access = AccessReadWrite
+	}
+
+	return p.normalizeAccess()
+}
+
+func (p *Point) normalizeAccess() error {
+	if p.Access != AccessReadWrite && p.Access != AccessReadOnly {
+		return fmt.Errorf("%w %q", ErrUnknownAccess, p.Access)
+	}
+	return nil
+}
+
+// Registers returns the number of registers the point spans.
+func (p *Point) Registers() int {
+	switch p.Type {
+	case DataTypeUint32, DataTypeInt32, DataTypeFloat32:
+		return 2
+	case DataTypeString:
+		return p.Length
+	}
+	return 1
+}
+
+func (p *Point) IsReadOnly() bool {
+	return p.Access == AccessReadOnly
+}
+
+// Label names the point in log and error messages.
+func (p *Point) Label() string {
+	if p.Name != "" {
+		return fmt.Sprintf("%q (0x%X)", p.Name, p.Addr)
+	}
+	return fmt.Sprintf("0x%X", p.Addr)
+}
+
+// Bounds returns the limits of the engineering value: min/max if set,
+// otherwise the range of the data type.
+func (p *Point) Bounds() (float64, float64) {
+	var low, high float64
+	switch p.Type {
+	case DataTypeInt16:
+		low, high = math.MinInt16, math.MaxInt16
+	case DataTypeUint32:
+		low, high = 0, math.MaxUint32
+	case DataTypeInt32:
+		low, high = math.MinInt32, math.MaxInt32
+	case DataTypeFloat32:
+		low, high = -math.MaxFloat32, math.MaxFloat32
+	default:
+		low, high = 0, math.MaxUint16
+	}
+
+	if p.Type != DataTypeFloat32 {
+		low, high = low*p.Scale, high*p.Scale
+		if low > high {
+			low, high = high, low
+		}
+	}
+
+	if p.Min != nil {
+		low = *p.Min
+	}
+	if p.Max != nil {
+		high = *p.Max
+	}
+	return low, high
+}
+
+// CheckLimits reports whether the engineering value is within min/max.
+func (p *Point) CheckLimits(value float64) error {
+	if p.Min != nil && value < *p.Min {
+		return fmt.Errorf("%v is below min %v of point %s: %w", value, *p.Min, p.Label(), ErrValueOutOfRange)
+	}
+	if p.Max != nil && value > *p.Max {
+		return fmt.Errorf("%v is above max %v of point %s: %w", value, *p.Max, p.Label(), ErrValueOutOfRange)
+	}
+	return nil
+}
+
+// Encode turns the engineering value into raw register values.
+func (p *Point) Encode(value float64) ([]uint16, error) {
+	if p.Type == DataTypeString {
+		return nil, fmt.Errorf("point %s is a string", p.Label())
+	}
+
+	if p.Type == DataTypeFloat32 {
+		return p.words(math.Float32bits(float32(value / p.Scale))), nil
+	}
+
+	raw := math.Round(value / p.Scale)
+	switch p.Type {
+	case DataTypeInt16:
+		if raw < math.MinInt16 || raw > math.MaxInt16 {
+			return nil, fmt.Errorf("%v does not fit int16: %w", value, ErrValueOutOfRange)
+		}
+		return []uint16{p.orderBytes(uint16(int16(raw)))}, nil
+
+	case DataTypeUint32:
+		if raw < 0 || raw > math.MaxUint32 {
+			return nil, fmt.Errorf("%v does not fit uint32: %w", value, ErrValueOutOfRange)
+		}
+		return p.words(uint32(raw)), nil
+
+	case DataTypeInt32:
+		if raw < math.MinInt32 || raw > math.MaxInt32 {
+			return nil, fmt.Errorf("%v does not fit int32: %w", value, ErrValueOutOfRange)
+		}
+		return p.words(uint32(int32(raw))), nil
+	}
+
+	if raw < 0 || raw > math.MaxUint16 {
+		return nil, fmt.Errorf("%v does not fit uint16: %w", value, ErrValueOutOfRange)
+	}
+	return []uint16{p.orderBytes(uint16(raw))}, nil
+}
+
+// Decode turns raw register values into the engineering value.
+func (p *Point) Decode(registers []uint16) float64 {
+	switch p.Type {
+	case DataTypeInt16:
+		return float64(int16(p.orderBytes(registers[0]))) * p.Scale
+	case DataTypeUint32:
+		return float64(p.dword(registers)) * p.Scale
+	case DataTypeInt32:
+		return float64(int32(p.dword(registers))) * p.Scale
+	case DataTypeFloat32:
+		return float64(math.Float32frombits(p.dword(registers))) * p.Scale
+	}
+	return float64(p.orderBytes(registers[0])) * p.Scale
+}
+
+// EncodeString turns text into raw registers, two characters per register,
+// padded with zeros.
+func (p *Point) EncodeString(text string) ([]uint16, error) {
+	if len(text) > 2*p.Length {
+		return nil, fmt.Errorf("%q is longer than %d characters: %w", text, 2*p.Length, ErrValueOutOfRange)
+	}
+
+	bytes := make([]byte, 2*p.Length)
+	copy(bytes, text)
+
+	result := make([]uint16, 0, p.Length)
+	for i := 0; i < len(bytes); i += 2 {
+		result = append(result, p.orderBytes(uint16(bytes[i])<<8|uint16(bytes[i+1])))
+	}
+	return result, nil
+}
+
+// DecodeString turns raw registers into text, dropping the zero padding.
+func (p *Point) DecodeString(registers []uint16) string {
+	bytes := make([]byte, 0, 2*len(registers))
+	for _, r := range registers {
+		r = p.orderBytes(r)
+		bytes = append(bytes, byte(r>>8), byte(r))
+	}
+	return strings.TrimRight(string(bytes), "\x00")
+}
+
+// Format renders the engineering value of the point with its unit.
+func (p *Point) Format(registers []uint16) string {
+	if p.Type == DataTypeString {
+		return fmt.Sprintf("%q", p.DecodeString(registers))
+	}
+
+	value := fmt.Sprintf("%g", p.Decode(registers))
+	if p.Unit != "" {
+		value += " " + p.Unit
+	}
+	return value
+}
+
+func (p *Point) orderBytes(register uint16) uint16 {
+	if p.ByteOrder == ByteOrderLittle {
+		return register<<8 | register>>8
+	}
+	return register
+}
+
+func (p *Point) words(value uint32) []uint16 {
+	high := p.orderBytes(uint16(value >> 16))
+	low := p.orderBytes(uint16(value))
+	if p.WordOrder == WordOrderLowFirst {
+		return []uint16{low, high}
+	}
+	return []uint16{high, low}
+}
+
+func (p *Point) dword(registers []uint16) uint32 {
+	high, low := p.orderBytes(registers[0]), p.orderBytes(registers[1])
+	if p.WordOrder == WordOrderLowFirst {
+		high, low = low, high
+	}
+	return uint32(high)<<16 | uint32(low)
+}
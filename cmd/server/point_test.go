@@ -0,0 +1,189 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func newTestPoint(t *testing.T, point Point) *Point {
+	t.Helper()
+
+	if err := point.normalize(); err != nil {
+		t.Fatalf("normalize %+v: %v", point, err)
+	}
+	return &point
+}
+
+func TestPointEncodeDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		point Point
+		value float64
+		raw   []uint16
+	}{
+		{"uint16", Point{}, 1234, []uint16{0x04D2}},
+		{"uint16 little endian", Point{ByteOrder: ByteOrderLittle}, 1234, []uint16{0xD204}},
+		{"int16", Point{Type: DataTypeInt16}, -2, []uint16{0xFFFE}},
+		{"int16 little endian", Point{Type: DataTypeInt16, ByteOrder: ByteOrderLittle}, -2, []uint16{0xFEFF}},
+		{"uint32", Point{Type: DataTypeUint32}, 0x12345678, []uint16{0x1234, 0x5678}},
+		{"uint32 low word first", Point{Type: DataTypeUint32, WordOrder: WordOrderLowFirst}, 0x12345678, []uint16{0x5678, 0x1234}},
+		{
+			"uint32 little endian, low word first",
+			Point{Type: DataTypeUint32, ByteOrder: ByteOrderLittle, WordOrder: WordOrderLowFirst},
+			0x12345678, []uint16{0x7856, 0x3412},
+		},
+		{"int32", Point{Type: DataTypeInt32}, -2, []uint16{0xFFFF, 0xFFFE}},
+		{"int32 low word first", Point{Type: DataTypeInt32, WordOrder: WordOrderLowFirst}, -2, []uint16{0xFFFE, 0xFFFF}},
+		{"float32", Point{Type: DataTypeFloat32}, 1.5, []uint16{0x3FC0, 0x0000}},
+		{"float32 low word first", Point{Type: DataTypeFloat32, WordOrder: WordOrderLowFirst}, 1.5, []uint16{0x0000, 0x3FC0}},
+		{"float32 little endian", Point{Type: DataTypeFloat32, ByteOrder: ByteOrderLittle}, -2, []uint16{0x00C0, 0x0000}},
+		{"scaled uint16", Point{Scale: 0.1}, 23.4, []uint16{234}},
+		{"scaled int16", Point{Type: DataTypeInt16, Scale: 10}, -50, []uint16{0xFFFB}},
+		{"scaled int32", Point{Type: DataTypeInt32, Scale: 0.01}, -1.5, []uint16{0xFFFF, 0xFF6A}},
+		{"scaled float32", Point{Type: DataTypeFloat32, Scale: 2}, 3, []uint16{0x3FC0, 0x0000}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			point := newTestPoint(t, test.point)
+
+			raw, err := point.Encode(test.value)
+			if err != nil {
+				t.Fatalf("encode %v: %v", test.value, err)
+			}
+			if !reflect.DeepEqual(raw, test.raw) {
+				t.Errorf("encode %v: got %04X, want %04X", test.value, raw, test.raw)
+			}
+
+			if got := point.Decode(test.raw); math.Abs(got-test.value) > 1e-9 {
+				t.Errorf("decode %04X: got %v, want %v", test.raw, got, test.value)
+			}
+		})
+	}
+}
+
+func TestPointEncodeOutOfRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		point Point
+		value float64
+	}{
+		{"uint16 above", Point{}, 65536},
+		{"uint16 negative", Point{}, -1},
+		{"int16 above", Point{Type: DataTypeInt16}, 32768},
+		{"int16 below", Point{Type: DataTypeInt16}, -32769},
+		{"uint32 negative", Point{Type: DataTypeUint32}, -1},
+		{"int32 above", Point{Type: DataTypeInt32}, math.MaxInt32 + 1},
+		{"scaled uint16 above", Point{Scale: 0.1}, 6553.6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			point := newTestPoint(t, test.point)
+			if _, err := point.Encode(test.value); !errors.Is(err, ErrValueOutOfRange) {
+				t.Errorf("encode %v: got %v, want %v", test.value, err, ErrValueOutOfRange)
+			}
+		})
+	}
+}
+
+func TestPointString(t *testing.T) {
+	tests := []struct {
+		name  string
+		point Point
+		text  string
+		raw   []uint16
+	}{
+		{"padded", Point{Type: DataTypeString, Length: 2}, "ABC", []uint16{0x4142, 0x4300}},
+		{"full", Point{Type: DataTypeString, Length: 2}, "ABCD", []uint16{0x4142, 0x4344}},
+		{"little endian", Point{Type: DataTypeString, Length: 2, ByteOrder: ByteOrderLittle}, "ABC", []uint16{0x4241, 0x0043}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			point := newTestPoint(t, test.point)
+
+			raw, err := point.EncodeString(test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(raw, test.raw) {
+				t.Errorf("encode %q: got %04X, want %04X", test.text, raw, test.raw)
+			}
+			if got := point.DecodeString(raw); got != test.text {
+				t.Errorf("decode %04X: got %q, want %q", raw, got, test.text)
+			}
+		})
+	}
+
+	point := newTestPoint(t, Point{Type: DataTypeString, Length: 2})
+	if _, err := point.EncodeString("ABCDE"); !errors.Is(err, ErrValueOutOfRange) {
+		t.Errorf("encode a too long string: got %v, want %v", err, ErrValueOutOfRange)
+	}
+	if _, err := point.Encode(1); err == nil {
+		t.Error("encoded a number into a string point")
+	}
+}
+
+func TestPointLimits(t *testing.T) {
+	min, max := -10.0, 10.0
+	point := newTestPoint(t, Point{Type: DataTypeInt16, Min: &min, Max: &max})
+
+	for _, value := range []float64{-10, 0, 10} {
+		if err := point.CheckLimits(value); err != nil {
+			t.Errorf("check %v: %v", value, err)
+		}
+	}
+	for _, value := range []float64{-10.5, 11} {
+		if err := point.CheckLimits(value); !errors.Is(err, ErrValueOutOfRange) {
+			t.Errorf("check %v: got %v, want %v", value, err, ErrValueOutOfRange)
+		}
+	}
+
+	if low, high := point.Bounds(); low != min || high != max {
+		t.Errorf("bounds with min/max: got %v..%v, want %v..%v", low, high, min, max)
+	}
+
+	scaled := newTestPoint(t, Point{Type: DataTypeInt16, Scale: -0.5})
+	if low, high := scaled.Bounds(); low != -16383.5 || high != 16384 {
+		t.Errorf("bounds of a negative scale: got %v..%v, want -16383.5..16384", low, high)
+	}
+}
+
+func TestPointNormalize(t *testing.T) {
+	min, max := 10.0, 0.0
+
+	tests := []struct {
+		name  string
+		point Point
+		want  error
+	}{
+		{"unknown type", Point{Type: "int64"}, ErrUnknownDataType},
+		{"unknown byte order", Point{ByteOrder: "middle"}, ErrUnknownByteOrder},
+		{"unknown word order", Point{WordOrder: "middle"}, ErrUnknownWordOrder},
+		{"unknown access", Point{Access: "write-only"}, ErrUnknownAccess},
+		{"length of a number", Point{Length: 2}, nil},
+		{"string without length", Point{Type: DataTypeString}, nil},
+		{"min above max", Point{Min: &min, Max: &max}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			point := test.point
+			err := point.normalize()
+			if err == nil {
+				t.Fatal("no error")
+			}
+			if test.want != nil && !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+
+	coil := Point{Scale: 2}
+	if err := coil.normalizeCoil(); !errors.Is(err, ErrNotForCoils) {
+		t.Errorf("coil with scale: got %v, want %v", err, ErrNotForCoils)
+	}
+}
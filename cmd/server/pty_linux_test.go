@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// openPty opens a new pseudo terminal and returns its master side and the
+// path of its slave side, which acts as the serial port.
+func openPty(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Skipf("no pseudo terminals: %v", err)
+	}
+
+	conn, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+
+	var number uint32
+	var ioctlErr error
+	err = conn.Control(func(fd uintptr) {
+		var unlock int32
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+			ioctlErr = fmt.Errorf("unlock pty: %w", errno)
+			return
+		}
+		if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&number))); errno != 0 {
+			ioctlErr = fmt.Errorf("get pty number: %w", errno)
+		}
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	if err != nil {
+		master.Close()
+		t.Fatal(err)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", number)
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !linux
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func openPty(t *testing.T) (*os.File, string) {
+	t.Skip("pseudo terminals are only opened on linux")
+	return nil, ""
+}
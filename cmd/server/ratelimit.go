@@ -0,0 +1,345 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// rateLimitMaxClients is how many clients are tracked, the one silent the
+// longest is forgotten to make room for a new one.
+const rateLimitMaxClients = 1024
+
+// RateLimitConfig limits how many requests each client may send. Clients
+// are told apart by IP address, all clients of the rtu listener share the
+// serial port.
+type RateLimitConfig struct {
+	// Rate is the number of requests per second each client may send, zero
+	// disables the limit.
+	Rate float64 `json:"rate"`
+	// Burst is how many requests may be sent at once after a pause, zero
+	// allows a second's worth of requests.
+	Burst uint `json:"burst"`
+	// FunctionCodes limits some function codes further, each one with its
+	// own bucket per client.
+	FunctionCodes []FunctionRateLimit `json:"function_codes"`
+}
+
+// FunctionRateLimit is the limit of a single function code. A write of a
+// single coil or register counts against the limits of both its single and
+// multiple write codes, the handler chain can't tell them apart.
+type FunctionRateLimit struct {
+	FunctionCode uint8   `json:"function_code"`
+	Rate         float64 `json:"rate"`
+	Burst        uint    `json:"burst"`
+}
+
+// Validate reports the problems of the rate limit settings.
+func (c RateLimitConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	if c.Rate < 0 {
+		problems = append(problems, fmt.Sprintf("rate: must not be negative, got %v", c.Rate))
+	}
+
+	if c.Rate == 0 && c.Burst != 0 {
+		problems = append(problems, "burst: requires a rate")
+	}
+
+	seen := make(map[uint8]bool)
+	for i, limit := range c.FunctionCodes {
+		if !containsUint8(chainFunctionCodes, limit.FunctionCode) {
+			problems = append(problems, fmt.Sprintf("function_codes[%d].function_code: 0x%02X can not be rate limited", i, limit.FunctionCode))
+		}
+
+		if seen[limit.FunctionCode] {
+			problems = append(problems, fmt.Sprintf("function_codes[%d].function_code: 0x%02X is listed more than once", i, limit.FunctionCode))
+		}
+		seen[limit.FunctionCode] = true
+
+		if limit.Rate <= 0 {
+			problems = append(problems, fmt.Sprintf("function_codes[%d].rate: must be positive, got %v", i, limit.Rate))
+		}
+	}
+
+	return problems
+}
+
+// tokenBucket refills rate tokens per second up to burst, every request
+// takes one.
+type tokenBucket struct {
+	name   string
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// refused counts the requests refused since the bucket ran empty, so
+	// only the start and the end of a flood are logged.
+	refused uint64
+}
+
+func newTokenBucket(name string, rate float64, burst uint, now time.Time) *tokenBucket {
+	size := float64(burst)
+	if burst == 0 {
+		size = math.Max(1, math.Ceil(rate))
+	}
+
+	return &tokenBucket{
+		name:   name,
+		rate:   rate,
+		burst:  size,
+		tokens: size,
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// RateLimitStat is how many requests of a client passed and how many were
+// answered Server Device Busy.
+type RateLimitStat struct {
+	Client  string
+	Passed  uint64
+	Limited uint64
+}
+
+func (s RateLimitStat) String() string {
+	return fmt.Sprintf("%s: %d passed, %d limited", s.Client, s.Passed, s.Limited)
+}
+
+// rateLimitedClient holds the buckets and counters of a client.
+type rateLimitedClient struct {
+	bucket    *tokenBucket
+	functions map[uint8]*tokenBucket
+
+	RateLimitStat
+}
+
+// RateLimitMiddleware answers Server Device Busy to clients sending more
+// requests than their token buckets allow: one per client and one per
+// client and limited function code. A request must get a token from every
+// bucket it counts against.
+type RateLimitMiddleware struct {
+	base   RequestHandler
+	logger *logging.Logger
+	config RateLimitConfig
+	limits map[uint8]FunctionRateLimit
+
+	// now is the clock of the buckets, replaced in tests.
+	now func() time.Time
+
+	lock sync.Mutex
+	// clients holds the elements of recent, most recent first.
+	clients map[string]*list.Element
+	recent  *list.List
+}
+
+func NewRateLimitMiddleware(base RequestHandler, config RateLimitConfig, logger *logging.Logger) *RateLimitMiddleware {
+	middleware := &RateLimitMiddleware{
+		base:    base,
+		logger:  logger,
+		config:  config,
+		limits:  make(map[uint8]FunctionRateLimit, len(config.FunctionCodes)),
+		now:     time.Now,
+		clients: make(map[string]*list.Element),
+		recent:  list.New(),
+	}
+
+	for _, limit := range config.FunctionCodes {
+		middleware.limits[limit.FunctionCode] = limit
+	}
+
+	return middleware
+}
+
+// Enabled tells whether any limit is set.
+func (h *RateLimitMiddleware) Enabled() bool {
+	return h.config.Rate > 0 || len(h.limits) != 0
+}
+
+// Stats returns the counters of every tracked client, by client.
+func (h *RateLimitMiddleware) Stats() []RateLimitStat {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	stats := make([]RateLimitStat, 0, len(h.clients))
+	for e := h.recent.Front(); e != nil; e = e.Next() {
+		stats = append(stats, e.Value.(*rateLimitedClient).RateLimitStat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Client < stats[j].Client
+	})
+	return stats
+}
+
+// ClearStats resets the counters of every client, the buckets are kept.
+func (h *RateLimitMiddleware) ClearStats() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for e := h.recent.Front(); e != nil; e = e.Next() {
+		client := e.Value.(*rateLimitedClient)
+		client.Passed = 0
+		client.Limited = 0
+	}
+}
+
+// client returns the state of a client, creating it on its first request,
+// and marks it as the most recent one.
+func (h *RateLimitMiddleware) client(key string, now time.Time) *rateLimitedClient {
+	if e, ok := h.clients[key]; ok {
+		h.recent.MoveToFront(e)
+		return e.Value.(*rateLimitedClient)
+	}
+
+	if h.recent.Len() >= rateLimitMaxClients {
+		oldest := h.recent.Back()
+		h.recent.Remove(oldest)
+		delete(h.clients, oldest.Value.(*rateLimitedClient).Client)
+	}
+
+	client := &rateLimitedClient{
+		functions:     make(map[uint8]*tokenBucket),
+		RateLimitStat: RateLimitStat{Client: key},
+	}
+	if h.config.Rate > 0 {
+		client.bucket = newTokenBucket("rate limit", h.config.Rate, h.config.Burst, now)
+	}
+	h.clients[key] = h.recent.PushFront(client)
+	return client
+}
+
+// allow takes a token from every bucket the request counts against, or
+// none if one of them is empty.
+func (h *RateLimitMiddleware) allow(clientAddr string, functionCodes []uint8) bool {
+	if !h.Enabled() {
+		return true
+	}
+
+	key := clientAddr
+	if ip := clientIP(clientAddr); ip != nil {
+		key = ip.String()
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := h.now()
+	client := h.client(key, now)
+
+	buckets := make([]*tokenBucket, 0, 1+len(functionCodes))
+	if client.bucket != nil {
+		buckets = append(buckets, client.bucket)
+	}
+	for _, code := range functionCodes {
+		limit, ok := h.limits[code]
+		if !ok {
+			continue
+		}
+
+		bucket, ok := client.functions[code]
+		if !ok {
+			bucket = newTokenBucket(fmt.Sprintf("rate limit of function 0x%02X", code), limit.Rate, limit.Burst, now)
+			client.functions[code] = bucket
+		}
+		buckets = append(buckets, bucket)
+	}
+
+	allowed := true
+	for _, bucket := range buckets {
+		bucket.refill(now)
+		allowed = allowed && bucket.tokens >= 1
+	}
+
+	if !allowed {
+		client.Limited++
+		for _, bucket := range buckets {
+			if bucket.tokens >= 1 {
+				continue
+			}
+
+			if bucket.refused == 0 {
+				h.logger.Warn("Client exceeded its limit, answering Server Device Busy", logging.FieldClientAddr(key), logging.Field("limit", bucket.name))
+			}
+			bucket.refused++
+		}
+		return false
+	}
+
+	client.Passed++
+	for _, bucket := range buckets {
+		bucket.tokens--
+
+		if bucket.refused != 0 {
+			h.logger.Info("Client is back within its limit", logging.FieldClientAddr(key), logging.Field("limit", bucket.name), logging.Field("refused", bucket.refused))
+			bucket.refused = 0
+		}
+	}
+	return true
+}
+
+func (h *RateLimitMiddleware) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	if !h.allow(req.ClientAddr, boolFunctionCodes(fcReadCoils, req.IsWrite, req.Quantity)) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleCoils(req)
+}
+
+func (h *RateLimitMiddleware) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	if !h.allow(req.ClientAddr, []uint8{fcReadDiscreteInputs}) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleDiscreteInputs(req)
+}
+
+func (h *RateLimitMiddleware) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	if !h.allow(req.ClientAddr, registerFunctionCodes(fcReadHoldingRegisters, req.IsWrite, req.Quantity)) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleHoldingRegisters(req)
+}
+
+func (h *RateLimitMiddleware) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	if !h.allow(req.ClientAddr, []uint8{fcReadInputRegisters}) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleInputRegisters(req)
+}
+
+func (h *RateLimitMiddleware) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	if !h.allow(req.ClientAddr, []uint8{fcMaskWriteRegister}) {
+		return modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleMaskWriteRegister(req)
+}
+
+func (h *RateLimitMiddleware) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	if !h.allow(req.ClientAddr, []uint8{fcReadWriteMultipleRegisters}) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleReadWriteRegisters(req)
+}
+
+func (h *RateLimitMiddleware) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	if !h.allow(req.ClientAddr, []uint8{fcEncapsulatedInterface}) {
+		return IdentificationResult{}, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleDeviceIdentification(req)
+}
+
+func (h *RateLimitMiddleware) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	if !h.allow(req.ClientAddr, []uint8{req.FunctionCode}) {
+		return nil, modbus.ErrServerDeviceBusy
+	}
+	return h.base.HandleDiagnostics(req)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// newTestRateLimit serves holding register 100 and input register 30 of
+// unit 1 behind the rate limit, its buckets refilled by the returned clock.
+func newTestRateLimit(t *testing.T, config RateLimitConfig) (*RateLimitMiddleware, *testClock) {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		InputRegisters:   []Register{{addr: 30}},
+		HoldingRegisters: []Register{{addr: 100}},
+	})
+	router := NewUnitRouter(nil, logger)
+	router.AddUnit(1, NewAdapterHandler(NewModbusHandler(service, nil, logger), logger))
+
+	rateLimit := NewRateLimitMiddleware(router, config, logger)
+	clock := &testClock{at: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	rateLimit.now = clock.now
+	return rateLimit, clock
+}
+
+// rateLimited sends a request with the function code and tells whether it
+// was answered Server Device Busy.
+func rateLimited(t *testing.T, rateLimit *RateLimitMiddleware, clientAddr string, functionCode uint8) bool {
+	t.Helper()
+
+	var err error
+	switch functionCode {
+	case fcReadHoldingRegisters:
+		_, err = rateLimit.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{ClientAddr: clientAddr, UnitId: 1, Addr: 100, Quantity: 1})
+	case fcWriteSingleRegister:
+		_, err = rateLimit.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{
+			ClientAddr: clientAddr, UnitId: 1, Addr: 100, Quantity: 1, IsWrite: true, Args: []uint16{1},
+		})
+	case fcReadInputRegisters:
+		_, err = rateLimit.HandleInputRegisters(&modbus.InputRegistersRequest{ClientAddr: clientAddr, UnitId: 1, Addr: 30, Quantity: 1})
+	default:
+		t.Fatalf("no request for function code 0x%02X", functionCode)
+	}
+
+	if err != nil && !errors.Is(err, modbus.ErrServerDeviceBusy) {
+		t.Fatalf("function code 0x%02X: %v", functionCode, err)
+	}
+	return err != nil
+}
+
+// expectLimited sends the requests in order and checks which of them were
+// answered Server Device Busy.
+func expectLimited(t *testing.T, rateLimit *RateLimitMiddleware, clientAddr string, functionCodes []uint8, want []bool) {
+	t.Helper()
+
+	got := make([]bool, 0, len(functionCodes))
+	for _, code := range functionCodes {
+		got = append(got, rateLimited(t, rateLimit, clientAddr, code))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("function codes %02X limited %v, want %v", functionCodes, got, want)
+	}
+}
+
+func TestRateLimitRefill(t *testing.T) {
+	rateLimit, clock := newTestRateLimit(t, RateLimitConfig{Rate: 2, Burst: 3})
+	reads := []uint8{fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadHoldingRegisters}
+
+	expectLimited(t, rateLimit, "192.0.2.1:5000", reads, []bool{false, false, false, true})
+
+	// half a second refills one token
+	clock.advance(500 * time.Millisecond)
+	expectLimited(t, rateLimit, "192.0.2.1:5000", reads[:2], []bool{false, true})
+
+	// a long pause refills up to the burst only
+	clock.advance(time.Hour)
+	expectLimited(t, rateLimit, "192.0.2.1:5000", reads, []bool{false, false, false, true})
+
+	// connections of the same address share the buckets, other addresses
+	// have their own
+	expectLimited(t, rateLimit, "192.0.2.1:6000", reads[:1], []bool{true})
+	expectLimited(t, rateLimit, "192.0.2.2:5000", reads[:1], []bool{false})
+
+	want := []RateLimitStat{{Client: "192.0.2.1", Passed: 7, Limited: 4}, {Client: "192.0.2.2", Passed: 1}}
+	if got := rateLimit.Stats(); !reflect.DeepEqual(got, want) {
+		t.Errorf("stats %v, want %v", got, want)
+	}
+}
+
+func TestRateLimitBurstDefault(t *testing.T) {
+	rateLimit, _ := newTestRateLimit(t, RateLimitConfig{Rate: 2.5})
+
+	// a second's worth of requests, rounded up
+	reads := []uint8{fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadHoldingRegisters}
+	expectLimited(t, rateLimit, "192.0.2.1:5000", reads, []bool{false, false, false, true})
+}
+
+func TestRateLimitFunctionCodes(t *testing.T) {
+	rateLimit, clock := newTestRateLimit(t, RateLimitConfig{
+		Rate:  10,
+		Burst: 4,
+		FunctionCodes: []FunctionRateLimit{
+			{FunctionCode: fcReadHoldingRegisters, Rate: 1, Burst: 1},
+			{FunctionCode: fcWriteMultipleRegisters, Rate: 1, Burst: 1},
+		},
+	})
+
+	// a refused request takes no token from the buckets it fits in
+	expectLimited(t, rateLimit, "192.0.2.1:5000",
+		[]uint8{fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadHoldingRegisters, fcReadInputRegisters, fcReadInputRegisters},
+		[]bool{false, true, true, false, false},
+	)
+
+	// the write of a single register counts against the multiple write
+	// limit too
+	expectLimited(t, rateLimit, "192.0.2.1:5000",
+		[]uint8{fcWriteSingleRegister, fcWriteSingleRegister, fcReadInputRegisters},
+		[]bool{false, true, true},
+	)
+
+	// the bucket of each function code refills at its own rate
+	clock.advance(time.Second)
+	expectLimited(t, rateLimit, "192.0.2.1:5000",
+		[]uint8{fcReadHoldingRegisters, fcReadHoldingRegisters, fcWriteSingleRegister, fcReadInputRegisters},
+		[]bool{false, true, false, false},
+	)
+}
+
+func TestRateLimitBusyAnswer(t *testing.T) {
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	rateLimit, _ := newTestRateLimit(t, RateLimitConfig{Rate: 1, Burst: 1})
+	diagnostics := NewDiagnostics()
+	dispatcher := NewRequestDispatcher(NewFallbackMiddleware(rateLimit, logger), diagnostics, nil, nil, logger)
+
+	req := pdu{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 1}}
+	if res, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); err != nil || res.functionCode != fcReadHoldingRegisters {
+		t.Fatalf("first request answered 0x%02X, %v", res.functionCode, err)
+	}
+
+	res, err := dispatcher.Dispatch("192.0.2.1:5000", "", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := pdu{unitId: 1, functionCode: fcReadHoldingRegisters | 0x80, payload: []byte{0x06}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("limited request answered %+v, want %+v", res, want)
+	}
+
+	if got := diagnostics.Counters().ServerBusy; got != 1 {
+		t.Errorf("server busy counter %d, want 1", got)
+	}
+}
+
+func TestRateLimitForgetsLeastRecentClient(t *testing.T) {
+	rateLimit, _ := newTestRateLimit(t, RateLimitConfig{Rate: 1, Burst: 1})
+
+	clientAddr := func(i int) string {
+		return fmt.Sprintf("10.0.%d.%d:5000", i/256, i%256)
+	}
+
+	for i := 0; i < rateLimitMaxClients; i++ {
+		rateLimited(t, rateLimit, clientAddr(i), fcReadHoldingRegisters)
+	}
+	// the first client is the most recent one again, the second is the
+	// least recent
+	if !rateLimited(t, rateLimit, clientAddr(0), fcReadHoldingRegisters) {
+		t.Fatal("second request of the first client not limited")
+	}
+
+	rateLimited(t, rateLimit, clientAddr(rateLimitMaxClients), fcReadHoldingRegisters)
+
+	if got := len(rateLimit.Stats()); got != rateLimitMaxClients {
+		t.Errorf("tracking %d clients, want %d", got, rateLimitMaxClients)
+	}
+	if !rateLimited(t, rateLimit, clientAddr(0), fcReadHoldingRegisters) {
+		t.Error("first client forgotten")
+	}
+	// the second client starts over with a full bucket
+	if rateLimited(t, rateLimit, clientAddr(1), fcReadHoldingRegisters) {
+		t.Error("second client not forgotten")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/recording"
+)
+
+// RequestRecorder writes the requests answered by the server to a file, one
+// JSON object per line. It records nothing until started, or when nil.
+type RequestRecorder struct {
+	lock  sync.Mutex
+	path  string
+	file  *os.File
+	first time.Time
+	// failed is set once a write error is logged, so a full disk doesn't
+	// log every request.
+	failed bool
+	logger *logging.Logger
+}
+
+func NewRequestRecorder(logger *logging.Logger) *RequestRecorder {
+	return &RequestRecorder{
+		logger: logger,
+	}
+}
+
+// Start starts a new recording in the file, overwriting it.
+func (r *RequestRecorder) Start(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("create recording: %w", err)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.path = path
+	r.file = file
+	r.first = time.Time{}
+	r.failed = false
+	return nil
+}
+
+// Stop closes the recording, requests handled afterwards are not recorded.
+func (r *RequestRecorder) Stop() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *RequestRecorder) Recording() bool {
+	if r == nil {
+		return false
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.file != nil
+}
+
+// Record writes the request received at the time.
+func (r *RequestRecorder) Record(at time.Time, request recording.RecordedRequest) {
+	if r == nil {
+		return
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.file == nil {
+		return
+	}
+
+	if r.first.IsZero() {
+		r.first = at
+	}
+	request.Offset = recording.Duration(at.Sub(r.first))
+
+	line, err := json.Marshal(request)
+	if err == nil {
+		_, err = r.file.Write(append(line, '\n'))
+	}
+
+	if err != nil && !r.failed {
+		r.logger.Error(
+			"Could not record request", logging.Field("path", r.path), logging.FieldFunctionCode(request.FunctionCode),
+			logging.FieldUnitId(request.UnitId), logging.FieldClientAddr(request.ClientAddr), logging.FieldError(err),
+		)
+	}
+	r.failed = err != nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/recording"
+	"github.com/simonvetter/modbus"
+)
+
+// startUpstreamServer serves the dump over Modbus TCP on a free port, as
+// the device a gateway unit forwards to.
+func startUpstreamServer(t *testing.T, dump Dump) (*ModbusService, string) {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(dump)
+	handler := NewAdapterHandler(NewModbusHandler(service, nil, logger), logger)
+	server := NewTCPServer(&modbus.ServerConfiguration{
+		URL:        "tcp://127.0.0.1:0",
+		Timeout:    5 * time.Second,
+		MaxClients: 10,
+	}, NewRequestDispatcher(handler, NewDiagnostics(), nil, nil, logger), nil, logger)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Stop() })
+
+	return service, "tcp://" + server.listener.Addr().String()
+}
+
+// newGatewayDispatcher serves unit 1 from the upstream, except holding
+// register 101 which is overridden by the local seed. Unit 2 is unknown.
+func newGatewayDispatcher(t *testing.T, upstreamURL string, recorder *RequestRecorder) *RequestDispatcher {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	local := NewModbusService(Dump{
+		HoldingRegisters: []Register{{addr: 101, value: 0xAAAA}},
+	})
+	upstream := NewUpstream(UpstreamConfig{URL: upstreamURL}, nil, logger)
+	t.Cleanup(func() { upstream.Close() })
+
+	router := NewUnitRouter(modbus.ErrGWTargetFailedToRespond, logger)
+	router.AddUnit(1, NewGatewayHandler(
+		NewAdapterHandler(NewModbusHandler(local, nil, logger), logger),
+		upstream,
+		GatewayConfig{
+			UpstreamConfig: UpstreamConfig{URL: upstreamURL},
+			Overrides:      []AddressRange{{Table: holdingRegistersSection.name, Start: 101, End: 101}},
+		},
+		logger))
+
+	return NewRequestDispatcher(NewFallbackMiddleware(router, logger), NewDiagnostics(), nil, recorder, logger)
+}
+
+// recordedPDU encodes a recorded request back into the request PDU it was
+// decoded from.
+func recordedPDU(r recording.RecordedRequest) pdu {
+	u16 := func(values ...uint16) []byte {
+		bytes := make([]byte, 2*len(values))
+		for i, value := range values {
+			binary.BigEndian.PutUint16(bytes[2*i:], value)
+		}
+		return bytes
+	}
+
+	req := pdu{unitId: r.UnitId, functionCode: r.FunctionCode}
+	switch r.FunctionCode {
+	case fcWriteSingleCoil:
+		value := uint16(0)
+		if r.Coils[0] {
+			value = 0xFF00
+		}
+		req.payload = u16(r.Addr, value)
+
+	case fcWriteSingleRegister:
+		req.payload = u16(r.Addr, r.Registers[0])
+
+	case fcWriteMultipleCoils:
+		bytes := encodeBools(r.Coils)
+		req.payload = append(append(u16(r.Addr, r.Quantity), uint8(len(bytes))), bytes...)
+
+	case fcWriteMultipleRegisters:
+		req.payload = append(append(u16(r.Addr, r.Quantity), uint8(2*len(r.Registers))), u16(r.Registers...)...)
+
+	case fcMaskWriteRegister:
+		req.payload = u16(r.Addr, r.Registers[0], r.Registers[1])
+
+	case fcReadWriteMultipleRegisters:
+		req.payload = append(append(u16(r.Addr, r.Quantity, r.WriteAddr, uint16(len(r.Registers))), uint8(2*len(r.Registers))), u16(r.Registers...)...)
+
+	case fcEncapsulatedInterface:
+		req.payload = []byte{meiReadDeviceIdentification, r.ReadDeviceIdCode, uint8(r.Addr)}
+
+	default:
+		req.payload = u16(r.Addr, r.Quantity)
+	}
+	return req
+}
+
+// record starts a recording, dispatches the requests and returns what was
+// recorded, without the offsets.
+func record(t *testing.T, upstreamURL string, requests []pdu) []recording.RecordedRequest {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	path := filepath.Join(t.TempDir(), "recording.jsonl")
+	recorder := NewRequestRecorder(logger)
+	if err := recorder.Start(path); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatcher := newGatewayDispatcher(t, upstreamURL, recorder)
+	for _, req := range requests {
+		if _, err := dispatcher.Dispatch("192.0.2.1:5000", "", req); err != nil {
+			t.Fatalf("dispatch function code 0x%02X: %v", req.functionCode, err)
+		}
+	}
+
+	if err := recorder.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	recorded, err := recording.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range recorded {
+		recorded[i].Offset = 0
+	}
+	return recorded
+}
+
+func TestRecordGatewayUnit(t *testing.T) {
+	dump := Dump{
+		Coils: []Coil{{addr: 10, value: true}, {addr: 11}},
+		HoldingRegisters: []Register{
+			{addr: 100, value: 0x1000}, {addr: 101, value: 0x1001},
+			{addr: 102, value: 0x1002}, {addr: 103, value: 0x1003},
+		},
+	}
+
+	_, upstreamURL := startUpstreamServer(t, dump)
+	recorded := record(t, upstreamURL, []pdu{
+		// split into upstream, local and upstream runs
+		{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 4}},
+		{unitId: 1, functionCode: fcWriteSingleRegister, payload: []byte{0x00, 102, 0xBE, 0xEF}},
+		{unitId: 1, functionCode: fcWriteMultipleCoils, payload: []byte{0x00, 10, 0x00, 2, 1, 0x02}},
+		{unitId: 1, functionCode: fcReadCoils, payload: []byte{0x00, 10, 0x00, 2}},
+		{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 4}},
+		// not served by the upstream
+		{unitId: 1, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 200, 0x00, 1}},
+		// rejected by the router
+		{unitId: 2, functionCode: fcReadHoldingRegisters, payload: []byte{0x00, 100, 0x00, 1}},
+		// not recorded, the client can't replay diagnostics
+		{unitId: 1, functionCode: fcDiagnostics, payload: []byte{0x00, 0x00, 0x12, 0x34}},
+	})
+
+	client := "192.0.2.1:5000"
+	want := []recording.RecordedRequest{
+		{
+			FunctionCode: fcReadHoldingRegisters, UnitId: 1, ClientAddr: client, Addr: 100, Quantity: 4,
+			Response: recording.RecordedResponse{Registers: []uint16{0x1000, 0xAAAA, 0x1002, 0x1003}},
+		},
+		{
+			FunctionCode: fcWriteSingleRegister, UnitId: 1, ClientAddr: client, Addr: 102, Quantity: 1,
+			Registers: []uint16{0xBEEF},
+		},
+		{
+			FunctionCode: fcWriteMultipleCoils, UnitId: 1, ClientAddr: client, Addr: 10, Quantity: 2,
+			Coils: []bool{false, true},
+		},
+		{
+			FunctionCode: fcReadCoils, UnitId: 1, ClientAddr: client, Addr: 10, Quantity: 2,
+			Response: recording.RecordedResponse{Coils: []bool{false, true}},
+		},
+		{
+			FunctionCode: fcReadHoldingRegisters, UnitId: 1, ClientAddr: client, Addr: 100, Quantity: 4,
+			Response: recording.RecordedResponse{Registers: []uint16{0x1000, 0xAAAA, 0xBEEF, 0x1003}},
+		},
+		{
+			FunctionCode: fcReadHoldingRegisters, UnitId: 1, ClientAddr: client, Addr: 200, Quantity: 1,
+			Response: recording.RecordedResponse{Exception: 0x02},
+		},
+		{
+			FunctionCode: fcReadHoldingRegisters, UnitId: 2, ClientAddr: client, Addr: 100, Quantity: 1,
+			Response: recording.RecordedResponse{Exception: 0x0B},
+		},
+	}
+
+	if len(recorded) != len(want) {
+		t.Fatalf("recorded %d requests, want %d: %+v", len(recorded), len(want), recorded)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(recorded[i], want[i]) {
+			t.Errorf("request %d:\n got %+v\nwant %+v", i, recorded[i], want[i])
+		}
+	}
+
+	// replaying the recording against the same devices gets the same
+	// responses
+	_, upstreamURL = startUpstreamServer(t, dump)
+	requests := make([]pdu, 0, len(recorded))
+	for _, r := range recorded {
+		requests = append(requests, recordedPDU(r))
+	}
+
+	replayed := record(t, upstreamURL, requests)
+	if !reflect.DeepEqual(replayed, recorded) {
+		t.Errorf("replay recorded\n%+v\nwant\n%+v", replayed, recorded)
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+const (
+	megabyte = 1024 * 1024
+	// rotatedLogTimeFormat is the time a log file was rotated at, put
+	// between its name and extension: server-2006-01-02T15-04-05.000.log.
+	rotatedLogTimeFormat = "2006-01-02T15-04-05.000"
+	compressedLogSuffix  = ".gz"
+	// rotationRetryDelay is how long the log goes on growing past its size
+	// after a failed rotation before rotating is tried again.
+	rotationRetryDelay = time.Minute
+)
+
+// LogRotationConfig rotates the log file once it grows too large. It only
+// applies when the log goes to a file.
+type LogRotationConfig struct {
+	// MaxSizeMB is the size in megabytes the log file is rotated at, zero
+	// never rotates.
+	MaxSizeMB int `json:"max_size_mb"`
+	// MaxAge is how long rotated files are kept, zero keeps them
+	// regardless of their age.
+	MaxAge Duration `json:"max_age"`
+	// MaxBackups is how many rotated files are kept, zero keeps them all.
+	MaxBackups int `json:"max_backups"`
+	// Compress gzips the rotated files.
+	Compress bool `json:"compress"`
+}
+
+// Validate reports the problems of the rotation settings.
+func (c LogRotationConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	if c.MaxSizeMB < 0 {
+		problems = append(problems, fmt.Sprintf("max_size_mb: must not be negative, got %d", c.MaxSizeMB))
+	}
+
+	if c.MaxAge < 0 {
+		problems = append(problems, fmt.Sprintf("max_age: must not be negative, got %v", time.Duration(c.MaxAge)))
+	}
+
+	if c.MaxBackups < 0 {
+		problems = append(problems, fmt.Sprintf("max_backups: must not be negative, got %d", c.MaxBackups))
+	}
+
+	if c.MaxSizeMB == 0 && (c.MaxAge != 0 || c.MaxBackups != 0 || c.Compress) {
+		problems = append(problems, "max_size_mb: max_age, max_backups and compress require a size to rotate at")
+	}
+
+	return problems
+}
+
+// RotatingFile is a log file that is renamed aside with the time of the
+// rotation once writing to it would exceed the size limit, and a new file
+// is started. Rotated files are compressed and removed in the background.
+type RotatingFile struct {
+	path   string
+	config LogRotationConfig
+	// logger reports the failures of rotation and of the background
+	// cleanup. It is only called from goroutines of its own, as it may log
+	// back into the file.
+	logger *logging.Logger
+	// now is the clock of the rotation, replaced in tests.
+	now func() time.Time
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	// retryAt is when rotating is tried again after a failure.
+	retryAt time.Time
+
+	// cleanup serializes the compression and removal of rotated files.
+	cleanup sync.Mutex
+	pending sync.WaitGroup
+}
+
+func OpenRotatingFile(path string, config LogRotationConfig, logger *logging.Logger) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:   path,
+		config: config,
+		logger: logger,
+		now:    time.Now,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	if f.size > 0 && f.size+int64(len(p)) > int64(f.config.MaxSizeMB)*megabyte && !f.now().Before(f.retryAt) {
+		if err := f.rotate(); err != nil {
+			if f.file == nil {
+				return 0, fmt.Errorf("rotate log file: %w", err)
+			}
+
+			f.retryAt = f.now().Add(rotationRetryDelay)
+			f.pending.Add(1)
+			go func() {
+				defer f.pending.Done()
+				f.logger.Error("Could not rotate log, writing on to it", logging.Field("path", f.path), logging.FieldError(err))
+			}()
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the log file aside and starts a new one. When the file
+// can't be renamed it is opened again, so the log isn't lost.
+func (f *RotatingFile) rotate() error {
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return f.reopen(fmt.Errorf("close: %w", err))
+	}
+
+	rotated := rotatedLogPath(f.path, f.now())
+	if err := os.Rename(f.path, rotated); err != nil {
+		return f.reopen(fmt.Errorf("rename: %w", err))
+	}
+
+	if err := f.open(); err != nil {
+		return err
+	}
+
+	f.pending.Add(1)
+	go func() {
+		defer f.pending.Done()
+
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+
+		if f.config.Compress {
+			if err := compressFile(rotated); err != nil {
+				f.logger.Error("Could not compress rotated log", logging.Field("path", rotated), logging.FieldError(err))
+			}
+		}
+		f.removeRotated()
+	}()
+
+	return nil
+}
+
+// reopen opens the log file again in append mode after a failed rotation
+// and returns the error of the rotation.
+func (f *RotatingFile) reopen(err error) error {
+	if openErr := f.open(); openErr != nil {
+		return fmt.Errorf("%v, reopen: %w", err, openErr)
+	}
+	return err
+}
+
+// Close closes the log file and waits for the rotated files to be
+// compressed.
+func (f *RotatingFile) Close() error {
+	f.lock.Lock()
+	file := f.file
+	f.file = nil
+	f.lock.Unlock()
+
+	f.pending.Wait()
+
+	if file == nil {
+		return nil
+	}
+	return file.Close()
+}
+
+func rotatedLogPath(path string, at time.Time) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), at.Format(rotatedLogTimeFormat), ext)
+}
+
+type rotatedLog struct {
+	path string
+	at   time.Time
+}
+
+// rotatedLogs returns the rotated files of the log, newest first.
+func (f *RotatingFile) rotatedLogs() ([]rotatedLog, error) {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(filepath.Base(f.path), ext) + "-"
+
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		return nil, err
+	}
+
+	logs := make([]rotatedLog, 0)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), compressedLogSuffix)
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) {
+			continue
+		}
+
+		at, err := time.ParseInLocation(rotatedLogTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext), time.Local)
+		if err != nil {
+			continue
+		}
+
+		logs = append(logs, rotatedLog{path: filepath.Join(filepath.Dir(f.path), entry.Name()), at: at})
+	}
+
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].at.After(logs[j].at)
+	})
+	return logs, nil
+}
+
+// removeRotated removes the rotated files beyond MaxBackups or older than
+// MaxAge.
+func (f *RotatingFile) removeRotated() {
+	if f.config.MaxBackups == 0 && f.config.MaxAge == 0 {
+		return
+	}
+
+	logs, err := f.rotatedLogs()
+	if err != nil {
+		f.logger.Error("Could not list rotated logs", logging.Field("path", f.path), logging.FieldError(err))
+		return
+	}
+
+	cutoff := f.now().Add(-time.Duration(f.config.MaxAge))
+	for i, rotated := range logs {
+		tooMany := f.config.MaxBackups != 0 && i >= f.config.MaxBackups
+		tooOld := f.config.MaxAge != 0 && rotated.at.Before(cutoff)
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := os.Remove(rotated.path); err != nil {
+			f.logger.Error("Could not remove rotated log", logging.Field("path", rotated.path), logging.FieldError(err))
+		}
+	}
+}
+
+// compressFile gzips the file next to it and removes the original.
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	tmp := path + compressedLogSuffix + ".tmp"
+	target, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := gzip.NewWriter(target)
+	if _, err := io.Copy(writer, source); err != nil {
+		target.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("compress: %w", err)
+	}
+
+	if err := writer.Close(); err != nil {
+		target.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("compress: %w", err)
+	}
+
+	if err := target.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path+compressedLogSuffix); err != nil {
+		return err
+	}
+
+	source.Close()
+	return os.Remove(path)
+}
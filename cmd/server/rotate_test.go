@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// testClock is the clock of a rotating file, read by its cleanup too.
+type testClock struct {
+	lock sync.Mutex
+	at   time.Time
+}
+
+func (c *testClock) now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.at
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.at = c.at.Add(d)
+}
+
+func openTestRotatingFile(t *testing.T, config LogRotationConfig) (*RotatingFile, *testClock) {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	f, err := OpenRotatingFile(filepath.Join(t.TempDir(), "server.log"), config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	clock := &testClock{at: time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)}
+	f.now = clock.now
+	return f, clock
+}
+
+// writeChunk writes a bit more than half a megabyte of the byte, so every
+// second chunk crosses a size limit of one megabyte.
+func writeChunk(t *testing.T, f *RotatingFile, b byte) []byte {
+	t.Helper()
+
+	chunk := bytes.Repeat([]byte{b}, megabyte/2+1)
+	if _, err := f.Write(chunk); err != nil {
+		t.Fatal(err)
+	}
+	return chunk
+}
+
+func readFile(t *testing.T, path string) []byte {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// rotatedFiles lists the names of the rotated files of the log, oldest
+// first.
+func rotatedFiles(t *testing.T, f *RotatingFile) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(filepath.Dir(f.path))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make([]string, 0)
+	for _, entry := range entries {
+		if entry.Name() != filepath.Base(f.path) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotatingFileRotatesAtSize(t *testing.T) {
+	f, clock := openTestRotatingFile(t, LogRotationConfig{MaxSizeMB: 1})
+
+	first := writeChunk(t, f, 'a')
+	rotatedAt := clock.now()
+	second := writeChunk(t, f, 'b')
+
+	rotated := rotatedLogPath(f.path, rotatedAt)
+	if got := readFile(t, rotated); !bytes.Equal(got, first) {
+		t.Errorf("rotated file has %d bytes, want the %d of the first write", len(got), len(first))
+	}
+	if got := readFile(t, f.path); !bytes.Equal(got, second) {
+		t.Errorf("log file has %d bytes, want the %d of the second write", len(got), len(second))
+	}
+	if got := filepath.Base(rotated); got != "server-2024-01-01T12-00-00.000.log" {
+		t.Errorf("rotated file named %s", got)
+	}
+}
+
+func TestRotatingFileRotationFailure(t *testing.T) {
+	f, clock := openTestRotatingFile(t, LogRotationConfig{MaxSizeMB: 1})
+
+	// a directory in the way of the rotated file fails the rename
+	blocked := rotatedLogPath(f.path, clock.now())
+	if err := os.MkdirAll(filepath.Join(blocked, "taken"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	first := writeChunk(t, f, 'a')
+	second := writeChunk(t, f, 'b')
+	if got := readFile(t, f.path); !bytes.Equal(got, append(first, second...)) {
+		t.Fatalf("log file has %d bytes after a failed rotation, want %d", len(got), len(first)+len(second))
+	}
+
+	// rotation is retried once the delay is over
+	clock.advance(rotationRetryDelay)
+	third := writeChunk(t, f, 'c')
+	if got := readFile(t, rotatedLogPath(f.path, clock.now())); len(got) != len(first)+len(second) {
+		t.Errorf("rotated file has %d bytes, want %d", len(got), len(first)+len(second))
+	}
+	if got := readFile(t, f.path); !bytes.Equal(got, third) {
+		t.Errorf("log file has %d bytes, want %d", len(got), len(third))
+	}
+}
+
+func TestRotatingFileMaxBackups(t *testing.T) {
+	f, clock := openTestRotatingFile(t, LogRotationConfig{MaxSizeMB: 1, MaxBackups: 2})
+
+	writeChunk(t, f, 'a')
+	for i := 0; i < 4; i++ {
+		clock.advance(time.Second)
+		writeChunk(t, f, 'a')
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"server-2024-01-01T12-00-03.000.log", "server-2024-01-01T12-00-04.000.log"}
+	if got := rotatedFiles(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestRotatingFileMaxAge(t *testing.T) {
+	f, clock := openTestRotatingFile(t, LogRotationConfig{MaxSizeMB: 1, MaxAge: Duration(time.Hour)})
+
+	for _, age := range []time.Duration{2 * time.Hour, 30 * time.Minute} {
+		if err := os.WriteFile(rotatedLogPath(f.path, clock.now().Add(-age)), []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not a rotated file of the log
+	if err := os.WriteFile(filepath.Join(filepath.Dir(f.path), "server-notes.log"), []byte("notes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	writeChunk(t, f, 'a')
+	writeChunk(t, f, 'a')
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"server-2024-01-01T11-30-00.000.log",
+		"server-2024-01-01T12-00-00.000.log",
+		"server-notes.log",
+	}
+	if got := rotatedFiles(t, f); !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
+
+func TestRotatingFileCompress(t *testing.T) {
+	f, clock := openTestRotatingFile(t, LogRotationConfig{MaxSizeMB: 1, Compress: true})
+
+	first := writeChunk(t, f, 'a')
+	rotatedAt := clock.now()
+	writeChunk(t, f, 'b')
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := rotatedLogPath(f.path, rotatedAt)
+	if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+		t.Errorf("uncompressed rotated file left: %v", err)
+	}
+
+	compressed, err := os.Open(rotated + compressedLogSuffix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer compressed.Close()
+
+	reader, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, first) {
+		t.Errorf("compressed file has %d bytes, want %d", len(got), len(first))
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// UnitRouter dispatches requests to the handler of the virtual slave
+// addressed by req.UnitId, so several slaves can share one listener.
+type UnitRouter struct {
+	units          map[uint8]RequestHandler
+	unknownUnitErr error
+	logger         *logging.Logger
+}
+
+func NewUnitRouter(unknownUnitErr error, logger *logging.Logger) *UnitRouter {
+	return &UnitRouter{
+		units:          make(map[uint8]RequestHandler),
+		unknownUnitErr: unknownUnitErr,
+		logger:         logger,
+	}
+}
+
+func (r *UnitRouter) AddUnit(unitId uint8, handler RequestHandler) {
+	r.units[unitId] = handler
+}
+
+func (r *UnitRouter) UnitIds() []uint8 {
+	ids := make([]uint8, 0, len(r.units))
+	for id := range r.units {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (r *UnitRouter) HandleCoils(req *modbus.CoilsRequest) ([]bool, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleCoils routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleCoils(req)
+}
+
+func (r *UnitRouter) HandleDiscreteInputs(req *modbus.DiscreteInputsRequest) ([]bool, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleDiscreteInputs routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleDiscreteInputs(req)
+}
+
+func (r *UnitRouter) HandleHoldingRegisters(req *modbus.HoldingRegistersRequest) ([]uint16, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleHoldingRegisters routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleHoldingRegisters(req)
+}
+
+func (r *UnitRouter) HandleInputRegisters(req *modbus.InputRegistersRequest) ([]uint16, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleInputRegisters routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleInputRegisters(req)
+}
+
+func (r *UnitRouter) HandleMaskWriteRegister(req *MaskWriteRegisterRequest) error {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleMaskWriteRegister routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return r.unknownUnitErr
+	}
+	return unit.HandleMaskWriteRegister(req)
+}
+
+func (r *UnitRouter) HandleReadWriteRegisters(req *ReadWriteRegistersRequest) ([]uint16, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleReadWriteRegisters routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleReadWriteRegisters(req)
+}
+
+func (r *UnitRouter) HandleDeviceIdentification(req *DeviceIdentificationRequest) (IdentificationResult, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleDeviceIdentification routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return IdentificationResult{}, r.unknownUnitErr
+	}
+	return unit.HandleDeviceIdentification(req)
+}
+
+func (r *UnitRouter) HandleDiagnostics(req *DiagnosticsRequest) ([]byte, error) {
+	unit, ok := r.units[req.UnitId]
+	if !ok {
+		r.logger.Warn("HandleDiagnostics routed to unknown UnitId", logging.FieldUnitId(req.UnitId), logging.FieldClientAddr(req.ClientAddr))
+		return nil, r.unknownUnitErr
+	}
+	return unit.HandleDiagnostics(req)
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/goburrow/serial"
+)
+
+const (
+	ParityNone = "none"
+	ParityEven = "even"
+	ParityOdd  = "odd"
+
+	DefaultBaudRate = 19200
+	DefaultDataBits = 8
+	DefaultParity   = ParityNone
+	DefaultStopBits = 2
+
+	// rtuReadTimeout bounds a single read from the port. Silence on the
+	// line for this long ends a frame whose length can't be told from its
+	// function code, and lets the server notice it is being stopped.
+	rtuReadTimeout = 50 * time.Millisecond
+
+	rtuMaxFrameLength = 256
+)
+
+var parities = map[string]string{
+	ParityNone: "N",
+	ParityEven: "E",
+	ParityOdd:  "O",
+}
+
+// SerialConfig holds the line settings of a serial port.
+type SerialConfig struct {
+	BaudRate int `json:"baud_rate"`
+	DataBits int `json:"data_bits"`
+	// Parity is "none", "even" or "odd". The spec asks for 2 stop bits
+	// without parity.
+	Parity   string `json:"parity"`
+	StopBits int    `json:"stop_bits"`
+}
+
+func DefaultSerialConfig() SerialConfig {
+	return SerialConfig{
+		BaudRate: DefaultBaudRate,
+		DataBits: DefaultDataBits,
+		Parity:   DefaultParity,
+		StopBits: DefaultStopBits,
+	}
+}
+
+// Validate reports the problems of the line settings.
+func (c SerialConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	if c.BaudRate <= 0 {
+		problems = append(problems, fmt.Sprintf("baud_rate: must be positive, got %d", c.BaudRate))
+	}
+
+	if c.DataBits < 5 || c.DataBits > 8 {
+		problems = append(problems, fmt.Sprintf("data_bits: must be between 5 and 8, got %d", c.DataBits))
+	}
+
+	if _, ok := parities[c.Parity]; !ok {
+		problems = append(problems, fmt.Sprintf("parity: %q is not one of %s, %s, %s", c.Parity, ParityNone, ParityEven, ParityOdd))
+	}
+
+	if c.StopBits != 1 && c.StopBits != 2 {
+		problems = append(problems, fmt.Sprintf("stop_bits: must be 1 or 2, got %d", c.StopBits))
+	}
+
+	return problems
+}
+
+// RTUServer serves the handler chain as a Modbus RTU slave on a serial
+// port. Requests to unit ids it doesn't serve are ignored, as they belong
+// to other slaves on the bus. Broadcasts (unit id 0) are applied to every
+// served unit and never answered.
+type RTUServer struct {
+	device      string
+	config      SerialConfig
+	dispatcher  *RequestDispatcher
+	diagnostics *Diagnostics
+	capture     *capture.FrameCapture
+	unitIds     map[uint8]bool
+	logger      *logging.Logger
+
+	port serial.Port
+	stop chan struct{}
+	done sync.WaitGroup
+}
+
+func NewRTUServer(device string, config SerialConfig, dispatcher *RequestDispatcher, unitIds []uint8, capture *capture.FrameCapture, logger *logging.Logger) *RTUServer {
+	ids := make(map[uint8]bool, len(unitIds))
+	for _, id := range unitIds {
+		ids[id] = true
+	}
+
+	return &RTUServer{
+		device:      device,
+		config:      config,
+		dispatcher:  dispatcher,
+		diagnostics: dispatcher.Diagnostics(),
+		capture:     capture,
+		unitIds:     ids,
+		logger:      logger,
+	}
+}
+
+func (s *RTUServer) Start() error {
+	port, err := serial.Open(&serial.Config{
+		Address:  s.device,
+		BaudRate: s.config.BaudRate,
+		DataBits: s.config.DataBits,
+		StopBits: s.config.StopBits,
+		Parity:   parities[s.config.Parity],
+		Timeout:  rtuReadTimeout,
+	})
+	if err != nil {
+		return fmt.Errorf("open serial port %s: %w", s.device, err)
+	}
+
+	s.port = port
+	s.stop = make(chan struct{})
+	s.done.Add(1)
+	go s.serve()
+
+	return nil
+}
+
+func (s *RTUServer) Stop() error {
+	close(s.stop)
+	s.done.Wait()
+
+	if err := s.port.Close(); err != nil {
+		return fmt.Errorf("close serial port %s: %w", s.device, err)
+	}
+	return nil
+}
+
+// Connections returns zero, masters on the serial line don't connect.
+func (s *RTUServer) Connections() int {
+	return 0
+}
+
+func (s *RTUServer) serve() {
+	defer s.done.Done()
+
+	frame := make([]byte, 0, rtuMaxFrameLength)
+	chunk := make([]byte, rtuMaxFrameLength)
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		n, err := s.port.Read(chunk)
+		if errors.Is(err, serial.ErrTimeout) || err == nil && n == 0 {
+			// Silence on the line: a frame whose length is known but which
+			// didn't arrive in full is garbage, one of unknown length ends
+			// here.
+			if len(frame) != 0 && rtuRequestLength(frame) < 0 {
+				s.handleFrame(frame)
+			}
+			frame = frame[:0]
+			continue
+		}
+
+		if err != nil {
+			s.logger.Error("Could not read from serial port", logging.Field("device", s.device), logging.FieldError(err))
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		frame = append(frame, chunk[:n]...)
+		for {
+			length := rtuRequestLength(frame)
+			if length <= 0 || len(frame) < length {
+				break
+			}
+
+			if !s.handleFrame(frame[:length]) {
+				frame = frame[:0]
+				break
+			}
+			frame = append(frame[:0], frame[length:]...)
+		}
+
+		if len(frame) > rtuMaxFrameLength {
+			s.diagnostics.BusCharOverrun()
+			frame = frame[:0]
+		}
+	}
+}
+
+// handleFrame dispatches a single frame and answers it. It returns false if
+// the frame is corrupt, in which case the rest of the buffer can't be
+// trusted either.
+func (s *RTUServer) handleFrame(frame []byte) bool {
+	s.capture.Record(s.captureLink(), capture.FrameIn, frame)
+	if len(frame) < 4 {
+		return false
+	}
+
+	body, checksum := frame[:len(frame)-2], frame[len(frame)-2:]
+	if crc := crc16(body); checksum[0] != byte(crc) || checksum[1] != byte(crc>>8) {
+		s.logger.Warn("Dropping RTU frame with bad CRC", logging.Field("frame", fmt.Sprintf("% X", frame)))
+		s.diagnostics.BusCommError()
+		return false
+	}
+	s.diagnostics.BusMessage()
+
+	req := pdu{
+		unitId:       body[0],
+		functionCode: body[1],
+		payload:      body[2:],
+	}
+
+	if req.unitId == 0 {
+		unitIds := make([]uint8, 0, len(s.unitIds))
+		for id := range s.unitIds {
+			unitIds = append(unitIds, id)
+		}
+		s.dispatcher.Broadcast(s.device, unitIds, req)
+		return true
+	}
+
+	if !s.unitIds[req.unitId] {
+		return true
+	}
+
+	res, err := s.dispatcher.Dispatch(s.device, "", req)
+	if errors.Is(err, ErrDropResponse) {
+		return true
+	}
+	if err != nil {
+		s.logger.Warn("Dropping malformed RTU request", logging.FieldUnitId(req.unitId), logging.Field("frame", fmt.Sprintf("% X", frame)))
+		return true
+	}
+
+	out := append([]byte{res.unitId, res.functionCode}, res.payload...)
+	crc := crc16(out)
+	out = append(out, byte(crc), byte(crc>>8))
+	s.capture.Record(s.captureLink(), capture.FrameOut, out)
+
+	if _, err := s.port.Write(out); err != nil {
+		s.logger.Error("Could not write to serial port", logging.Field("device", s.device), logging.FieldError(err))
+	}
+	return true
+}
+
+func (s *RTUServer) captureLink() capture.CaptureLink {
+	return capture.CaptureLink{
+		Framing: capture.FramingRTU,
+		Peer:    s.device,
+	}
+}
+
+// rtuRequestLength returns the length of the request frame at the start of
+// the buffer, including unit id and CRC, 0 if more bytes are needed to tell,
+// or -1 if the function code doesn't tell the length.
+func rtuRequestLength(frame []byte) int {
+	if len(frame) < 2 {
+		return 0
+	}
+
+	switch frame[1] {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters, fcReadInputRegisters,
+		fcWriteSingleCoil, fcWriteSingleRegister:
+		return 8
+
+	// serial lines carry a single data word with every sub-function
+	case fcDiagnostics:
+		return 8
+
+	case fcGetCommEventCounter:
+		return 4
+
+	case fcWriteMultipleCoils, fcWriteMultipleRegisters:
+		if len(frame) < 7 {
+			return 0
+		}
+		return 9 + int(frame[6])
+
+	case fcMaskWriteRegister:
+		return 10
+
+	case fcReadWriteMultipleRegisters:
+		if len(frame) < 11 {
+			return 0
+		}
+		return 13 + int(frame[10])
+
+	case fcEncapsulatedInterface:
+		if len(frame) < 3 {
+			return 0
+		}
+		if frame[2] == meiReadDeviceIdentification {
+			return 7
+		}
+	}
+
+	return -1
+}
+
+// rtuDevice returns the serial device of an rtu:// url, e.g. /dev/ttyUSB0
+// for rtu:///dev/ttyUSB0 or COM3 for rtu://COM3.
+func rtuDevice(url string) string {
+	return strings.TrimPrefix(url, "rtu://")
+}
+
+// crc16 is the Modbus CRC, sent low byte first.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
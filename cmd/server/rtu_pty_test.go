@@ -0,0 +1,75 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// readFrame reads from the master side of the pty until want bytes arrived
+// or the deadline passed.
+func readFrame(t *testing.T, master *os.File, want int) []byte {
+	t.Helper()
+
+	if err := master.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, want)
+	n, err := io.ReadFull(master, frame)
+	if err != nil {
+		t.Fatalf("read response: %v, got % X", err, frame[:n])
+	}
+	return frame
+}
+
+// TestRTUServerOverPty serves a unit on the slave side of a pseudo terminal
+// and talks to it as a master from the other side.
+func TestRTUServerOverPty(t *testing.T) {
+	master, device := openPty(t)
+	defer master.Close()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		HoldingRegisters: []Register{{addr: 100, value: 0x1234}, {addr: 101, value: 0x5678}},
+	})
+	handler := NewAdapterHandler(NewModbusHandler(service, nil, logger), logger)
+
+	s := NewRTUServer(device, DefaultSerialConfig(), NewRequestDispatcher(handler, NewDiagnostics(), nil, nil, logger), []uint8{1}, nil, logger)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// a corrupt frame is dropped, the next one is answered
+	if _, err := master.Write([]byte{0x01, 0x03, 0x00, 0x64, 0x00, 0x02, 0x00, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * rtuReadTimeout)
+
+	if _, err := master.Write(rtuFrame(0x01, 0x06, 0x00, 0x65, 0xAB, 0xCD)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFrame(t, master, 8), rtuFrame(0x01, 0x06, 0x00, 0x65, 0xAB, 0xCD); !bytes.Equal(got, want) {
+		t.Errorf("write answered % X, want % X", got, want)
+	}
+
+	if _, err := master.Write(rtuFrame(0x01, 0x03, 0x00, 0x64, 0x00, 0x02)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readFrame(t, master, 9), rtuFrame(0x01, 0x03, 0x04, 0x12, 0x34, 0xAB, 0xCD); !bytes.Equal(got, want) {
+		t.Errorf("read answered % X, want % X", got, want)
+	}
+
+	if counters := s.diagnostics.Counters(); counters.BusCommErrors != 1 || counters.BusMessages != 2 {
+		t.Errorf("counters are %+v, want 1 bus communication error and 2 bus messages", counters)
+	}
+}
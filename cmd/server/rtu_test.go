@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/goburrow/serial"
+)
+
+// rtuFrame appends the CRC to a frame body.
+func rtuFrame(body ...byte) []byte {
+	crc := crc16(body)
+	return append(body, byte(crc), byte(crc>>8))
+}
+
+func newTestRTUServer(t *testing.T) (*RTUServer, *ModbusService, *bytes.Buffer) {
+	t.Helper()
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		Coils:            []Coil{{addr: 10}, {addr: 11}},
+		HoldingRegisters: []Register{{addr: 100, value: 0x1234}, {addr: 101, value: 0x5678}},
+	})
+	handler := NewAdapterHandler(NewModbusHandler(service, nil, logger), logger)
+
+	written := &bytes.Buffer{}
+	s := NewRTUServer("test", DefaultSerialConfig(), NewRequestDispatcher(handler, NewDiagnostics(), nil, nil, logger), []uint8{1}, nil, logger)
+	s.port = &bufferPort{Buffer: written}
+	return s, service, written
+}
+
+// bufferPort is a serial port whose writes go to a buffer.
+type bufferPort struct {
+	*bytes.Buffer
+}
+
+func (p *bufferPort) Open(*serial.Config) error {
+	return nil
+}
+
+func (p *bufferPort) Close() error {
+	return nil
+}
+
+func TestCRC16(t *testing.T) {
+	// the example of the Modbus over serial line guide
+	frame := rtuFrame(0x01, 0x03, 0x00, 0x00, 0x00, 0x0A)
+	if want := []byte{0xC5, 0xCD}; !bytes.Equal(frame[6:], want) {
+		t.Errorf("crc is % X, want % X", frame[6:], want)
+	}
+}
+
+func TestRTURequestLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  int
+	}{
+		{"empty", nil, 0},
+		{"unit id only", []byte{0x01}, 0},
+		{"read coils", []byte{0x01, 0x01}, 8},
+		{"read discrete inputs", []byte{0x01, 0x02}, 8},
+		{"read holding registers", []byte{0x01, 0x03}, 8},
+		{"read input registers", []byte{0x01, 0x04}, 8},
+		{"write single coil", []byte{0x01, 0x05}, 8},
+		{"write single register", []byte{0x01, 0x06}, 8},
+		{"diagnostics", []byte{0x01, 0x08}, 8},
+		{"get comm event counter", []byte{0x01, 0x0B}, 4},
+		{"write multiple coils without byte count", []byte{0x01, 0x0F, 0x00, 0x0A, 0x00, 0x0A}, 0},
+		{"write multiple coils", []byte{0x01, 0x0F, 0x00, 0x0A, 0x00, 0x0A, 0x02}, 11},
+		{"write multiple registers without byte count", []byte{0x01, 0x10, 0x00, 0x0A}, 0},
+		{"write multiple registers", []byte{0x01, 0x10, 0x00, 0x0A, 0x00, 0x02, 0x04}, 13},
+		{"mask write register", []byte{0x01, 0x16}, 10},
+		{"read/write multiple registers without byte count", []byte{0x01, 0x17, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01}, 0},
+		{"read/write multiple registers", []byte{0x01, 0x17, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x01, 0x02}, 15},
+		{"encapsulated interface without mei type", []byte{0x01, 0x2B}, 0},
+		{"read device identification", []byte{0x01, 0x2B, 0x0E}, 7},
+		{"other mei type", []byte{0x01, 0x2B, 0x0D}, -1},
+		{"unknown function code", []byte{0x01, 0x41}, -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := rtuRequestLength(test.frame); got != test.want {
+				t.Errorf("got %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestRTUServerHandleFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		frame    []byte
+		ok       bool
+		response []byte
+		counters DiagnosticCounters
+	}{
+		{
+			name:     "read holding registers",
+			frame:    rtuFrame(0x01, 0x03, 0x00, 0x64, 0x00, 0x02),
+			ok:       true,
+			response: rtuFrame(0x01, 0x03, 0x04, 0x12, 0x34, 0x56, 0x78),
+			counters: DiagnosticCounters{BusMessages: 1, ServerMessages: 1, CommEvents: 1},
+		},
+		{
+			name:     "illegal data address",
+			frame:    rtuFrame(0x01, 0x03, 0x00, 0x65, 0x00, 0x02),
+			ok:       true,
+			response: rtuFrame(0x01, 0x83, 0x02),
+			counters: DiagnosticCounters{BusMessages: 1, ServerMessages: 1, BusExceptions: 1},
+		},
+		{
+			name:     "bad crc",
+			frame:    []byte{0x01, 0x03, 0x00, 0x64, 0x00, 0x02, 0x00, 0x00},
+			counters: DiagnosticCounters{BusCommErrors: 1},
+		},
+		{
+			name:  "too short",
+			frame: []byte{0x01, 0x03, 0x00},
+		},
+		{
+			name:     "other unit",
+			frame:    rtuFrame(0x02, 0x03, 0x00, 0x64, 0x00, 0x02),
+			ok:       true,
+			counters: DiagnosticCounters{BusMessages: 1},
+		},
+		{
+			name:     "broadcast",
+			frame:    rtuFrame(0x00, 0x06, 0x00, 0x64, 0xAB, 0xCD),
+			ok:       true,
+			counters: DiagnosticCounters{BusMessages: 1, ServerMessages: 1, ServerNoResponses: 1},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, _, written := newTestRTUServer(t)
+
+			if ok := s.handleFrame(test.frame); ok != test.ok {
+				t.Errorf("handleFrame returned %t, want %t", ok, test.ok)
+			}
+			if !bytes.Equal(written.Bytes(), test.response) {
+				t.Errorf("answered % X, want % X", written.Bytes(), test.response)
+			}
+			if counters := s.diagnostics.Counters(); counters != test.counters {
+				t.Errorf("counters are %+v, want %+v", counters, test.counters)
+			}
+		})
+	}
+}
+
+func TestRTUServerHandleBroadcastWrites(t *testing.T) {
+	s, service, _ := newTestRTUServer(t)
+
+	s.handleFrame(rtuFrame(0x00, 0x06, 0x00, 0x64, 0xAB, 0xCD))
+
+	value, err := service.GetHoldingRegister(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0xABCD {
+		t.Errorf("register is 0x%04X, want 0xABCD", value)
+	}
+}
@@ -1,133 +1,713 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 var (
-	ErrNoInputCoils     = errors.New("no input coils object")
-	ErrNoCoils          = errors.New("no coils object")
-	ErrNoInputRegisters = errors.New("no input registers")
-	ErrNoRegisters      = errors.New("no registers")
+	ErrNoInputCoils     = errors.New("no discrete_inputs section")
+	ErrNoCoils          = errors.New("no coils section")
+	ErrNoInputRegisters = errors.New("no input_registers section")
+	ErrNoRegisters      = errors.New("no holding_registers section")
 
 	ErrCoilsWrongType     = errors.New("coils object inconsistent typing")
 	ErrRegistersWrongType = errors.New("registers object inconsistent typing")
+
+	ErrInvalidSeed       = errors.New("invalid seed")
+	ErrUnknownSection    = errors.New("unknown section")
+	ErrAddressOutOfRange = errors.New("address out of range")
+	ErrValueNotInteger   = errors.New("value is not an integer")
+	ErrOverlap           = errors.New("overlapping declarations")
+)
+
+// SeedProblem is a single problem found in a seed file, located by the
+// JSON path of the offending section, entry or field.
+type SeedProblem struct {
+	Path string
+	Err  error
+}
+
+func (p SeedProblem) String() string {
+	return fmt.Sprintf("%s: %v", p.Path, p.Err)
+}
+
+// SeedError lists every problem found in a seed file. errors.Is matches
+// ErrInvalidSeed as well as the error of any problem, e.g. ErrNoCoils.
+type SeedError struct {
+	Problems []SeedProblem
+}
+
+func (e *SeedError) Error() string {
+	problems := make([]string, 0, len(e.Problems))
+	for _, p := range e.Problems {
+		problems = append(problems, p.String())
+	}
+	return fmt.Sprintf("%v:\n  %s", ErrInvalidSeed, strings.Join(problems, "\n  "))
+}
+
+func (e *SeedError) Is(target error) bool {
+	if target == ErrInvalidSeed {
+		return true
+	}
+	for _, p := range e.Problems {
+		if errors.Is(p.Err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+type seedSection struct {
+	name      string
+	missing   error
+	wrongType error
+}
+
+var (
+	coilsSection            = seedSection{"coils", ErrNoCoils, ErrCoilsWrongType}
+	discreteInputsSection   = seedSection{"discrete_inputs", ErrNoInputCoils, ErrCoilsWrongType}
+	inputRegistersSection   = seedSection{"input_registers", ErrNoInputRegisters, ErrRegistersWrongType}
+	holdingRegistersSection = seedSection{"holding_registers", ErrNoRegisters, ErrRegistersWrongType}
 )
 
+// identificationSection is optional: without it the unit answers the
+// device identification of the config.
+const identificationSection = "device_identification"
+
 func ReadSeed(filename string) (Dump, error) {
 	bytes, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return Dump{}, fmt.Errorf("read file: %w", err)
 	}
 
+	return ParseSeed(bytes)
+}
+
+// ParseSeed parses and validates a seed. It doesn't stop at the first
+// problem: the returned *SeedError lists all of them.
+func ParseSeed(data []byte) (Dump, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
 	seed := make(map[string]interface{})
-	if err := json.Unmarshal(bytes, &seed); err != nil {
-		return Dump{}, fmt.Errorf("unmarshall seed file: %w", err)
+	if err := decoder.Decode(&seed); err != nil {
+		return Dump{}, &SeedError{Problems: []SeedProblem{{Path: "$", Err: syntaxError(data, err)}}}
 	}
 
-	coilsObj, ok := seed["coils"]
-	if !ok {
-		return Dump{}, ErrNoInputCoils
+	names := make([]string, 0, len(seed))
+	for name := range seed {
+		names = append(names, name)
 	}
+	sort.Strings(names)
 
-	coils, err := unmarshallCoils(coilsObj)
+	p := &seedParser{}
+	for _, name := range names {
+		switch name {
+		case coilsSection.name, discreteInputsSection.name, inputRegistersSection.name, holdingRegistersSection.name,
+			identificationSection:
+		default:
+			p.report("$."+name, ErrUnknownSection)
+		}
+	}
+
+	coils, coilPoints := p.coils(seed, coilsSection)
+	discreteInputs, discreteInputPoints := p.coils(seed, discreteInputsSection)
+	inputRegisters, inputRegisterPoints := p.registers(seed, inputRegistersSection)
+	holdingRegisters, holdingRegisterPoints := p.registers(seed, holdingRegistersSection)
+	identification := p.identification(seed)
+
+	if len(p.problems) != 0 {
+		return Dump{}, &SeedError{Problems: p.problems}
+	}
+
+	return Dump{
+		Coils:            coils,
+		DiscreteInputs:   discreteInputs,
+		InputRegisters:   inputRegisters,
+		HoldingRegisters: holdingRegisters,
+		Points: PointSet{
+			Coils:            coilPoints,
+			DiscreteInputs:   discreteInputPoints,
+			HoldingRegisters: holdingRegisterPoints,
+			InputRegisters:   inputRegisterPoints,
+		},
+		Identification: identification,
+	}, nil
+}
+
+// syntaxError adds the line and column to JSON syntax errors.
+func syntaxError(data []byte, err error) error {
+	var syntax *json.SyntaxError
+	if !errors.As(err, &syntax) {
+		return fmt.Errorf("unmarshall seed file: %w", err)
+	}
+
+	before := data[:syntax.Offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("unmarshall seed file: line %d, column %d: %w", line, column, err)
+}
+
+// seedParser collects the problems found while parsing a seed, so they can
+// all be reported at once. Entries with problems are skipped.
+type seedParser struct {
+	problems []SeedProblem
+}
+
+func (p *seedParser) report(path string, err error) {
+	p.problems = append(p.problems, SeedProblem{Path: path, Err: err})
+}
+
+// seedPoint is the extended form of a seed entry: the value together with
+// the metadata of the point.
+type seedPoint struct {
+	Point
+	Value json.RawMessage `json:"value"`
+}
+
+func unmarshallPoint(addr uint16, v interface{}) (seedPoint, error) {
+	bytes, err := json.Marshal(v)
 	if err != nil {
-		return Dump{}, err
+		return seedPoint{}, fmt.Errorf("marshall point: %w", err)
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	decoder.DisallowUnknownFields()
+
+	var point seedPoint
+	if err := decoder.Decode(&point); err != nil {
+		return seedPoint{}, err
 	}
+	point.Addr = addr
 
-	discreteInputsObj, ok := seed["discrete_inputs"]
+	return point, nil
+}
+
+// identification decodes the device identification section, nil if the
+// seed has none.
+func (p *seedParser) identification(seed map[string]interface{}) *DeviceIdentification {
+	v, ok := seed[identificationSection]
 	if !ok {
-		return Dump{}, ErrNoInputCoils
+		return nil
 	}
 
-	discreteInputs, err := unmarshallCoils(discreteInputsObj)
+	path := "$." + identificationSection
+	bytes, err := json.Marshal(v)
 	if err != nil {
-		return Dump{}, err
+		p.report(path, fmt.Errorf("marshall section: %w", err))
+		return nil
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(string(bytes)))
+	decoder.DisallowUnknownFields()
+
+	var identification DeviceIdentification
+	if err := decoder.Decode(&identification); err != nil {
+		p.report(path, err)
+		return nil
+	}
+
+	for _, problem := range identification.Validate() {
+		p.report(path+"."+problem.Path, problem.Err)
 	}
 
-	inputRegistersObj, ok := seed["input_registers"]
+	return &identification
+}
+
+// seedEntry is a single address of a seed section together with its value,
+// the JSON path of the value and the declaration it came from.
+type seedEntry struct {
+	addr  int
+	value interface{}
+	path  string
+	label string
+}
+
+// entries expands a section into single addresses. A section is either an
+// object mapping addresses to values, or an array of blocks which may be
+// mixed freely: a single address with addr, count consecutive addresses
+// sharing value, or consecutive addresses with individual values.
+func (p *seedParser) entries(seed map[string]interface{}, section seedSection) []seedEntry {
+	path := "$." + section.name
+
+	intface, ok := seed[section.name]
 	if !ok {
-		return Dump{}, ErrNoInputCoils
+		p.report(path, section.missing)
+		return nil
 	}
 
-	inpuRegisters, err := unmarhsallRegisters(inputRegistersObj)
-	if err != nil {
-		return Dump{}, err
+	switch obj := intface.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sortAddressKeys(keys)
+
+		result := make([]seedEntry, 0, len(obj))
+		for _, k := range keys {
+			entryPath := fmt.Sprintf("%s[%q]", path, k)
+
+			addr, err := strconv.Atoi(k)
+			if err != nil {
+				p.report(entryPath, fmt.Errorf("address %q is not an integer: %w", k, section.wrongType))
+				continue
+			}
+			if addr < 0 || addr > 0xFFFF {
+				p.report(entryPath, fmt.Errorf("address %d: %w", addr, ErrAddressOutOfRange))
+				continue
+			}
+
+			result = append(result, seedEntry{addr: addr, value: obj[k], path: entryPath, label: strconv.Quote(k)})
+		}
+		return result
+
+	case []interface{}:
+		result := make([]seedEntry, 0, len(obj))
+		for i, v := range obj {
+			result = append(result, p.blockEntries(fmt.Sprintf("%s[%d]", path, i), i, v, section)...)
+		}
+		return result
+	}
+
+	p.report(path, fmt.Errorf("section should be an object or an array: %w", section.wrongType))
+	return nil
+}
+
+// sortAddressKeys sorts the keys of an object section by address, so "10"
+// comes after "2". Keys that are not addresses go last, in text order.
+func sortAddressKeys(keys []string) {
+	sort.Slice(keys, func(i, j int) bool {
+		a, errA := strconv.Atoi(keys[i])
+		b, errB := strconv.Atoi(keys[j])
+		switch {
+		case errA != nil || errB != nil:
+			if (errA == nil) != (errB == nil) {
+				return errA == nil
+			}
+		case a != b:
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+}
+
+func (p *seedParser) blockEntries(path string, i int, v interface{}, section seedSection) []seedEntry {
+	fields, ok := v.(map[string]interface{})
+	if !ok {
+		p.report(path, fmt.Errorf("block should be an object: %w", section.wrongType))
+		return nil
 	}
 
-	holdingRegistersObj, ok := seed["holding_registers"]
+	// A single address may carry point metadata, so everything except addr
+	// is the value of the point.
+	if addr, ok := fields["addr"]; ok {
+		a, ok := p.integer(path+".addr", addr, 0, 0xFFFF, ErrAddressOutOfRange)
+		if !ok {
+			return nil
+		}
+
+		point := make(map[string]interface{}, len(fields))
+		for k, f := range fields {
+			if k != "addr" {
+				point[k] = f
+			}
+		}
+
+		var value interface{} = point
+		if v, ok := point["value"]; ok && len(point) == 1 {
+			value = v
+		}
+
+		label := fmt.Sprintf("entry %d (%d)", i, a)
+		return []seedEntry{{addr: a, value: value, path: path, label: label}}
+	}
+
+	valid := true
+	for k := range fields {
+		switch k {
+		case "start", "count", "value", "values":
+		default:
+			p.report(path+"."+k, fmt.Errorf("unknown block field: %w", section.wrongType))
+			valid = false
+		}
+	}
+
+	start, ok := fields["start"]
 	if !ok {
-		return Dump{}, ErrNoInputCoils
+		p.report(path, fmt.Errorf("block needs addr or start: %w", section.wrongType))
+		return nil
 	}
 
-	holdingRegisters, err := unmarhsallRegisters(holdingRegistersObj)
-	if err != nil {
-		return Dump{}, err
+	first, ok := p.integer(path+".start", start, 0, 0xFFFF, ErrAddressOutOfRange)
+	if !ok || !valid {
+		return nil
 	}
 
-	return Dump{
-		Coils:            coils,
-		DiscreteInputs:   discreteInputs,
-		InputRegisters:   inpuRegisters,
-		HoldingRegisters: holdingRegisters,
-	}, nil
+	count, hasCount := fields["count"]
+	value, hasValue := fields["value"]
+	values, hasValues := fields["values"]
+
+	var result []seedEntry
+	switch {
+	case hasCount && hasValues:
+		p.report(path, fmt.Errorf("block has both count and values: %w", section.wrongType))
+
+	case hasCount:
+		n, ok := p.integer(path+".count", count, 1, 0x10000, ErrValueOutOfRange)
+		if !ok {
+			return nil
+		}
+		if !hasValue {
+			p.report(path, fmt.Errorf("block with count needs a value: %w", section.wrongType))
+			return nil
+		}
+		if first+n-1 > 0xFFFF {
+			p.report(path, fmt.Errorf("block %d..%d: %w", first, first+n-1, ErrAddressOutOfRange))
+			return nil
+		}
+
+		label := fmt.Sprintf("entry %d (%d..%d)", i, first, first+n-1)
+		result = make([]seedEntry, 0, n)
+		for j := 0; j < n; j++ {
+			result = append(result, seedEntry{addr: first + j, value: value, path: path + ".value", label: label})
+		}
+
+	case hasValues:
+		if hasValue {
+			p.report(path, fmt.Errorf("block has both value and values: %w", section.wrongType))
+			return nil
+		}
+
+		list, ok := values.([]interface{})
+		if !ok || len(list) == 0 {
+			p.report(path+".values", fmt.Errorf("values should be a non-empty array: %w", section.wrongType))
+			return nil
+		}
+		if first+len(list)-1 > 0xFFFF {
+			p.report(path, fmt.Errorf("block %d..%d: %w", first, first+len(list)-1, ErrAddressOutOfRange))
+			return nil
+		}
+
+		label := fmt.Sprintf("entry %d (%d..%d)", i, first, first+len(list)-1)
+		result = make([]seedEntry, 0, len(list))
+		for j, v := range list {
+			result = append(result, seedEntry{addr: first + j, value: v, path: fmt.Sprintf("%s.values[%d]", path, j), label: label})
+		}
+
+	default:
+		p.report(path, fmt.Errorf("block needs count or values: %w", section.wrongType))
+	}
+
+	for _, e := range result {
+		if _, ok := e.value.(map[string]interface{}); ok {
+			p.report(e.path, fmt.Errorf("block values can't carry point metadata: %w", section.wrongType))
+			return nil
+		}
+	}
+
+	return result
 }
 
-func unmarshallCoils(intface interface{}) ([]Coil, error) {
-	obj, ok := intface.(map[string]interface{})
+// integer parses a whole number within [min, max].
+func (p *seedParser) integer(path string, v interface{}, min, max int, outOfRange error) (int, bool) {
+	n, ok := v.(json.Number)
 	if !ok {
-		return nil, fmt.Errorf("can't parse obj %v: %w", intface, ErrCoilsWrongType)
+		p.report(path, fmt.Errorf("%v is not a number: %w", v, ErrValueNotInteger))
+		return 0, false
 	}
 
-	result := make([]Coil, 0, len(obj))
-	for k, v := range obj {
-		addr, err := strconv.Atoi(k)
-		if err != nil {
-			return nil, fmt.Errorf("atoi: %w", err)
+	f, err := n.Float64()
+	if err != nil || f != math.Trunc(f) {
+		p.report(path, fmt.Errorf("%v: %w", n, ErrValueNotInteger))
+		return 0, false
+	}
+
+	if f < float64(min) || f > float64(max) {
+		p.report(path, fmt.Errorf("%v is not within %d..%d: %w", n, min, max, outOfRange))
+		return 0, false
+	}
+
+	return int(f), true
+}
+
+// owners tracks which entry declared each address and reports overlaps,
+// once per pair of entries.
+type owners struct {
+	labels   map[uint16]string
+	reported map[[2]string]bool
+}
+
+func newOwners(size int) *owners {
+	return &owners{
+		labels:   make(map[uint16]string, size),
+		reported: make(map[[2]string]bool),
+	}
+}
+
+func (o *owners) claim(p *seedParser, e seedEntry, addr uint16) bool {
+	owner, ok := o.labels[addr]
+	if !ok {
+		o.labels[addr] = e.label
+		return true
+	}
+
+	if pair := [2]string{owner, e.label}; !o.reported[pair] {
+		o.reported[pair] = true
+		p.report(e.path, fmt.Errorf("address %d is declared by both %s and %s: %w", addr, owner, e.label, ErrOverlap))
+	}
+	return false
+}
+
+func (p *seedParser) coils(seed map[string]interface{}, section seedSection) ([]Coil, []*Point) {
+	entries := p.entries(seed, section)
+
+	result := make([]Coil, 0, len(entries))
+	points := make([]*Point, 0)
+	owners := newOwners(len(entries))
+	for _, e := range entries {
+		addr, v := uint16(e.addr), e.value
+
+		var point *seedPoint
+		if fields, ok := v.(map[string]interface{}); ok {
+			parsed, err := unmarshallPoint(addr, fields)
+			if err != nil {
+				p.report(e.path, err)
+				continue
+			}
+
+			if err := parsed.normalizeCoil(); err != nil {
+				p.report(e.path, err)
+				continue
+			}
+
+			v = false
+			if len(parsed.Value) != 0 {
+				if err := json.Unmarshal(parsed.Value, &v); err != nil {
+					p.report(e.path+".value", err)
+					continue
+				}
+			}
+			point = &parsed
 		}
 
 		coil, ok := v.(bool)
 		if !ok {
-			fmt.Println(k, v)
-			return nil, fmt.Errorf("can't parse bool %v: %w", v, ErrCoilsWrongType)
+			p.report(e.path, fmt.Errorf("%v is not a bool: %w", v, section.wrongType))
+			continue
 		}
 
+		if !owners.claim(p, e, addr) {
+			continue
+		}
+
+		if point != nil {
+			points = append(points, &point.Point)
+		}
 		result = append(result, Coil{
-			addr:  uint16(addr),
+			addr:  addr,
 			value: coil,
 		})
 	}
 
-	return result, nil
+	return result, points
 }
 
-func unmarhsallRegisters(intface interface{}) ([]Register, error) {
-	obj, ok := intface.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("can't parse obj %v: %w", intface, ErrRegistersWrongType)
+func (p *seedParser) registers(seed map[string]interface{}, section seedSection) ([]Register, []*Point) {
+	entries := p.entries(seed, section)
+
+	result := make([]Register, 0, len(entries))
+	points := make([]*Point, 0)
+	owners := newOwners(len(entries))
+	for _, e := range entries {
+		var values []uint16
+		var point *seedPoint
+		if fields, ok := e.value.(map[string]interface{}); ok {
+			parsed, err := unmarshallPoint(uint16(e.addr), fields)
+			if err != nil {
+				p.report(e.path, err)
+				continue
+			}
+
+			values, err = encodeSeedPoint(&parsed)
+			if err != nil {
+				p.report(e.path, err)
+				continue
+			}
+			point = &parsed
+		} else {
+			register, ok := p.integer(e.path, e.value, 0, 0xFFFF, ErrValueOutOfRange)
+			if !ok {
+				continue
+			}
+			values = []uint16{uint16(register)}
+		}
+
+		if last := e.addr + len(values) - 1; last > 0xFFFF {
+			p.report(e.path, fmt.Errorf("point %d..%d: %w", e.addr, last, ErrAddressOutOfRange))
+			continue
+		}
+
+		claimed := true
+		for i := range values {
+			claimed = owners.claim(p, e, uint16(e.addr+i)) && claimed
+		}
+		if !claimed {
+			continue
+		}
+
+		if point != nil {
+			points = append(points, &point.Point)
+		}
+		for i, value := range values {
+			result = append(result, Register{
+				addr:  uint16(e.addr + i),
+				value: value,
+			})
+		}
 	}
 
-	result := make([]Register, 0, len(obj))
-	for k, v := range obj {
-		addr, err := strconv.Atoi(k)
-		if err != nil {
-			return nil, fmt.Errorf("atoi: %w", err)
+	return result, points
+}
+
+// encodeSeedPoint checks the metadata of the point and turns its seed value
+// into raw registers. A point without a value starts zeroed.
+func encodeSeedPoint(point *seedPoint) ([]uint16, error) {
+	if err := point.normalize(); err != nil {
+		return nil, err
+	}
+
+	if len(point.Value) == 0 {
+		return make([]uint16, point.Registers()), nil
+	}
+
+	if point.Type == DataTypeString {
+		var text string
+		if err := json.Unmarshal(point.Value, &text); err != nil {
+			return nil, fmt.Errorf("string value: %w", err)
 		}
+		return point.EncodeString(text)
+	}
 
-		register, ok := v.(float64)
-		if !ok {
-			return nil, fmt.Errorf("can't parse float64 %v: %w", v, ErrRegistersWrongType)
+	var value float64
+	if err := json.Unmarshal(point.Value, &value); err != nil {
+		return nil, fmt.Errorf("numeric value: %w", err)
+	}
+
+	if err := point.CheckLimits(value); err != nil {
+		return nil, err
+	}
+
+	if raw := value / point.Scale; point.Type != DataTypeFloat32 && math.Abs(raw-math.Round(raw)) > 1e-6 {
+		return nil, fmt.Errorf("%v is not a multiple of scale %v: %w", value, point.Scale, ErrValueNotInteger)
+	}
+
+	return point.Encode(value)
+}
+
+// WriteSeed writes the dump in the seed file format, so it can be read back
+// with ReadSeed. Points keep their metadata, with the value in engineering
+// units. The file is replaced atomically.
+func WriteSeed(filename string, dump Dump) error {
+	seed := map[string]interface{}{
+		"coils":             marshallCoils(dump.Coils, dump.Points.Coils),
+		"discrete_inputs":   marshallCoils(dump.DiscreteInputs, dump.Points.DiscreteInputs),
+		"input_registers":   marshallRegisters(dump.InputRegisters, dump.Points.InputRegisters),
+		"holding_registers": marshallRegisters(dump.HoldingRegisters, dump.Points.HoldingRegisters),
+	}
+
+	if dump.Identification != nil {
+		seed[identificationSection] = dump.Identification
+	}
+
+	bytes, err := json.MarshalIndent(seed, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshall seed: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(bytes, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write temp file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close temp file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("rename temp file: %w", err)
+	}
+
+	return nil
+}
+
+func marshallCoils(coils []Coil, points []*Point) map[string]interface{} {
+	byAddr := make(map[uint16]*Point, len(points))
+	for _, p := range points {
+		byAddr[p.Addr] = p
+	}
+
+	result := make(map[string]interface{}, len(coils))
+	for _, c := range coils {
+		key := strconv.Itoa(int(c.addr))
+		if p, ok := byAddr[c.addr]; ok {
+			result[key] = marshallPoint(p, c.value)
+			continue
 		}
+		result[key] = c.value
+	}
+	return result
+}
 
-		result = append(result, Register{
-			addr:  uint16(addr),
-			value: uint16(register),
-		})
+func marshallRegisters(registers []Register, points []*Point) map[string]interface{} {
+	values := make(map[uint16]uint16, len(registers))
+	for _, r := range registers {
+		values[r.addr] = r.value
+	}
+
+	result := make(map[string]interface{}, len(registers))
+	covered := make(map[uint16]bool)
+	for _, p := range points {
+		raw := make([]uint16, p.Registers())
+		for i := range raw {
+			a := p.Addr + uint16(i)
+			raw[i] = values[a]
+			covered[a] = true
+		}
+
+		var value interface{} = p.Decode(raw)
+		if p.Type == DataTypeString {
+			value = p.DecodeString(raw)
+		}
+		result[strconv.Itoa(int(p.Addr))] = marshallPoint(p, value)
+	}
+
+	for _, r := range registers {
+		if covered[r.addr] {
+			continue
+		}
+		result[strconv.Itoa(int(r.addr))] = r.value
 	}
+	return result
+}
 
-	return result, nil
+func marshallPoint(p *Point, value interface{}) seedPoint {
+	bytes, _ := json.Marshal(value)
+	return seedPoint{Point: *p, Value: bytes}
 }
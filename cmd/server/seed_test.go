@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testSeed is a seed with the sections given and the other data tables
+// empty. An empty section leaves the section out.
+func testSeed(sections map[string]string) string {
+	all := map[string]string{"coils": "{}", "discrete_inputs": "{}", "input_registers": "{}", "holding_registers": "{}"}
+	for name, section := range sections {
+		all[name] = section
+	}
+
+	names := make([]string, 0, len(all))
+	for name, section := range all {
+		if section != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%q: %s", name, all[name]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+func equalEntries[T Coil | Register](got, want []T) bool {
+	return len(got) == 0 && len(want) == 0 || reflect.DeepEqual(got, want)
+}
+
+func TestParseSeed(t *testing.T) {
+	tests := []struct {
+		name     string
+		sections map[string]string
+		coils    []Coil
+		inputs   []Register
+		holding  []Register
+	}{
+		{
+			name: "empty tables",
+		},
+		{
+			name: "objects sorted by address",
+			sections: map[string]string{
+				"coils":             `{"10": true, "9": false, "100": true}`,
+				"holding_registers": `{"10": 3, "2": 1, "65535": 65535}`,
+			},
+			coils:   []Coil{{addr: 9}, {addr: 10, value: true}, {addr: 100, value: true}},
+			holding: []Register{{addr: 2, value: 1}, {addr: 10, value: 3}, {addr: 65535, value: 65535}},
+		},
+		{
+			name: "blocks",
+			sections: map[string]string{
+				"holding_registers": `[
+					{"addr": 1, "value": 7},
+					{"start": 10, "count": 3, "value": 5},
+					{"start": 20, "values": [1, 2]},
+					{"start": 65534, "count": 2, "value": 65535}
+				]`,
+			},
+			holding: []Register{
+				{addr: 1, value: 7},
+				{addr: 10, value: 5}, {addr: 11, value: 5}, {addr: 12, value: 5},
+				{addr: 20, value: 1}, {addr: 21, value: 2},
+				{addr: 65534, value: 65535}, {addr: 65535, value: 65535},
+			},
+		},
+		{
+			name: "points",
+			sections: map[string]string{
+				"input_registers": `{
+					"1": {"name": "temperature", "type": "int16", "scale": 0.1, "value": -1.5},
+					"2": {"type": "float32", "word_order": "low_first", "value": 1.5},
+					"4": {"type": "uint32", "byte_order": "little", "value": 65536},
+					"6": {"type": "string", "length": 2, "value": "ABC"},
+					"8": {"name": "unset", "type": "int32"}
+				}`,
+			},
+			inputs: []Register{
+				{addr: 1, value: 0xFFF1},
+				{addr: 2, value: 0x0000}, {addr: 3, value: 0x3FC0},
+				{addr: 4, value: 0x0100}, {addr: 5, value: 0x0000},
+				{addr: 6, value: 0x4142}, {addr: 7, value: 0x4300},
+				{addr: 8}, {addr: 9},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dump, err := ParseSeed([]byte(testSeed(test.sections)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !equalEntries(dump.Coils, test.coils) {
+				t.Errorf("coils: got %+v, want %+v", dump.Coils, test.coils)
+			}
+			if !equalEntries(dump.InputRegisters, test.inputs) {
+				t.Errorf("input registers: got %+v, want %+v", dump.InputRegisters, test.inputs)
+			}
+			if !equalEntries(dump.HoldingRegisters, test.holding) {
+				t.Errorf("holding registers: got %+v, want %+v", dump.HoldingRegisters, test.holding)
+			}
+		})
+	}
+}
+
+func TestParseSeedPoints(t *testing.T) {
+	dump, err := ParseSeed([]byte(testSeed(map[string]string{
+		"coils":             `{"1": {"name": "pump", "access": "read-only", "value": true}}`,
+		"holding_registers": `{"10": {"name": "setpoint", "unit": "°C", "scale": 0.5, "min": 0, "max": 100, "value": 20}}`,
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dump.Points.Coils) != 1 || !dump.Points.Coils[0].IsReadOnly() || dump.Points.Coils[0].Name != "pump" {
+		t.Errorf("coil points: %+v", dump.Points.Coils)
+	}
+
+	if len(dump.Points.HoldingRegisters) != 1 {
+		t.Fatalf("holding register points: %+v", dump.Points.HoldingRegisters)
+	}
+	point := dump.Points.HoldingRegisters[0]
+	if point.Addr != 10 || point.Scale != 0.5 || point.Format([]uint16{40}) != "20 °C" {
+		t.Errorf("holding register point: %+v", point)
+	}
+	if !equalEntries(dump.HoldingRegisters, []Register{{addr: 10, value: 40}}) {
+		t.Errorf("holding registers: %+v", dump.HoldingRegisters)
+	}
+}
+
+func TestParseSeedProblems(t *testing.T) {
+	type problem struct {
+		path string
+		err  error
+		// text is part of the message, if it matters
+		text string
+	}
+
+	tests := []struct {
+		name     string
+		sections map[string]string
+		problems []problem
+	}{
+		{
+			name:     "missing sections",
+			sections: map[string]string{"coils": "", "input_registers": ""},
+			problems: []problem{
+				{path: "$.coils", err: ErrNoCoils},
+				{path: "$.input_registers", err: ErrNoInputRegisters},
+			},
+		},
+		{
+			name:     "unknown section",
+			sections: map[string]string{"holding": "{}"},
+			problems: []problem{{path: "$.holding", err: ErrUnknownSection}},
+		},
+		{
+			name:     "section of the wrong type",
+			sections: map[string]string{"coils": "true"},
+			problems: []problem{{path: "$.coils", err: ErrCoilsWrongType}},
+		},
+		{
+			name:     "addresses",
+			sections: map[string]string{"coils": `{"1.5": true, "-1": true, "65536": true, "x": true}`},
+			problems: []problem{
+				{path: `$.coils["-1"]`, err: ErrAddressOutOfRange},
+				{path: `$.coils["65536"]`, err: ErrAddressOutOfRange},
+				{path: `$.coils["1.5"]`, err: ErrCoilsWrongType},
+				{path: `$.coils["x"]`, err: ErrCoilsWrongType},
+			},
+		},
+		{
+			name:     "values",
+			sections: map[string]string{"holding_registers": `{"1": 1.5, "2": 65536, "3": -1, "4": "1", "5": 1e3}`},
+			problems: []problem{
+				{path: `$.holding_registers["1"]`, err: ErrValueNotInteger},
+				{path: `$.holding_registers["2"]`, err: ErrValueOutOfRange},
+				{path: `$.holding_registers["3"]`, err: ErrValueOutOfRange},
+				{path: `$.holding_registers["4"]`, err: ErrValueNotInteger},
+			},
+		},
+		{
+			name:     "coil values",
+			sections: map[string]string{"discrete_inputs": `{"1": 1}`},
+			problems: []problem{{path: `$.discrete_inputs["1"]`, err: ErrCoilsWrongType}},
+		},
+		{
+			name: "blocks",
+			sections: map[string]string{"holding_registers": `[
+				{"start": 65535, "count": 2, "value": 0},
+				{"start": 1, "count": 1, "values": [1]},
+				{"start": 1, "values": [{"value": 1}]},
+				{"start": 1, "count": 0, "value": 1},
+				{"start": 1.5, "count": 1, "value": 1},
+				{"start": 1, "count": 1},
+				{"start": 1, "values": []},
+				{"start": 1, "step": 2, "count": 1, "value": 1},
+				{"count": 1, "value": 1},
+				{"addr": 70000, "value": 1},
+				1
+			]`},
+			problems: []problem{
+				{path: "$.holding_registers[0]", err: ErrAddressOutOfRange, text: "65535..65536"},
+				{path: "$.holding_registers[1]", err: ErrRegistersWrongType, text: "both count and values"},
+				{path: "$.holding_registers[2].values[0]", err: ErrRegistersWrongType, text: "metadata"},
+				{path: "$.holding_registers[3].count", err: ErrValueOutOfRange},
+				{path: "$.holding_registers[4].start", err: ErrValueNotInteger},
+				{path: "$.holding_registers[5]", err: ErrRegistersWrongType, text: "needs a value"},
+				{path: "$.holding_registers[6].values", err: ErrRegistersWrongType},
+				{path: "$.holding_registers[7].step", err: ErrRegistersWrongType},
+				{path: "$.holding_registers[8]", err: ErrRegistersWrongType, text: "needs addr or start"},
+				{path: "$.holding_registers[9].addr", err: ErrAddressOutOfRange},
+				{path: "$.holding_registers[10]", err: ErrRegistersWrongType},
+			},
+		},
+		{
+			name: "overlaps",
+			sections: map[string]string{
+				"coils": `{"01": true, "1": false}`,
+				"holding_registers": `[
+					{"addr": 5, "value": 1},
+					{"start": 4, "count": 3, "value": 0},
+					{"start": 6, "values": [1, 2]},
+					{"addr": 7, "type": "int32"}
+				]`,
+			},
+			problems: []problem{
+				{path: `$.coils["1"]`, err: ErrOverlap, text: `address 1 is declared by both "01" and "1"`},
+				{path: "$.holding_registers[1].value", err: ErrOverlap, text: "address 5 is declared by both entry 0 (5) and entry 1 (4..6)"},
+				{path: "$.holding_registers[2].values[0]", err: ErrOverlap, text: "address 6 is declared by both entry 1 (4..6) and entry 2 (6..7)"},
+				{path: "$.holding_registers[3]", err: ErrOverlap, text: "address 7 is declared by both entry 2 (6..7) and entry 3 (7)"},
+			},
+		},
+		{
+			name: "points",
+			sections: map[string]string{
+				"coils": `{"1": {"value": true, "scale": 2}, "2": {"value": 1}, "3": {"colour": "red"}}`,
+				"holding_registers": `[
+					{"addr": 65535, "type": "int32"},
+					{"addr": 1, "value": 11, "max": 10},
+					{"addr": 2, "value": -1, "min": 0},
+					{"addr": 3, "value": 0.15, "scale": 0.1},
+					{"addr": 4, "type": "int64"},
+					{"addr": 5, "type": "int16", "value": 40000},
+					{"addr": 6, "type": "string", "length": 1, "value": "ABC"},
+					{"addr": 7, "type": "string", "value": "A"},
+					{"addr": 8, "name": "flow", "value": "1"},
+					{"addr": 9, "value": "1"}
+				]`,
+			},
+			problems: []problem{
+				{path: `$.coils["1"]`, err: ErrNotForCoils},
+				{path: `$.coils["2"]`, err: ErrCoilsWrongType},
+				{path: `$.coils["3"]`, text: "colour"},
+				{path: "$.holding_registers[0]", err: ErrAddressOutOfRange, text: "65535..65536"},
+				{path: "$.holding_registers[1]", err: ErrValueOutOfRange, text: "above max 10"},
+				{path: "$.holding_registers[2]", err: ErrValueOutOfRange, text: "below min 0"},
+				{path: "$.holding_registers[3]", err: ErrValueNotInteger, text: "scale 0.1"},
+				{path: "$.holding_registers[4]", err: ErrUnknownDataType},
+				{path: "$.holding_registers[5]", err: ErrValueOutOfRange},
+				{path: "$.holding_registers[6]", err: ErrValueOutOfRange},
+				{path: "$.holding_registers[7]", text: "length"},
+				{path: "$.holding_registers[8]", text: "numeric value"},
+				{path: "$.holding_registers[9]", err: ErrValueNotInteger},
+			},
+		},
+		{
+			name:     "device identification",
+			sections: map[string]string{"device_identification": `{"vendor": "ACME"}`},
+			problems: []problem{{path: "$.device_identification", text: "vendor"}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ParseSeed([]byte(testSeed(test.sections)))
+
+			var seedErr *SeedError
+			if !errors.As(err, &seedErr) {
+				t.Fatalf("got %v, want a *SeedError", err)
+			}
+			if !errors.Is(err, ErrInvalidSeed) {
+				t.Errorf("%v is not %v", err, ErrInvalidSeed)
+			}
+
+			if len(seedErr.Problems) != len(test.problems) {
+				t.Fatalf("got %d problems, want %d:\n%v", len(seedErr.Problems), len(test.problems), err)
+			}
+			for i, want := range test.problems {
+				got := seedErr.Problems[i]
+				if got.Path != want.path {
+					t.Errorf("problem %d: got path %s, want %s", i, got.Path, want.path)
+				}
+				if want.err != nil && !errors.Is(got.Err, want.err) {
+					t.Errorf("problem %d: got %v, want %v", i, got.Err, want.err)
+				}
+				if !strings.Contains(got.Err.Error(), want.text) {
+					t.Errorf("problem %d: %q doesn't mention %q", i, got.Err, want.text)
+				}
+				if want.err != nil && !errors.Is(err, want.err) {
+					t.Errorf("seed error is not %v", want.err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSeedSyntaxError(t *testing.T) {
+	_, err := ParseSeed([]byte("{\n  \"coils\": [,\n}"))
+
+	var seedErr *SeedError
+	if !errors.As(err, &seedErr) || len(seedErr.Problems) != 1 {
+		t.Fatalf("got %v, want a single problem", err)
+	}
+	if got := seedErr.Problems[0]; got.Path != "$" || !strings.Contains(got.Err.Error(), "line 2, column 14") {
+		t.Errorf("got %s, want the line and column of the error", got)
+	}
+}
+
+func TestSeedRoundTrip(t *testing.T) {
+	seed := testSeed(map[string]string{
+		"coils":             `[{"start": 0, "count": 3, "value": true}, {"addr": 10, "name": "pump", "value": false}]`,
+		"holding_registers": `{"2": 7, "10": {"type": "float32", "word_order": "low_first", "scale": 0.5, "value": 2.5}}`,
+	})
+
+	dump, err := ParseSeed([]byte(seed))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := t.TempDir() + "/seed.json"
+	if err := WriteSeed(path, dump); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadSeed(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(read, dump) {
+		t.Errorf("read back\n%+v\nwant\n%+v", read, dump)
+	}
+}
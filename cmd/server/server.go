@@ -1,48 +1,114 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"strings"
+	"sync"
 
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
 	"github.com/simonvetter/modbus"
 )
 
+var ErrServerNotRunning = errors.New("server is not running")
+
+// Server is a running listener: the TCP server or the serial RTU server.
+type Server interface {
+	Start() error
+	Stop() error
+	// Connections returns the number of client connections open.
+	Connections() int
+}
+
 type ServerManager struct {
-	config  *modbus.ServerConfiguration
-	handler modbus.RequestHandler
+	config     *modbus.ServerConfiguration
+	serial     SerialConfig
+	unitIds    []uint8
+	dispatcher *RequestDispatcher
+	capture    *capture.FrameCapture
+	logger     *logging.Logger
 
-	server *modbus.ModbusServer
+	lock   sync.Mutex
+	server Server
 }
 
 func NewServerManager(
 	config *modbus.ServerConfiguration,
-	handler modbus.RequestHandler,
+	serial SerialConfig,
+	unitIds []uint8,
+	dispatcher *RequestDispatcher,
+	capture *capture.FrameCapture,
+	logger *logging.Logger,
 ) *ServerManager {
 
 	return &ServerManager{
-		config:  config,
-		handler: handler,
+		config:     config,
+		serial:     serial,
+		unitIds:    unitIds,
+		dispatcher: dispatcher,
+		capture:    capture,
+		logger:     logger,
 	}
 }
 
+// Diagnostics returns the counters of the listener. They start from zero
+// every time the server is started.
+func (s *ServerManager) Diagnostics() *Diagnostics {
+	return s.dispatcher.Diagnostics()
+}
+
 func (s *ServerManager) StartServer() error {
-	server, err := modbus.NewServer(s.config, s.handler)
+	server, err := s.newServer()
 	if err != nil {
 		return fmt.Errorf("create server: %w", err)
 	}
 
-	s.server = server
-	if err := s.server.Start(); err != nil {
+	s.dispatcher.Diagnostics().Clear()
+	if err := server.Start(); err != nil {
 		return fmt.Errorf("start server: %w", err)
 	}
 
+	s.lock.Lock()
+	s.server = server
+	s.lock.Unlock()
 	return nil
 }
 
+func (s *ServerManager) newServer() (Server, error) {
+	if strings.HasPrefix(s.config.URL, "rtu://") {
+		return NewRTUServer(rtuDevice(s.config.URL), s.serial, s.dispatcher, s.unitIds, s.capture, s.logger), nil
+	}
+
+	return NewTCPServer(s.config, s.dispatcher, s.capture, s.logger), nil
+}
+
+// StopServer stops the running server. The server is forgotten even if
+// stopping it fails, so it can be started again.
 func (s *ServerManager) StopServer() error {
-	if err := s.server.Stop(); err != nil {
-		return fmt.Errorf("stop server: %w", err)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.server == nil {
+		return ErrServerNotRunning
 	}
 
+	err := s.server.Stop()
 	s.server = nil
+	if err != nil {
+		return fmt.Errorf("stop server: %w", err)
+	}
 	return nil
 }
+
+// Connections returns the number of client connections of the running
+// server, zero while it is stopped.
+func (s *ServerManager) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.server == nil {
+		return 0
+	}
+	return s.server.Connections()
+}
@@ -1,12 +1,31 @@
 package main
 
-import "github.com/simonvetter/modbus"
-
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/simonvetter/modbus"
+)
+
+// ModbusService holds the register map of a single slave. It is safe for
+// concurrent use: reads share a read lock, writes are serialized and
+// subscribers are notified in the order the writes were applied. Range
+// writes are all-or-nothing and produce a single notification with every
+// change in the range. Subscribers may read from the service but must not
+// write to it.
+//
+// Writes are checked against the point metadata: coils and holding
+// registers of read-only points can't be written, and values of points with
+// limits must stay within min/max.
 type ModbusService struct {
-	coils            []Coil
-	discreteInputs   []Coil
-	holdingRegisters []Register
-	inputRegisters   []Register
+	lock   sync.RWMutex
+	notify sync.Mutex
+
+	coils            *table[bool]
+	discreteInputs   *table[bool]
+	holdingRegisters *table[uint16]
+	inputRegisters   *table[uint16]
 
 	coilSubs            []CoilSub
 	discreteInputSubs   []CoilSub
@@ -19,6 +38,13 @@ type Dump struct {
 	DiscreteInputs   []Coil
 	HoldingRegisters []Register
 	InputRegisters   []Register
+
+	Points PointSet
+
+	// Identification is what the unit answers to Read Device
+	// Identification, nil if the seed doesn't declare it. It is static, so
+	// the service doesn't keep it and snapshots leave it out.
+	Identification *DeviceIdentification
 }
 
 type Coil struct {
@@ -32,7 +58,7 @@ type CoilChange struct {
 	to   bool
 }
 
-type CoilSub func(change CoilChange)
+type CoilSub func(changes []CoilChange)
 
 type Register struct {
 	addr  uint16
@@ -45,166 +71,509 @@ type RegisterChange struct {
 	to   uint16
 }
 
-type RegisterSub func(change RegisterChange)
+type RegisterSub func(changes []RegisterChange)
+
+// table keeps the points of a single data table sorted by address. Runs of
+// consecutive addresses are stored as spans, so a range always maps to
+// consecutive positions; large blocks declared in the seed cost no more than
+// a slice. index maps every address up to the highest one of the table to
+// its span, so a lookup doesn't depend on the number of spans. owners maps
+// every address covered by a point with metadata to that point.
+type table[T bool | uint16] struct {
+	addrs  []uint16
+	values []T
+	spans  []span
+	// index holds the position of the span of an address in spans plus
+	// one, zero for addresses that are not part of the table. A table has
+	// at most 0x8000 spans, as they are separated by at least one address.
+	index []uint16
+
+	points []*Point
+	owners map[uint16]*Point
+}
 
-func NewModbusService(seed Dump) *ModbusService {
-	return &ModbusService{
-		coils:            append(make([]Coil, 0, len(seed.Coils)), seed.Coils...),
-		discreteInputs:   append(make([]Coil, 0, len(seed.DiscreteInputs)), seed.DiscreteInputs...),
-		holdingRegisters: append(make([]Register, 0, len(seed.HoldingRegisters)), seed.HoldingRegisters...),
-		inputRegisters:   append(make([]Register, 0, len(seed.InputRegisters)), seed.InputRegisters...),
+// span is a run of consecutive addresses [start, end) stored from pos on.
+type span struct {
+	start uint32
+	end   uint32
+	pos   int
+}
 
-		coilSubs:            make([]CoilSub, 0),
-		discreteInputSubs:   make([]CoilSub, 0),
-		holdingRegisterSubs: make([]RegisterSub, 0),
-		inputRegisterSubs:   make([]RegisterSub, 0),
+func newTable[T bool | uint16](addrs []uint16, values []T) *table[T] {
+	t := &table[T]{
+		addrs:  make([]uint16, 0, len(addrs)),
+		values: make([]T, 0, len(values)),
+		spans:  make([]span, 0),
 	}
-}
 
-func (s *ModbusService) GetCoil(addr uint16) (bool, error) {
-	for _, v := range s.coils {
-		if v.addr == addr {
-			return v.value, nil
+	order := make([]int, len(addrs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return addrs[order[i]] < addrs[order[j]]
+	})
+
+	for _, i := range order {
+		addr := uint32(addrs[i])
+		if n := len(t.spans); n > 0 {
+			last := &t.spans[n-1]
+			if addr == last.end-1 {
+				t.values[len(t.values)-1] = values[i]
+				continue
+			}
+			if addr == last.end {
+				last.end++
+				t.addrs = append(t.addrs, addrs[i])
+				t.values = append(t.values, values[i])
+				continue
+			}
 		}
+
+		t.spans = append(t.spans, span{start: addr, end: addr + 1, pos: len(t.addrs)})
+		t.addrs = append(t.addrs, addrs[i])
+		t.values = append(t.values, values[i])
 	}
-	return false, modbus.ErrIllegalDataAddress
+
+	if n := len(t.spans); n > 0 {
+		t.index = make([]uint16, t.spans[n-1].end)
+		for i, s := range t.spans {
+			for addr := s.start; addr < s.end; addr++ {
+				t.index[addr] = uint16(i + 1)
+			}
+		}
+	}
+
+	return t
 }
 
-func (s *ModbusService) SetCoil(addr uint16, value bool) error {
-	var found bool
-	var index int
-	for i, v := range s.coils {
-		if v.addr == addr {
-			found = true
-			index = i
-			break
+func (t *table[T]) setPoints(points []*Point, registers bool) *table[T] {
+	t.points = points
+	t.owners = make(map[uint16]*Point, len(points))
+	for _, p := range points {
+		n := 1
+		if registers {
+			n = p.Registers()
+		}
+		for i := 0; i < n; i++ {
+			t.owners[p.Addr+uint16(i)] = p
 		}
 	}
+	return t
+}
+
+// find returns the span containing addr.
+func (t *table[T]) find(addr uint32) (span, bool) {
+	if addr >= uint32(len(t.index)) || t.index[addr] == 0 {
+		return span{}, false
+	}
+	return t.spans[t.index[addr]-1], true
+}
 
-	if !found {
-		return modbus.ErrIllegalDataAddress
+func (t *table[T]) get(addr uint16) (T, bool) {
+	s, ok := t.find(uint32(addr))
+	if !ok {
+		var zero T
+		return zero, false
 	}
+	return t.values[s.pos+int(uint32(addr)-s.start)], true
+}
 
-	prev := s.coils[index].value
-	s.coils[index].value = value
-	for _, sub := range s.coilSubs {
-		sub(CoilChange{from: prev, to: value, addr: addr})
+// position resolves cnt consecutive addresses starting at addr to the
+// position of the first one, failing on the first address that is not
+// part of the table.
+func (t *table[T]) position(addr uint16, cnt int) (int, error) {
+	s, ok := t.find(uint32(addr))
+	if !ok {
+		return 0, fmt.Errorf("address 0x%X: %w", addr, modbus.ErrIllegalDataAddress)
 	}
 
-	return nil
+	if end := uint32(addr) + uint32(cnt); end > s.end {
+		return 0, fmt.Errorf("address 0x%X: %w", s.end, modbus.ErrIllegalDataAddress)
+	}
+
+	return s.pos + int(uint32(addr)-s.start), nil
 }
 
-func (s *ModbusService) GetDiscreteInputs(addr uint16) (bool, error) {
-	for _, v := range s.discreteInputs {
-		if v.addr == addr {
-			return v.value, nil
-		}
+func newCoilTable(coils []Coil) *table[bool] {
+	addrs := make([]uint16, 0, len(coils))
+	values := make([]bool, 0, len(coils))
+	for _, c := range coils {
+		addrs = append(addrs, c.addr)
+		values = append(values, c.value)
 	}
-	return false, modbus.ErrIllegalDataAddress
+	return newTable(addrs, values)
 }
 
-func (s *ModbusService) SetDiscreteInput(addr uint16, value bool) error {
-	var found bool
-	var index int
-	for i, v := range s.discreteInputs {
-		if v.addr == addr {
-			found = true
-			index = i
-			break
-		}
+func newRegisterTable(registers []Register) *table[uint16] {
+	addrs := make([]uint16, 0, len(registers))
+	values := make([]uint16, 0, len(registers))
+	for _, r := range registers {
+		addrs = append(addrs, r.addr)
+		values = append(values, r.value)
 	}
+	return newTable(addrs, values)
+}
 
-	if !found {
-		return modbus.ErrIllegalDataAddress
+func dumpCoils(t *table[bool]) []Coil {
+	result := make([]Coil, 0, len(t.addrs))
+	for i, addr := range t.addrs {
+		result = append(result, Coil{addr: addr, value: t.values[i]})
 	}
+	return result
+}
 
-	prev := s.discreteInputs[index].value
-	s.discreteInputs[index].value = value
-	for _, sub := range s.discreteInputSubs {
-		sub(CoilChange{from: prev, to: value, addr: addr})
+func dumpRegisters(t *table[uint16]) []Register {
+	result := make([]Register, 0, len(t.addrs))
+	for i, addr := range t.addrs {
+		result = append(result, Register{addr: addr, value: t.values[i]})
 	}
+	return result
+}
 
-	return nil
+func NewModbusService(seed Dump) *ModbusService {
+	return &ModbusService{
+		coils:            newCoilTable(seed.Coils).setPoints(seed.Points.Coils, false),
+		discreteInputs:   newCoilTable(seed.DiscreteInputs).setPoints(seed.Points.DiscreteInputs, false),
+		holdingRegisters: newRegisterTable(seed.HoldingRegisters).setPoints(seed.Points.HoldingRegisters, true),
+		inputRegisters:   newRegisterTable(seed.InputRegisters).setPoints(seed.Points.InputRegisters, true),
+
+		coilSubs:            make([]CoilSub, 0),
+		discreteInputSubs:   make([]CoilSub, 0),
+		holdingRegisterSubs: make([]RegisterSub, 0),
+		inputRegisterSubs:   make([]RegisterSub, 0),
+	}
 }
 
-func (s *ModbusService) GetHoldingRegister(addr uint16) (uint16, error) {
-	for _, v := range s.holdingRegisters {
-		if v.addr == addr {
-			return v.value, nil
-		}
+// Dump returns a consistent snapshot of all four tables sorted by address.
+func (s *ModbusService) Dump() Dump {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return Dump{
+		Coils:            dumpCoils(s.coils),
+		DiscreteInputs:   dumpCoils(s.discreteInputs),
+		HoldingRegisters: dumpRegisters(s.holdingRegisters),
+		InputRegisters:   dumpRegisters(s.inputRegisters),
+		Points: PointSet{
+			Coils:            s.coils.points,
+			DiscreteInputs:   s.discreteInputs.points,
+			HoldingRegisters: s.holdingRegisters.points,
+			InputRegisters:   s.inputRegisters.points,
+		},
 	}
-	return 0, modbus.ErrIllegalDataAddress
+}
+
+func (s *ModbusService) GetCoil(addr uint16) (bool, error) {
+	return getPoint(s, s.coils, addr)
+}
+
+func (s *ModbusService) GetCoilRange(addr uint16, cnt int) ([]bool, error) {
+	return getRange(s, s.coils, addr, cnt)
+}
+
+func (s *ModbusService) SetCoil(addr uint16, value bool) error {
+	return setCoilRange(s, s.coils, &s.coilSubs, addr, []bool{value})
+}
+
+func (s *ModbusService) SetCoilRange(addr uint16, values []bool) error {
+	return setCoilRange(s, s.coils, &s.coilSubs, addr, values)
+}
+
+func (s *ModbusService) GetDiscreteInputs(addr uint16) (bool, error) {
+	return getPoint(s, s.discreteInputs, addr)
+}
+
+func (s *ModbusService) GetDiscreteInputRange(addr uint16, cnt int) ([]bool, error) {
+	return getRange(s, s.discreteInputs, addr, cnt)
+}
+
+func (s *ModbusService) SetDiscreteInput(addr uint16, value bool) error {
+	return setCoilRange(s, s.discreteInputs, &s.discreteInputSubs, addr, []bool{value})
+}
+
+func (s *ModbusService) SetDiscreteInputRange(addr uint16, values []bool) error {
+	return setCoilRange(s, s.discreteInputs, &s.discreteInputSubs, addr, values)
+}
+
+func (s *ModbusService) GetHoldingRegister(addr uint16) (uint16, error) {
+	return getPoint(s, s.holdingRegisters, addr)
+}
+
+func (s *ModbusService) GetHoldingRegisterRange(addr uint16, cnt int) ([]uint16, error) {
+	return getRange(s, s.holdingRegisters, addr, cnt)
 }
 
 func (s *ModbusService) SetHoldingRegister(addr uint16, value uint16) error {
-	var found bool
-	var index int
-	for i, v := range s.holdingRegisters {
-		if v.addr == addr {
-			found = true
-			index = i
-			break
-		}
-	}
+	return setRegisterRange(s, s.holdingRegisters, &s.holdingRegisterSubs, addr, []uint16{value})
+}
+
+func (s *ModbusService) SetHoldingRegisterRange(addr uint16, values []uint16) error {
+	return setRegisterRange(s, s.holdingRegisters, &s.holdingRegisterSubs, addr, values)
+}
 
-	if !found {
-		return modbus.ErrIllegalDataAddress
+// MaskWriteHoldingRegister sets the holding register to (current AND
+// andMask) OR (orMask AND NOT andMask) in a single read-modify-write, so
+// concurrent writes to other bits of the register are never lost.
+func (s *ModbusService) MaskWriteHoldingRegister(addr uint16, andMask uint16, orMask uint16) error {
+	s.notify.Lock()
+	defer s.notify.Unlock()
+
+	s.lock.Lock()
+	current, ok := s.holdingRegisters.get(addr)
+	if !ok {
+		s.lock.Unlock()
+		return fmt.Errorf("register at 0x%X: %w", addr, modbus.ErrIllegalDataAddress)
 	}
 
-	prev := s.holdingRegisters[index].value
-	s.holdingRegisters[index].value = value
-	for _, sub := range s.holdingRegisterSubs {
-		sub(RegisterChange{from: prev, to: value, addr: addr})
+	value := current&andMask | orMask&^andMask
+	changes, err := writeRegisters(s, s.holdingRegisters, addr, []uint16{value})
+	subs := s.holdingRegisterSubs
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
 	}
 
+	notifyRegisters(subs, changes)
 	return nil
 }
 
-func (s *ModbusService) GetInputRegister(addr uint16) (uint16, error) {
-	for _, v := range s.inputRegisters {
-		if v.addr == addr {
-			return v.value, nil
-		}
+// ReadWriteHoldingRegisterRange writes values at writeAddr and then reads
+// readCnt holding registers at readAddr under the same lock, so the read
+// sees the write and nothing in between. Both ranges are checked before
+// anything is written.
+func (s *ModbusService) ReadWriteHoldingRegisterRange(readAddr uint16, readCnt int, writeAddr uint16, values []uint16) ([]uint16, error) {
+	s.notify.Lock()
+	defer s.notify.Unlock()
+
+	s.lock.Lock()
+	if _, err := s.holdingRegisters.position(readAddr, readCnt); err != nil {
+		s.lock.Unlock()
+		return nil, err
 	}
-	return 0, modbus.ErrIllegalDataAddress
-}
 
-func (s *ModbusService) SetInputRegister(addr uint16, value uint16) error {
-	var found bool
-	var index int
-	for i, v := range s.inputRegisters {
-		if v.addr == addr {
-			found = true
-			index = i
-			break
-		}
+	changes, err := writeRegisters(s, s.holdingRegisters, writeAddr, values)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
 	}
 
-	if !found {
-		return modbus.ErrIllegalDataAddress
-	}
+	pos, _ := s.holdingRegisters.position(readAddr, readCnt)
+	result := make([]uint16, readCnt)
+	copy(result, s.holdingRegisters.values[pos:pos+readCnt])
+	subs := s.holdingRegisterSubs
+	s.lock.Unlock()
 
-	prev := s.inputRegisters[index].value
-	s.inputRegisters[index].value = value
-	for _, sub := range s.inputRegisterSubs {
-		sub(RegisterChange{from: prev, to: value, addr: addr})
-	}
+	notifyRegisters(subs, changes)
+	return result, nil
+}
 
-	return nil
+func (s *ModbusService) GetInputRegister(addr uint16) (uint16, error) {
+	return getPoint(s, s.inputRegisters, addr)
+}
+
+func (s *ModbusService) GetInputRegisterRange(addr uint16, cnt int) ([]uint16, error) {
+	return getRange(s, s.inputRegisters, addr, cnt)
+}
+
+func (s *ModbusService) SetInputRegister(addr uint16, value uint16) error {
+	return setRegisterRange(s, s.inputRegisters, &s.inputRegisterSubs, addr, []uint16{value})
+}
+
+func (s *ModbusService) SetInputRegisterRange(addr uint16, values []uint16) error {
+	return setRegisterRange(s, s.inputRegisters, &s.inputRegisterSubs, addr, values)
 }
 
 func (s *ModbusService) SubscribeToCoilChanges(sub CoilSub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.coilSubs = append(s.coilSubs, sub)
 }
 
 func (s *ModbusService) SubscribeToDiscreteInputChages(sub CoilSub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.discreteInputSubs = append(s.discreteInputSubs, sub)
 }
 
 func (s *ModbusService) SubscribeToHoldingRegisterChanges(sub RegisterSub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.holdingRegisterSubs = append(s.holdingRegisterSubs, sub)
 }
 
 func (s *ModbusService) SubscribeToInputRegisterChanges(sub RegisterSub) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	s.inputRegisterSubs = append(s.inputRegisterSubs, sub)
 }
+
+func getPoint[T bool | uint16](s *ModbusService, t *table[T], addr uint16) (T, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	value, ok := t.get(addr)
+	if !ok {
+		return value, modbus.ErrIllegalDataAddress
+	}
+	return value, nil
+}
+
+// getRange reads cnt consecutive points under a single read lock, so the
+// result is a consistent snapshot of the range.
+func getRange[T bool | uint16](s *ModbusService, t *table[T], addr uint16, cnt int) ([]T, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	pos, err := t.position(addr, cnt)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]T, cnt)
+	copy(result, t.values[pos:pos+cnt])
+	return result, nil
+}
+
+// setCoilRange validates the whole range and applies it under the write
+// lock, then notifies subscribers once after releasing it. The notify lock
+// is held for the whole operation, so subscribers see changes in the order
+// they were applied.
+func setCoilRange(s *ModbusService, t *table[bool], subs *[]CoilSub, addr uint16, values []bool) error {
+	s.notify.Lock()
+	defer s.notify.Unlock()
+
+	s.lock.Lock()
+	pos, err := t.position(addr, len(values))
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	if err := checkCoilWrite(s, t, addr, len(values)); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	changes := make([]CoilChange, 0, len(values))
+	for i, value := range values {
+		changes = append(changes, CoilChange{addr: t.addrs[pos+i], from: t.values[pos+i], to: value})
+		t.values[pos+i] = value
+	}
+	current := *subs
+	s.lock.Unlock()
+
+	for _, sub := range current {
+		sub(changes)
+	}
+
+	return nil
+}
+
+// setRegisterRange is the register counterpart of setCoilRange.
+func setRegisterRange(s *ModbusService, t *table[uint16], subs *[]RegisterSub, addr uint16, values []uint16) error {
+	s.notify.Lock()
+	defer s.notify.Unlock()
+
+	s.lock.Lock()
+	changes, err := writeRegisters(s, t, addr, values)
+	current := *subs
+	s.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	notifyRegisters(current, changes)
+	return nil
+}
+
+// writeRegisters validates and applies a register write. The caller must
+// hold the write lock.
+func writeRegisters(s *ModbusService, t *table[uint16], addr uint16, values []uint16) ([]RegisterChange, error) {
+	pos, err := t.position(addr, len(values))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkRegisterWrite(s, t, addr, values); err != nil {
+		return nil, err
+	}
+
+	changes := make([]RegisterChange, 0, len(values))
+	for i, value := range values {
+		changes = append(changes, RegisterChange{addr: t.addrs[pos+i], from: t.values[pos+i], to: value})
+		t.values[pos+i] = value
+	}
+
+	return changes, nil
+}
+
+func notifyRegisters(subs []RegisterSub, changes []RegisterChange) {
+	for _, sub := range subs {
+		sub(changes)
+	}
+}
+
+// writable reports whether masters may write to the table. Discrete inputs
+// and input registers are only written by the simulator, so access modes
+// don't apply to them.
+func (s *ModbusService) writable(t interface{}) bool {
+	switch t {
+	case s.coils, s.holdingRegisters:
+		return true
+	}
+	return false
+}
+
+func checkCoilWrite(s *ModbusService, t *table[bool], addr uint16, cnt int) error {
+	if !s.writable(t) {
+		return nil
+	}
+
+	for i := 0; i < cnt; i++ {
+		if p, ok := t.owners[addr+uint16(i)]; ok && p.IsReadOnly() {
+			return fmt.Errorf("point %s is read-only: %w", p.Label(), modbus.ErrIllegalDataAddress)
+		}
+	}
+	return nil
+}
+
+// checkRegisterWrite checks every point touched by the write. The value of
+// a multi-register point is decoded from the registers it would have after
+// the write, so a point may be written register by register only as long
+// as each intermediate value stays within its limits.
+func checkRegisterWrite(s *ModbusService, t *table[uint16], addr uint16, values []uint16) error {
+	checked := make(map[*Point]bool)
+	for i := range values {
+		p, ok := t.owners[addr+uint16(i)]
+		if !ok || checked[p] {
+			continue
+		}
+		checked[p] = true
+
+		if p.IsReadOnly() && s.writable(t) {
+			return fmt.Errorf("point %s is read-only: %w", p.Label(), modbus.ErrIllegalDataAddress)
+		}
+
+		if p.Min == nil && p.Max == nil || p.Type == DataTypeString {
+			continue
+		}
+
+		raw := make([]uint16, p.Registers())
+		for j := range raw {
+			a := p.Addr + uint16(j)
+			if a >= addr && int(a-addr) < len(values) {
+				raw[j] = values[a-addr]
+			} else {
+				raw[j], _ = t.get(a)
+			}
+		}
+
+		if err := p.CheckLimits(p.Decode(raw)); err != nil {
+			return fmt.Errorf("%v: %w", err, modbus.ErrIllegalDataValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	testBlockAddr = 100
+	// testPointAddr starts the points written one by one, apart from the
+	// block written as a whole.
+	testPointAddr = 200
+	testBlockSize = 16
+	testWorkers   = 16
+	testRounds    = 200
+)
+
+func newTestService() *ModbusService {
+	seed := Dump{}
+	for _, start := range []uint16{testBlockAddr, testPointAddr} {
+		for i := uint16(0); i < testBlockSize; i++ {
+			seed.Coils = append(seed.Coils, Coil{addr: start + i})
+			seed.DiscreteInputs = append(seed.DiscreteInputs, Coil{addr: start + i})
+			seed.HoldingRegisters = append(seed.HoldingRegisters, Register{addr: start + i})
+			seed.InputRegisters = append(seed.InputRegisters, Register{addr: start + i})
+		}
+	}
+	return NewModbusService(seed)
+}
+
+func repeatUint16(value uint16, cnt int) []uint16 {
+	values := make([]uint16, cnt)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func repeatBool(value bool, cnt int) []bool {
+	values := make([]bool, cnt)
+	for i := range values {
+		values[i] = value
+	}
+	return values
+}
+
+func uniform[T bool | uint16](values []T) bool {
+	for _, value := range values {
+		if value != values[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// registerLog replays the notifications of a table onto a copy of it, so
+// the copy ends up equal to the table only if every change was notified
+// once and in the order it was applied.
+type registerLog struct {
+	lock   sync.Mutex
+	values map[uint16]uint16
+	broken []RegisterChange
+}
+
+func (l *registerLog) sub(changes []RegisterChange) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, change := range changes {
+		if l.values[change.addr] != change.from {
+			l.broken = append(l.broken, change)
+		}
+		l.values[change.addr] = change.to
+	}
+}
+
+type coilLog struct {
+	lock   sync.Mutex
+	values map[uint16]bool
+	broken []CoilChange
+}
+
+func (l *coilLog) sub(changes []CoilChange) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, change := range changes {
+		if l.values[change.addr] != change.from {
+			l.broken = append(l.broken, change)
+		}
+		l.values[change.addr] = change.to
+	}
+}
+
+// TestModbusServiceConcurrentAccess runs single and range writes, mask
+// writes, read/write requests, reads and subscriptions from many goroutines
+// at once. Run it with -race.
+func TestModbusServiceConcurrentAccess(t *testing.T) {
+	s := newTestService()
+
+	holding := &registerLog{values: make(map[uint16]uint16)}
+	input := &registerLog{values: make(map[uint16]uint16)}
+	coils := &coilLog{values: make(map[uint16]bool)}
+	discrete := &coilLog{values: make(map[uint16]bool)}
+	s.SubscribeToHoldingRegisterChanges(holding.sub)
+	s.SubscribeToInputRegisterChanges(input.sub)
+	s.SubscribeToCoilChanges(coils.sub)
+	s.SubscribeToDiscreteInputChages(discrete.sub)
+
+	errs := make(chan error, testWorkers*8)
+	var wg sync.WaitGroup
+	run := func(f func(worker int) error) {
+		for worker := 0; worker < testWorkers; worker++ {
+			wg.Add(1)
+			go func(worker int) {
+				defer wg.Done()
+				if err := f(worker); err != nil {
+					errs <- err
+				}
+			}(worker)
+		}
+	}
+
+	// range writes of one value over the whole block, readers must never
+	// see a mix of two writes
+	run(func(worker int) error {
+		for round := 0; round < testRounds; round++ {
+			value := uint16(worker*testRounds + round)
+			if err := s.SetHoldingRegisterRange(testBlockAddr, repeatUint16(value, testBlockSize)); err != nil {
+				return err
+			}
+			if err := s.SetInputRegisterRange(testBlockAddr, repeatUint16(value, testBlockSize)); err != nil {
+				return err
+			}
+			if err := s.SetCoilRange(testBlockAddr, repeatBool(round%2 == 0, testBlockSize)); err != nil {
+				return err
+			}
+			if err := s.SetDiscreteInputRange(testBlockAddr, repeatBool(round%2 == 1, testBlockSize)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	run(func(worker int) error {
+		for round := 0; round < testRounds; round++ {
+			registers, err := s.GetHoldingRegisterRange(testBlockAddr, testBlockSize)
+			if err != nil {
+				return err
+			}
+			if !uniform(registers) {
+				return errors.New("holding register range read a partial write")
+			}
+
+			inputs, err := s.GetInputRegisterRange(testBlockAddr, testBlockSize)
+			if err != nil {
+				return err
+			}
+			if !uniform(inputs) {
+				return errors.New("input register range read a partial write")
+			}
+
+			values, err := s.GetCoilRange(testBlockAddr, testBlockSize)
+			if err != nil {
+				return err
+			}
+			if !uniform(values) {
+				return errors.New("coil range read a partial write")
+			}
+
+			values, err = s.GetDiscreteInputRange(testBlockAddr, testBlockSize)
+			if err != nil {
+				return err
+			}
+			if !uniform(values) {
+				return errors.New("discrete input range read a partial write")
+			}
+
+			registers, err = s.ReadWriteHoldingRegisterRange(testBlockAddr, testBlockSize, testBlockAddr, repeatUint16(uint16(round), testBlockSize))
+			if err != nil {
+				return err
+			}
+			if !uniform(registers) || registers[0] != uint16(round) {
+				return errors.New("read/write didn't read its own write")
+			}
+		}
+		return nil
+	})
+
+	run(func(worker int) error {
+		addr := uint16(testPointAddr + worker%testBlockSize)
+		for round := 0; round < testRounds; round++ {
+			if err := s.SetHoldingRegister(addr, uint16(round)); err != nil {
+				return err
+			}
+			if _, err := s.GetHoldingRegister(addr); err != nil {
+				return err
+			}
+			if err := s.SetCoil(addr, round%2 == 0); err != nil {
+				return err
+			}
+			if _, err := s.GetCoil(addr); err != nil {
+				return err
+			}
+			if err := s.MaskWriteHoldingRegister(addr, 0xFF00, uint16(round)); err != nil {
+				return err
+			}
+			if _, err := s.GetInputRegister(addr); err != nil {
+				return err
+			}
+			if _, err := s.GetDiscreteInputs(addr); err != nil {
+				return err
+			}
+			s.Dump()
+		}
+		return nil
+	})
+
+	// subscribers added while writes are notified
+	run(func(worker int) error {
+		for round := 0; round < testRounds/10; round++ {
+			s.SubscribeToHoldingRegisterChanges(func(changes []RegisterChange) {})
+			s.SubscribeToCoilChanges(func(changes []CoilChange) {})
+		}
+		return nil
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	dump := s.Dump()
+	checkRegisterLog(t, "holding register", holding, dump.HoldingRegisters)
+	checkRegisterLog(t, "input register", input, dump.InputRegisters)
+	checkCoilLog(t, "coil", coils, dump.Coils)
+	checkCoilLog(t, "discrete input", discrete, dump.DiscreteInputs)
+}
+
+func checkRegisterLog(t *testing.T, name string, log *registerLog, registers []Register) {
+	t.Helper()
+
+	if len(log.broken) > 0 {
+		t.Errorf("%d %s changes notified out of order, first %+v", len(log.broken), name, log.broken[0])
+	}
+	for _, register := range registers {
+		if log.values[register.addr] != register.value {
+			t.Errorf("%s 0x%X: notified 0x%X, table has 0x%X", name, register.addr, log.values[register.addr], register.value)
+		}
+	}
+}
+
+func checkCoilLog(t *testing.T, name string, log *coilLog, coils []Coil) {
+	t.Helper()
+
+	if len(log.broken) > 0 {
+		t.Errorf("%d %s changes notified out of order, first %+v", len(log.broken), name, log.broken[0])
+	}
+	for _, coil := range coils {
+		if log.values[coil.addr] != coil.value {
+			t.Errorf("%s 0x%X: notified %t, table has %t", name, coil.addr, log.values[coil.addr], coil.value)
+		}
+	}
+}
+
+// TestModbusServiceConcurrentMaskWrite sets a bit of the same register per
+// goroutine, a lost read-modify-write leaves its bit cleared.
+func TestModbusServiceConcurrentMaskWrite(t *testing.T) {
+	s := newTestService()
+
+	var wg sync.WaitGroup
+	for bit := 0; bit < 16; bit++ {
+		wg.Add(1)
+		go func(bit int) {
+			defer wg.Done()
+			for round := 0; round < testRounds; round++ {
+				mask := uint16(1) << bit
+				if err := s.MaskWriteHoldingRegister(testBlockAddr, ^mask, 0); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.MaskWriteHoldingRegister(testBlockAddr, ^mask, mask); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(bit)
+	}
+	wg.Wait()
+
+	value, err := s.GetHoldingRegister(testBlockAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 0xFFFF {
+		t.Errorf("register is 0x%04X, want 0xFFFF", value)
+	}
+}
+
+// TestModbusServiceRangeWriteAllOrNothing checks that a range write running
+// past the table changes nothing and notifies no one.
+func TestModbusServiceRangeWriteAllOrNothing(t *testing.T) {
+	s := newTestService()
+
+	notified := false
+	s.SubscribeToHoldingRegisterChanges(func(changes []RegisterChange) {
+		notified = true
+	})
+
+	err := s.SetHoldingRegisterRange(testBlockAddr+testBlockSize-2, []uint16{1, 2, 3})
+	if !errors.Is(err, modbus.ErrIllegalDataAddress) {
+		t.Fatalf("got %v, want illegal data address", err)
+	}
+
+	registers, err := s.GetHoldingRegisterRange(testBlockAddr, testBlockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !uniform(registers) || registers[0] != 0 {
+		t.Errorf("registers changed to %v", registers)
+	}
+	if notified {
+		t.Error("failed write notified subscribers")
+	}
+}
+
+func TestTablePosition(t *testing.T) {
+	// spans 0-1, 5 and 0xFFFE-0xFFFF, declared out of order
+	table := newRegisterTable([]Register{
+		{addr: 0xFFFF, value: 4}, {addr: 5, value: 3}, {addr: 1, value: 2}, {addr: 0, value: 1}, {addr: 0xFFFE, value: 5},
+	})
+
+	tests := []struct {
+		addr uint16
+		cnt  int
+		want int
+		ok   bool
+	}{
+		{0, 2, 0, true},
+		{1, 1, 1, true},
+		{1, 2, 0, false},
+		{2, 1, 0, false},
+		{5, 1, 2, true},
+		{6, 1, 0, false},
+		{0x1000, 1, 0, false},
+		{0xFFFE, 2, 3, true},
+		{0xFFFF, 1, 4, true},
+		{0xFFFF, 2, 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := table.position(test.addr, test.cnt)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("position(0x%X, %d): got %d, %v, want %d", test.addr, test.cnt, got, err, test.want)
+		}
+		if !test.ok && !errors.Is(err, modbus.ErrIllegalDataAddress) {
+			t.Errorf("position(0x%X, %d): got %d, %v, want %v", test.addr, test.cnt, got, err, modbus.ErrIllegalDataAddress)
+		}
+	}
+
+	if value, ok := table.get(0xFFFF); !ok || value != 4 {
+		t.Errorf("get(0xFFFF): got %d, %t, want 4", value, ok)
+	}
+	if _, ok := newRegisterTable(nil).get(0); ok {
+		t.Error("empty table has address 0")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var snapshotSignals = []os.Signal{syscall.SIGUSR1}
+
+var faultSignals = []os.Signal{syscall.SIGUSR2}
+
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+var snapshotSignals = []os.Signal{}
+
+var faultSignals = []os.Signal{}
+
+var reloadSignals = []os.Signal{}
@@ -2,14 +2,21 @@ package main
 
 import (
 	"context"
-	"log"
+	"math"
 	"math/rand"
+	"sort"
+	"sync/atomic"
 	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
 )
 
 type ActivitySimulatorImpl struct {
-	service *ModbusService
-	seed    Dump
+	service  *ModbusService
+	seed     Dump
+	interval time.Duration
+	ticks    uint64
+	logger   *logging.Logger
 
 	cancel func()
 }
@@ -17,10 +24,14 @@ type ActivitySimulatorImpl struct {
 func NewActivitySimulatorImpl(
 	service *ModbusService,
 	seed Dump,
+	interval time.Duration,
+	logger *logging.Logger,
 ) *ActivitySimulatorImpl {
 	return &ActivitySimulatorImpl{
-		service: service,
-		seed:    seed,
+		service:  service,
+		seed:     seed,
+		interval: interval,
+		logger:   logger,
 	}
 }
 
@@ -31,11 +42,18 @@ func (a *ActivitySimulatorImpl) StartSimulation() {
 }
 
 func (a *ActivitySimulatorImpl) StopSimulation() {
+	if a.cancel == nil {
+		return
+	}
+
 	a.cancel()
+	a.cancel = nil
 }
 
 func (a *ActivitySimulatorImpl) SimulateActivity(ctx context.Context) {
-	ticker := time.NewTicker(2 * time.Second)
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -44,22 +62,151 @@ func (a *ActivitySimulatorImpl) SimulateActivity(ctx context.Context) {
 		case <-ticker.C:
 			a.RandomizeDiscreteInputs()
 			a.RandomizeInputRegisters()
+			atomic.AddUint64(&a.ticks, 1)
 		}
 	}
 }
 
+// Ticks returns how many times the simulator updated the unit.
+func (a *ActivitySimulatorImpl) Ticks() uint64 {
+	return atomic.LoadUint64(&a.ticks)
+}
+
 func (a *ActivitySimulatorImpl) RandomizeDiscreteInputs() {
+	addrs := make([]uint16, 0, len(a.seed.DiscreteInputs))
 	for _, coil := range a.seed.DiscreteInputs {
-		c := rand.Intn(100)%2 == 0
-		a.service.SetDiscreteInput(coil.addr, c)
-		log.Printf("upating discret input at 0x%X to %v", coil.addr, c)
+		addrs = append(addrs, coil.addr)
+	}
+
+	for _, run := range addrRuns(addrs, nil) {
+		values := make([]bool, run.count)
+		for i := range values {
+			values[i] = rand.Intn(100)%2 == 0
+		}
+
+		a.service.SetDiscreteInputRange(run.start, values)
+		a.logger.Debug("Updated discrete inputs", logging.FieldAddr(run.start), logging.FieldCount(run.count), logging.Field("values", values))
 	}
 }
 
+// RandomizeInputRegisters writes random values to the input registers.
+// Points with metadata get a random engineering value within their limits,
+// encoded according to their type; string points are left alone.
 func (a *ActivitySimulatorImpl) RandomizeInputRegisters() {
+	covered := make(map[uint16]bool)
+	for _, p := range a.seed.Points.InputRegisters {
+		for i := 0; i < p.Registers(); i++ {
+			covered[p.Addr+uint16(i)] = true
+		}
+
+		if p.Type == DataTypeString {
+			continue
+		}
+
+		raw, err := p.Encode(simulatedValue(p))
+		if err != nil {
+			a.logger.Warn("Could not simulate point", logging.Field("point", p.Label()), logging.FieldError(err))
+			continue
+		}
+
+		if err := a.service.SetInputRegisterRange(p.Addr, raw); err != nil {
+			a.logger.Warn("Could not simulate point", logging.Field("point", p.Label()), logging.FieldError(err))
+			continue
+		}
+		a.logger.Debug("Updated input point", logging.Field("point", p.Label()), logging.Field("value", p.Format(raw)))
+	}
+
+	addrs := make([]uint16, 0, len(a.seed.InputRegisters))
 	for _, reg := range a.seed.InputRegisters {
-		r := uint16(rand.Int())
-		a.service.SetInputRegister(reg.addr, r)
-		log.Printf("upating input reg at 0x%X to 0x%X", reg.addr, r)
+		addrs = append(addrs, reg.addr)
+	}
+
+	for _, run := range addrRuns(addrs, covered) {
+		values := make([]uint16, run.count)
+		for i := range values {
+			values[i] = uint16(rand.Int())
+		}
+
+		a.service.SetInputRegisterRange(run.start, values)
+		a.logger.Debug("Updated input registers", logging.FieldAddr(run.start), logging.FieldCount(run.count), logging.Field("values", values))
+	}
+}
+
+type addrRun struct {
+	start uint16
+	count int
+}
+
+// addrRuns groups addresses into runs of consecutive addresses, leaving out
+// the skipped ones, so each run can be written with a single range write.
+func addrRuns(addrs []uint16, skip map[uint16]bool) []addrRun {
+	sorted := make([]uint16, 0, len(addrs))
+	for _, addr := range addrs {
+		if !skip[addr] {
+			sorted = append(sorted, addr)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+
+	result := make([]addrRun, 0)
+	for i, addr := range sorted {
+		if i > 0 && addr == sorted[i-1] {
+			continue
+		}
+
+		if n := len(result); n > 0 && uint32(result[n-1].start)+uint32(result[n-1].count) == uint32(addr) {
+			result[n-1].count++
+			continue
+		}
+		result = append(result, addrRun{start: addr, count: 1})
+	}
+	return result
+}
+
+// simulatedValue picks a random engineering value within the limits of the
+// point. Integer points only get values they can represent exactly, so the
+// encoded value can't round past a limit.
+func simulatedValue(p *Point) float64 {
+	low, high := p.Bounds()
+	r := rand.Float64()
+	if p.Type == DataTypeFloat32 {
+		return low*(1-r) + high*r
+	}
+
+	step := math.Abs(p.Scale)
+	first, last := math.Ceil(low/step), math.Floor(high/step)
+	if last < first {
+		return low
+	}
+	return (first + float64(rand.Int63n(int64(last-first)+1))) * step
+}
+
+// SimulatorGroup starts and stops the simulators of all virtual slaves
+// together.
+type SimulatorGroup struct {
+	simulators []ActivitySimulator
+}
+
+func NewSimulatorGroup() *SimulatorGroup {
+	return &SimulatorGroup{
+		simulators: make([]ActivitySimulator, 0),
+	}
+}
+
+func (g *SimulatorGroup) Add(simulator ActivitySimulator) {
+	g.simulators = append(g.simulators, simulator)
+}
+
+func (g *SimulatorGroup) StartSimulation() {
+	for _, s := range g.simulators {
+		s.StartSimulation()
+	}
+}
+
+func (g *SimulatorGroup) StopSimulation() {
+	for _, s := range g.simulators {
+		s.StopSimulation()
 	}
 }
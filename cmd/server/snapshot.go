@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+)
+
+// RestoreSnapshot overlays the values saved in the snapshot file on top of
+// the seed. The seed stays authoritative for which points exist: points
+// missing from the snapshot keep their seed value and points unknown to the
+// seed are skipped. Point metadata and the device identification always
+// come from the seed. It returns false if there is no snapshot to restore.
+func RestoreSnapshot(filename string, seed Dump) (Dump, bool, error) {
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return seed, false, nil
+	}
+
+	snapshot, err := ReadSeed(filename)
+	if err != nil {
+		return seed, false, fmt.Errorf("read snapshot: %w", err)
+	}
+
+	return Dump{
+		Coils:            overlayCoils(seed.Coils, snapshot.Coils),
+		DiscreteInputs:   overlayCoils(seed.DiscreteInputs, snapshot.DiscreteInputs),
+		HoldingRegisters: overlayRegisters(seed.HoldingRegisters, snapshot.HoldingRegisters),
+		InputRegisters:   overlayRegisters(seed.InputRegisters, snapshot.InputRegisters),
+		Points:           seed.Points,
+		Identification:   seed.Identification,
+	}, true, nil
+}
+
+func overlayCoils(seed, snapshot []Coil) []Coil {
+	values := make(map[uint16]bool, len(snapshot))
+	for _, c := range snapshot {
+		values[c.addr] = c.value
+	}
+
+	result := make([]Coil, 0, len(seed))
+	for _, c := range seed {
+		if value, ok := values[c.addr]; ok {
+			c.value = value
+		}
+		result = append(result, c)
+	}
+	return result
+}
+
+func overlayRegisters(seed, snapshot []Register) []Register {
+	values := make(map[uint16]uint16, len(snapshot))
+	for _, r := range snapshot {
+		values[r.addr] = r.value
+	}
+
+	result := make([]Register, 0, len(seed))
+	for _, r := range seed {
+		if value, ok := values[r.addr]; ok {
+			r.value = value
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// Snapshotter saves the register image of every slave that has a snapshot
+// path, on demand and periodically.
+type Snapshotter struct {
+	slaves   []*Slave
+	interval time.Duration
+	logger   *logging.Logger
+
+	lock   sync.Mutex
+	cancel func()
+	done   chan struct{}
+}
+
+func NewSnapshotter(slaves []*Slave, interval time.Duration, logger *logging.Logger) *Snapshotter {
+	return &Snapshotter{
+		slaves:   slaves,
+		interval: interval,
+		logger:   logger,
+	}
+}
+
+// SaveSnapshots saves the snapshot of every slave, continuing past failures
+// and returning the first error.
+func (s *Snapshotter) SaveSnapshots() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var first error
+	for _, slave := range s.slaves {
+		if slave.SnapshotPath == "" {
+			continue
+		}
+
+		if err := WriteSeed(slave.SnapshotPath, slave.Service.Dump()); err != nil {
+			s.logger.Error("Could not save snapshot", logging.FieldUnitId(slave.Id), logging.Field("path", slave.SnapshotPath), logging.FieldError(err))
+			if first == nil {
+				first = fmt.Errorf("save snapshot of unit %d: %w", slave.Id, err)
+			}
+			continue
+		}
+
+		s.logger.Info("Saved snapshot", logging.FieldUnitId(slave.Id), logging.Field("path", slave.SnapshotPath))
+	}
+
+	return first
+}
+
+// Start begins saving snapshots periodically, if an interval is set.
+func (s *Snapshotter) Start() {
+	if s.interval <= 0 || s.cancel != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-ticker.C:
+				s.SaveSnapshots()
+			}
+		}
+	}()
+}
+
+// Stop stops periodic saving and saves the final snapshot.
+func (s *Snapshotter) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+		s.cancel = nil
+	}
+
+	return s.SaveSnapshots()
+}
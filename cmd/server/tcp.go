@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	mbapHeaderLength = 7
+	mbapMaxLength    = 254
+
+	tlsHandshakeTimeout = 30 * time.Second
+)
+
+// modbusRoleOID is the certificate extension carrying the client role
+// (R-21 of the Modbus/TCP Security spec).
+var modbusRoleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// TCPServer serves the handler chain as Modbus TCP, or Modbus/TCP Security
+// for tcp+tls:// urls. It replaces the library server, which only knows the
+// function codes of modbus.RequestHandler. Connections over MaxClients are
+// closed right away, idle ones after Timeout.
+type TCPServer struct {
+	config      *modbus.ServerConfiguration
+	dispatcher  *RequestDispatcher
+	diagnostics *Diagnostics
+	capture     *capture.FrameCapture
+	logger      *logging.Logger
+
+	listener net.Listener
+	lock     sync.Mutex
+	conns    map[net.Conn]bool
+	stopped  bool
+	done     sync.WaitGroup
+}
+
+func NewTCPServer(config *modbus.ServerConfiguration, dispatcher *RequestDispatcher, capture *capture.FrameCapture, logger *logging.Logger) *TCPServer {
+	return &TCPServer{
+		config:      config,
+		dispatcher:  dispatcher,
+		diagnostics: dispatcher.Diagnostics(),
+		capture:     capture,
+		logger:      logger,
+		conns:       make(map[net.Conn]bool),
+	}
+}
+
+func (s *TCPServer) Start() error {
+	parts := strings.SplitN(s.config.URL, "://", 2)
+	if len(parts) != 2 || parts[0] != "tcp" && parts[0] != "tcp+tls" {
+		return fmt.Errorf("url %q: %w", s.config.URL, modbus.ErrConfigurationError)
+	}
+
+	if parts[0] == "tcp+tls" && (s.config.TLSServerCert == nil || s.config.TLSClientCAs == nil) {
+		return fmt.Errorf("tcp+tls needs a server certificate and client CAs: %w", modbus.ErrConfigurationError)
+	}
+
+	listener, err := net.Listen("tcp", parts[1])
+	if err != nil {
+		return fmt.Errorf("listen on %s: %w", parts[1], err)
+	}
+
+	s.listener = listener
+	s.done.Add(1)
+	go s.accept(parts[0] == "tcp+tls")
+
+	return nil
+}
+
+func (s *TCPServer) Stop() error {
+	err := s.listener.Close()
+
+	s.lock.Lock()
+	s.stopped = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.done.Wait()
+	return err
+}
+
+func (s *TCPServer) accept(secure bool) {
+	defer s.done.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			s.logger.Error("Could not accept connection", logging.FieldError(err))
+			continue
+		}
+
+		if !s.track(conn) {
+			s.logger.Warn("Rejecting connection, max clients reached", logging.FieldClientAddr(conn.RemoteAddr().String()), logging.Field("max_clients", s.config.MaxClients))
+			conn.Close()
+			continue
+		}
+
+		s.done.Add(1)
+		go func() {
+			defer s.done.Done()
+			defer s.untrack(conn)
+			s.serve(conn, secure)
+		}()
+	}
+}
+
+func (s *TCPServer) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped || uint(len(s.conns)) >= s.config.MaxClients {
+		return false
+	}
+
+	s.conns[conn] = true
+	return true
+}
+
+func (s *TCPServer) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return len(s.conns)
+}
+
+func (s *TCPServer) untrack(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+
+	conn.Close()
+}
+
+func (s *TCPServer) serve(conn net.Conn, secure bool) {
+	clientAddr := conn.RemoteAddr().String()
+
+	var clientRole string
+	if secure {
+		tlsConn, role, err := s.handshake(conn)
+		if err != nil {
+			s.logger.Warn("TLS handshake failed", logging.FieldClientAddr(clientAddr), logging.FieldError(err))
+			return
+		}
+		conn, clientRole = tlsConn, role
+	}
+
+	link := capture.CaptureLink{
+		Framing: capture.FramingMBAP,
+		Network: "tcp",
+		Local:   conn.LocalAddr().String(),
+		Peer:    clientAddr,
+	}
+
+	header := make([]byte, mbapHeaderLength)
+	for {
+		if s.config.Timeout > 0 {
+			conn.SetDeadline(time.Now().Add(s.config.Timeout))
+		} else {
+			conn.SetDeadline(time.Time{})
+		}
+
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return
+		}
+
+		txnId := binary.BigEndian.Uint16(header[0:2])
+		protocolId := binary.BigEndian.Uint16(header[2:4])
+		length := int(binary.BigEndian.Uint16(header[4:6]))
+		if protocolId != 0 || length < 2 || length > mbapMaxLength {
+			s.logger.Warn("Closing connection, malformed MBAP header", logging.FieldClientAddr(clientAddr), logging.Field("header", fmt.Sprintf("% X", header)))
+			s.diagnostics.BusCommError()
+			return
+		}
+
+		body := make([]byte, length-1)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			return
+		}
+		s.capture.Record(link, capture.FrameIn, append(header, body...))
+		s.diagnostics.BusMessage()
+
+		res, err := s.dispatcher.Dispatch(clientAddr, clientRole, pdu{
+			unitId:       header[6],
+			functionCode: body[0],
+			payload:      body[1:],
+		})
+		if errors.Is(err, ErrDropResponse) {
+			continue
+		}
+		if err != nil {
+			s.logger.Warn("Dropping malformed request", logging.FieldClientAddr(clientAddr), logging.FieldUnitId(header[6]), logging.Field("request", fmt.Sprintf("% X", body)))
+			continue
+		}
+
+		out := make([]byte, mbapHeaderLength, mbapHeaderLength+1+len(res.payload))
+		binary.BigEndian.PutUint16(out[0:2], txnId)
+		binary.BigEndian.PutUint16(out[4:6], uint16(2+len(res.payload)))
+		out[6] = res.unitId
+		out = append(append(out, res.functionCode), res.payload...)
+		s.capture.Record(link, capture.FrameOut, out)
+
+		if _, err := conn.Write(out); err != nil {
+			s.logger.Warn("Could not write response", logging.FieldClientAddr(clientAddr), logging.FieldError(err))
+			return
+		}
+	}
+}
+
+// handshake authenticates the client with its certificate and returns the
+// role the certificate carries, if any.
+func (s *TCPServer) handshake(conn net.Conn) (net.Conn, string, error) {
+	tlsConn := tls.Server(conn, &tls.Config{
+		Certificates: []tls.Certificate{*s.config.TLSServerCert},
+		ClientCAs:    s.config.TLSClientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		// TLS 1.2 or higher (R-01 of the Modbus/TCP Security spec)
+		MinVersion: tls.VersionTLS12,
+	})
+
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, "", err
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, "", errors.New("no client certificate")
+	}
+
+	return tlsConn, certificateRole(certs[0], s.logger), nil
+}
+
+// certificateRole returns the role of the Modbus Role extension. A
+// certificate without it, with more than one, or with one that is not a
+// UTF8String has no role (R-22, R-23, R-65).
+func certificateRole(cert *x509.Certificate, logger *logging.Logger) string {
+	var role string
+	var found bool
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(modbusRoleOID) {
+			continue
+		}
+
+		if found {
+			logger.Warn("Client certificate has more than one role", logging.Field("subject", cert.Subject.CommonName))
+			return ""
+		}
+		found = true
+
+		// 0x0C is the ASN.1 tag of UTF8String
+		if len(ext.Value) < 2 || ext.Value[0] != 0x0C {
+			return ""
+		}
+
+		if _, err := asn1.Unmarshal(ext.Value, &role); err != nil {
+			logger.Warn("Could not decode role of client certificate", logging.Field("subject", cert.Subject.CommonName), logging.FieldError(err))
+			return ""
+		}
+	}
+
+	return role
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/simonvetter/modbus"
+)
+
+// testPKI is a CA made up for a test, with the certificates it issued.
+type testPKI struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return &testPKI{cert: cert, key: key, pool: pool, serial: 1}
+}
+
+// roleExtension is the Modbus Role extension carrying the role.
+func roleExtension(t *testing.T, role string) pkix.Extension {
+	t.Helper()
+
+	value, err := asn1.MarshalWithParams(role, "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: modbusRoleOID, Value: value}
+}
+
+// issue signs a certificate for a client, or for the server at 127.0.0.1,
+// with the extra extensions.
+func (p *testPKI) issue(t *testing.T, name string, server bool, extensions ...pkix.Extension) *tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(p.serial),
+		Subject:         pkix.Name{CommonName: name},
+		NotBefore:       time.Now().Add(-time.Hour),
+		NotAfter:        time.Now().Add(time.Hour),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		ExtraExtensions: extensions,
+	}
+	if server {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		template.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestCertificateRole(t *testing.T) {
+	ia5, err := asn1.MarshalWithParams("operator", "ia5")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	tests := []struct {
+		name       string
+		extensions []pkix.Extension
+		want       string
+	}{
+		{"no role", nil, ""},
+		{"role", []pkix.Extension{roleExtension(t, "operator")}, "operator"},
+		{"two roles", []pkix.Extension{roleExtension(t, "operator"), roleExtension(t, "viewer")}, ""},
+		{"not a utf8 string", []pkix.Extension{{Id: modbusRoleOID, Value: ia5}}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// crypto/x509 refuses to sign duplicate extensions, the parsed
+			// certificate is made up instead
+			cert := &x509.Certificate{Extensions: test.extensions}
+			if got := certificateRole(cert, logger); got != test.want {
+				t.Errorf("got role %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestTLSWriteAuthorization serves a unit over tcp+tls letting only the
+// operator role write, and talks to it with certificates of every kind.
+func TestTLSWriteAuthorization(t *testing.T) {
+	pki := newTestPKI(t)
+
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		Coils:            []Coil{{addr: 10}},
+		HoldingRegisters: []Register{{addr: 100, value: 0x1234}},
+	})
+	handler := NewAuthorizationMiddleware(
+		NewAdapterHandler(NewModbusHandler(service, nil, logger), logger),
+		[]string{"operator"},
+		logger)
+
+	server := NewTCPServer(&modbus.ServerConfiguration{
+		URL:           "tcp+tls://127.0.0.1:0",
+		Timeout:       5 * time.Second,
+		MaxClients:    10,
+		TLSServerCert: pki.issue(t, "server", true),
+		TLSClientCAs:  pki.pool,
+	}, NewRequestDispatcher(handler, NewDiagnostics(), nil, nil, logger), nil, logger)
+	if err := server.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer server.Stop()
+
+	tests := []struct {
+		name       string
+		extensions []pkix.Extension
+		canWrite   bool
+	}{
+		{"write role", []pkix.Extension{roleExtension(t, "operator")}, true},
+		{"other role", []pkix.Extension{roleExtension(t, "viewer")}, false},
+		{"no role", nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := modbus.NewClient(&modbus.ClientConfiguration{
+				URL:           "tcp+tls://" + server.listener.Addr().String(),
+				Timeout:       5 * time.Second,
+				TLSClientCert: pki.issue(t, test.name, false, test.extensions...),
+				TLSRootCAs:    pki.pool,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := client.Open(); err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if _, err := client.ReadRegisters(100, 1, modbus.HOLDING_REGISTER); err != nil {
+				t.Errorf("read holding register: %v", err)
+			}
+			if _, err := client.ReadCoils(10, 1); err != nil {
+				t.Errorf("read coil: %v", err)
+			}
+
+			writes := map[string]error{
+				"write register":  client.WriteRegister(100, 0x4321),
+				"write registers": client.WriteRegisters(100, []uint16{0x4321}),
+				"write coil":      client.WriteCoil(10, true),
+				"write coils":     client.WriteCoils(10, []bool{true}),
+			}
+			for name, err := range writes {
+				if test.canWrite && err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+				if !test.canWrite && !errors.Is(err, modbus.ErrIllegalFunction) {
+					t.Errorf("%s: got %v, want illegal function", name, err)
+				}
+			}
+		})
+	}
+}
+
+// TestAuthorizationMiddleware covers the function codes the library client
+// can't send.
+func TestAuthorizationMiddleware(t *testing.T) {
+	logger := logging.NewLogger(logging.LogFormatText, logging.LogLevels{})
+	logger.SetOutputs(io.Discard)
+
+	service := NewModbusService(Dump{
+		HoldingRegisters: []Register{{addr: 100}},
+	})
+	handler := NewAuthorizationMiddleware(
+		NewAdapterHandler(NewModbusHandler(service, nil, logger), logger),
+		[]string{"operator"},
+		logger)
+
+	for _, role := range []string{"operator", "viewer", ""} {
+		canWrite := role == "operator"
+
+		err := handler.HandleMaskWriteRegister(&MaskWriteRegisterRequest{ClientRole: role, UnitId: 1, Addr: 100, AndMask: 0xFFFF})
+		if canWrite && err != nil || !canWrite && !errors.Is(err, modbus.ErrIllegalFunction) {
+			t.Errorf("role %q: mask write register got %v", role, err)
+		}
+
+		_, err = handler.HandleReadWriteRegisters(&ReadWriteRegistersRequest{
+			ClientRole: role, UnitId: 1, ReadAddr: 100, ReadQuantity: 1, WriteAddr: 100, Args: []uint16{1},
+		})
+		if canWrite && err != nil || !canWrite && !errors.Is(err, modbus.ErrIllegalFunction) {
+			t.Errorf("role %q: read/write multiple registers got %v", role, err)
+		}
+
+		_, err = handler.HandleHoldingRegisters(&modbus.HoldingRegistersRequest{ClientRole: role, UnitId: 1, Addr: 100, Quantity: 1})
+		if err != nil {
+			t.Errorf("role %q: read holding registers got %v", role, err)
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
+	"github.com/aveplen/mirea-modbus/internal/modbusclient"
+	"github.com/goburrow/serial"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	UpstreamTCP        = "tcp"
+	UpstreamTCPTLS     = "tcp+tls"
+	UpstreamUDP        = "udp"
+	UpstreamRTU        = "rtu"
+	UpstreamRTUOverTCP = "rtuovertcp"
+	UpstreamRTUOverUDP = "rtuoverudp"
+
+	DefaultUpstreamTimeout = time.Second
+)
+
+var upstreamTransports = []string{
+	UpstreamTCP, UpstreamTCPTLS, UpstreamUDP, UpstreamRTUOverTCP, UpstreamRTUOverUDP, UpstreamRTU,
+}
+
+// UpstreamConfig tells how to reach an upstream device, with the same
+// transports the client offers except ASCII.
+type UpstreamConfig struct {
+	// URL is e.g. tcp://192.168.0.10:502, tcp+tls://plc:802,
+	// rtuovertcp://gateway:4001 or rtu:///dev/ttyUSB1.
+	URL string `json:"url"`
+	// Serial holds the line settings of rtu:// upstreams, the defaults
+	// when not set.
+	Serial *SerialConfig `json:"serial,omitempty"`
+	// TLS holds the certificates of tcp+tls:// upstreams.
+	TLS UpstreamTLSConfig `json:"tls"`
+	// Timeout bounds a single upstream request, zero picks the default
+	// of 1s.
+	Timeout Duration `json:"timeout"`
+}
+
+// UpstreamTLSConfig holds the PEM files of a tcp+tls upstream: the key pair
+// the gateway presents, carrying its role, and the CAs the upstream
+// certificate is checked against.
+type UpstreamTLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file"`
+}
+
+// Validate reports the problems of the upstream settings.
+func (c UpstreamConfig) Validate() []string {
+	problems := make([]string, 0)
+
+	transport, address := splitUpstreamURL(c.URL)
+	switch transport {
+	case UpstreamRTU:
+		if address == "" {
+			problems = append(problems, fmt.Sprintf("url: %q should name a serial port, e.g. rtu:///dev/ttyUSB1", c.URL))
+		}
+		for _, problem := range c.serial().Validate() {
+			problems = append(problems, "serial."+problem)
+		}
+
+	case UpstreamTCP, UpstreamTCPTLS, UpstreamUDP, UpstreamRTUOverTCP, UpstreamRTUOverUDP:
+		if _, port, err := net.SplitHostPort(address); err != nil {
+			problems = append(problems, fmt.Sprintf("url: %q: %v", address, err))
+		} else if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+			problems = append(problems, fmt.Sprintf("url: port %q is not a number between 0 and 65535", port))
+		}
+
+	default:
+		problems = append(problems, fmt.Sprintf(
+			"url: %q should look like tcp://192.168.0.10:502, transports are %s",
+			c.URL, strings.Join(upstreamTransports, ", "),
+		))
+	}
+
+	if transport == UpstreamTCPTLS {
+		files := []struct {
+			name string
+			path string
+		}{
+			{"cert_file", c.TLS.CertFile},
+			{"key_file", c.TLS.KeyFile},
+			{"ca_file", c.TLS.CAFile},
+		}
+
+		for _, file := range files {
+			if file.path == "" {
+				problems = append(problems, fmt.Sprintf("tls.%s: is required for tcp+tls", file.name))
+			} else if _, err := os.Stat(file.path); err != nil {
+				problems = append(problems, fmt.Sprintf("tls.%s: %v", file.name, err))
+			}
+		}
+	}
+
+	if c.Timeout < 0 {
+		problems = append(problems, fmt.Sprintf("timeout: must not be negative, got %v", time.Duration(c.Timeout)))
+	}
+
+	return problems
+}
+
+func (c UpstreamConfig) serial() SerialConfig {
+	if c.Serial == nil {
+		return DefaultSerialConfig()
+	}
+	return *c.Serial
+}
+
+func (c UpstreamConfig) timeout() time.Duration {
+	if c.Timeout == 0 {
+		return DefaultUpstreamTimeout
+	}
+	return time.Duration(c.Timeout)
+}
+
+// newTransport creates the transport of the url, like the client does,
+// recording its frames to the capture.
+func (c UpstreamConfig) newTransport(capture *capture.FrameCapture) (modbusclient.FrameTransport, error) {
+	transport, address := splitUpstreamURL(c.URL)
+	switch transport {
+	case UpstreamTCP:
+		return modbusclient.NewMBAPTransport("tcp", address, nil, c.timeout(), capture), nil
+
+	case UpstreamUDP:
+		return modbusclient.NewMBAPTransport("udp", address, nil, c.timeout(), capture), nil
+
+	case UpstreamTCPTLS:
+		cert, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load key pair: %w", err)
+		}
+
+		rootCAs, err := modbus.LoadCertPool(c.TLS.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load root CAs: %w", err)
+		}
+
+		return modbusclient.NewMBAPTransport("tcp", address, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      rootCAs,
+			// TLS 1.2 or higher (R-01 of the Modbus/TCP Security spec)
+			MinVersion: tls.VersionTLS12,
+		}, c.timeout(), capture), nil
+
+	case UpstreamRTUOverTCP:
+		return modbusclient.NewNetworkRTUTransport("tcp", address, c.timeout(), capture), nil
+
+	case UpstreamRTUOverUDP:
+		return modbusclient.NewNetworkRTUTransport("udp", address, c.timeout(), capture), nil
+
+	case UpstreamRTU:
+		config := c.serial()
+		return modbusclient.NewSerialRTUTransport(&serial.Config{
+			Address:  address,
+			BaudRate: config.BaudRate,
+			DataBits: config.DataBits,
+			StopBits: config.StopBits,
+			Parity:   parities[config.Parity],
+			Timeout:  c.timeout(),
+		}, capture), nil
+	}
+
+	return nil, fmt.Errorf("url %q: %w", c.URL, modbus.ErrConfigurationError)
+}
+
+func splitUpstreamURL(url string) (string, string) {
+	parts := strings.SplitN(url, "://", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return parts[0], parts[1]
+}
+
+// Upstream is the connection to an upstream device, shared by every unit
+// forwarded to it. Requests are serialized. The connection is opened by the
+// first request and reopened by the next one after a failure.
+type Upstream struct {
+	config  UpstreamConfig
+	capture *capture.FrameCapture
+	logger  *logging.Logger
+
+	lock   sync.Mutex
+	client *modbusclient.RawClient
+}
+
+func NewUpstream(config UpstreamConfig, capture *capture.FrameCapture, logger *logging.Logger) *Upstream {
+	return &Upstream{
+		config:  config,
+		capture: capture,
+		logger:  logger.With(logging.Field("upstream", config.URL)),
+	}
+}
+
+func (u *Upstream) URL() string {
+	return u.config.URL
+}
+
+// Close closes the connection, if open.
+func (u *Upstream) Close() error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	return u.disconnect()
+}
+
+func (u *Upstream) disconnect() error {
+	if u.client == nil {
+		return nil
+	}
+
+	err := u.client.Close()
+	u.client = nil
+	return err
+}
+
+func (u *Upstream) connect() error {
+	transport, err := u.config.newTransport(u.capture)
+	if err != nil {
+		return fmt.Errorf("create transport: %w", err)
+	}
+
+	client := modbusclient.NewRawClient(transport)
+	if err := client.Open(); err != nil {
+		return err
+	}
+
+	u.logger.Info("Connected to upstream")
+	u.client = client
+	return nil
+}
+
+// forward sends a request to the unit through the client. A device that
+// can't be reached is reported as Gateway Path Unavailable, one that doesn't
+// answer properly as Gateway Target Device Failed to Respond; exception
+// responses are passed on as they are.
+func (u *Upstream) forward(unitId uint8, fc uint8, request func(client *modbusclient.RawClient) error) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+
+	if u.client == nil {
+		if err := u.connect(); err != nil {
+			u.logger.Warn("Could not connect to upstream", logging.FieldUnitId(unitId), logging.FieldFunctionCode(fc), logging.FieldError(err))
+			return fmt.Errorf("upstream %s: %v: %w", u.config.URL, err, modbus.ErrGWPathUnavailable)
+		}
+	}
+
+	u.client.SetUnitId(unitId)
+	err := request(u.client)
+	if err == nil {
+		return nil
+	}
+
+	if isException(err) {
+		return fmt.Errorf("upstream %s: %w", u.config.URL, err)
+	}
+
+	u.logger.Warn("Could not forward request to upstream", logging.FieldUnitId(unitId), logging.FieldFunctionCode(fc), logging.FieldError(err))
+	u.disconnect()
+	return fmt.Errorf("upstream %s: %v: %w", u.config.URL, err, modbus.ErrGWTargetFailedToRespond)
+}
+
+func (u *Upstream) ReadBools(unitId uint8, fc uint8, addr uint16, quantity uint16) ([]bool, error) {
+	var result []bool
+	err := u.forward(unitId, fc, func(client *modbusclient.RawClient) error {
+		var err error
+		if fc == fcReadDiscreteInputs {
+			result, err = client.ReadDiscreteInputs(addr, quantity)
+		} else {
+			result, err = client.ReadCoils(addr, quantity)
+		}
+		return err
+	})
+	return result, err
+}
+
+func (u *Upstream) ReadRegisters(unitId uint8, fc uint8, addr uint16, quantity uint16) ([]uint16, error) {
+	regType := modbus.HOLDING_REGISTER
+	if fc == fcReadInputRegisters {
+		regType = modbus.INPUT_REGISTER
+	}
+
+	var result []uint16
+	err := u.forward(unitId, fc, func(client *modbusclient.RawClient) error {
+		var err error
+		result, err = client.ReadRegisters(addr, quantity, regType)
+		return err
+	})
+	return result, err
+}
+
+func (u *Upstream) WriteCoils(unitId uint8, addr uint16, values []bool) error {
+	if len(values) == 1 {
+		return u.forward(unitId, fcWriteSingleCoil, func(client *modbusclient.RawClient) error {
+			return client.WriteCoil(addr, values[0])
+		})
+	}
+
+	return u.forward(unitId, fcWriteMultipleCoils, func(client *modbusclient.RawClient) error {
+		return client.WriteCoils(addr, values)
+	})
+}
+
+func (u *Upstream) WriteRegisters(unitId uint8, addr uint16, values []uint16) error {
+	if len(values) == 1 {
+		return u.forward(unitId, fcWriteSingleRegister, func(client *modbusclient.RawClient) error {
+			return client.WriteRegister(addr, values[0])
+		})
+	}
+
+	return u.forward(unitId, fcWriteMultipleRegisters, func(client *modbusclient.RawClient) error {
+		return client.WriteRegisters(addr, values)
+	})
+}
+
+func (u *Upstream) MaskWriteRegister(unitId uint8, addr uint16, andMask uint16, orMask uint16) error {
+	return u.forward(unitId, fcMaskWriteRegister, func(client *modbusclient.RawClient) error {
+		return client.MaskWriteRegister(addr, andMask, orMask)
+	})
+}
+
+func (u *Upstream) ReadWriteRegisters(unitId uint8, readAddr uint16, readQuantity uint16, writeAddr uint16, values []uint16) ([]uint16, error) {
+	var result []uint16
+	err := u.forward(unitId, fcReadWriteMultipleRegisters, func(client *modbusclient.RawClient) error {
+		var err error
+		result, err = client.ReadWriteRegisters(readAddr, readQuantity, writeAddr, values)
+		return err
+	})
+	return result, err
+}
+
+// ReadDeviceIdentification forwards a single Read Device Identification
+// request. "More follows" is passed on to the client, which asks again.
+func (u *Upstream) ReadDeviceIdentification(unitId uint8, code uint8, objectId uint8) (IdentificationResult, error) {
+	var res modbusclient.IdentificationResponse
+	err := u.forward(unitId, fcEncapsulatedInterface, func(client *modbusclient.RawClient) error {
+		var err error
+		res, err = client.ReadDeviceIdentificationOnce(code, objectId)
+		return err
+	})
+	if err != nil {
+		return IdentificationResult{}, err
+	}
+
+	result := IdentificationResult{
+		ConformityLevel: res.ConformityLevel,
+		MoreFollows:     res.MoreFollows,
+		NextObjectId:    res.NextObjectId,
+	}
+	for _, object := range res.Objects {
+		result.Objects = append(result.Objects, IdentificationObject{Id: object.Id, Value: object.Value})
+	}
+	return result, nil
+}
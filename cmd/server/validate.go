@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+const (
+	ValidateSeedOk      = 0
+	ValidateSeedInvalid = 1
+	ValidateSeedUsage   = 2
+)
+
+// RunValidateSeed checks seed files without starting the server and prints
+// every problem found, one per line prefixed with the file name, so it can
+// be used in CI on device profiles. It returns the process exit code.
+func RunValidateSeed(args []string) int {
+	flags := flag.NewFlagSet("validate-seed", flag.ContinueOnError)
+	quiet := flags.Bool("q", false, "print problems only")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: server validate-seed [-q] seed.json...")
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return ValidateSeedUsage
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return ValidateSeedUsage
+	}
+
+	code := ValidateSeedOk
+	for _, filename := range flags.Args() {
+		_, err := ReadSeed(filename)
+		if err == nil {
+			if !*quiet {
+				fmt.Printf("%s: ok\n", filename)
+			}
+			continue
+		}
+
+		code = ValidateSeedInvalid
+
+		var seedErr *SeedError
+		if !errors.As(err, &seedErr) {
+			fmt.Printf("%s: %v\n", filename, err)
+			continue
+		}
+
+		for _, problem := range seedErr.Problems {
+			fmt.Printf("%s: %s\n", filename, problem)
+		}
+	}
+
+	return code
+}
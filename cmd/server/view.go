@@ -1,9 +1,14 @@
+//go:build windows
+
 package main
 
 import (
 	"fmt"
 	"sort"
+	"strings"
 
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/aveplen/mirea-modbus/internal/logging"
 	"github.com/lxn/walk"
 	d "github.com/lxn/walk/declarative"
 )
@@ -12,6 +17,7 @@ type CoilView struct {
 	Index   int
 	Address uint16
 	Value   bool
+	Name    string
 }
 
 type CoilsModel struct {
@@ -19,7 +25,12 @@ type CoilsModel struct {
 	items []*CoilView
 }
 
-func NewCoilsModel(coils []Coil) *CoilsModel {
+func NewCoilsModel(coils []Coil, points []*Point) *CoilsModel {
+	names := make(map[uint16]string, len(points))
+	for _, p := range points {
+		names[p.Addr] = p.Name
+	}
+
 	m := new(CoilsModel)
 	m.items = make([]*CoilView, len(coils))
 	for i := range m.items {
@@ -27,6 +38,7 @@ func NewCoilsModel(coils []Coil) *CoilsModel {
 			Index:   i,
 			Address: coils[i].addr,
 			Value:   coils[i].value,
+			Name:    names[coils[i].addr],
 		}
 	}
 
@@ -38,6 +50,16 @@ func NewCoilsModel(coils []Coil) *CoilsModel {
 	return m
 }
 
+func (m *CoilsModel) item(addr uint16) *CoilView {
+	i := sort.Search(len(m.items), func(i int) bool {
+		return m.items[i].Address >= addr
+	})
+	if i < len(m.items) && m.items[i].Address == addr {
+		return m.items[i]
+	}
+	return nil
+}
+
 func (m *CoilsModel) RowCount() int {
 	return len(m.items)
 }
@@ -54,6 +76,9 @@ func (m *CoilsModel) Value(row, col int) interface{} {
 
 	case 3:
 		return item.Value
+
+	case 4:
+		return item.Name
 	}
 
 	panic("unexpected col")
@@ -63,15 +88,19 @@ type RegisterView struct {
 	Index   int
 	Address uint16
 	Value   uint16
+	Name    string
+	Point   string
 }
 
 type RegistersModel struct {
 	walk.TableModelBase
-	items []*RegisterView
+	items  []*RegisterView
+	points []*Point
 }
 
-func NewRegistersModel(registers []Register) *RegistersModel {
+func NewRegistersModel(registers []Register, points []*Point) *RegistersModel {
 	m := new(RegistersModel)
+	m.points = points
 	m.ResetRows(registers)
 	return m
 }
@@ -90,9 +119,46 @@ func (m *RegistersModel) ResetRows(registers []Register) {
 		return m.items[i].Address < m.items[j].Address
 	})
 
+	for _, p := range m.points {
+		if item := m.item(p.Addr); item != nil {
+			item.Name = p.Name
+		}
+	}
+	m.RefreshPoints()
+
 	m.PublishRowsReset()
 }
 
+func (m *RegistersModel) item(addr uint16) *RegisterView {
+	i := sort.Search(len(m.items), func(i int) bool {
+		return m.items[i].Address >= addr
+	})
+	if i < len(m.items) && m.items[i].Address == addr {
+		return m.items[i]
+	}
+	return nil
+}
+
+// RefreshPoints decodes the engineering values of the points with metadata
+// from the current register values. The value is shown on the first
+// register of the point.
+func (m *RegistersModel) RefreshPoints() {
+	for _, p := range m.points {
+		first := m.item(p.Addr)
+		if first == nil {
+			continue
+		}
+
+		raw := make([]uint16, p.Registers())
+		for i := range raw {
+			if item := m.item(p.Addr + uint16(i)); item != nil {
+				raw[i] = item.Value
+			}
+		}
+		first.Point = p.Format(raw)
+	}
+}
+
 func (m *RegistersModel) RowCount() int {
 	return len(m.items)
 }
@@ -109,6 +175,12 @@ func (m *RegistersModel) Value(row, col int) interface{} {
 
 	case 3, 4:
 		return item.Value
+
+	case 5:
+		return item.Name
+
+	case 6:
+		return item.Point
 	}
 
 	panic("unexpected col coils")
@@ -120,17 +192,48 @@ type MainModel interface {
 
 	StartSimulation()
 	StopSimulation()
+
+	SaveSnapshot() bool
+
+	DiagnosticCounters() DiagnosticCounters
+	RateLimitStats() []RateLimitStat
+	ClearDiagnostics()
+
+	FaultInjectionEnabled() bool
+	SetFaultInjection(enabled bool)
+
+	ReloadAccess() bool
 }
 
-type ViewController struct {
-	MainWindow *d.MainWindow
-	model      MainModel
+// UnitModels holds the table models of a single virtual slave.
+type UnitModels struct {
+	Id uint8
 
 	discreteInputsModel   *CoilsModel
 	coilsModel            *CoilsModel
 	inputRegistersModel   *RegistersModel
 	holdingRegistersModel *RegistersModel
+}
+
+func NewUnitModels(id uint8, seed Dump) *UnitModels {
+	return &UnitModels{
+		Id: id,
+
+		discreteInputsModel:   NewCoilsModel(seed.DiscreteInputs, seed.Points.DiscreteInputs),
+		coilsModel:            NewCoilsModel(seed.Coils, seed.Points.Coils),
+		inputRegistersModel:   NewRegistersModel(seed.InputRegisters, seed.Points.InputRegisters),
+		holdingRegistersModel: NewRegistersModel(seed.HoldingRegisters, seed.Points.HoldingRegisters),
+	}
+}
 
+type ViewController struct {
+	MainWindow *d.MainWindow
+	model      MainModel
+
+	units   []*UnitModels
+	current *UnitModels
+
+	unitComboBox          *walk.ComboBox
 	discreteInputsView    *walk.TableView
 	coilsView             *walk.TableView
 	inputRegisterView     *walk.TableView
@@ -139,57 +242,103 @@ type ViewController struct {
 	stopServerButton      *walk.PushButton
 	startSimulationButton *walk.PushButton
 	stopSimulationButton  *walk.PushButton
+	saveSnapshotButton    *walk.PushButton
+	faultsCheckBox        *walk.CheckBox
 	clearLogButton        *walk.PushButton
+	exportLogButton       *walk.PushButton
+	diagnosticsEdit       *walk.TextEdit
 
-	AppendLog func(value string)
+	AppendLog func(level logging.LogLevel, value string)
+	Frames    capture.FrameRecorder
 }
 
-func (v *ViewController) UpdateDiscreteInputs(change CoilChange) {
-	for _, item := range v.discreteInputsModel.items {
-		if item.Address == change.addr {
-			item.Value = change.to
-			break
+func (v *ViewController) unit(unitId uint8) *UnitModels {
+	for _, unit := range v.units {
+		if unit.Id == unitId {
+			return unit
 		}
 	}
-
-	v.discreteInputsModel.PublishRowsReset()
-	v.discreteInputsView.Invalidate()
+	panic(fmt.Sprintf("unexpected unit id %d", unitId))
 }
 
-func (v *ViewController) UpdateCoils(change CoilChange) {
-	for _, item := range v.coilsModel.items {
-		if item.Address == change.addr {
-			item.Value = change.to
-			break
-		}
+// SelectUnit shows the tables of the unit chosen in the unit combo box.
+func (v *ViewController) SelectUnit() {
+	index := v.unitComboBox.CurrentIndex()
+	if index < 0 || index >= len(v.units) {
+		return
 	}
 
-	v.coilsModel.PublishRowsReset()
-	v.coilsView.Invalidate()
+	v.current = v.units[index]
+	v.discreteInputsView.SetModel(v.current.discreteInputsModel)
+	v.coilsView.SetModel(v.current.coilsModel)
+	v.inputRegisterView.SetModel(v.current.inputRegistersModel)
+	v.holdingRegistersView.SetModel(v.current.holdingRegistersModel)
 }
 
-func (v *ViewController) UpdateInputRegisters(change RegisterChange) {
-	for _, item := range v.inputRegistersModel.items {
-		if item.Address == change.addr {
-			item.Value = change.to
-			break
+func (v *ViewController) UpdateDiscreteInputs(unitId uint8) CoilSub {
+	unit := v.unit(unitId)
+	return func(changes []CoilChange) {
+		for _, change := range changes {
+			if item := unit.discreteInputsModel.item(change.addr); item != nil {
+				item.Value = change.to
+			}
+		}
+
+		unit.discreteInputsModel.PublishRowsReset()
+		if unit == v.current {
+			v.discreteInputsView.Invalidate()
 		}
 	}
+}
 
-	v.inputRegistersModel.PublishRowsReset()
-	v.inputRegisterView.Invalidate()
+func (v *ViewController) UpdateCoils(unitId uint8) CoilSub {
+	unit := v.unit(unitId)
+	return func(changes []CoilChange) {
+		for _, change := range changes {
+			if item := unit.coilsModel.item(change.addr); item != nil {
+				item.Value = change.to
+			}
+		}
+
+		unit.coilsModel.PublishRowsReset()
+		if unit == v.current {
+			v.coilsView.Invalidate()
+		}
+	}
 }
 
-func (v *ViewController) UpdateHoldingRegisters(change RegisterChange) {
-	for _, item := range v.holdingRegistersModel.items {
-		if item.Address == change.addr {
-			item.Value = change.to
-			break
+func (v *ViewController) UpdateInputRegisters(unitId uint8) RegisterSub {
+	unit := v.unit(unitId)
+	return func(changes []RegisterChange) {
+		for _, change := range changes {
+			if item := unit.inputRegistersModel.item(change.addr); item != nil {
+				item.Value = change.to
+			}
+		}
+
+		unit.inputRegistersModel.RefreshPoints()
+		unit.inputRegistersModel.PublishRowsReset()
+		if unit == v.current {
+			v.inputRegisterView.Invalidate()
 		}
 	}
+}
 
-	v.holdingRegistersModel.PublishRowsReset()
-	v.holdingRegistersView.Invalidate()
+func (v *ViewController) UpdateHoldingRegisters(unitId uint8) RegisterSub {
+	unit := v.unit(unitId)
+	return func(changes []RegisterChange) {
+		for _, change := range changes {
+			if item := unit.holdingRegistersModel.item(change.addr); item != nil {
+				item.Value = change.to
+			}
+		}
+
+		unit.holdingRegistersModel.RefreshPoints()
+		unit.holdingRegistersModel.PublishRowsReset()
+		if unit == v.current {
+			v.holdingRegistersView.Invalidate()
+		}
+	}
 }
 
 func (v *ViewController) StartServer() {
@@ -197,6 +346,7 @@ func (v *ViewController) StartServer() {
 		v.startServerButton.Button.SetEnabled(false)
 		v.stopServerButton.Button.SetEnabled(true)
 	}
+	v.RefreshDiagnostics()
 }
 
 func (v *ViewController) StopServer() {
@@ -218,19 +368,61 @@ func (v *ViewController) StopSimulation() {
 	v.stopSimulationButton.Button.SetEnabled(false)
 }
 
-func NewView(seed Dump, model MainModel) *ViewController {
+func (v *ViewController) SaveSnapshot() {
+	v.model.SaveSnapshot()
+}
+
+func (v *ViewController) ReloadAccess() {
+	v.model.ReloadAccess()
+}
+
+func (v *ViewController) ToggleFaults() {
+	v.model.SetFaultInjection(v.faultsCheckBox.Checked())
+}
+
+// RefreshDiagnostics shows the current diagnostic counters of the server
+// and the requests of every client rate limiting let through or refused.
+func (v *ViewController) RefreshDiagnostics() {
+	counters := v.model.DiagnosticCounters().List()
+
+	lines := make([]string, 0, len(counters))
+	for _, counter := range counters {
+		lines = append(lines, fmt.Sprintf("%s: %d", counter.Name, counter.Value))
+	}
+
+	if stats := v.model.RateLimitStats(); len(stats) != 0 {
+		lines = append(lines, "", "Rate limit:")
+		for _, stat := range stats {
+			lines = append(lines, stat.String())
+		}
+	}
+	v.diagnosticsEdit.SetText(strings.Join(lines, "\r\n"))
+}
+
+func (v *ViewController) ClearDiagnostics() {
+	v.model.ClearDiagnostics()
+	v.RefreshDiagnostics()
+}
+
+func NewView(slaves []*Slave, model MainModel, logLines int, logger *logging.Logger) *ViewController {
 	view := &ViewController{
 		model: model,
+		units: make([]*UnitModels, 0, len(slaves)),
+	}
 
-		discreteInputsModel:   NewCoilsModel(seed.DiscreteInputs),
-		coilsModel:            NewCoilsModel(seed.Coils),
-		inputRegistersModel:   NewRegistersModel(seed.InputRegisters),
-		holdingRegistersModel: NewRegistersModel(seed.HoldingRegisters),
+	unitNames := make([]string, 0, len(slaves))
+	for _, slave := range slaves {
+		view.units = append(view.units, NewUnitModels(slave.Id, slave.Seed))
+		unitNames = append(unitNames, fmt.Sprintf("Unit %d", slave.Id))
 	}
+	view.current = view.units[0]
 
-	lv := NewLogView()
+	lv := NewLogView(logLines, logger)
 	view.AppendLog = lv.Append
 
+	fv := NewFrameView(logger)
+	view.Frames = fv
+
 	view.MainWindow = &d.MainWindow{
 		Title:  "Modbus server (slave)",
 		Size:   d.Size{Width: 1200, Height: 1000},
@@ -264,6 +456,34 @@ func NewView(seed Dump, model MainModel) *ViewController {
 						OnClicked: view.StopSimulation,
 						Enabled:   false,
 					},
+
+					d.PushButton{
+						AssignTo:  &view.saveSnapshotButton,
+						Text:      "Save snapshot",
+						OnClicked: view.SaveSnapshot,
+					},
+
+					d.PushButton{
+						Text:      "Reload access rules",
+						OnClicked: view.ReloadAccess,
+					},
+
+					d.CheckBox{
+						AssignTo:         &view.faultsCheckBox,
+						Text:             "Inject faults",
+						Checked:          model.FaultInjectionEnabled(),
+						OnCheckedChanged: view.ToggleFaults,
+					},
+
+					d.HSpacer{},
+
+					d.Label{Text: "Unit:"},
+					d.ComboBox{
+						AssignTo:              &view.unitComboBox,
+						Model:                 unitNames,
+						CurrentIndex:          0,
+						OnCurrentIndexChanged: view.SelectUnit,
+					},
 				},
 			},
 
@@ -277,7 +497,7 @@ func NewView(seed Dump, model MainModel) *ViewController {
 							d.Label{Text: "Discrete inputs:"},
 							d.TableView{
 								AssignTo:         &view.discreteInputsView,
-								Model:            view.discreteInputsModel,
+								Model:            view.current.discreteInputsModel,
 								AlternatingRowBG: true,
 								ColumnsOrderable: true,
 								Columns: []d.TableViewColumn{
@@ -285,13 +505,14 @@ func NewView(seed Dump, model MainModel) *ViewController {
 									{Title: "Address (dec)", FormatFunc: numberDecimalFormat},
 									{Title: "Address (hex)", FormatFunc: numberHexFormat},
 									{Title: "Value", FormatFunc: boolFormat},
+									{Title: "Name"},
 								},
 							},
 
 							d.Label{Text: "Coils:"},
 							d.TableView{
 								AssignTo:         &view.coilsView,
-								Model:            view.coilsModel,
+								Model:            view.current.coilsModel,
 								AlternatingRowBG: true,
 								ColumnsOrderable: true,
 								Columns: []d.TableViewColumn{
@@ -299,13 +520,14 @@ func NewView(seed Dump, model MainModel) *ViewController {
 									{Title: "Address (dec)", FormatFunc: numberDecimalFormat},
 									{Title: "Address (hex)", FormatFunc: numberHexFormat},
 									{Title: "Coil", FormatFunc: boolFormat},
+									{Title: "Name"},
 								},
 							},
 
 							d.Label{Text: "Input registers:"},
 							d.TableView{
 								AssignTo:         &view.inputRegisterView,
-								Model:            view.inputRegistersModel,
+								Model:            view.current.inputRegistersModel,
 								AlternatingRowBG: true,
 								ColumnsOrderable: true,
 								Columns: []d.TableViewColumn{
@@ -314,13 +536,15 @@ func NewView(seed Dump, model MainModel) *ViewController {
 									{Title: "Address (hex)", FormatFunc: numberHexFormat},
 									{Title: "Value (dec)", FormatFunc: numberDecimalFormat},
 									{Title: "Value (hex)", FormatFunc: numberHexFormat},
+									{Title: "Name"},
+									{Title: "Point value"},
 								},
 							},
 
 							d.Label{Text: "Holding registers:"},
 							d.TableView{
 								AssignTo:         &view.holdingRegistersView,
-								Model:            view.holdingRegistersModel,
+								Model:            view.current.holdingRegistersModel,
 								AlternatingRowBG: true,
 								ColumnsOrderable: true,
 								Columns: []d.TableViewColumn{
@@ -329,6 +553,8 @@ func NewView(seed Dump, model MainModel) *ViewController {
 									{Title: "Address (hex)", FormatFunc: numberHexFormat},
 									{Title: "Value (dec)", FormatFunc: numberDecimalFormat},
 									{Title: "Value (hex)", FormatFunc: numberHexFormat},
+									{Title: "Name"},
+									{Title: "Point value"},
 								},
 							},
 						},
@@ -337,15 +563,63 @@ func NewView(seed Dump, model MainModel) *ViewController {
 					d.Composite{
 						Layout: d.VBox{},
 						Children: []d.Widget{
+							d.Composite{
+								Layout: d.HBox{},
+								Children: []d.Widget{
+									d.Label{Text: "Diagnostic counters:"},
+									d.PushButton{
+										Text:      "Refresh",
+										OnClicked: view.RefreshDiagnostics,
+									},
+									d.PushButton{
+										Text:      "Clear",
+										OnClicked: view.ClearDiagnostics,
+									},
+								},
+							},
+
+							d.TextEdit{
+								AssignTo: &view.diagnosticsEdit,
+								ReadOnly: true,
+								VScroll:  true,
+								MinSize:  d.Size{Height: 150},
+								MaxSize:  d.Size{Height: 150},
+							},
+
+							d.Composite{
+								Layout: d.HBox{},
+								Children: []d.Widget{
+									d.Label{Text: "Frames:"},
+									*fv.CaptureCheckBox,
+									d.PushButton{
+										Text:      "Clear",
+										OnClicked: fv.ClearFrames,
+									},
+									d.PushButton{
+										Text:      "Save...",
+										OnClicked: fv.SaveFrames,
+									},
+								},
+							},
+
+							fv.TextEdit,
+
 							d.Composite{
 								Layout: d.HBox{},
 								Children: []d.Widget{
 									d.Label{Text: "Log view:"},
+									d.Label{Text: "Level:"},
+									*lv.LevelComboBox,
 									d.PushButton{
 										AssignTo:  &view.clearLogButton,
 										Text:      "Clear",
 										OnClicked: lv.ClearLog,
 									},
+									d.PushButton{
+										AssignTo:  &view.exportLogButton,
+										Text:      "Export...",
+										OnClicked: lv.ExportLog,
+									},
 								},
 							},
 
@@ -3,12 +3,12 @@ module github.com/aveplen/mirea-modbus
 go 1.18
 
 require (
+	github.com/goburrow/serial v0.1.0
 	github.com/lxn/walk v0.0.0-20210112085537-c389da54e794
 	github.com/simonvetter/modbus v1.6.0
 )
 
 require (
-	github.com/goburrow/serial v0.1.0 // indirect
 	github.com/lxn/win v0.0.0-20210218163916-a377121e959e // indirect
 	golang.org/x/sys v0.0.0-20201018230417-eeed37f84f13 // indirect
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
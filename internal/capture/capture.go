@@ -0,0 +1,234 @@
+// Package capture hands the frames sent and received by the server and the
+// client to recorders, and writes them to text or pcap capture files.
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Directions of captured frames, seen from this side of the link.
+const (
+	FrameIn  = "in"
+	FrameOut = "out"
+)
+
+// Framings of captured frames.
+const (
+	FramingMBAP  = "mbap"
+	FramingRTU   = "rtu"
+	FramingASCII = "ascii"
+)
+
+const (
+	CaptureFormatText = "text"
+	CaptureFormatPcap = "pcap"
+)
+
+// textCaptureHeader starts a capture file in the text format, every line
+// after it is a frame.
+const textCaptureHeader = "# time direction framing peer [txn=id] bytes\n"
+
+const captureTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// CaptureLink is the link frames are captured on.
+type CaptureLink struct {
+	Framing string
+	// Network is "tcp" or "udp" for frames carried over IP, empty on a
+	// serial line.
+	Network string
+	// Local and Peer are the addresses of both ends, Peer is the serial
+	// device on a serial line.
+	Local string
+	Peer  string
+}
+
+// CapturedFrame is an ADU as it was sent or received, with the MBAP header
+// or the unit id and checksum.
+type CapturedFrame struct {
+	CaptureLink
+	Time      time.Time
+	Direction string
+	Data      []byte
+}
+
+// TxnId returns the transaction id of an MBAP frame.
+func (f CapturedFrame) TxnId() (uint16, bool) {
+	if f.Framing != FramingMBAP || len(f.Data) < 2 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint16(f.Data[0:2]), true
+}
+
+// Summary describes the frame without its bytes, e.g.
+//
+//	in mbap 127.0.0.1:50312 txn=5
+func (f CapturedFrame) Summary() string {
+	summary := fmt.Sprintf("%s %s %s", f.Direction, f.Framing, f.Peer)
+	if txnId, ok := f.TxnId(); ok {
+		summary += fmt.Sprintf(" txn=%d", txnId)
+	}
+	return summary
+}
+
+// FrameRecorder keeps captured frames, in a file or in the GUI.
+type FrameRecorder interface {
+	Record(frame CapturedFrame)
+}
+
+// FrameCapture hands every frame sent or received by a transport or a
+// listener to its recorders. A nil capture records nothing.
+type FrameCapture struct {
+	lock      sync.Mutex
+	recorders []FrameRecorder
+}
+
+func NewFrameCapture() *FrameCapture {
+	return &FrameCapture{}
+}
+
+func (c *FrameCapture) AddRecorder(recorder FrameRecorder) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.recorders = append(c.recorders, recorder)
+}
+
+// Record hands a copy of the frame to the recorders, the caller may reuse
+// data afterwards.
+func (c *FrameCapture) Record(link CaptureLink, direction string, data []byte) {
+	if c == nil {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(c.recorders) == 0 {
+		return
+	}
+
+	frame := CapturedFrame{
+		CaptureLink: link,
+		Time:        time.Now(),
+		Direction:   direction,
+		Data:        append([]byte(nil), data...),
+	}
+	for _, recorder := range c.recorders {
+		recorder.Record(frame)
+	}
+}
+
+// CaptureFile writes captured frames to a file, either as text lines or as
+// pcap for Wireshark.
+type CaptureFile struct {
+	lock sync.Mutex
+	file *os.File
+	pcap *pcapWriter
+	// err is the first write error, reported by Close.
+	err error
+}
+
+func CreateCaptureFile(path string, format string) (*CaptureFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create capture file: %w", err)
+	}
+
+	f := &CaptureFile{
+		file: file,
+	}
+
+	if format == CaptureFormatPcap {
+		f.pcap = newPcapWriter()
+	} else if _, err := file.WriteString(textCaptureHeader); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("write capture file: %w", err)
+	}
+
+	return f, nil
+}
+
+// WriteCaptureFile writes the frames to a new capture file. A pcap file
+// only gets the frames of the link type of the first one.
+func WriteCaptureFile(path string, format string, frames []CapturedFrame) error {
+	f, err := CreateCaptureFile(path, format)
+	if err != nil {
+		return err
+	}
+
+	for _, frame := range frames {
+		if err := f.write(frame); err != nil && !errors.Is(err, errLinkTypeMismatch) {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+// Record writes the frame. Frames of another link type than the first one
+// are left out of a pcap file.
+func (f *CaptureFile) Record(frame CapturedFrame) {
+	err := f.write(frame)
+	if errors.Is(err, errLinkTypeMismatch) {
+		return
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+}
+
+func (f *CaptureFile) write(frame CapturedFrame) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	var record []byte
+	if f.pcap != nil {
+		packet, err := f.pcap.Packet(frame)
+		if err != nil {
+			return err
+		}
+		record = packet
+	} else {
+		var line bytes.Buffer
+		fmt.Fprintf(&line, "%s %s % X\n", frame.Time.Format(captureTimeFormat), frame.Summary(), frame.Data)
+		record = line.Bytes()
+	}
+
+	if _, err := f.file.Write(record); err != nil {
+		return fmt.Errorf("write capture file: %w", err)
+	}
+	return nil
+}
+
+// Close closes the file and returns the first error frames were recorded
+// with, if any.
+func (f *CaptureFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	if f.file == nil {
+		return f.err
+	}
+
+	err := f.file.Close()
+	f.file = nil
+	if f.err != nil {
+		return f.err
+	}
+	return err
+}
@@ -0,0 +1,17 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// FormatFrame formats the frame for the frame views as a summary line
+// followed by its hex dump, with Windows line endings:
+//
+//	15:04:05.000 out mbap 127.0.0.1:502 txn=5, 12 bytes
+//	00000000  00 05 00 00 00 06 01 03  af 43 00 08              |.........C..|
+func FormatFrame(frame CapturedFrame) string {
+	dump := strings.ReplaceAll(strings.TrimRight(hex.Dump(frame.Data), "\n"), "\n", "\r\n")
+	return fmt.Sprintf("\r\n%s %s, %d bytes\r\n%s", frame.Time.Format("15:04:05.000"), frame.Summary(), len(frame.Data), dump)
+}
@@ -0,0 +1,220 @@
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	pcapMagic   = 0xA1B2C3D4
+	pcapSnapLen = 65535
+
+	// linkTypeRaw carries bare IPv4 and IPv6 packets. Frames sent over tcp
+	// and udp are wrapped into made up packets between the real addresses,
+	// so Wireshark dissects them as Modbus/TCP.
+	linkTypeRaw = 101
+	// linkTypeUser0 (DLT_USER0) carries the serial frames as they are,
+	// Wireshark dissects them once mbrtu is set for DLT 147 in the User DLTs
+	// table.
+	linkTypeUser0 = 147
+
+	ipProtocolTCP = 6
+	ipProtocolUDP = 17
+)
+
+// errLinkTypeMismatch is returned for a frame whose link type differs from
+// that of the capture file.
+var errLinkTypeMismatch = errors.New("link type differs from the capture")
+
+// pcapWriter turns captured frames into pcap records. The link type of the
+// file is that of the first frame, frames of the other link type can't be
+// written to it.
+type pcapWriter struct {
+	linkType uint32
+	// seqs is the next TCP sequence number of every direction of a
+	// connection, keyed by "source>destination".
+	seqs map[string]uint32
+}
+
+func newPcapWriter() *pcapWriter {
+	return &pcapWriter{
+		seqs: make(map[string]uint32),
+	}
+}
+
+// Packet returns the record of the frame, preceded by the file header for
+// the first frame.
+func (w *pcapWriter) Packet(frame CapturedFrame) ([]byte, error) {
+	linkType := uint32(linkTypeUser0)
+	data := frame.Data
+	if frame.Network != "" {
+		linkType = linkTypeRaw
+
+		packet, err := w.ipPacket(frame)
+		if err != nil {
+			return nil, err
+		}
+		data = packet
+	}
+
+	var out []byte
+	if w.linkType == 0 {
+		w.linkType = linkType
+		out = pcapFileHeader(linkType)
+	} else if w.linkType != linkType {
+		return nil, fmt.Errorf("%s frame, capture of link type %d: %w", frame.Framing, w.linkType, errLinkTypeMismatch)
+	}
+
+	header := make([]byte, 16)
+	binary.LittleEndian.PutUint32(header[0:4], uint32(frame.Time.Unix()))
+	binary.LittleEndian.PutUint32(header[4:8], uint32(frame.Time.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(header[8:12], uint32(len(data)))
+	binary.LittleEndian.PutUint32(header[12:16], uint32(len(data)))
+
+	return append(append(out, header...), data...), nil
+}
+
+func pcapFileHeader(linkType uint32) []byte {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], linkType)
+	return header
+}
+
+// ipPacket wraps the frame into an IP packet from the sender to the
+// receiver, with a TCP segment continuing the previous ones of the same
+// direction or a UDP datagram.
+func (w *pcapWriter) ipPacket(frame CapturedFrame) ([]byte, error) {
+	source, destination := frame.Local, frame.Peer
+	if frame.Direction == FrameIn {
+		source, destination = destination, source
+	}
+
+	sourceIP, sourcePort, err := splitIPPort(source)
+	if err != nil {
+		return nil, err
+	}
+
+	destinationIP, destinationPort, err := splitIPPort(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	var segment []byte
+	var protocol byte
+	if frame.Network == "udp" {
+		protocol = ipProtocolUDP
+		segment = make([]byte, 8, 8+len(frame.Data))
+		binary.BigEndian.PutUint16(segment[0:2], sourcePort)
+		binary.BigEndian.PutUint16(segment[2:4], destinationPort)
+		binary.BigEndian.PutUint16(segment[4:6], uint16(8+len(frame.Data)))
+	} else {
+		key, reverse := source+">"+destination, destination+">"+source
+		seq := w.seqs[key]
+		w.seqs[key] = seq + uint32(len(frame.Data))
+
+		protocol = ipProtocolTCP
+		segment = make([]byte, 20, 20+len(frame.Data))
+		binary.BigEndian.PutUint16(segment[0:2], sourcePort)
+		binary.BigEndian.PutUint16(segment[2:4], destinationPort)
+		binary.BigEndian.PutUint32(segment[4:8], seq)
+		binary.BigEndian.PutUint32(segment[8:12], w.seqs[reverse])
+		// 5 words of header, PSH and ACK
+		segment[12] = 5 << 4
+		segment[13] = 0x18
+		binary.BigEndian.PutUint16(segment[14:16], 0xFFFF)
+	}
+	segment = append(segment, frame.Data...)
+
+	checksumOffset := 16
+	if protocol == ipProtocolUDP {
+		checksumOffset = 6
+	}
+
+	if source4, destination4 := sourceIP.To4(), destinationIP.To4(); source4 != nil && destination4 != nil {
+		pseudo := make([]byte, 12)
+		copy(pseudo[0:4], source4)
+		copy(pseudo[4:8], destination4)
+		pseudo[9] = protocol
+		binary.BigEndian.PutUint16(pseudo[10:12], uint16(len(segment)))
+		binary.BigEndian.PutUint16(segment[checksumOffset:], internetChecksum(pseudo, segment))
+
+		header := make([]byte, 20, 20+len(segment))
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:4], uint16(20+len(segment)))
+		// don't fragment
+		header[6] = 0x40
+		header[8] = 64
+		header[9] = protocol
+		copy(header[12:16], source4)
+		copy(header[16:20], destination4)
+		binary.BigEndian.PutUint16(header[10:12], internetChecksum(header))
+
+		return append(header, segment...), nil
+	}
+
+	pseudo := make([]byte, 40)
+	copy(pseudo[0:16], sourceIP.To16())
+	copy(pseudo[16:32], destinationIP.To16())
+	binary.BigEndian.PutUint32(pseudo[32:36], uint32(len(segment)))
+	pseudo[39] = protocol
+	binary.BigEndian.PutUint16(segment[checksumOffset:], internetChecksum(pseudo, segment))
+
+	header := make([]byte, 40, 40+len(segment))
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:6], uint16(len(segment)))
+	header[6] = protocol
+	header[7] = 64
+	copy(header[8:24], pseudo[0:16])
+	copy(header[24:40], pseudo[16:32])
+
+	return append(header, segment...), nil
+}
+
+func splitIPPort(address string) (net.IP, uint16, error) {
+	host, rawPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, 0, fmt.Errorf("address %q: %w", address, err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("address %q: %q is not an IP address", address, host)
+	}
+
+	port, err := strconv.ParseUint(rawPort, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("address %q: port %q is not a number between 0 and 65535", address, rawPort)
+	}
+
+	return ip, uint16(port), nil
+}
+
+// internetChecksum is the ones' complement sum of IP, TCP and UDP headers
+// over the parts in order.
+func internetChecksum(parts ...[]byte) uint16 {
+	var sum uint32
+	var odd []byte
+	for _, part := range parts {
+		data := append(odd, part...)
+		for len(data) >= 2 {
+			sum += uint32(binary.BigEndian.Uint16(data))
+			data = data[2:]
+		}
+		odd = data
+	}
+	if len(odd) == 1 {
+		sum += uint32(odd[0]) << 8
+	}
+
+	for sum > 0xFFFF {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
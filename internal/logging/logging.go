@@ -0,0 +1,365 @@
+// Package logging is the leveled logger of the server and the client:
+// entries of a component at or above its level are written as text or JSON
+// lines to every output.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log entry.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// LogLevelNames returns the names of the levels from debug to error, the
+// index of a name is its level.
+func LogLevelNames() []string {
+	return append([]string(nil), logLevelNames...)
+}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return logLevelNames[l]
+}
+
+// ParseLogLevel parses one of debug, info, warn or error.
+func ParseLogLevel(name string) (LogLevel, error) {
+	for i, levelName := range logLevelNames {
+		if strings.EqualFold(name, levelName) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// LogLevels is the lowest level logged by every component, components not
+// listed log from Default on.
+type LogLevels struct {
+	Default    LogLevel
+	Components map[string]LogLevel
+}
+
+// ParseLogLevels parses a comma separated list of a default level and
+// component=level pairs, e.g. "info,handler=debug,access=warn". An empty
+// spec logs everything from info on. Only the components listed may be
+// given a level.
+func ParseLogLevels(spec string, components []string) (LogLevels, error) {
+	levels := LogLevels{
+		Default:    LevelInfo,
+		Components: make(map[string]LogLevel),
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		component, name, found := strings.Cut(part, "=")
+		if !found {
+			level, err := ParseLogLevel(part)
+			if err != nil {
+				return LogLevels{}, err
+			}
+			levels.Default = level
+			continue
+		}
+
+		component = strings.TrimSpace(component)
+		if !containsString(components, component) {
+			return LogLevels{}, fmt.Errorf("unknown component %q, known are %s", component, strings.Join(components, ", "))
+		}
+
+		level, err := ParseLogLevel(strings.TrimSpace(name))
+		if err != nil {
+			return LogLevels{}, fmt.Errorf("%s: %w", component, err)
+		}
+		levels.Components[component] = level
+	}
+
+	return levels, nil
+}
+
+func (l LogLevels) level(component string) LogLevel {
+	if level, ok := l.Components[component]; ok {
+		return level
+	}
+	return l.Default
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// LogField is a named value attached to a log entry.
+type LogField struct {
+	Key   string
+	Value interface{}
+}
+
+func Field(key string, value interface{}) LogField {
+	return LogField{Key: key, Value: value}
+}
+
+func FieldFunctionCode(functionCode uint8) LogField {
+	return Field("function_code", fmt.Sprintf("0x%02X", functionCode))
+}
+
+func FieldUnitId(unitId uint8) LogField {
+	return Field("unit_id", unitId)
+}
+
+func FieldAddr(addr uint16) LogField {
+	return Field("addr", addr)
+}
+
+func FieldCount(count int) LogField {
+	return Field("count", count)
+}
+
+func FieldClientAddr(clientAddr string) LogField {
+	return Field("client_addr", clientAddr)
+}
+
+func FieldDuration(duration time.Duration) LogField {
+	return Field("duration", duration.String())
+}
+
+func FieldError(err error) LogField {
+	return Field("error", err.Error())
+}
+
+// LevelWriter is a log output that needs the level of every line, like the
+// GUI log view filtering by level.
+type LevelWriter interface {
+	WriteLevel(level LogLevel, p []byte) (int, error)
+}
+
+// logSink is shared by a logger and every logger derived from it.
+type logSink struct {
+	lock    sync.Mutex
+	format  string
+	levels  LogLevels
+	outputs []io.Writer
+}
+
+// Logger writes leveled entries with fields as text or JSON lines. Loggers
+// derived with Component and With share the outputs and levels of their
+// parent.
+type Logger struct {
+	sink      *logSink
+	component string
+	fields    []LogField
+}
+
+// NewLogger creates a logger writing to stderr until SetOutputs is called.
+func NewLogger(format string, levels LogLevels) *Logger {
+	return &Logger{
+		sink: &logSink{
+			format:  format,
+			levels:  levels,
+			outputs: []io.Writer{os.Stderr},
+		},
+	}
+}
+
+// SetOutputs replaces the outputs of the logger and of every logger derived
+// from it.
+func (l *Logger) SetOutputs(outputs ...io.Writer) {
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	l.sink.outputs = outputs
+}
+
+// Component returns a logger for a component, logging from the level of
+// that component on.
+func (l *Logger) Component(name string) *Logger {
+	return &Logger{
+		sink:      l.sink,
+		component: name,
+		fields:    l.fields,
+	}
+}
+
+// With returns a logger adding the fields to every entry.
+func (l *Logger) With(fields ...LogField) *Logger {
+	merged := make([]LogField, 0, len(l.fields)+len(fields))
+	merged = append(merged, l.fields...)
+	merged = append(merged, fields...)
+
+	return &Logger{
+		sink:      l.sink,
+		component: l.component,
+		fields:    merged,
+	}
+}
+
+// Enabled tells whether entries of the level are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level >= l.sink.levels.level(l.component)
+}
+
+func (l *Logger) Debug(msg string, fields ...LogField) {
+	l.log(LevelDebug, msg, fields)
+}
+
+func (l *Logger) Info(msg string, fields ...LogField) {
+	l.log(LevelInfo, msg, fields)
+}
+
+func (l *Logger) Warn(msg string, fields ...LogField) {
+	l.log(LevelWarn, msg, fields)
+}
+
+func (l *Logger) Error(msg string, fields ...LogField) {
+	l.log(LevelError, msg, fields)
+}
+
+func (l *Logger) log(level LogLevel, msg string, fields []LogField) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	all := make([]LogField, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+
+	now := time.Now()
+	var line []byte
+	if l.sink.format == LogFormatJSON {
+		line = formatJSONEntry(now, level, l.component, msg, all)
+	} else {
+		line = formatTextEntry(now, level, l.component, msg, all)
+	}
+
+	l.sink.lock.Lock()
+	defer l.sink.lock.Unlock()
+
+	for _, output := range l.sink.outputs {
+		if writer, ok := output.(LevelWriter); ok {
+			writer.WriteLevel(level, line)
+			continue
+		}
+		output.Write(line)
+	}
+}
+
+// formatTextEntry formats an entry as
+//
+//	2006/01/02 15:04:05 INFO  adapter: message key=value key="a value"
+func formatTextEntry(now time.Time, level LogLevel, component string, msg string, fields []LogField) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(now.Format("2006/01/02 15:04:05"))
+	fmt.Fprintf(&buf, " %-5s ", strings.ToUpper(level.String()))
+	if component != "" {
+		buf.WriteString(component)
+		buf.WriteString(": ")
+	}
+	buf.WriteString(msg)
+
+	for _, field := range fields {
+		buf.WriteByte(' ')
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+
+		value := fmt.Sprint(field.Value)
+		if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// formatJSONEntry formats an entry as a JSON object on a single line, the
+// fields follow time, level, component and msg in order.
+func formatJSONEntry(now time.Time, level LogLevel, component string, msg string, fields []LogField) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	writeJSONField(&buf, "time", now.Format(time.RFC3339Nano))
+	buf.WriteByte(',')
+	writeJSONField(&buf, "level", level.String())
+	if component != "" {
+		buf.WriteByte(',')
+		writeJSONField(&buf, "component", component)
+	}
+	buf.WriteByte(',')
+	writeJSONField(&buf, "msg", msg)
+
+	for _, field := range fields {
+		buf.WriteByte(',')
+		writeJSONField(&buf, field.Key, field.Value)
+	}
+
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSONField(buf *bytes.Buffer, key string, value interface{}) {
+	encodedKey, _ := json.Marshal(key)
+	buf.Write(encodedKey)
+	buf.WriteByte(':')
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(encoded)
+}
+
+// RedirectStandardLog makes the lines logged with the log package entries
+// of the component, at info level.
+func (l *Logger) RedirectStandardLog(component string) {
+	log.SetFlags(0)
+	log.SetOutput(l.Component(component).Writer(LevelInfo))
+}
+
+// Writer returns a writer logging every line written to it as an entry of
+// the level, for the log package and other line oriented loggers.
+func (l *Logger) Writer(level LogLevel) io.Writer {
+	return &loggerWriter{logger: l, level: level}
+}
+
+type loggerWriter struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (w *loggerWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		w.logger.log(w.level, line, nil)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,135 @@
+package modbusclient
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/goburrow/serial"
+	"github.com/simonvetter/modbus"
+)
+
+// ASCIITransport speaks Modbus ASCII over a serial line: every frame is
+// ':' followed by the hex encoded unit id, PDU and LRC, ended with CRLF.
+type ASCIITransport struct {
+	config  *serial.Config
+	capture *capture.FrameCapture
+	port    serial.Port
+}
+
+// NewASCIITransport creates a transport over a serial port, requests time
+// out after the timeout of the config.
+func NewASCIITransport(config *serial.Config, capture *capture.FrameCapture) *ASCIITransport {
+	return &ASCIITransport{
+		config:  config,
+		capture: capture,
+	}
+}
+
+func (t *ASCIITransport) Open() error {
+	port, err := serial.Open(t.config)
+	if err != nil {
+		return fmt.Errorf("open serial port %s: %w", t.config.Address, err)
+	}
+
+	t.port = port
+	return nil
+}
+
+func (t *ASCIITransport) Close() error {
+	if t.port == nil {
+		return nil
+	}
+
+	err := t.port.Close()
+	t.port = nil
+	return err
+}
+
+func (t *ASCIITransport) Exchange(unitId uint8, req []byte) ([]byte, error) {
+	if t.port == nil {
+		return nil, ErrNotConnected
+	}
+
+	frame := append([]byte{unitId}, req...)
+	frame = append(frame, lrc(frame))
+	out := ":" + strings.ToUpper(hex.EncodeToString(frame)) + "\r\n"
+	t.capture.Record(t.captureLink(), capture.FrameOut, []byte(out))
+	if _, err := t.port.Write([]byte(out)); err != nil {
+		return nil, fmt.Errorf("write frame: %w", err)
+	}
+
+	line, err := t.readLine(time.Now().Add(t.config.Timeout))
+	if err != nil {
+		return nil, err
+	}
+	t.capture.Record(t.captureLink(), capture.FrameIn, []byte(":"+string(line)+"\r\n"))
+
+	res, err := hex.DecodeString(string(line))
+	if err != nil || len(res) < 3 {
+		return nil, fmt.Errorf("decode frame %q: %w", line, modbus.ErrProtocolError)
+	}
+
+	body, checksum := res[:len(res)-1], res[len(res)-1]
+	if lrc(body) != checksum {
+		return nil, fmt.Errorf("frame %q: bad lrc: %w", line, modbus.ErrProtocolError)
+	}
+
+	if body[0] != unitId {
+		return nil, modbus.ErrBadUnitId
+	}
+
+	return body[1:], nil
+}
+
+func (t *ASCIITransport) captureLink() capture.CaptureLink {
+	return capture.CaptureLink{
+		Framing: capture.FramingASCII,
+		Peer:    t.config.Address,
+	}
+}
+
+// readLine reads a response frame and returns the hex digits between ':'
+// and CRLF. Anything before the ':' is noise and is skipped.
+func (t *ASCIITransport) readLine(deadline time.Time) ([]byte, error) {
+	buf := make([]byte, 0, 2*256+4)
+	chunk := make([]byte, 64)
+	for {
+		if time.Now().After(deadline) {
+			return nil, modbus.ErrRequestTimedOut
+		}
+
+		n, err := t.port.Read(chunk)
+		if errors.Is(err, serial.ErrTimeout) {
+			return nil, modbus.ErrRequestTimedOut
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read frame: %w", err)
+		}
+
+		buf = append(buf, chunk[:n]...)
+		start := bytes.IndexByte(buf, ':')
+		if start < 0 {
+			buf = buf[:0]
+			continue
+		}
+
+		if end := bytes.Index(buf[start:], []byte("\r\n")); end >= 0 {
+			return buf[start+1 : start+end], nil
+		}
+	}
+}
+
+// lrc is the longitudinal redundancy check of Modbus ASCII: the two's
+// complement of the sum of the bytes.
+func lrc(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
@@ -0,0 +1,368 @@
+// Package modbusclient talks to Modbus devices over MBAP (tcp, udp and
+// tcp+tls), RTU and ASCII framing, encoding requests and decoding responses
+// itself. It is the client of the client tool and of the server gateway.
+package modbusclient
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	fcReadCoils              uint8 = 0x01
+	fcReadDiscreteInputs     uint8 = 0x02
+	fcReadHoldingRegisters   uint8 = 0x03
+	fcReadInputRegisters     uint8 = 0x04
+	fcWriteSingleCoil        uint8 = 0x05
+	fcWriteSingleRegister    uint8 = 0x06
+	fcDiagnostics            uint8 = 0x08
+	fcGetCommEventCounter    uint8 = 0x0B
+	fcWriteMultipleCoils     uint8 = 0x0F
+	fcWriteMultipleRegisters uint8 = 0x10
+
+	fcMaskWriteRegister          uint8 = 0x16
+	fcReadWriteMultipleRegisters uint8 = 0x17
+	fcEncapsulatedInterface      uint8 = 0x2B
+)
+
+// defaultUnitId is the unit requests are addressed to until SetUnitId.
+const defaultUnitId = 1
+
+// ErrNotConnected is returned by the transports before Open and after
+// Close.
+var ErrNotConnected = errors.New("connection not established")
+
+// FrameTransport sends a request PDU (function code and data) to a unit
+// and returns the response PDU, taking care of the framing of the link.
+type FrameTransport interface {
+	Open() error
+	Close() error
+	Exchange(unitId uint8, req []byte) ([]byte, error)
+}
+
+// RawClient encodes requests and decodes responses itself, so it works over
+// any FrameTransport and covers function codes the library client doesn't
+// offer.
+type RawClient struct {
+	transport FrameTransport
+	unitId    uint8
+}
+
+func NewRawClient(transport FrameTransport) *RawClient {
+	return &RawClient{
+		transport: transport,
+		unitId:    defaultUnitId,
+	}
+}
+
+func (c *RawClient) Open() error {
+	return c.transport.Open()
+}
+
+func (c *RawClient) Close() error {
+	return c.transport.Close()
+}
+
+func (c *RawClient) SetUnitId(id uint8) error {
+	c.unitId = id
+	return nil
+}
+
+func (c *RawClient) ReadCoils(addr uint16, quantity uint16) ([]bool, error) {
+	return c.readBools(fcReadCoils, addr, quantity)
+}
+
+func (c *RawClient) ReadDiscreteInputs(addr uint16, quantity uint16) ([]bool, error) {
+	return c.readBools(fcReadDiscreteInputs, addr, quantity)
+}
+
+func (c *RawClient) ReadRegisters(addr uint16, quantity uint16, regType modbus.RegType) ([]uint16, error) {
+	fc := fcReadHoldingRegisters
+	if regType == modbus.INPUT_REGISTER {
+		fc = fcReadInputRegisters
+	}
+
+	if quantity == 0 || quantity > 125 {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+
+	res, err := c.exchange(fc, uint16sToBytes(addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 1 || int(res[0]) != 2*int(quantity) || len(res)-1 != 2*int(quantity) {
+		return nil, modbus.ErrProtocolError
+	}
+
+	return bytesToUint16s(res[1:]), nil
+}
+
+func (c *RawClient) WriteCoil(addr uint16, value bool) error {
+	var raw uint16
+	if value {
+		raw = 0xFF00
+	}
+
+	req := uint16sToBytes(addr, raw)
+	return c.expectEcho(fcWriteSingleCoil, req, req)
+}
+
+func (c *RawClient) WriteCoils(addr uint16, values []bool) error {
+	if len(values) == 0 || len(values) > 0x7B0 {
+		return modbus.ErrUnexpectedParameters
+	}
+
+	bytes := make([]byte, (len(values)+7)/8)
+	for i, value := range values {
+		if value {
+			bytes[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	head := uint16sToBytes(addr, uint16(len(values)))
+	req := append(append(head, uint8(len(bytes))), bytes...)
+	return c.expectEcho(fcWriteMultipleCoils, req, head)
+}
+
+func (c *RawClient) WriteRegister(addr uint16, value uint16) error {
+	req := uint16sToBytes(addr, value)
+	return c.expectEcho(fcWriteSingleRegister, req, req)
+}
+
+func (c *RawClient) WriteRegisters(addr uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > 0x7B {
+		return modbus.ErrUnexpectedParameters
+	}
+
+	head := uint16sToBytes(addr, uint16(len(values)))
+	req := append(append(head, uint8(2*len(values))), uint16sToBytes(values...)...)
+	return c.expectEcho(fcWriteMultipleRegisters, req, head)
+}
+
+func (c *RawClient) MaskWriteRegister(addr uint16, andMask uint16, orMask uint16) error {
+	req := uint16sToBytes(addr, andMask, orMask)
+	return c.expectEcho(fcMaskWriteRegister, req, req)
+}
+
+func (c *RawClient) ReadWriteRegisters(readAddr uint16, readQuantity uint16, writeAddr uint16, values []uint16) ([]uint16, error) {
+	if readQuantity == 0 || readQuantity > 0x7D || len(values) == 0 || len(values) > 0x79 {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+
+	req := uint16sToBytes(readAddr, readQuantity, writeAddr, uint16(len(values)))
+	req = append(append(req, uint8(2*len(values))), uint16sToBytes(values...)...)
+
+	res, err := c.exchange(fcReadWriteMultipleRegisters, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 1 || int(res[0]) != 2*int(readQuantity) || len(res)-1 != 2*int(readQuantity) {
+		return nil, modbus.ErrProtocolError
+	}
+
+	return bytesToUint16s(res[1:]), nil
+}
+
+// ReadDeviceIdentification reads the objects of the category given by code
+// from objectId on, following "more follows" until the device has sent all
+// of them. With ReadDeviceIdIndividual only objectId is read.
+func (c *RawClient) ReadDeviceIdentification(code uint8, objectId uint8) (*DeviceIdentification, error) {
+	if code < ReadDeviceIdBasic || code > ReadDeviceIdIndividual {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+
+	result := &DeviceIdentification{}
+	for i := 0; i < identificationMaxRequests; i++ {
+		res, err := c.ReadDeviceIdentificationOnce(code, objectId)
+		if err != nil {
+			return nil, err
+		}
+
+		result.ConformityLevel = res.ConformityLevel
+		result.Objects = append(result.Objects, res.Objects...)
+
+		if !res.MoreFollows {
+			return result, nil
+		}
+
+		// every response must move forward, a device answering the same
+		// objects again would stream forever
+		if code == ReadDeviceIdIndividual || res.NextObjectId <= objectId && i > 0 {
+			return nil, fmt.Errorf("next object id 0x%02X: %w", res.NextObjectId, modbus.ErrProtocolError)
+		}
+		objectId = res.NextObjectId
+	}
+
+	return nil, fmt.Errorf("more than %d responses: %w", identificationMaxRequests, modbus.ErrProtocolError)
+}
+
+// ReadDeviceIdentificationOnce sends a single Read Device Identification
+// request, "more follows" is left to the caller.
+func (c *RawClient) ReadDeviceIdentificationOnce(code uint8, objectId uint8) (IdentificationResponse, error) {
+	res, err := c.exchange(fcEncapsulatedInterface, []byte{meiReadDeviceIdentification, code, objectId})
+	if err != nil {
+		return IdentificationResponse{}, err
+	}
+
+	if len(res) < 6 || res[0] != meiReadDeviceIdentification || res[1] != code {
+		return IdentificationResponse{}, modbus.ErrProtocolError
+	}
+
+	objects, err := decodeIdentificationObjects(int(res[5]), res[6:])
+	if err != nil {
+		return IdentificationResponse{}, err
+	}
+
+	return IdentificationResponse{
+		ConformityLevel: res[2],
+		MoreFollows:     res[3] == 0xFF,
+		NextObjectId:    res[4],
+		Objects:         objects,
+	}, nil
+}
+
+// Diagnostics sends a Diagnostics (0x08) sub-function with its data and
+// returns the data of the response, e.g. a counter.
+func (c *RawClient) Diagnostics(subFunction uint16, data []uint16) ([]uint16, error) {
+	if len(data) == 0 || len(data) > 0x7C {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+
+	res, err := c.exchange(fcDiagnostics, uint16sToBytes(append([]uint16{subFunction}, data...)...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 4 || len(res)%2 != 0 || binary.BigEndian.Uint16(res[0:2]) != subFunction {
+		return nil, modbus.ErrProtocolError
+	}
+
+	return bytesToUint16s(res[2:]), nil
+}
+
+func (c *RawClient) GetCommEventCounter() (CommEventCounter, error) {
+	res, err := c.exchange(fcGetCommEventCounter, nil)
+	if err != nil {
+		return CommEventCounter{}, err
+	}
+
+	if len(res) != 4 {
+		return CommEventCounter{}, modbus.ErrProtocolError
+	}
+
+	return CommEventCounter{
+		Busy:  binary.BigEndian.Uint16(res[0:2]) == 0xFFFF,
+		Count: binary.BigEndian.Uint16(res[2:4]),
+	}, nil
+}
+
+func decodeIdentificationObjects(count int, data []byte) ([]IdentificationObject, error) {
+	objects := make([]IdentificationObject, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, modbus.ErrProtocolError
+		}
+
+		objects = append(objects, IdentificationObject{
+			Id:    data[0],
+			Value: string(data[2 : 2+int(data[1])]),
+		})
+		data = data[2+int(data[1]):]
+	}
+
+	if len(data) != 0 {
+		return nil, modbus.ErrProtocolError
+	}
+
+	return objects, nil
+}
+
+func (c *RawClient) readBools(fc uint8, addr uint16, quantity uint16) ([]bool, error) {
+	if quantity == 0 || quantity > 2000 {
+		return nil, modbus.ErrUnexpectedParameters
+	}
+
+	res, err := c.exchange(fc, uint16sToBytes(addr, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	expected := (int(quantity) + 7) / 8
+	if len(res) < 1 || int(res[0]) != expected || len(res)-1 != expected {
+		return nil, modbus.ErrProtocolError
+	}
+
+	result := make([]bool, quantity)
+	for i := range result {
+		result[i] = res[1+i/8]&(1<<(i%8)) != 0
+	}
+	return result, nil
+}
+
+// expectEcho sends a write request whose response repeats echo.
+func (c *RawClient) expectEcho(fc uint8, req []byte, echo []byte) error {
+	res, err := c.exchange(fc, req)
+	if err != nil {
+		return err
+	}
+
+	if string(res) != string(echo) {
+		return modbus.ErrProtocolError
+	}
+	return nil
+}
+
+// exchange sends the request and returns the data of the response, turning
+// exception responses into the matching modbus errors.
+func (c *RawClient) exchange(fc uint8, data []byte) ([]byte, error) {
+	res, err := c.transport.Exchange(c.unitId, append([]byte{fc}, data...))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(res) < 1 {
+		return nil, modbus.ErrProtocolError
+	}
+
+	switch res[0] {
+	case fc:
+		return res[1:], nil
+
+	case fc | 0x80:
+		if len(res) != 2 {
+			return nil, modbus.ErrProtocolError
+		}
+		return nil, exceptionError(res[1])
+	}
+
+	return nil, fmt.Errorf("unexpected function code 0x%02X: %w", res[0], modbus.ErrProtocolError)
+}
+
+// exceptionError maps an exception code to the library error for it.
+func exceptionError(code uint8) error {
+	if e, ok := ExceptionByCode(code); ok {
+		return e.Err
+	}
+	return fmt.Errorf("exception 0x%02X: %w", code, modbus.ErrProtocolError)
+}
+
+func uint16sToBytes(values ...uint16) []byte {
+	result := make([]byte, 2*len(values))
+	for i, value := range values {
+		binary.BigEndian.PutUint16(result[2*i:], value)
+	}
+	return result
+}
+
+func bytesToUint16s(bytes []byte) []uint16 {
+	result := make([]uint16, len(bytes)/2)
+	for i := range result {
+		result[i] = binary.BigEndian.Uint16(bytes[2*i:])
+	}
+	return result
+}
@@ -0,0 +1,49 @@
+package modbusclient
+
+import (
+	"errors"
+
+	"github.com/simonvetter/modbus"
+)
+
+// Exception is an exception code a device may answer with, its name in the
+// specification and the library error it maps to.
+type Exception struct {
+	Code uint8
+	Name string
+	Err  error
+}
+
+// Exceptions are the exceptions the library has an error for. The client
+// tool, the gateway and the server all map exceptions with this table.
+var Exceptions = []Exception{
+	{Code: 0x01, Name: "Illegal Function", Err: modbus.ErrIllegalFunction},
+	{Code: 0x02, Name: "Illegal Data Address", Err: modbus.ErrIllegalDataAddress},
+	{Code: 0x03, Name: "Illegal Data Value", Err: modbus.ErrIllegalDataValue},
+	{Code: 0x04, Name: "Server Device Failure", Err: modbus.ErrServerDeviceFailure},
+	{Code: 0x05, Name: "Acknowledge", Err: modbus.ErrAcknowledge},
+	{Code: 0x06, Name: "Server Device Busy", Err: modbus.ErrServerDeviceBusy},
+	{Code: 0x08, Name: "Memory Parity Error", Err: modbus.ErrMemoryParityError},
+	{Code: 0x0A, Name: "Gateway Path Unavailable", Err: modbus.ErrGWPathUnavailable},
+	{Code: 0x0B, Name: "Gateway Target Device Failed to Respond", Err: modbus.ErrGWTargetFailedToRespond},
+}
+
+// FindException returns the exception the error is or wraps.
+func FindException(err error) (Exception, bool) {
+	for _, e := range Exceptions {
+		if errors.Is(err, e.Err) {
+			return e, true
+		}
+	}
+	return Exception{}, false
+}
+
+// ExceptionByCode returns the exception with the code.
+func ExceptionByCode(code uint8) (Exception, bool) {
+	for _, e := range Exceptions {
+		if e.Code == code {
+			return e, true
+		}
+	}
+	return Exception{}, false
+}
@@ -0,0 +1,86 @@
+package modbusclient
+
+const (
+	ReadDeviceIdBasic      uint8 = 0x01
+	ReadDeviceIdRegular    uint8 = 0x02
+	ReadDeviceIdExtended   uint8 = 0x03
+	ReadDeviceIdIndividual uint8 = 0x04
+
+	meiReadDeviceIdentification uint8 = 0x0E
+
+	// identificationMaxRequests bounds the requests of a single stream
+	// read: every object id is asked for at most once.
+	identificationMaxRequests = 256
+)
+
+var identificationObjectNames = []string{
+	"VendorName",
+	"ProductCode",
+	"MajorMinorRevision",
+	"VendorUrl",
+	"ProductName",
+	"ModelName",
+	"UserApplicationName",
+}
+
+// IdentificationObject is a single object of the device identification.
+type IdentificationObject struct {
+	Id    uint8
+	Value string
+}
+
+// Name returns the name of a standard object, or tells reserved (0x07 to
+// 0x7F) and private (0x80 to 0xFF) objects apart.
+func (o IdentificationObject) Name() string {
+	switch {
+	case int(o.Id) < len(identificationObjectNames):
+		return identificationObjectNames[o.Id]
+	case o.Id < 0x80:
+		return "Reserved"
+	}
+	return "Private"
+}
+
+// DeviceIdentification is the answer to Read Device Identification, with
+// the objects of every response of a stream read.
+type DeviceIdentification struct {
+	ConformityLevel uint8
+	Objects         []IdentificationObject
+}
+
+// ConformityName describes the conformity level of the device.
+func (d *DeviceIdentification) ConformityName() string {
+	var name string
+	switch d.ConformityLevel &^ 0x80 {
+	case ReadDeviceIdBasic:
+		name = "basic"
+	case ReadDeviceIdRegular:
+		name = "regular"
+	case ReadDeviceIdExtended:
+		name = "extended"
+	default:
+		return "unknown"
+	}
+
+	if d.ConformityLevel&0x80 != 0 {
+		return name + ", stream and individual access"
+	}
+	return name + ", stream access only"
+}
+
+// IdentificationResponse is a single response to Read Device
+// Identification, telling where a stream read goes on.
+type IdentificationResponse struct {
+	ConformityLevel uint8
+	MoreFollows     bool
+	NextObjectId    uint8
+	Objects         []IdentificationObject
+}
+
+// CommEventCounter is the answer to Get Comm Event Counter (0x0B).
+type CommEventCounter struct {
+	// Busy is set while the device still processes a previous program
+	// command.
+	Busy  bool
+	Count uint16
+}
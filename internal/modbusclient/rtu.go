@@ -0,0 +1,226 @@
+package modbusclient
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/goburrow/serial"
+	"github.com/simonvetter/modbus"
+)
+
+const rtuMaxFrameLength = 256
+
+// RTUTransport speaks Modbus RTU: every frame is the unit id, the PDU and a
+// CRC. The link is either a serial port (rtu) or a connection to a serial
+// gateway (rtuovertcp, rtuoverudp).
+type RTUTransport struct {
+	dial    func() (io.ReadWriteCloser, error)
+	name    string
+	timeout time.Duration
+	capture *capture.FrameCapture
+
+	port io.ReadWriteCloser
+	link capture.CaptureLink
+}
+
+// NewSerialRTUTransport creates a transport over a serial port, requests
+// time out after the timeout of the config.
+func NewSerialRTUTransport(config *serial.Config, capture *capture.FrameCapture) *RTUTransport {
+	return &RTUTransport{
+		dial: func() (io.ReadWriteCloser, error) {
+			return serial.Open(config)
+		},
+		name:    config.Address,
+		timeout: config.Timeout,
+		capture: capture,
+	}
+}
+
+// NewNetworkRTUTransport creates a transport over a tcp or udp connection
+// to a serial gateway.
+func NewNetworkRTUTransport(network string, address string, timeout time.Duration, capture *capture.FrameCapture) *RTUTransport {
+	return &RTUTransport{
+		dial: func() (io.ReadWriteCloser, error) {
+			return net.DialTimeout(network, address, timeout)
+		},
+		name:    address,
+		timeout: timeout,
+		capture: capture,
+	}
+}
+
+func (t *RTUTransport) Open() error {
+	port, err := t.dial()
+	if err != nil {
+		return fmt.Errorf("open %s: %w", t.name, err)
+	}
+
+	t.port = port
+	t.link = capture.CaptureLink{
+		Framing: capture.FramingRTU,
+		Peer:    t.name,
+	}
+	if conn, ok := port.(net.Conn); ok {
+		t.link.Network = conn.LocalAddr().Network()
+		t.link.Local = conn.LocalAddr().String()
+		t.link.Peer = conn.RemoteAddr().String()
+	}
+	return nil
+}
+
+func (t *RTUTransport) Close() error {
+	if t.port == nil {
+		return nil
+	}
+
+	err := t.port.Close()
+	t.port = nil
+	return err
+}
+
+func (t *RTUTransport) Exchange(unitId uint8, req []byte) ([]byte, error) {
+	if t.port == nil {
+		return nil, ErrNotConnected
+	}
+
+	frame := append([]byte{unitId}, req...)
+	crc := crc16(frame)
+	frame = append(frame, byte(crc), byte(crc>>8))
+	t.capture.Record(t.link, capture.FrameOut, frame)
+
+	deadline := time.Now().Add(t.timeout)
+	if conn, ok := t.port.(net.Conn); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, err := t.port.Write(frame); err != nil {
+		return nil, fmt.Errorf("write frame: %w", netError(err))
+	}
+
+	res, err := t.readFrame(deadline)
+	if err != nil {
+		return nil, err
+	}
+	t.capture.Record(t.link, capture.FrameIn, res)
+
+	body, checksum := res[:len(res)-2], res[len(res)-2:]
+	if crc := crc16(body); checksum[0] != byte(crc) || checksum[1] != byte(crc>>8) {
+		return nil, modbus.ErrBadCRC
+	}
+
+	if body[0] != unitId {
+		return nil, modbus.ErrBadUnitId
+	}
+
+	return body[1:], nil
+}
+
+// readFrame reads until the response is complete, as told by its function
+// code.
+func (t *RTUTransport) readFrame(deadline time.Time) ([]byte, error) {
+	frame := make([]byte, 0, rtuMaxFrameLength)
+	chunk := make([]byte, rtuMaxFrameLength)
+	for {
+		if time.Now().After(deadline) {
+			return nil, modbus.ErrRequestTimedOut
+		}
+
+		n, err := t.port.Read(chunk)
+		if errors.Is(err, serial.ErrTimeout) {
+			return nil, modbus.ErrRequestTimedOut
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read frame: %w", netError(err))
+		}
+
+		frame = append(frame, chunk[:n]...)
+		length := rtuResponseLength(frame)
+		if length < 0 || len(frame) > rtuMaxFrameLength {
+			return nil, fmt.Errorf("frame % X: %w", frame, modbus.ErrProtocolError)
+		}
+
+		if length > 0 && len(frame) >= length {
+			return frame[:length], nil
+		}
+	}
+}
+
+// rtuResponseLength returns the length of the response frame at the start
+// of the buffer, including unit id and CRC, 0 if more bytes are needed to
+// tell, or -1 if the function code is unknown.
+func rtuResponseLength(frame []byte) int {
+	if len(frame) < 2 {
+		return 0
+	}
+
+	if frame[1]&0x80 != 0 {
+		return 5
+	}
+
+	switch frame[1] {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters, fcReadInputRegisters,
+		fcReadWriteMultipleRegisters:
+		if len(frame) < 3 {
+			return 0
+		}
+		return 5 + int(frame[2])
+
+	// serial lines carry a single data word with every diagnostic
+	case fcWriteSingleCoil, fcWriteSingleRegister, fcWriteMultipleCoils, fcWriteMultipleRegisters,
+		fcDiagnostics, fcGetCommEventCounter:
+		return 8
+
+	case fcMaskWriteRegister:
+		return 10
+
+	case fcEncapsulatedInterface:
+		return rtuIdentificationLength(frame)
+	}
+
+	return -1
+}
+
+// rtuIdentificationLength walks the objects of a Read Device
+// Identification response, whose length is only known once every object
+// length has arrived.
+func rtuIdentificationLength(frame []byte) int {
+	if len(frame) < 3 {
+		return 0
+	}
+	if frame[2] != meiReadDeviceIdentification {
+		return -1
+	}
+	if len(frame) < 8 {
+		return 0
+	}
+
+	length := 8
+	for i := 0; i < int(frame[7]); i++ {
+		if len(frame) < length+2 {
+			return 0
+		}
+		length += 2 + int(frame[length+1])
+	}
+
+	return length + 2
+}
+
+// crc16 is the Modbus CRC, sent low byte first.
+func crc16(data []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = crc>>1 ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
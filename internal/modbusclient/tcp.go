@@ -0,0 +1,162 @@
+package modbusclient
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aveplen/mirea-modbus/internal/capture"
+	"github.com/simonvetter/modbus"
+)
+
+const (
+	mbapHeaderLength = 7
+	mbapMaxLength    = 254
+)
+
+// MBAPTransport speaks Modbus TCP: every PDU is prefixed with the MBAP
+// header carrying a transaction id, so responses to requests that already
+// timed out are recognized and skipped. The same framing is used over UDP
+// and, with a tls config, over TLS (Modbus/TCP Security).
+type MBAPTransport struct {
+	network   string
+	address   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+	capture   *capture.FrameCapture
+
+	conn  net.Conn
+	link  capture.CaptureLink
+	txnId uint16
+}
+
+func NewMBAPTransport(network string, address string, tlsConfig *tls.Config, timeout time.Duration, capture *capture.FrameCapture) *MBAPTransport {
+	return &MBAPTransport{
+		network:   network,
+		address:   address,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+		capture:   capture,
+	}
+}
+
+func (t *MBAPTransport) Open() error {
+	dialer := &net.Dialer{Timeout: t.timeout}
+
+	var conn net.Conn
+	var err error
+	if t.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, t.network, t.address, t.tlsConfig)
+	} else {
+		conn, err = dialer.Dial(t.network, t.address)
+	}
+	if err != nil {
+		return fmt.Errorf("dial %s %s: %w", t.network, t.address, err)
+	}
+
+	t.conn = conn
+	t.link = capture.CaptureLink{
+		Framing: capture.FramingMBAP,
+		Network: t.network,
+		Local:   conn.LocalAddr().String(),
+		Peer:    conn.RemoteAddr().String(),
+	}
+	return nil
+}
+
+func (t *MBAPTransport) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+func (t *MBAPTransport) Exchange(unitId uint8, req []byte) ([]byte, error) {
+	if t.conn == nil {
+		return nil, ErrNotConnected
+	}
+
+	t.txnId++
+	frame := make([]byte, mbapHeaderLength, mbapHeaderLength+len(req))
+	binary.BigEndian.PutUint16(frame[0:2], t.txnId)
+	binary.BigEndian.PutUint16(frame[4:6], uint16(1+len(req)))
+	frame[6] = unitId
+	frame = append(frame, req...)
+	t.capture.Record(t.link, capture.FrameOut, frame)
+
+	t.conn.SetDeadline(time.Now().Add(t.timeout))
+	if _, err := t.conn.Write(frame); err != nil {
+		return nil, fmt.Errorf("write frame: %w", netError(err))
+	}
+
+	for {
+		header, body, err := t.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if binary.BigEndian.Uint16(header[0:2]) != t.txnId {
+			continue
+		}
+
+		if header[6] != unitId {
+			return nil, modbus.ErrBadUnitId
+		}
+
+		return body, nil
+	}
+}
+
+// readFrame reads a single response: from the stream for tcp, as a whole
+// datagram for udp.
+func (t *MBAPTransport) readFrame() ([]byte, []byte, error) {
+	if t.network == "udp" {
+		buf := make([]byte, mbapHeaderLength+mbapMaxLength)
+		n, err := t.conn.Read(buf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read frame: %w", netError(err))
+		}
+
+		if n < mbapHeaderLength+1 || int(binary.BigEndian.Uint16(buf[4:6])) != n-mbapHeaderLength+1 {
+			return nil, nil, fmt.Errorf("datagram % X: %w", buf[:n], modbus.ErrProtocolError)
+		}
+
+		t.capture.Record(t.link, capture.FrameIn, buf[:n])
+		return buf[:mbapHeaderLength], buf[mbapHeaderLength:n], nil
+	}
+
+	header := make([]byte, mbapHeaderLength)
+	if _, err := io.ReadFull(t.conn, header); err != nil {
+		return nil, nil, fmt.Errorf("read header: %w", netError(err))
+	}
+
+	length := int(binary.BigEndian.Uint16(header[4:6]))
+	if binary.BigEndian.Uint16(header[2:4]) != 0 || length < 2 || length > mbapMaxLength {
+		return nil, nil, fmt.Errorf("header % X: %w", header, modbus.ErrProtocolError)
+	}
+
+	body := make([]byte, length-1)
+	if _, err := io.ReadFull(t.conn, body); err != nil {
+		return nil, nil, fmt.Errorf("read body: %w", netError(err))
+	}
+	t.capture.Record(t.link, capture.FrameIn, append(header, body...))
+
+	return header, body, nil
+}
+
+// netError turns a timeout into modbus.ErrRequestTimedOut, so callers can
+// tell it from other failures.
+func netError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return modbus.ErrRequestTimedOut
+	}
+	return err
+}
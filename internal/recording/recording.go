@@ -0,0 +1,159 @@
+// Package recording is the format of the requests the server records and
+// the client replays: one RecordedRequest per line, as JSON.
+package recording
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	fcReadCoils                  uint8 = 0x01
+	fcReadDiscreteInputs         uint8 = 0x02
+	fcReadHoldingRegisters       uint8 = 0x03
+	fcReadInputRegisters         uint8 = 0x04
+	fcWriteSingleCoil            uint8 = 0x05
+	fcWriteSingleRegister        uint8 = 0x06
+	fcWriteMultipleCoils         uint8 = 0x0F
+	fcWriteMultipleRegisters     uint8 = 0x10
+	fcMaskWriteRegister          uint8 = 0x16
+	fcReadWriteMultipleRegisters uint8 = 0x17
+	fcEncapsulatedInterface      uint8 = 0x2B
+)
+
+// Duration is a time.Duration written as a string like "1.5s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration should be a string like \"30s\": %w", err)
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parse duration: %w", err)
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// RecordedRequest is a request answered by the server, with the response
+// it got, as a line of a recording.
+type RecordedRequest struct {
+	// Offset is the time since the first request of the recording.
+	Offset       Duration `json:"offset"`
+	FunctionCode uint8    `json:"function_code"`
+	UnitId       uint8    `json:"unit_id"`
+	ClientAddr   string   `json:"client_addr"`
+	// Addr is the address read or written, the object id to start from for
+	// Read Device Identification.
+	Addr     uint16 `json:"addr"`
+	Quantity uint16 `json:"quantity"`
+	// WriteAddr is where Read/Write Multiple Registers writes.
+	WriteAddr uint16 `json:"write_addr,omitempty"`
+	// Registers are the registers written, or the AND and OR masks of Mask
+	// Write Register.
+	Registers []uint16 `json:"registers,omitempty"`
+	// Coils are the coils written.
+	Coils []bool `json:"coils,omitempty"`
+	// ReadDeviceIdCode is the category of objects read by Read Device
+	// Identification.
+	ReadDeviceIdCode uint8            `json:"read_device_id_code,omitempty"`
+	Response         RecordedResponse `json:"response"`
+}
+
+// RecordedResponse is what the unit answered a recorded request.
+type RecordedResponse struct {
+	// Exception is the exception code answered, zero for a normal response.
+	Exception   uint8            `json:"exception,omitempty"`
+	Registers   []uint16         `json:"registers,omitempty"`
+	Coils       []bool           `json:"coils,omitempty"`
+	Objects     []RecordedObject `json:"objects,omitempty"`
+	MoreFollows bool             `json:"more_follows,omitempty"`
+}
+
+// RecordedObject is an identification object of a recorded response.
+type RecordedObject struct {
+	Id    uint8  `json:"id"`
+	Value string `json:"value"`
+}
+
+// Validate reports a request that can't be replayed.
+func (r RecordedRequest) Validate() error {
+	switch r.FunctionCode {
+	case fcReadCoils, fcReadDiscreteInputs, fcReadHoldingRegisters, fcReadInputRegisters, fcEncapsulatedInterface:
+		return nil
+
+	case fcWriteSingleCoil:
+		if len(r.Coils) != 1 {
+			return fmt.Errorf("function code 0x%02X: expected 1 coil, got %d", r.FunctionCode, len(r.Coils))
+		}
+
+	case fcWriteMultipleCoils:
+		if len(r.Coils) == 0 {
+			return fmt.Errorf("function code 0x%02X: no coils", r.FunctionCode)
+		}
+
+	case fcWriteSingleRegister:
+		if len(r.Registers) != 1 {
+			return fmt.Errorf("function code 0x%02X: expected 1 register, got %d", r.FunctionCode, len(r.Registers))
+		}
+
+	case fcMaskWriteRegister:
+		if len(r.Registers) != 2 {
+			return fmt.Errorf("function code 0x%02X: expected the AND and OR masks, got %d registers", r.FunctionCode, len(r.Registers))
+		}
+
+	case fcWriteMultipleRegisters, fcReadWriteMultipleRegisters:
+		if len(r.Registers) == 0 {
+			return fmt.Errorf("function code 0x%02X: no registers", r.FunctionCode)
+		}
+
+	default:
+		return fmt.Errorf("function code 0x%02X can't be replayed", r.FunctionCode)
+	}
+
+	return nil
+}
+
+// Load reads a recording written by the server, one request per line.
+func Load(path string) ([]RecordedRequest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open recording: %w", err)
+	}
+	defer file.Close()
+
+	requests := make([]RecordedRequest, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var request RecordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			return nil, fmt.Errorf("recording %s, line %d: %w", path, line, err)
+		}
+		if err := request.Validate(); err != nil {
+			return nil, fmt.Errorf("recording %s, line %d: %w", path, line, err)
+		}
+		requests = append(requests, request)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read recording %s: %w", path, err)
+	}
+
+	return requests, nil
+}